@@ -0,0 +1,408 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/blob"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/gitsync"
+	"github.com/mxbossard/tui-journal/internal/todo"
+)
+
+// Passphrase of encrypted patches is read from the environment to keep it out of shell history.
+const passphraseEnv = "TUI_JOURNAL_PASSPHRASE"
+
+var commands = map[string]func(args []string) error{
+	"compact":       compact,
+	"export-car":    exportCAR,
+	"export-patch":  exportPatch,
+	"import-patch":  importPatch,
+	"instance-todo": instanceTodo,
+	"merge-todo":    mergeTodo,
+	"search":        search,
+	"split-todo":    splitTodo,
+	"sync":          syncCmd,
+}
+
+type dbFlags struct {
+	root   string
+	device string
+	blobs  bool
+	secret string
+}
+
+// Content-addressed store of layer contents, in the db directory.
+const blobsDirname = "blobs"
+
+func defaultDbRoot() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "tui-journal")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "tui-journal"
+	}
+	return filepath.Join(home, ".local", "share", "tui-journal")
+}
+
+func defaultKeyPath(device string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "tui-journal", device+".key")
+}
+
+// The db secret is shared by all devices, it is copied to them like public keys.
+func defaultSecretPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "tui-journal", "db.secret")
+}
+
+func (f *dbFlags) register(fs *flag.FlagSet) {
+	hostname, _ := os.Hostname()
+	fs.StringVar(&f.root, "db", defaultDbRoot(), "db directory")
+	fs.StringVar(&f.device, "device", hostname, "name of this device")
+	fs.BoolVar(&f.blobs, "blobs", false, "store layer contents as content-addressed chunks (kept once enabled)")
+	fs.StringVar(&f.secret, "secret", defaultSecretPath(), "secret file keying the label index, generated if missing, shared by all devices")
+}
+
+func (f *dbFlags) open() (*db.DB, error) {
+	if f.device == "" {
+		return nil, fmt.Errorf("a device name is required")
+	}
+	secret, err := db.LoadSecret(f.secret)
+	if err != nil {
+		return nil, err
+	}
+	opts := []db.Option{db.WithSecret(secret)}
+	blobsDir := filepath.Join(f.root, blobsDirname)
+	if _, err := os.Stat(blobsDir); f.blobs || err == nil {
+		store, err := blob.NewFSStore(blobsDir)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, db.WithBlobStore(store))
+	}
+	return db.Open(f.root, f.device, opts...)
+}
+
+// Parse --since as a date or a cursor printed by a previous export.
+func parseSince(d *db.DB, since string) (db.Cursor, error) {
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		t, err := time.ParseInLocation(layout, since, time.Local)
+		if err == nil {
+			return d.CursorAt(t)
+		}
+	}
+	return db.ParseCursor(since)
+}
+
+func exportPatch(args []string) error {
+	fs := flag.NewFlagSet("export-patch", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	since := fs.String("since", "", "cursor printed by the previous export, or date (YYYY-MM-DD)")
+	keyPath := fs.String("key", "", "signing key file, generated if missing (default in user config dir)")
+	encrypt := fs.Bool("encrypt", false, "encrypt the patch with the passphrase of $"+passphraseEnv)
+	output := fs.String("o", "", "patch file (default stdout)")
+	fs.Parse(args)
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if *keyPath == "" {
+		*keyPath = defaultKeyPath(dbf.device)
+	}
+	key, err := db.LoadSigningKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	opts := []db.PatchOption{db.WithSigningKey(key)}
+	if *encrypt {
+		passphrase := os.Getenv(passphraseEnv)
+		if passphrase == "" {
+			return fmt.Errorf("$%s is not set", passphraseEnv)
+		}
+		opts = append(opts, db.WithPassphrase(passphrase))
+	}
+	cursor, err := parseSince(d, *since)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	next, err := d.ExportPatch(w, cursor, opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Next patch: --since %s\n", next)
+	return nil
+}
+
+func exportCAR(args []string) error {
+	fs := flag.NewFlagSet("export-car", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	output := fs.String("o", "", "CAR file (default stdout)")
+	fs.Parse(args)
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return d.ExportCAR(w)
+}
+
+func compact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	retention := fs.Duration("retention", 30*24*time.Hour, "keep layers saved during this window as history")
+	fs.Parse(args)
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	stats, err := d.Compact(db.WithRetention(*retention))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Compacted: %s\n", stats)
+	return nil
+}
+
+func search(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	fuzzy := fs.Bool("fuzzy", false, "tolerate typos, accept label:value and date:FROM..TO filters")
+	fs.Parse(args)
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if *fuzzy {
+		return fuzzySearch(d, strings.Join(fs.Args(), " "))
+	}
+	p, err := d.Search(strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+	for err, page := range p.All() {
+		if err != nil {
+			return err
+		}
+		for _, entry := range page.Entries() {
+			fmt.Printf("%.3f\t%s\n", entry.Val().Score, entry.Key())
+		}
+	}
+	return nil
+}
+
+// Print hits with their snippet, matches in bold.
+func fuzzySearch(d *db.DB, query string) error {
+	p, err := d.FuzzySearch(query)
+	if err != nil {
+		return err
+	}
+	for err, page := range p.All() {
+		if err != nil {
+			return err
+		}
+		for _, entry := range page.Entries() {
+			hit := entry.Val()
+			fmt.Printf("%.3f\t%s\t%s\n", hit.Score, hit.Uid, hit.Snippet.Highlight("\x1b[1m", "\x1b[0m"))
+		}
+	}
+	return nil
+}
+
+func importPatch(args []string) error {
+	fs := flag.NewFlagSet("import-patch", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	var trusted []string
+	fs.Func("trust", "public key file DEVICE.key.pub of a trusted device (repeatable)", func(path string) error {
+		trusted = append(trusted, path)
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: import-patch [flags] PATCH_FILE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a patch file is required")
+	}
+
+	var opts []db.PatchOption
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		opts = append(opts, db.WithPassphrase(passphrase))
+	}
+	for _, path := range trusted {
+		key, err := db.LoadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		// Public keys are named after their device, see defaultKeyPath.
+		device := strings.TrimSuffix(filepath.Base(path), ".key.pub")
+		opts = append(opts, db.WithTrustedDevice(device, key))
+	}
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cursor, err := d.ImportPatch(f, opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported: %s\n", cursor)
+	return nil
+}
+
+func syncCmd(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	remote := fs.String("remote", "", "git remote url, required on first sync")
+	untrusted := fs.Bool("untrusted-remote", false, "allow a remote which is not local, synced files are not encrypted")
+	fs.Parse(args)
+	if dbf.device == "" {
+		return fmt.Errorf("a device name is required")
+	}
+
+	var opts []gitsync.Option
+	if *untrusted {
+		opts = append(opts, gitsync.WithUntrustedRemote())
+	}
+	driver := gitsync.NewDriver(dbf.root, dbf.device, opts...)
+	if *remote != "" {
+		err := driver.Init(*remote)
+		if err != nil {
+			return err
+		}
+	}
+	summary, err := driver.Sync()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, summary)
+	return nil
+}
+
+// Move the tasks at some lines of a list, counted from 1, into a new list.
+func splitTodo(args []string) error {
+	fs := flag.NewFlagSet("split-todo", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	from := fs.String("from", "", "uid of the list holding the tasks")
+	to := fs.String("to", "", "uid of the new list")
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		return fmt.Errorf("-from and -to lists are required")
+	}
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	todos := todo.New(d)
+	tasks, err := todos.Tasks(todo.Query{})
+	if err != nil {
+		return err
+	}
+	var selected []todo.Task
+	for _, arg := range fs.Args() {
+		line, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		k := slices.IndexFunc(tasks, func(t todo.Task) bool { return t.Uid == *from && t.Line == line-1 })
+		if k < 0 {
+			return fmt.Errorf("no task at line %d of %s", line, *from)
+		}
+		selected = append(selected, tasks[k])
+	}
+	return todos.Split(selected, *to)
+}
+
+func mergeTodo(args []string) error {
+	fs := flag.NewFlagSet("merge-todo", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	into := fs.String("into", "", "uid of the list merged into")
+	fs.Parse(args)
+	if *into == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: merge-todo -into LIST MERGED_LIST")
+	}
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return todo.New(d).Merge(*into, fs.Arg(0))
+}
+
+func instanceTodo(args []string) error {
+	fs := flag.NewFlagSet("instance-todo", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	template := fs.String("template", "", "uid of the template list")
+	fs.Parse(args)
+	if *template == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: instance-todo -template TEMPLATE NEW_LIST")
+	}
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return todo.New(d).Instantiate(*template, fs.Arg(0))
+}
@@ -0,0 +1,107 @@
+package date
+
+import (
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Names and words of a language to format and parse dates.
+type Locale struct {
+	Tag string
+	// Week days from Sunday.
+	Weekdays [7]string
+	Months   [12]string
+	// Layout of short dates, like 24/11/2025.
+	Layout string
+	// Layout of short dates without year, like 24/11.
+	ShortLayout string
+	// Words of relative days, lower cased. Several spellings may be given.
+	Today, Tomorrow, AfterTomorrow, Yesterday, BeforeYesterday []string
+	// Words before or after a week day for its next or last occurrence.
+	Next, Last []string
+	// Unit letters of relative durations: +3d, -2w, +1m, +1y.
+	DayUnits, WeekUnits, MonthUnits, YearUnits []string
+}
+
+var French = Locale{
+	Tag:             "fr",
+	Weekdays:        [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+	Months:          [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+	Layout:          "02/01/2006",
+	ShortLayout:     "02/01",
+	Today:           []string{"aujourd'hui", "aujourd’hui", "auj"},
+	Tomorrow:        []string{"demain"},
+	AfterTomorrow:   []string{"après-demain", "apres-demain"},
+	Yesterday:       []string{"hier"},
+	BeforeYesterday: []string{"avant-hier"},
+	Next:            []string{"prochain", "prochaine"},
+	Last:            []string{"dernier", "dernière", "derniere"},
+	DayUnits:        []string{"j"},
+	WeekUnits:       []string{"s", "sem"},
+	MonthUnits:      []string{"m", "mois"},
+	YearUnits:       []string{"a", "an"},
+}
+
+var English = Locale{
+	Tag:             "en",
+	Weekdays:        [7]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"},
+	Months:          [12]string{"january", "february", "march", "april", "may", "june", "july", "august", "september", "october", "november", "december"},
+	Layout:          "01/02/2006",
+	ShortLayout:     "01/02",
+	Today:           []string{"today"},
+	Tomorrow:        []string{"tomorrow"},
+	AfterTomorrow:   []string{"overmorrow"},
+	Yesterday:       []string{"yesterday"},
+	BeforeYesterday: []string{},
+	Next:            []string{"next"},
+	Last:            []string{"last"},
+	DayUnits:        []string{"d"},
+	WeekUnits:       []string{"w"},
+	MonthUnits:      []string{"m"},
+	YearUnits:       []string{"y"},
+}
+
+var locales = []Locale{French, English}
+
+// Locale of a language tag like fr, fr-FR or fr_FR.UTF-8.
+func Lookup(tag string) (Locale, bool) {
+	language, _, _ := strings.Cut(strings.ToLower(tag), "_")
+	language, _, _ = strings.Cut(language, "-")
+	for _, l := range locales {
+		if l.Tag == language {
+			return l, true
+		}
+	}
+	return Locale{}, false
+}
+
+// Locale of the LC_ALL, LC_TIME or LANG environment variables. Default is English.
+func FromEnv() Locale {
+	for _, name := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if l, ok := Lookup(os.Getenv(name)); ok {
+			return l
+		}
+	}
+	return English
+}
+
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+func (l Locale) Weekday(t time.Time) string {
+	return l.Weekdays[t.Weekday()]
+}
+
+func (l Locale) Month(t time.Time) string {
+	return l.Months[t.Month()-1]
+}
+
+// Capitalized week day and short date: Vendredi 24/11/2025.
+func (l Locale) FormatDay(t time.Time) string {
+	return capitalize(l.Weekday(t)) + " " + t.Format(l.Layout)
+}
@@ -0,0 +1,161 @@
+package date
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dates are written as ISO dates (2025-12-01), short dates of a locale (01/12/2025, 01/12),
+// relative days (demain, yesterday), relative durations (+3d, -2s) or week days (vendredi,
+// next friday, lundi dernier). Relative dates are computed from a reference day, the day of a
+// journal entry. Words may be separated by spaces, - or _ so they fit in a @DATE reference.
+
+var durationRegexp = regexp.MustCompile(`^([+-])(\d+)(\pL+)$`)
+
+// Layouts parsed whatever the locale.
+var isoLayouts = []string{time.DateOnly, "2006-01-02T15:04"}
+
+type Parser struct {
+	locales []Locale
+	now     func() time.Time
+}
+
+type Option func(*Parser)
+
+// Locales of the parsed words and short dates, the first ones win for ambiguous short dates.
+// Default is the environment locale then the other ones.
+func WithLocales(locales ...Locale) Option {
+	return func(p *Parser) {
+		p.locales = locales
+	}
+}
+
+// Clock telling the reference day of relative dates. Default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(p *Parser) {
+		p.now = now
+	}
+}
+
+func NewParser(opts ...Option) *Parser {
+	env := FromEnv()
+	p := &Parser{locales: []Locale{env}, now: time.Now}
+	for _, l := range locales {
+		if l.Tag != env.Tag {
+			p.locales = append(p.locales, l)
+		}
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Parser of dates relative to a reference day.
+func (p *Parser) At(reference time.Time) *Parser {
+	return &Parser{locales: p.locales, now: func() time.Time { return reference }}
+}
+
+var defaultParser = NewParser()
+
+// Parse a date with the default parser.
+func Parse(s string) (time.Time, bool) {
+	return defaultParser.Parse(s)
+}
+
+// Midnight of a day, in the local time zone.
+func Midnight(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// Parse a date. Dates without time are at midnight in the local time zone.
+func (p *Parser) Parse(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	today := Midnight(p.now())
+	for _, layout := range isoLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	for _, l := range p.locales {
+		if t, err := time.ParseInLocation(l.Layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	for _, l := range p.locales {
+		if t, err := time.ParseInLocation(l.ShortLayout, s, time.Local); err == nil {
+			return t.AddDate(today.Year(), 0, 0), true
+		}
+	}
+	s = strings.ToLower(s)
+	for _, l := range p.locales {
+		if t, ok := l.parseRelative(s, today); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (l Locale) parseRelative(s string, today time.Time) (time.Time, bool) {
+	for offset, words := range map[int][]string{0: l.Today, 1: l.Tomorrow, 2: l.AfterTomorrow, -1: l.Yesterday, -2: l.BeforeYesterday} {
+		if slices.Contains(words, s) {
+			return today.AddDate(0, 0, offset), true
+		}
+	}
+	if m := durationRegexp.FindStringSubmatch(s); m != nil {
+		n, err := strconv.Atoi(m[2])
+		if err != nil {
+			return time.Time{}, false
+		}
+		if m[1] == "-" {
+			n = -n
+		}
+		switch {
+		case slices.Contains(l.DayUnits, m[3]):
+			return today.AddDate(0, 0, n), true
+		case slices.Contains(l.WeekUnits, m[3]):
+			return today.AddDate(0, 0, 7*n), true
+		case slices.Contains(l.MonthUnits, m[3]):
+			return today.AddDate(0, n, 0), true
+		case slices.Contains(l.YearUnits, m[3]):
+			return today.AddDate(n, 0, 0), true
+		}
+		return time.Time{}, false
+	}
+	return l.parseWeekday(s, today)
+}
+
+// A week day is its next occurrence, today included. Next and last words give its next
+// occurrence after today or its last one before today.
+func (l Locale) parseWeekday(s string, today time.Time) (time.Time, bool) {
+	words := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == '-' || r == '_' })
+	direction := 0
+	weekday := -1
+	for _, w := range words {
+		switch {
+		case slices.Contains(l.Next, w) && direction == 0:
+			direction = 1
+		case slices.Contains(l.Last, w) && direction == 0:
+			direction = -1
+		case slices.Contains(l.Weekdays[:], w) && weekday < 0:
+			weekday = slices.Index(l.Weekdays[:], w)
+		default:
+			return time.Time{}, false
+		}
+	}
+	if weekday < 0 {
+		return time.Time{}, false
+	}
+	days := (weekday - int(today.Weekday()) + 7) % 7
+	switch {
+	case direction > 0 && days == 0:
+		days = 7
+	case direction < 0:
+		days -= 7
+	}
+	return today.AddDate(0, 0, days), true
+}
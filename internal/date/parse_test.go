@@ -0,0 +1,75 @@
+package date
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+}
+
+func TestLocale(t *testing.T) {
+	friday := day(2025, 11, 24).AddDate(0, 0, 4)
+	assert.Equal(t, "Vendredi 28/11/2025", French.FormatDay(friday))
+	assert.Equal(t, "Friday 11/28/2025", English.FormatDay(friday))
+	assert.Equal(t, "novembre", French.Month(friday))
+
+	l, ok := Lookup("fr_FR.UTF-8")
+	assert.True(t, ok)
+	assert.Equal(t, "fr", l.Tag)
+	l, ok = Lookup("en-US")
+	assert.True(t, ok)
+	assert.Equal(t, "en", l.Tag)
+	_, ok = Lookup("C")
+	assert.False(t, ok)
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_TIME", "fr_FR.UTF-8")
+	assert.Equal(t, "fr", FromEnv().Tag)
+}
+
+func TestParser_Parse(t *testing.T) {
+	// Monday
+	now := time.Date(2025, 11, 24, 18, 30, 0, 0, time.Local)
+	p := NewParser(WithLocales(French, English), WithClock(func() time.Time { return now }))
+	for s, expected := range map[string]time.Time{
+		"2025-12-01":       day(2025, 12, 1),
+		"2025-12-01T09:30": time.Date(2025, 12, 1, 9, 30, 0, 0, time.Local),
+		"01/12/2025":       day(2025, 12, 1),
+		"13/12":            day(2025, 12, 13),
+		"aujourd'hui":      day(2025, 11, 24),
+		"Demain":           day(2025, 11, 25),
+		"après-demain":     day(2025, 11, 26),
+		"yesterday":        day(2025, 11, 23),
+		"+3d":              day(2025, 11, 27),
+		"+3j":              day(2025, 11, 27),
+		"-2w":              day(2025, 11, 10),
+		"+1m":              day(2025, 12, 24),
+		"+1a":              day(2026, 11, 24),
+		"vendredi":         day(2025, 11, 28),
+		"lundi":            day(2025, 11, 24),
+		"lundi-prochain":   day(2025, 12, 1),
+		"next friday":      day(2025, 11, 28),
+		"next_monday":      day(2025, 12, 1),
+		"last monday":      day(2025, 11, 17),
+		"vendredi dernier": day(2025, 11, 21),
+	} {
+		parsed, ok := p.Parse(s)
+		if assert.True(t, ok, s) {
+			assert.Equal(t, expected, parsed, s)
+		}
+	}
+	for _, s := range []string{"", "jamais", "+3x", "friday friday", "next", "32/13/2025"} {
+		_, ok := p.Parse(s)
+		assert.False(t, ok, s)
+	}
+
+	// Ambiguous short dates are read with the first locale
+	parsed, _ := NewParser(WithLocales(English, French)).Parse("01/12/2025")
+	assert.Equal(t, day(2025, 1, 12), parsed)
+	// Relative to another day
+	parsed, _ = p.At(day(2025, 12, 31)).Parse("demain")
+	assert.Equal(t, day(2026, 1, 1), parsed)
+}
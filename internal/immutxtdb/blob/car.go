@@ -0,0 +1,237 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CARv1 archives of blocks, readable by IPFS tools (ipfs dag import).
+// CAR: [VARINT(HEADER_LEN),HEADER,SECTION...]
+// HEADER: DAG-CBOR {"roots": [CID...], "version": 1}
+// SECTION: [VARINT(CID_LEN+DATA_LEN),CID,DATA]
+
+var ErrBadCAR = errors.New("bad car file")
+
+const (
+	cborUint  = 0
+	cborBytes = 2
+	cborText  = 3
+	cborArray = 4
+	cborMap   = 5
+	cborTag   = 6
+	// CIDs are tagged byte strings in DAG-CBOR, prefixed by the identity multibase.
+	cborCidTag = 42
+)
+
+func appendCborHead(buf []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major<<5|byte(n))
+	case n <= 0xff:
+		return append(buf, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major<<5|27), n)
+	}
+}
+
+func appendCborText(buf []byte, s string) []byte {
+	return append(appendCborHead(buf, cborText, uint64(len(s))), s...)
+}
+
+func encodeCarHeader(roots []CID) []byte {
+	buf := appendCborHead(nil, cborMap, 2)
+	// DAG-CBOR map keys are sorted by length first.
+	buf = appendCborText(buf, "roots")
+	buf = appendCborHead(buf, cborArray, uint64(len(roots)))
+	for _, c := range roots {
+		cid := append([]byte{0}, c.Bytes()...)
+		buf = appendCborHead(buf, cborTag, cborCidTag)
+		buf = appendCborHead(buf, cborBytes, uint64(len(cid)))
+		buf = append(buf, cid...)
+	}
+	buf = appendCborText(buf, "version")
+	return appendCborHead(buf, cborUint, 1)
+}
+
+func readCborHead(r *bytes.Reader) (byte, uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	size := 1 << (info - 24)
+	if info > 27 {
+		return 0, 0, fmt.Errorf("%w: unsupported cbor item", ErrBadCAR)
+	}
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(r, buf[8-size:])
+	return major, binary.BigEndian.Uint64(buf), err
+}
+
+func readCborString(r *bytes.Reader, major byte) ([]byte, error) {
+	m, n, err := readCborHead(r)
+	if err != nil {
+		return nil, err
+	}
+	if m != major || n > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: unexpected cbor item", ErrBadCAR)
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+func decodeCarHeader(header []byte) ([]CID, error) {
+	r := bytes.NewReader(header)
+	major, count, err := readCborHead(r)
+	if err != nil || major != cborMap {
+		return nil, fmt.Errorf("%w: header is not a map", ErrBadCAR)
+	}
+	var roots []CID
+	version := uint64(0)
+	for range count {
+		key, err := readCborString(r, cborText)
+		if err != nil {
+			return nil, err
+		}
+		switch string(key) {
+		case "roots":
+			major, n, err := readCborHead(r)
+			if err != nil || major != cborArray {
+				return nil, fmt.Errorf("%w: roots is not an array", ErrBadCAR)
+			}
+			for range n {
+				major, tag, err := readCborHead(r)
+				if err != nil || major != cborTag || tag != cborCidTag {
+					return nil, fmt.Errorf("%w: root is not a cid", ErrBadCAR)
+				}
+				cid, err := readCborString(r, cborBytes)
+				if err != nil || len(cid) < 1 {
+					return nil, fmt.Errorf("%w: root is not a cid", ErrBadCAR)
+				}
+				c, _, err := decodeCID(cid[1:])
+				if err != nil {
+					return nil, err
+				}
+				roots = append(roots, c)
+			}
+		case "version":
+			major, version, err = readCborHead(r)
+			if err != nil || major != cborUint {
+				return nil, fmt.Errorf("%w: bad version", ErrBadCAR)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unexpected header key %q", ErrBadCAR, key)
+		}
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadCAR, version)
+	}
+	return roots, nil
+}
+
+func writeSection(w io.Writer, payload ...[]byte) error {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	_, err := w.Write(binary.AppendUvarint(nil, uint64(size)))
+	for _, p := range payload {
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(p)
+	}
+	return err
+}
+
+// Write the blocks reachable from roots into a CAR archive, each block once.
+func WriteCAR(w io.Writer, s BlobStore, roots ...CID) error {
+	bw := bufio.NewWriter(w)
+	err := writeSection(bw, encodeCarHeader(roots))
+	if err != nil {
+		return err
+	}
+	written := map[CID]bool{}
+	stack := append([]CID{}, roots...)
+	for len(stack) > 0 {
+		c := stack[0]
+		stack = stack[1:]
+		if written[c] {
+			continue
+		}
+		written[c] = true
+		data, err := s.Get(c)
+		if err != nil {
+			return err
+		}
+		err = writeSection(bw, c.Bytes(), data)
+		if err != nil {
+			return err
+		}
+		links, err := Links(s, c)
+		if err != nil {
+			return err
+		}
+		stack = append(stack, links...)
+	}
+	return bw.Flush()
+}
+
+func readSection(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	section := make([]byte, size)
+	_, err = io.ReadFull(r, section)
+	if err != nil {
+		return nil, fmt.Errorf("%w: truncated section", ErrBadCAR)
+	}
+	return section, nil
+}
+
+// Read the blocks of a CAR archive into the store, verifying each block against its cid.
+// Return the archive roots.
+func ReadCAR(r io.Reader, s BlobStore) ([]CID, error) {
+	br := bufio.NewReader(r)
+	header, err := readSection(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadCAR, err)
+	}
+	roots, err := decodeCarHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		section, err := readSection(br)
+		if err == io.EOF {
+			return roots, nil
+		} else if err != nil {
+			return nil, err
+		}
+		c, n, err := decodeCID(section)
+		if err != nil {
+			return nil, err
+		}
+		data := section[n:]
+		if !c.Verify(data) {
+			return nil, fmt.Errorf("%w: %s", ErrCorrupted, c)
+		}
+		_, err = s.Put(c.Codec, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package blob
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAR(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestCAR")
+	defer os.RemoveAll(tmpDir)
+	from, err := NewFSStore(filepath.Join(tmpDir, "from"))
+	require.NoError(t, err)
+	to, err := NewFSStore(filepath.Join(tmpDir, "to"))
+	require.NoError(t, err)
+
+	c1, err := PutContent(from, []byte("foo\n\nbar"))
+	require.NoError(t, err)
+	c2, err := PutContent(from, []byte("foo\n\nbaz"))
+	require.NoError(t, err)
+	_, err = PutContent(from, []byte("not exported"))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteCAR(buf, from, c1, c2))
+	car := buf.Bytes()
+	roots, err := ReadCAR(bytes.NewReader(car), to)
+	require.NoError(t, err)
+	assert.Equal(t, []CID{c1, c2}, roots)
+	// 2 manifests, foo written once, bar and baz
+	assert.Equal(t, 5, count(t, to))
+	content, err := GetContent(to, c2)
+	require.NoError(t, err)
+	assert.Equal(t, "foo\n\nbaz", string(content))
+
+	// A tampered block is refused
+	tampered := bytes.Replace(car, []byte("bar"), []byte("baa"), 1)
+	_, err = ReadCAR(bytes.NewReader(tampered), to)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	_, err = ReadCAR(bytes.NewReader(car[:len(car)-1]), to)
+	assert.ErrorIs(t, err, ErrBadCAR)
+	_, err = ReadCAR(bytes.NewReader([]byte{3, 1, 2, 3}), to)
+	assert.ErrorIs(t, err, ErrBadCAR)
+}
@@ -0,0 +1,119 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Content identifiers compatible with IPFS CIDv1: [VERSION,CODEC,MULTIHASH]
+// MULTIHASH: [HASH_CODE,DIGEST_LEN,DIGEST], always sha2-256 here.
+// The string form is the multibase base32 encoding used by IPFS (b prefix).
+
+type Codec uint64
+
+const (
+	// A chunk of content.
+	Raw Codec = 0x55
+	// A manifest listing the chunks of a content.
+	DagJSON Codec = 0x0129
+)
+
+const (
+	cidVersion      = 1
+	sha256Code      = 0x12
+	multibaseBase32 = 'b'
+)
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var ErrBadCID = errors.New("bad cid")
+
+type CID struct {
+	Codec  Codec
+	Digest [sha256.Size]byte
+}
+
+// Identify a block of data.
+func Sum(codec Codec, data []byte) CID {
+	return CID{Codec: codec, Digest: sha256.Sum256(data)}
+}
+
+func (c CID) IsZero() bool {
+	return c == CID{}
+}
+
+// Check data is the block identified by the cid.
+func (c CID) Verify(data []byte) bool {
+	return sha256.Sum256(data) == c.Digest
+}
+
+func (c CID) Bytes() []byte {
+	buf := binary.AppendUvarint(nil, cidVersion)
+	buf = binary.AppendUvarint(buf, uint64(c.Codec))
+	buf = append(buf, sha256Code, sha256.Size)
+	return append(buf, c.Digest[:]...)
+}
+
+func (c CID) String() string {
+	return string(multibaseBase32) + strings.ToLower(base32Encoding.EncodeToString(c.Bytes()))
+}
+
+func (c CID) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *CID) UnmarshalText(text []byte) error {
+	parsed, err := ParseCID(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+func ParseCID(s string) (CID, error) {
+	if len(s) < 2 || s[0] != multibaseBase32 {
+		return CID{}, fmt.Errorf("%w: %q", ErrBadCID, s)
+	}
+	buf, err := base32Encoding.DecodeString(strings.ToUpper(s[1:]))
+	if err != nil {
+		return CID{}, fmt.Errorf("%w: %w", ErrBadCID, err)
+	}
+	c, n, err := decodeCID(buf)
+	if err != nil {
+		return CID{}, err
+	}
+	if n != len(buf) {
+		return CID{}, fmt.Errorf("%w: trailing bytes", ErrBadCID)
+	}
+	return c, nil
+}
+
+// Decode a binary cid at the beginning of buf, returning its length.
+func decodeCID(buf []byte) (CID, int, error) {
+	r := bytes.NewReader(buf)
+	version, err := binary.ReadUvarint(r)
+	if err != nil || version != cidVersion {
+		return CID{}, 0, fmt.Errorf("%w: unsupported version", ErrBadCID)
+	}
+	codec, err := binary.ReadUvarint(r)
+	if err != nil {
+		return CID{}, 0, fmt.Errorf("%w: %w", ErrBadCID, err)
+	}
+	code, err1 := r.ReadByte()
+	size, err2 := r.ReadByte()
+	if err1 != nil || err2 != nil || code != sha256Code || size != sha256.Size {
+		return CID{}, 0, fmt.Errorf("%w: unsupported multihash", ErrBadCID)
+	}
+	c := CID{Codec: Codec(codec)}
+	n, err := r.Read(c.Digest[:])
+	if err != nil || n != sha256.Size {
+		return CID{}, 0, fmt.Errorf("%w: truncated digest", ErrBadCID)
+	}
+	return c, len(buf) - r.Len(), nil
+}
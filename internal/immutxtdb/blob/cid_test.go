@@ -0,0 +1,28 @@
+package blob
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCID_String(t *testing.T) {
+	// Same cid as `ipfs add --cid-version 1 --raw-leaves` of "hello world".
+	c := Sum(Raw, []byte("hello world"))
+	assert.Equal(t, "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", c.String())
+
+	parsed, err := ParseCID(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	manifest := Sum(DagJSON, []byte("{}"))
+	parsed, err = ParseCID(manifest.String())
+	require.NoError(t, err)
+	assert.Equal(t, manifest, parsed)
+
+	for _, s := range []string{"", "b", "Qmfoo", "bafkrei", c.String() + "aa"} {
+		_, err = ParseCID(s)
+		assert.ErrorIs(t, err, ErrBadCID, s)
+	}
+}
@@ -0,0 +1,108 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// A content is stored as chunks listed by a manifest block, the manifest cid identifying the
+// content. Chunks are cut after paragraphs, so a paragraph repeated in several contents, days or
+// devices is stored once. Manifests are DAG-JSON: chunks are links, keys are sorted, so IPFS tools
+// traverse a content from its manifest.
+
+const MaxChunkSize = 4096
+
+type manifest struct {
+	Chunks []link `json:"chunks"`
+	Size   int    `json:"size"`
+}
+
+// A DAG-JSON link: {"/":"<cid>"}
+type link struct {
+	CID CID `json:"/"`
+}
+
+// Cut content after each blank line, and every MaxChunkSize bytes in long paragraphs.
+func chunks(content []byte) [][]byte {
+	var cs [][]byte
+	for len(content) > 0 {
+		end := len(content)
+		if k := bytes.Index(content, []byte("\n\n")); k >= 0 {
+			end = k + 2
+		}
+		end = min(end, MaxChunkSize)
+		cs = append(cs, content[:end])
+		content = content[end:]
+	}
+	return cs
+}
+
+// Store a content, returning the cid of its manifest.
+func PutContent(s BlobStore, content []byte) (CID, error) {
+	m := manifest{Size: len(content), Chunks: []link{}}
+	for _, chunk := range chunks(content) {
+		c, err := s.Put(Raw, chunk)
+		if err != nil {
+			return CID{}, err
+		}
+		m.Chunks = append(m.Chunks, link{CID: c})
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return CID{}, err
+	}
+	return s.Put(DagJSON, data)
+}
+
+func getManifest(s BlobStore, root CID) (*manifest, error) {
+	if root.Codec != DagJSON {
+		return nil, fmt.Errorf("%w: %s is not a manifest", ErrBadCID, root)
+	}
+	data, err := s.Get(root)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest %s: %w", root, err)
+	}
+	return m, nil
+}
+
+// Read back a content from the cid of its manifest, verifying every chunk.
+func GetContent(s BlobStore, root CID) ([]byte, error) {
+	m, err := getManifest(s, root)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, 0, m.Size)
+	for _, l := range m.Chunks {
+		chunk, err := s.Get(l.CID)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+	}
+	if len(content) != m.Size {
+		return nil, fmt.Errorf("%w: %s size is %d, expected %d", ErrCorrupted, root, len(content), m.Size)
+	}
+	return content, nil
+}
+
+// Blocks linked by a block: the chunks of a manifest.
+func Links(s BlobStore, c CID) ([]CID, error) {
+	if c.Codec != DagJSON {
+		return nil, nil
+	}
+	m, err := getManifest(s, c)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]CID, len(m.Chunks))
+	for k, l := range m.Chunks {
+		links[k] = l.CID
+	}
+	return links, nil
+}
@@ -0,0 +1,100 @@
+package blob
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func count(t *testing.T, s BlobStore) int {
+	n := 0
+	for _, err := range s.All() {
+		require.NoError(t, err)
+		n++
+	}
+	return n
+}
+
+func TestPutContent(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestPutContent")
+	defer os.RemoveAll(tmpDir)
+	s, err := NewFSStore(tmpDir)
+	require.NoError(t, err)
+
+	monday := "# Monday\n\nSame paragraph.\n\nMonday notes."
+	tuesday := "# Tuesday\n\nSame paragraph.\n\nTuesday notes."
+	c1, err := PutContent(s, []byte(monday))
+	require.NoError(t, err)
+	c2, err := PutContent(s, []byte(tuesday))
+	require.NoError(t, err)
+	// 2 manifests, 5 distinct paragraphs
+	assert.Equal(t, 7, count(t, s))
+
+	c3, err := PutContent(s, []byte(monday))
+	require.NoError(t, err)
+	assert.Equal(t, c1, c3)
+	assert.Equal(t, 7, count(t, s))
+
+	content, err := GetContent(s, c1)
+	require.NoError(t, err)
+	assert.Equal(t, monday, string(content))
+	// Chunks are DAG-JSON links
+	links, err := Links(s, c1)
+	require.NoError(t, err)
+	data, err := s.Get(c1)
+	require.NoError(t, err)
+	assert.Equal(t, `{"chunks":[{"/":"`+links[0].String()+`"},{"/":"`+links[1].String()+`"},{"/":"`+links[2].String()+`"}],"size":40}`, string(data))
+	content, err = GetContent(s, c2)
+	require.NoError(t, err)
+	assert.Equal(t, tuesday, string(content))
+
+	// Long paragraphs are cut
+	long := strings.Repeat("a", 2*MaxChunkSize+1)
+	c4, err := PutContent(s, []byte(long))
+	require.NoError(t, err)
+	links, err = Links(s, c4)
+	require.NoError(t, err)
+	assert.Len(t, links, 3)
+	content, err = GetContent(s, c4)
+	require.NoError(t, err)
+	assert.Equal(t, long, string(content))
+
+	c5, err := PutContent(s, nil)
+	require.NoError(t, err)
+	content, err = GetContent(s, c5)
+	require.NoError(t, err)
+	assert.Empty(t, content)
+}
+
+func TestGetContent_Corrupted(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestGetContent_Corrupted")
+	defer os.RemoveAll(tmpDir)
+	s, err := NewFSStore(tmpDir)
+	require.NoError(t, err)
+
+	c, err := PutContent(s, []byte("foo\n\nbar"))
+	require.NoError(t, err)
+	links, err := Links(s, c)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(s.path(links[1]), []byte("baz"), 0600))
+
+	_, err = GetContent(s, c)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	require.NoError(t, os.Remove(s.path(links[1])))
+	_, err = GetContent(s, c)
+	assert.ErrorIs(t, err, ErrNotFound)
+	ok, err := s.Has(links[1])
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = GetContent(s, links[0])
+	assert.ErrorIs(t, err, ErrBadCID)
+	_, err = os.Stat(filepath.Join(tmpDir, c.String()[len(c.String())-2:], c.String()))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,139 @@
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/utilz/filez"
+)
+
+var (
+	ErrNotFound  = errors.New("blob not found")
+	ErrCorrupted = errors.New("blob does not match its cid")
+)
+
+// BlobStore keep blocks of data by their content identifier.
+// Storing a block twice store it once, and blocks are verified against their cid when read.
+type BlobStore interface {
+	Put(codec Codec, data []byte) (CID, error)
+	Get(c CID) ([]byte, error)
+	Has(c CID) (bool, error)
+	All() iter.Seq2[CID, error]
+	// Time a block was last put.
+	ModTime(c CID) (time.Time, error)
+	// Return ErrNotFound if the block does not exist.
+	Remove(c CID) error
+}
+
+// FSStore keep each block in a file named by its cid, spread in directories by cid prefix.
+type FSStore struct {
+	root string
+}
+
+func NewFSStore(root string) (*FSStore, error) {
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FSStore{root: root}, nil
+}
+
+func (s *FSStore) path(c CID) string {
+	name := c.String()
+	return filepath.Join(s.root, name[len(name)-2:], name)
+}
+
+func (s *FSStore) Put(codec Codec, data []byte) (CID, error) {
+	c := Sum(codec, data)
+	path := s.path(c)
+	if _, err := os.Stat(path); err == nil {
+		// Putting a block again keeps it from a collection.
+		now := time.Now()
+		return c, os.Chtimes(path, now, now)
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return CID{}, err
+	}
+	// Write then rename to never leave a torn block under its cid.
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, filez.DefaultFilePerms)
+	if err != nil {
+		return CID{}, err
+	}
+	return c, os.Rename(tmpPath, path)
+}
+
+func (s *FSStore) Get(c CID) ([]byte, error) {
+	data, err := os.ReadFile(s.path(c))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, c)
+	} else if err != nil {
+		return nil, err
+	}
+	if !c.Verify(data) {
+		return nil, fmt.Errorf("%w: %s", ErrCorrupted, c)
+	}
+	return data, nil
+}
+
+func (s *FSStore) ModTime(c CID) (time.Time, error) {
+	info, err := os.Stat(s.path(c))
+	if os.IsNotExist(err) {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrNotFound, c)
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s *FSStore) Remove(c CID) error {
+	err := os.Remove(s.path(c))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrNotFound, c)
+	}
+	return err
+}
+
+func (s *FSStore) Has(c CID) (bool, error) {
+	_, err := os.Stat(s.path(c))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Iterate over all cids of the store.
+func (s *FSStore) All() iter.Seq2[CID, error] {
+	return func(yield func(CID, error) bool) {
+		dirs, err := os.ReadDir(s.root)
+		if err != nil {
+			yield(CID{}, err)
+			return
+		}
+		for _, dir := range dirs {
+			if !dir.IsDir() {
+				continue
+			}
+			entries, err := os.ReadDir(filepath.Join(s.root, dir.Name()))
+			if err != nil {
+				yield(CID{}, err)
+				return
+			}
+			for _, entry := range entries {
+				if strings.HasSuffix(entry.Name(), ".tmp") {
+					continue
+				}
+				c, err := ParseCID(entry.Name())
+				if !yield(c, err) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+type Stats struct {
+	Hits      int
+	Misses    int
+	Evictions int
+	Len       int
+	Size      int
+	Budget    int
+}
+
+type lruItem[K comparable, V any] struct {
+	key  K
+	val  V
+	size int
+}
+
+// LRU is a bounded cache evicting least recently used items when its memory budget is exceeded.
+// Item sizes are supplied by the caller on Put. LRU is safe for concurrent use.
+type LRU[K comparable, V any] struct {
+	mutex     sync.Mutex
+	budget    int
+	size      int
+	items     map[K]*list.Element
+	recency   *list.List
+	hits      int
+	misses    int
+	evictions int
+}
+
+func NewLRU[K comparable, V any](budget int) *LRU[K, V] {
+	return &LRU[K, V]{
+		budget:  budget,
+		items:   make(map[K]*list.Element),
+		recency: list.New(),
+	}
+}
+
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.hits++
+		c.recency.MoveToFront(e)
+		return e.Value.(*lruItem[K, V]).val, true
+	}
+	c.misses++
+	var zero V
+	return zero, false
+}
+
+// Get an item without counting a hit nor making it recently used.
+func (c *LRU[K, V]) Peek(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		return e.Value.(*lruItem[K, V]).val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Put an item in the cache. An item bigger than the whole budget is not cached.
+func (c *LRU[K, V]) Put(key K, val V, size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(key)
+	if size > c.budget {
+		return
+	}
+	e := c.recency.PushFront(&lruItem[K, V]{key: key, val: val, size: size})
+	c.items[key] = e
+	c.size += size
+	for c.size > c.budget {
+		last := c.recency.Back()
+		c.remove(last.Value.(*lruItem[K, V]).key)
+		c.evictions++
+	}
+}
+
+func (c *LRU[K, V]) Invalidate(key K) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(key)
+}
+
+// Invalidate all items matching a predicate.
+func (c *LRU[K, V]) InvalidateFunc(match func(K) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.items {
+		if match(key) {
+			c.remove(key)
+		}
+	}
+}
+
+func (c *LRU[K, V]) remove(key K) {
+	if e, ok := c.items[key]; ok {
+		c.size -= e.Value.(*lruItem[K, V]).size
+		c.recency.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+func (c *LRU[K, V]) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Len:       len(c.items),
+		Size:      c.size,
+		Budget:    c.budget,
+	}
+}
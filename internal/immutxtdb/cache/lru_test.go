@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU_GetPut(t *testing.T) {
+	c := NewLRU[string, int](10)
+
+	_, ok := c.Get("foo")
+	assert.False(t, ok)
+
+	c.Put("foo", 1, 4)
+	c.Put("bar", 2, 4)
+	v, ok := c.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	// bar is the least recently used
+	c.Put("baz", 3, 4)
+	_, ok = c.Get("bar")
+	assert.False(t, ok)
+	v, ok = c.Get("baz")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Hits)
+	assert.Equal(t, 2, stats.Misses)
+	assert.Equal(t, 1, stats.Evictions)
+	assert.Equal(t, 2, stats.Len)
+	assert.Equal(t, 8, stats.Size)
+
+	// Peek neither counts nor refresh recency
+	v, ok = c.Peek("foo")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, stats, c.Stats())
+	c.Put("qux", 4, 4)
+	_, ok = c.Peek("foo")
+	assert.False(t, ok)
+}
+
+func TestLRU_Budget(t *testing.T) {
+	c := NewLRU[string, int](10)
+
+	// Too big to be cached
+	c.Put("foo", 1, 11)
+	_, ok := c.Get("foo")
+	assert.False(t, ok)
+
+	c.Put("foo", 1, 6)
+	c.Put("foo", 2, 8)
+	assert.Equal(t, 8, c.Stats().Size)
+	v, _ := c.Get("foo")
+	assert.Equal(t, 2, v)
+}
+
+func TestLRU_Invalidate(t *testing.T) {
+	c := NewLRU[string, int](10)
+	c.Put("a/1", 1, 1)
+	c.Put("a/2", 2, 1)
+	c.Put("b/1", 3, 1)
+
+	c.Invalidate("b/1")
+	_, ok := c.Get("b/1")
+	assert.False(t, ok)
+
+	c.InvalidateFunc(func(k string) bool { return k[0] == 'a' })
+	assert.Equal(t, 0, c.Stats().Len)
+	assert.Equal(t, 0, c.Stats().Size)
+}
@@ -0,0 +1,182 @@
+package crdt
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/diff"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+)
+
+// Replicated Growable Array of runes.
+// Each rune is identified by the clock of the layer which inserted it and its offset in the layer.
+// Removed runes are kept as tombstones so concurrent operations can still reference them.
+// Applying the same layers in clock order on any device always produce the same text.
+
+// Identify a rune. A zero clock refer to the layer holding the operation.
+type ID struct {
+	Clock  hlc.Timestamp `json:"c"`
+	Offset int           `json:"o"`
+}
+
+// Head is the virtual element before the first rune.
+var Head = ID{Offset: -1}
+
+func (i ID) Compare(o ID) int {
+	if c := i.Clock.Compare(o.Clock); c != 0 {
+		return c
+	}
+	return i.Offset - o.Offset
+}
+
+func (i ID) resolve(clock hlc.Timestamp) ID {
+	if i.Clock.IsZero() && i.Clock.Device == "" && i.Offset >= 0 {
+		i.Clock = clock
+	}
+	return i
+}
+
+// A range of consecutive runes inserted by a same layer.
+type Span struct {
+	Start ID  `json:"s"`
+	Len   int `json:"l"`
+}
+
+// Op insert Text after the rune After, the first inserted rune having Offset in the layer,
+// or delete the runes of the spans.
+type Op struct {
+	After  ID     `json:"a"`
+	Offset int    `json:"o,omitempty"`
+	Text   string `json:"t,omitempty"`
+	Delete []Span `json:"d,omitempty"`
+}
+
+type node struct {
+	id      ID
+	r       rune
+	deleted bool
+}
+
+type Doc struct {
+	nodes []node
+	// Restarted from a snapshot: runes deleted before the snapshot are unknown.
+	restarted bool
+}
+
+func NewDoc() *Doc {
+	return &Doc{}
+}
+
+func (d *Doc) position(id ID) int {
+	if id == Head {
+		return -1
+	}
+	for k, n := range d.nodes {
+		if n.id == id {
+			return k
+		}
+	}
+	return -2
+}
+
+func (d *Doc) integrate(after, id ID, r rune) error {
+	pos := d.position(after)
+	if pos < -1 && d.restarted {
+		pos = len(d.nodes) - 1
+	} else if pos < -1 {
+		return fmt.Errorf("cannot insert after unknown rune %v", after)
+	}
+	// Skip runes inserted after the same rune by layers ordered later.
+	pos++
+	for pos < len(d.nodes) && d.nodes[pos].id.Compare(id) > 0 {
+		pos++
+	}
+	d.nodes = slices.Insert(d.nodes, pos, node{id: id, r: r})
+	return nil
+}
+
+// Apply operations of a layer timestamped by clock.
+func (d *Doc) Apply(clock hlc.Timestamp, ops []Op) error {
+	for _, op := range ops {
+		after := op.After.resolve(clock)
+		offset := op.Offset
+		for _, r := range op.Text {
+			id := ID{Clock: clock, Offset: offset}
+			err := d.integrate(after, id, r)
+			if err != nil {
+				return err
+			}
+			after = id
+			offset++
+		}
+		for _, s := range op.Delete {
+			start := s.Start.resolve(clock)
+			for k := range s.Len {
+				pos := d.position(ID{Clock: start.Clock, Offset: start.Offset + k})
+				if pos < 0 && d.restarted {
+					continue
+				} else if pos < 0 {
+					return fmt.Errorf("cannot delete unknown rune %v", start)
+				}
+				d.nodes[pos].deleted = true
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Doc) visible() ([]rune, []ID) {
+	var runes []rune
+	var ids []ID
+	for _, n := range d.nodes {
+		if !n.deleted {
+			runes = append(runes, n.r)
+			ids = append(ids, n.id)
+		}
+	}
+	return runes, ids
+}
+
+func (d *Doc) Text() string {
+	runes, _ := d.visible()
+	return string(runes)
+}
+
+// Compute operations transforming the document text into text.
+// Ids of inserted runes are relative to the layer which will hold the operations.
+func (d *Doc) Diff(text string) []Op {
+	runes, ids := d.visible()
+	target := []rune(text)
+	var ops []Op
+	last := Head
+	offset := 0
+	for _, e := range diff.Diff(runes, target) {
+		switch e.Op {
+		case diff.Equal:
+			last = ids[e.AEnd-1]
+		case diff.Delete:
+			ops = append(ops, Op{After: Head, Delete: spans(ids[e.AStart:e.AEnd])})
+		case diff.Insert:
+			ops = append(ops, Op{After: last, Offset: offset, Text: string(target[e.BStart:e.BEnd])})
+			offset += e.BEnd - e.BStart
+			last = ID{Offset: offset - 1}
+		}
+	}
+	return ops
+}
+
+// Group ids in spans of consecutive offsets of a same layer.
+func spans(ids []ID) []Span {
+	var spans []Span
+	for _, id := range ids {
+		if n := len(spans); n > 0 {
+			s := &spans[n-1]
+			if s.Start.Clock == id.Clock && s.Start.Offset+s.Len == id.Offset {
+				s.Len++
+				continue
+			}
+		}
+		spans = append(spans, Span{Start: id, Len: 1})
+	}
+	return spans
+}
@@ -0,0 +1,117 @@
+package crdt
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type layer struct {
+	clock hlc.Timestamp
+	ops   []Op
+}
+
+func clock(wall int64, device string) hlc.Timestamp {
+	return hlc.Timestamp{Wall: wall, Device: device}
+}
+
+func replay(t *testing.T, layers ...layer) *Doc {
+	d := NewDoc()
+	for _, l := range layers {
+		require.NoError(t, d.Apply(l.clock, l.ops))
+	}
+	return d
+}
+
+// Edit a replica of the document built from layers.
+func edit(t *testing.T, c hlc.Timestamp, text string, layers ...layer) layer {
+	return layer{clock: c, ops: replay(t, layers...).Diff(text)}
+}
+
+func TestDoc_Edits(t *testing.T) {
+	l1 := edit(t, clock(1, "a"), "hello world")
+	l2 := edit(t, clock(2, "a"), "hello big world", l1)
+	l3 := edit(t, clock(3, "a"), "Hello world!", l1, l2)
+
+	assert.Equal(t, "hello world", replay(t, l1).Text())
+	assert.Equal(t, "hello big world", replay(t, l1, l2).Text())
+	assert.Equal(t, "Hello world!", replay(t, l1, l2, l3).Text())
+
+	l4 := edit(t, clock(4, "a"), "", l1, l2, l3)
+	assert.Equal(t, "", replay(t, l1, l2, l3, l4).Text())
+}
+
+func TestDoc_ConcurrentEdits(t *testing.T) {
+	base := edit(t, clock(1, "a"), "le chat dort\n")
+
+	// Both devices edit the same entry offline
+	a := edit(t, clock(2, "a"), "le gros chat dort\n", base)
+	b := edit(t, clock(2, "b"), "le chat dort.\nil pleut\n", base)
+
+	ab := replay(t, base, a, b).Text()
+	ba := replay(t, base, b, a).Text()
+	assert.Equal(t, "le gros chat dort.\nil pleut\n", ab)
+	assert.Equal(t, ab, ba)
+}
+
+func TestDoc_ConcurrentInsertsAtSamePlace(t *testing.T) {
+	base := edit(t, clock(1, "a"), "[]")
+	a := edit(t, clock(2, "a"), "[foo]", base)
+	b := edit(t, clock(2, "b"), "[bar]", base)
+
+	ab := replay(t, base, a, b).Text()
+	assert.Equal(t, ab, replay(t, base, b, a).Text())
+	// Inserts are not interleaved
+	assert.Contains(t, []string{"[foobar]", "[barfoo]"}, ab)
+}
+
+func TestDoc_ConcurrentDeleteAndInsert(t *testing.T) {
+	base := edit(t, clock(1, "a"), "foo bar baz")
+	a := edit(t, clock(2, "a"), "foo baz", base)
+	b := edit(t, clock(2, "b"), "foo barbie baz", base)
+
+	ab := replay(t, base, a, b).Text()
+	assert.Equal(t, ab, replay(t, base, b, a).Text())
+	// Text inserted in a concurrently deleted range is kept
+	assert.Contains(t, ab, "bie")
+	assert.NotContains(t, ab, "bar")
+}
+
+func TestDoc_Convergence(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	mutate := func(s string) string {
+		runes := []rune(s)
+		for range 1 + r.IntN(3) {
+			pos := r.IntN(len(runes) + 1)
+			if r.IntN(2) == 0 && pos < len(runes) {
+				runes = append(runes[:pos], runes[pos+1:]...)
+			} else {
+				runes = append(runes[:pos], append([]rune{rune('a' + r.IntN(26))}, runes[pos:]...)...)
+			}
+		}
+		return string(runes)
+	}
+	for k := range 200 {
+		base := edit(t, clock(1, "a"), "lorem ipsum")
+		a := edit(t, clock(int64(2+k%2), "a"), mutate("lorem ipsum"), base)
+		b := edit(t, clock(2, "b"), mutate("lorem ipsum"), base)
+		c := edit(t, clock(3, "c"), mutate("lorem ipsum"), base)
+		expected := replay(t, base, a, b, c).Text()
+		assert.Equal(t, expected, replay(t, base, c, b, a).Text())
+		assert.Equal(t, expected, replay(t, base, b, a, c).Text())
+	}
+}
+
+func TestOp_Json(t *testing.T) {
+	base := edit(t, clock(1, "a"), "foo")
+	l := edit(t, clock(2, "a"), "fooBar", base)
+	data, err := json.Marshal(l.ops)
+	require.NoError(t, err)
+	var ops []Op
+	require.NoError(t, json.Unmarshal(data, &ops))
+	assert.Equal(t, "fooBar", replay(t, base, layer{clock: l.clock, ops: ops}).Text())
+}
@@ -0,0 +1,44 @@
+package crdt
+
+// A snapshot keep the visible runes of a document with their ids, so the document can restart
+// from it once the layers it folds are compacted: operations saved on top of the snapshot still
+// reference valid ids. Deleted runes are not kept, so operations saved concurrently to the
+// snapshot may reference runes it dropped: deleting them is ignored, and text inserted after them
+// is appended at the end of the document, the same way on all devices.
+
+// Runes of consecutive offsets inserted by a same layer.
+type Run struct {
+	Start ID     `json:"s"`
+	Text  string `json:"t"`
+}
+
+// Visible runes of the document.
+func (d *Doc) Snapshot() []Run {
+	var runs []Run
+	last := Head
+	for _, n := range d.nodes {
+		if n.deleted {
+			continue
+		}
+		if k := len(runs) - 1; k >= 0 && n.id.Clock == last.Clock && n.id.Offset == last.Offset+1 {
+			runs[k].Text += string(n.r)
+		} else {
+			runs = append(runs, Run{Start: n.id, Text: string(n.r)})
+		}
+		last = n.id
+	}
+	return runs
+}
+
+// Restart a document from a snapshot.
+func NewDocFromSnapshot(runs []Run) *Doc {
+	d := &Doc{restarted: true}
+	for _, r := range runs {
+		offset := r.Start.Offset
+		for _, c := range r.Text {
+			d.nodes = append(d.nodes, node{id: ID{Clock: r.Start.Clock, Offset: offset}, r: c})
+			offset++
+		}
+	}
+	return d
+}
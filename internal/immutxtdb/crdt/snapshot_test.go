@@ -0,0 +1,37 @@
+package crdt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoc_Snapshot(t *testing.T) {
+	l1 := edit(t, clock(1, "a"), "hello world")
+	l2 := edit(t, clock(2, "a"), "hello big world", l1)
+	l3 := edit(t, clock(3, "a"), "hello big wide", l1, l2)
+	runs := replay(t, l1, l2, l3).Snapshot()
+
+	// Operations saved on top of the snapshot apply on the restarted document
+	l4 := edit(t, clock(4, "a"), "hello, big wide world", l1, l2, l3)
+	d := NewDocFromSnapshot(runs)
+	assert.Equal(t, "hello big wide", d.Text())
+	require.NoError(t, d.Apply(l4.clock, l4.ops))
+	assert.Equal(t, "hello, big wide world", d.Text())
+}
+
+func TestDoc_SnapshotConcurrentEdits(t *testing.T) {
+	base := edit(t, clock(1, "a"), "foo bar baz")
+	a := edit(t, clock(2, "a"), "foo baz", base)
+	// b edits runes the snapshot dropped
+	b := edit(t, clock(3, "b"), "foo barbie baz!", base)
+
+	d := NewDocFromSnapshot(replay(t, base, a).Snapshot())
+	require.NoError(t, d.Apply(b.clock, b.ops))
+	// Text inserted after dropped runes is kept
+	assert.Contains(t, d.Text(), "foo ")
+	assert.Contains(t, d.Text(), "bie")
+	assert.Contains(t, d.Text(), "!")
+	assert.NotContains(t, d.Text(), "bar")
+}
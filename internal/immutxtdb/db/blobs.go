@@ -0,0 +1,175 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/blob"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+)
+
+var ErrNoBlobStore = errors.New("a blob store is required")
+
+// A block of the blob store carried by a patch, for the layers of the patch stored as blobs.
+type patchBlock struct {
+	CID  blob.CID `json:"cid"`
+	Data []byte   `json:"data"`
+}
+
+// Blocks of the layer contents stored as blobs by layer data records.
+func (d *DB) recordsBlocks(records []wal.Record) ([]patchBlock, error) {
+	var blocks []patchBlock
+	seen := map[blob.CID]bool{}
+	for _, r := range records {
+		var p layerPayload
+		err := json.Unmarshal(r.Data, &p)
+		if err != nil {
+			return nil, fmt.Errorf("decoding layer: %w", err)
+		}
+		stack := p.roots()
+		if len(stack) == 0 {
+			continue
+		}
+		if d.blobs == nil {
+			return nil, fmt.Errorf("%w: layer content %s", ErrNoBlobStore, stack[0])
+		}
+		for len(stack) > 0 {
+			c := stack[0]
+			stack = stack[1:]
+			if seen[c] {
+				continue
+			}
+			seen[c] = true
+			data, err := d.blobs.Get(c)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, patchBlock{CID: c, Data: data})
+			links, err := blob.Links(d.blobs, c)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, links...)
+		}
+	}
+	return blocks, nil
+}
+
+// Store the blocks of a patch, before the layers referencing them are written.
+func (d *DB) importBlocks(blocks []patchBlock) error {
+	if len(blocks) > 0 && d.blobs == nil {
+		return ErrNoBlobStore
+	}
+	for _, b := range blocks {
+		if !b.CID.Verify(b.Data) {
+			return fmt.Errorf("%w: block %s does not match its cid", ErrBadPatch, b.CID)
+		}
+		_, err := d.blobs.Put(b.CID.Codec, b.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export the layer contents of the blob store in a CAR archive, rooted at each content.
+func (d *DB) ExportCAR(w io.Writer) error {
+	if d.blobs == nil {
+		return ErrNoBlobStore
+	}
+	var roots []blob.CID
+	for c, err := range d.blobs.All() {
+		if err != nil {
+			return err
+		}
+		if c.Codec == blob.DagJSON {
+			roots = append(roots, c)
+		}
+	}
+	slices.SortFunc(roots, func(a, b blob.CID) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return blob.WriteCAR(w, d.blobs, roots...)
+}
+
+// Remove the blocks no layer of any device references anymore, unless put during the retention
+// window: the blocks of an other device may reach the store before the layers referencing them.
+// Return the count of removed blocks. Caller must hold the db lock.
+func (d *DB) removeUnreferencedBlocks(before time.Time) (int, error) {
+	entries, err := os.ReadDir(d.rootPath)
+	if err != nil {
+		return 0, err
+	}
+	var stack []blob.CID
+	for _, entry := range entries {
+		if !layerDataFilenameRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		data, err := openLayerData(filepath.Join(d.rootPath, entry.Name()), false)
+		if err != nil {
+			return 0, err
+		}
+		for blocId := range data.count() {
+			payload, err := data.read(blocId)
+			if err != nil {
+				return 0, err
+			}
+			var p layerPayload
+			err = json.Unmarshal(payload, &p)
+			if err != nil {
+				return 0, fmt.Errorf("decoding layer: %w", err)
+			}
+			stack = append(stack, p.roots()...)
+		}
+	}
+	referenced := map[blob.CID]bool{}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if referenced[c] {
+			continue
+		}
+		referenced[c] = true
+		links, err := blob.Links(d.blobs, c)
+		if errors.Is(err, blob.ErrNotFound) {
+			// Not replicated yet
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		stack = append(stack, links...)
+	}
+
+	var unreferenced []blob.CID
+	for c, err := range d.blobs.All() {
+		if err != nil {
+			return 0, err
+		}
+		if !referenced[c] {
+			unreferenced = append(unreferenced, c)
+		}
+	}
+	removed := 0
+	for _, c := range unreferenced {
+		modTime, err := d.blobs.ModTime(c)
+		if err != nil {
+			return removed, err
+		}
+		if !modTime.Before(before) {
+			continue
+		}
+		err = d.blobs.Remove(c)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/blob"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func count(t *testing.T, s blob.BlobStore) int {
+	n := 0
+	for _, err := range s.All() {
+		require.NoError(t, err)
+		n++
+	}
+	return n
+}
+
+func openWithBlobs(t *testing.T, dir, device string) (*DB, *blob.FSStore) {
+	store, err := blob.NewFSStore(filepath.Join(dir, "blobs"))
+	require.NoError(t, err)
+	d, err := Open(dir, device, WithBlobStore(store))
+	require.NoError(t, err)
+	return d, store
+}
+
+func TestDB_BlobStore(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_BlobStore")
+	defer os.RemoveAll(tmpDir)
+	key, err := LoadSigningKey(filepath.Join(tmpDir, "keys", "a.key"))
+	require.NoError(t, err)
+
+	a, storeA := openWithBlobs(t, filepath.Join(tmpDir, "a"), "a")
+	require.NoError(t, a.Save("monday", index.Document, "Monday\n\nRecurring paragraph.\n\n", nil))
+	require.NoError(t, a.Save("tuesday", index.Document, "Tuesday\n\nRecurring paragraph.\n\n", nil))
+	assert.Equal(t, "Monday\n\nRecurring paragraph.\n\n", projectContent(t, a, "monday"))
+	// 2 manifests, 3 distinct paragraphs
+	assert.Equal(t, 5, count(t, storeA))
+
+	// Layers stored as blobs need a blob store
+	noBlobs, err := Open(filepath.Join(tmpDir, "a"), "c")
+	require.NoError(t, err)
+	bucket, err := noBlobs.Bucket("monday")
+	require.NoError(t, err)
+	_, err = bucket.Project()
+	assert.ErrorIs(t, err, ErrNoBlobStore)
+
+	// Patches carry the blocks of their layers
+	patch := &bytes.Buffer{}
+	_, err = a.ExportPatch(patch, Cursor{}, WithSigningKey(key))
+	require.NoError(t, err)
+	b, _ := openWithBlobs(t, filepath.Join(tmpDir, "b"), "b")
+	_, err = b.ImportPatch(bytes.NewReader(patch.Bytes()), WithTrustedDevice("a", key.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+	assert.Equal(t, "Tuesday\n\nRecurring paragraph.\n\n", projectContent(t, b, "tuesday"))
+
+	car := &bytes.Buffer{}
+	require.NoError(t, a.ExportCAR(car))
+	storeC, err := blob.NewFSStore(filepath.Join(tmpDir, "c"))
+	require.NoError(t, err)
+	roots, err := blob.ReadCAR(car, storeC)
+	require.NoError(t, err)
+	require.Len(t, roots, 2)
+	for _, root := range roots {
+		_, err = blob.GetContent(storeC, root)
+		assert.NoError(t, err)
+	}
+}
+
+func TestDB_BlobStoreOps(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_BlobStoreOps")
+	defer os.RemoveAll(tmpDir)
+
+	a, store := openWithBlobs(t, tmpDir, "a")
+	require.NoError(t, a.Save("monday", index.Document, "Monday\n\nRecurring paragraph.\n\n", nil))
+	require.NoError(t, a.Save("2025-11-24", index.Journal, "Monday\n\nRecurring paragraph.\n\n", nil))
+	require.NoError(t, a.Save("2025-11-24", index.Journal, "Monday\n\nRecurring paragraph.\n\nLater.\n\n", nil))
+	assert.Equal(t, "Monday\n\nRecurring paragraph.\n\nLater.\n\n", projectContent(t, a, "2025-11-24"))
+	// The texts of the first operations are the paragraphs of the document
+	assert.Equal(t, 5, count(t, store))
+
+	bucket, err := a.Bucket("2025-11-24")
+	require.NoError(t, err)
+	ops, err := bucket.EditOps("Monday\n\nRecurring paragraph.\n\nLater.\n\nAgain.\n\n")
+	require.NoError(t, err)
+	layer := model.NewOpsLayer(ops, model.NewMetadata(3, time.Now(), nil))
+	payload, err := encodeLayer(layer, store)
+	require.NoError(t, err)
+	assert.NotContains(t, string(payload), "Again.")
+	decoded, err := decodeLayer(payload, store)
+	require.NoError(t, err)
+	assert.Equal(t, layer.Ops(), decoded.Ops())
+}
+
+func TestDB_CompactBlocks(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_CompactBlocks")
+	defer os.RemoveAll(tmpDir)
+
+	a, store := openWithBlobs(t, tmpDir, "a")
+	require.NoError(t, a.Save("foo", index.Document, "Kept paragraph.\n\nOld paragraph.\n\n", nil))
+	require.NoError(t, a.Save("foo", index.Document, "Kept paragraph.\n\nNew paragraph.\n\n", nil))
+	require.Equal(t, 5, count(t, store))
+
+	// Unreferenced blocks are kept during the retention window
+	stats, err := a.Compact()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Blocks)
+
+	time.Sleep(5 * time.Millisecond)
+	stats, err = a.Compact(WithRetention(0))
+	require.NoError(t, err)
+	// The first manifest and the old paragraph
+	assert.Equal(t, CompactStats{Layers: 1, Files: 1, Blocks: 2}, stats)
+	assert.Equal(t, 3, count(t, store))
+	assert.Equal(t, "Kept paragraph.\n\nNew paragraph.\n\n", projectContent(t, a, "foo"))
+}
+
+func TestDB_BlobStoreSnapshot(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_BlobStoreSnapshot")
+	defer os.RemoveAll(tmpDir)
+
+	a, store := openWithBlobs(t, tmpDir, "a")
+	require.NoError(t, a.Save("2025-11-24", index.Journal, "Monday\n\nFirst paragraph.\n\n", nil))
+	require.NoError(t, a.Save("2025-11-24", index.Journal, "Monday\n\nFirst paragraph.\n\nSecond.\n\n", nil))
+	require.NoError(t, a.Squash("2025-11-24"))
+	assert.Equal(t, "Monday\n\nFirst paragraph.\n\nSecond.\n\n", projectContent(t, a, "2025-11-24"))
+
+	bucket, err := a.Bucket("2025-11-24")
+	require.NoError(t, err)
+	runs, err := bucket.Snapshot()
+	require.NoError(t, err)
+	layer := model.NewSnapshotLayer("Monday\n\nFirst paragraph.\n\nSecond.\n\n", runs, bucket.Frontier(), model.NewMetadata(4, time.Now(), nil))
+	n := count(t, store)
+	payload, err := encodeLayer(layer, store)
+	require.NoError(t, err)
+	// The texts of the runs are the snapshot content, stored once
+	assert.NotContains(t, string(payload), "Second.")
+	assert.Equal(t, n, count(t, store))
+	decoded, err := decodeLayer(payload, store)
+	require.NoError(t, err)
+	assert.Equal(t, runs, decoded.Runs())
+	assert.Equal(t, layer.Content(), decoded.Content())
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Buckets written by this db are tracked, so what is derived from them is computed again only for
+// the buckets which changed: the uids of the live buckets, and what callers cache by revision.
+// Imports, refreshes and compactions may change any bucket.
+
+// Revision of a bucket in an open db. A bucket did not change while its revision is the same.
+type Revision struct {
+	epoch, count int
+}
+
+type changes struct {
+	sync.Mutex
+	// Incremented when any bucket may have changed.
+	epoch  int
+	counts map[string]int
+	// Whether each bucket holds layers and is not deleted, nil until loaded. Stale buckets are
+	// checked again.
+	live  map[string]bool
+	stale map[string]bool
+}
+
+func newChanges() *changes {
+	return &changes{counts: map[string]int{}, stale: map[string]bool{}}
+}
+
+func (c *changes) touch(uids ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, uid := range uids {
+		c.counts[uid]++
+		c.stale[uid] = true
+	}
+}
+
+func (c *changes) touchAll() {
+	c.Lock()
+	defer c.Unlock()
+	c.epoch++
+	c.counts = map[string]int{}
+	c.live = nil
+	c.stale = map[string]bool{}
+}
+
+// Revision of a bucket, to know whether it changed since a value derived from it was cached.
+func (d *DB) Revision(uid string) Revision {
+	d.changes.Lock()
+	defer d.changes.Unlock()
+	return Revision{epoch: d.changes.epoch, count: d.changes.counts[uid]}
+}
+
+// Whether a bucket holds layers and is not deleted.
+func (d *DB) isLive(uid string) (bool, error) {
+	b, err := d.Bucket(uid)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := b.Deleted()
+	if err != nil {
+		return false, err
+	}
+	return len(b.Layers()) > 0 && !deleted, nil
+}
+
+// Uids of the buckets holding content whose uid starts with a prefix, sorted. Deleted buckets
+// are left out.
+func (d *DB) Uids(prefix string) ([]string, error) {
+	c := d.changes
+	c.Lock()
+	defer c.Unlock()
+	if c.live == nil {
+		all, err := d.bucketUids()
+		if err != nil {
+			return nil, err
+		}
+		c.live = make(map[string]bool, len(all))
+		for _, uid := range all {
+			c.stale[uid] = true
+		}
+	}
+	for uid := range c.stale {
+		live, err := d.isLive(uid)
+		if err != nil {
+			return nil, err
+		}
+		c.live[uid] = live
+		delete(c.stale, uid)
+	}
+	var uids []string
+	for uid, live := range c.live {
+		if live && strings.HasPrefix(uid, prefix) {
+			uids = append(uids, uid)
+		}
+	}
+	slices.Sort(uids)
+	return uids, nil
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/utilz/errorz"
+)
+
+// A compaction drops the layers no projection reads anymore: ancestors of squashed layers,
+// superseded layers and deleted buckets, and the superseded label and topic words. Only this
+// device files are rewritten, into a new rotation of its idx files and layer data file, so
+// other devices keep appending to their own files meanwhile. Layers saved during the retention
+// window are kept as history. The blocks of the blob store left unreferenced by the removed
+// data files are then removed.
+
+const defaultRetention = 30 * 24 * time.Hour
+
+type compactOptions struct {
+	retention time.Duration
+}
+
+type CompactOption func(*compactOptions)
+
+// Keep layers saved during the retention window before now. Default is 30 days.
+func WithRetention(retention time.Duration) CompactOption {
+	return func(o *compactOptions) {
+		o.retention = retention
+	}
+}
+
+type CompactStats struct {
+	Layers   int
+	Buckets  int
+	Labels   int
+	Mentions int
+	Files    int
+	Blocks   int
+}
+
+func (s CompactStats) String() string {
+	return fmt.Sprintf("dropped %d layers, %d buckets, %d labels and %d mentions, removed %d data files and %d blocks", s.Layers, s.Buckets, s.Labels, s.Mentions, s.Files, s.Blocks)
+}
+
+// Rewrite this device files without the obsolete layers and buckets, and remove the files
+// superseded by a newer rotation of any device.
+func (d *DB) Compact(opts ...CompactOption) (CompactStats, error) {
+	o := compactOptions{retention: defaultRetention}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	before := time.Now().Add(-o.retention)
+
+	// Obsolete layers are found before locking the db, layers saved meanwhile are kept.
+	uids, err := d.bucketUids()
+	if err != nil {
+		return CompactStats{}, err
+	}
+	obsolete := map[hlc.Timestamp]bool{}
+	deleted := map[string]bool{}
+	for _, uid := range uids {
+		b, err := d.Bucket(uid)
+		if err != nil {
+			return CompactStats{}, err
+		}
+		refs, err := b.Obsolete(before)
+		if err != nil {
+			return CompactStats{}, err
+		}
+		for _, ref := range refs {
+			if ref.Clock().Device == d.device {
+				obsolete[ref.Clock()] = true
+			}
+		}
+		isDeleted, err := b.Deleted()
+		if err != nil {
+			return CompactStats{}, err
+		}
+		if isDeleted && b.Layers()[len(b.Layers())-1].Clock().Time().Before(before) {
+			deleted[uid] = true
+		}
+	}
+	rotations := d.layerIdx.Rotations()
+
+	defer d.changes.touchAll()
+	d.lock()
+	defer d.unlock()
+	stats := CompactStats{}
+	stats.Buckets, err = d.bucketIdx.Compact(func(uid string, s model.State) bool {
+		return !deleted[uid]
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.Labels, err = d.labelIdx.Compact()
+	if err != nil {
+		return stats, err
+	}
+	stats.Mentions, err = d.topicIdx.Compact()
+	if err != nil {
+		return stats, err
+	}
+	if len(obsolete) > 0 {
+		stats.Layers, err = d.compactLayers(obsolete, rotations[d.device])
+		if err != nil {
+			return stats, err
+		}
+		if stats.Layers > 0 {
+			rotations[d.device]++
+		}
+	}
+	stats.Files, err = d.removeSupersededData(rotations)
+	if err != nil || d.blobs == nil {
+		return stats, err
+	}
+	stats.Blocks, err = d.removeUnreferencedBlocks(before)
+	return stats, err
+}
+
+// Uids of the buckets of all devices.
+func (d *DB) bucketUids() ([]string, error) {
+	p, errChan := d.bucketIdx.PaginateAll(model.TopToBottom, 100)
+	seen := map[string]bool{}
+	var uids []string
+	for err, page := range p.All() {
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range page.Entries() {
+			if !seen[entry.Key()] {
+				seen[entry.Key()] = true
+				uids = append(uids, entry.Key())
+			}
+		}
+	}
+	return uids, errorz.ConsumedAggregated(errChan).Return()
+}
+
+// Copy the kept layers data into the next data rotation, then rotate the layer idx file on it.
+// A crash before the idx rotation leaves an unreferenced data file, overwritten by the next
+// compaction. Caller must hold the db lock.
+func (d *DB) compactLayers(obsolete map[hlc.Timestamp]bool, rotation int) (int, error) {
+	path := filepath.Join(d.rootPath, layerDataFilename(d.device, rotation+1))
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	data, err := openLayerData(path, true)
+	if err != nil {
+		return 0, err
+	}
+	// Data files are read through their own handle: the db lock holds the current one lock.
+	olds := map[string]*layerData{}
+	dropped, err := d.layerIdx.Compact(func(uidHash []byte, ref *model.LayerRef) (*model.LayerRef, bool, error) {
+		if obsolete[ref.Clock()] {
+			return nil, false, nil
+		}
+		old, ok := olds[ref.BlocsFilepath()]
+		if !ok {
+			old, err = openLayerData(filepath.Join(d.rootPath, ref.BlocsFilepath()), false)
+			if err != nil {
+				return nil, false, err
+			}
+			olds[ref.BlocsFilepath()] = old
+		}
+		payload, err := old.read(ref.BlocId())
+		if err != nil {
+			return nil, false, err
+		}
+		blocId := data.count()
+		err = data.write(data.record(blocId, payload))
+		if err != nil {
+			return nil, false, err
+		}
+		return model.NewClockedLayerRef(data.name(), blocId, ref.State(), ref.Clock()), true, nil
+	}, func() error {
+		// The new data file must survive a crash before the idx rotation referencing it.
+		err := data.sync()
+		if err != nil {
+			return err
+		}
+		return storage.SyncDir(d.rootPath)
+	})
+	if err != nil || dropped == 0 {
+		// The idx file was not rotated: the new data file is not referenced.
+		removeErr := os.Remove(path)
+		if os.IsNotExist(removeErr) {
+			removeErr = nil
+		}
+		return 0, errors.Join(err, removeErr)
+	}
+	// The db lock is released through the new data file.
+	data.Mutex = d.data.Mutex
+	d.data = data
+	return dropped, nil
+}
+
+// Remove the layer data files of all devices superseded by the rotation of their layer idx
+// file. Return the count of removed files. Caller must hold the db lock.
+func (d *DB) removeSupersededData(rotations map[string]int) (int, error) {
+	entries, err := os.ReadDir(d.rootPath)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		m := layerDataFilenameRegexp.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		rotation, _ := strconv.Atoi(m[2])
+		if latest, ok := rotations[m[1]]; !ok || rotation >= latest {
+			continue
+		}
+		err = os.Remove(filepath.Join(d.rootPath, entry.Name()))
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Compact(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Compact")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	for _, content := range []string{"foo v1", "foo v2", "foo v3"} {
+		require.NoError(t, a.Save("foo", index.Document, content, nil))
+	}
+	for _, content := range []string{"hello", "hello world", "hello big world"} {
+		require.NoError(t, a.Save("bar", index.Journal, content, nil))
+	}
+	require.NoError(t, a.Squash("bar"))
+	require.NoError(t, a.Save("bar", index.Journal, "hello big wide world", nil))
+	require.NoError(t, a.Save("baz", index.Document, "baz", nil))
+	require.NoError(t, a.Delete("baz"))
+	bucket, err := a.Bucket("baz")
+	require.NoError(t, err)
+	_, err = bucket.Project()
+	assert.ErrorIs(t, err, model.ErrDeletedBucket)
+
+	// Layers are kept during the retention window
+	stats, err := a.Compact()
+	require.NoError(t, err)
+	assert.Equal(t, CompactStats{}, stats)
+
+	time.Sleep(5 * time.Millisecond)
+	stats, err = a.Compact(WithRetention(0))
+	require.NoError(t, err)
+	// foo v1, foo v2, the 3 bar layers squashed and the deleted baz layer
+	assert.Equal(t, CompactStats{Layers: 6, Buckets: 1, Files: 1}, stats)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "layer-a-001.idx"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "data-a-001.dat"))
+	assert.FileExists(t, filepath.Join(tmpDir, "layer-a-002.idx"))
+	assert.FileExists(t, filepath.Join(tmpDir, "data-a-002.dat"))
+	assert.FileExists(t, filepath.Join(tmpDir, "bucket-a-002.idx"))
+
+	check := func(d *DB) {
+		assert.Equal(t, "foo v3", projectContent(t, d, "foo"))
+		assert.Equal(t, "hello big wide world", projectContent(t, d, "bar"))
+		count, err := d.layerIdx.Count()
+		require.NoError(t, err)
+		// Layer seqs stay contiguous in the new rotation
+		assert.Equal(t, 4, count)
+		count, err = d.bucketIdx.Count()
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+	}
+	check(a)
+	require.NoError(t, a.Save("bar", index.Journal, "hello big wide world!", nil))
+	assert.Equal(t, "hello big wide world!", projectContent(t, a, "bar"))
+
+	require.NoError(t, a.Close())
+	a, err = Open(tmpDir, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "hello big wide world!", projectContent(t, a, "bar"))
+	require.NoError(t, a.Save("foo", index.Document, "foo v4", nil))
+	assert.Equal(t, "foo v4", projectContent(t, a, "foo"))
+
+	stats, err = a.Compact(WithRetention(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, CompactStats{}, stats)
+}
+
+func TestDB_CompactWhileOtherDevicesAppend(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_CompactWhileOtherDevicesAppend")
+	defer os.RemoveAll(tmpDir)
+	key, err := LoadSigningKey(filepath.Join(tmpDir, "keys", "a.key"))
+	require.NoError(t, err)
+
+	a, err := Open(filepath.Join(tmpDir, "db"), "a")
+	require.NoError(t, err)
+	b, err := Open(filepath.Join(tmpDir, "db"), "b")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Journal, "hello", nil))
+	_, err = b.Refresh()
+	require.NoError(t, err)
+	require.NoError(t, b.Save("foo", index.Journal, "hello from b", nil))
+
+	// A patch exported before the compaction
+	c, err := Open(filepath.Join(tmpDir, "c"), "c")
+	require.NoError(t, err)
+	patch := &bytes.Buffer{}
+	_, err = a.ExportPatch(patch, Cursor{}, WithSigningKey(key))
+	require.NoError(t, err)
+	_, err = c.ImportPatch(patch, WithTrustedDevice("a", key.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+
+	_, err = a.Refresh()
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Journal, "hello from b and a", nil))
+	require.NoError(t, a.Squash("foo"))
+	time.Sleep(5 * time.Millisecond)
+	stats, err := a.Compact(WithRetention(0))
+	require.NoError(t, err)
+	// Layers of b are not dropped by a
+	assert.Equal(t, 2, stats.Layers)
+
+	// b keeps appending to its own files
+	require.NoError(t, b.Save("bar", index.Document, "bar", nil))
+	_, err = b.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, "hello from b and a", projectContent(t, b, "foo"))
+	require.NoError(t, b.Save("foo", index.Journal, "hello from b and a again", nil))
+	_, err = a.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, "hello from b and a again", projectContent(t, a, "foo"))
+	assert.Equal(t, "bar", projectContent(t, a, "bar"))
+
+	// A patch of the new rotation supersedes the imported one
+	patch.Reset()
+	_, err = a.ExportPatch(patch, Cursor{}, WithSigningKey(key))
+	require.NoError(t, err)
+	_, err = c.ImportPatch(patch, WithTrustedDevice("a", key.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+	assert.Equal(t, "hello from b and a", projectContent(t, c, "foo"))
+	count, err := c.layerIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	stats, err = c.Compact()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Files)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "c", "data-a-001.dat"))
+}
@@ -1,39 +1,602 @@
 package db
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/blob"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/crdt"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/merge"
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
 	"github.com/mxbossard/utilz/errorz"
 )
 
+var (
+	ErrUnmerged  = errors.New("bucket has divergent heads to merge")
+	ErrBadDevice = errors.New("not a valid device name")
+)
+
+const (
+	defaultCacheBudget = 4 << 20
+	layerKeySize       = 16
+	secretSize         = 32
+)
+
+// Query buckets holding all the labels. A query without labels matches no bucket.
 type Query struct {
+	Labels model.Labels
+}
+
+type options struct {
+	syncPolicy  wal.SyncPolicy
+	cacheBudget int
+	blobs       blob.BlobStore
+	idxBackend  storage.Backend
+	now         func() time.Time
+	secret      []byte
+}
+
+type Option func(*options)
+
+// Choose when write-ahead logs are synced to disk. Default is wal.SyncAlways.
+func WithSyncPolicy(policy wal.SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
+
+// Memory budget in bytes of the bloc cache shared by the indexes.
+func WithCacheBudget(budget int) Option {
+	return func(o *options) {
+		o.cacheBudget = budget
+	}
+}
+
+// Store layer contents, the texts inserted by journal operations and the texts of snapshot runs as
+// content-addressed chunks, so identical paragraphs are stored once.
+// Layers saved with a blob store can only be read with a blob store holding their chunks.
+func WithBlobStore(s blob.BlobStore) Option {
+	return func(o *options) {
+		o.blobs = s
+	}
+}
+
+// Keep the idx files in a storage backend instead of the db directory.
+func WithIndexBackend(b storage.Backend) Option {
+	return func(o *options) {
+		o.idxBackend = b
+	}
+}
+
+// Wall clock timestamping the layers. Default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// Secret keying the hashes of labels in the label index, shared by all devices of the db. Without
+// secret, low entropy label values can be guessed from their hash.
+func WithSecret(secret []byte) Option {
+	return func(o *options) {
+		o.secret = secret
+	}
+}
+
+// Load the secret of a db, generating it if the file does not exist.
+// The file must be copied to the other devices of the db.
+func LoadSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err == nil {
+		if len(secret) != secretSize {
+			return nil, fmt.Errorf("bad secret file: %s", path)
+		}
+		return secret, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	secret = make([]byte, secretSize)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return secret, os.WriteFile(path, secret, 0600)
 }
 
 type DB struct {
 	rootPath string
+	device   string
 
 	bucketIdx *index.BucketIndex
 	layerIdx  *index.LayerIndex
+	labelIdx  *index.LabelIndex
+	topicIdx  *index.TopicIndex
+	text      *index.TextIndex
+	data      *layerData
+	wal       *wal.Log
+	clock     *hlc.Clock
+	blobs     blob.BlobStore
+	secret    []byte
+	changes   *changes
+
+	// Written idx and data files are synced before the wal is checkpointed, unless SyncNever.
+	syncPolicy wal.SyncPolicy
+}
+
+// Device names are part of the db file names, they must not reach outside the db directory.
+func checkDevice(device string) error {
+	if device == "" || device == "." || strings.Contains(device, "..") || strings.ContainsAny(device, `/\`) || filepath.Base(device) != device {
+		return fmt.Errorf("%w: %q", ErrBadDevice, device)
+	}
+	return nil
+}
+
+func Open(rootPath, device string, opts ...Option) (*DB, error) {
+	o := options{cacheBudget: defaultCacheBudget, now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	err := checkDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(rootPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	c := index.NewBlocCache(o.cacheBudget)
+	idxOpts := []index.Option{index.WithBlocCache(c), index.WithSyncPolicy(o.syncPolicy)}
+	if o.idxBackend != nil {
+		idxOpts = append(idxOpts, index.WithBackend(o.idxBackend))
+	}
+
+	bucketIdx, err := index.NewBucketIndex(rootPath, device, idxOpts...)
+	if err != nil {
+		return nil, err
+	}
+	layerIdx, err := index.NewLayerIndex(rootPath, device, idxOpts...)
+	if err != nil {
+		return nil, err
+	}
+	labelIdx, err := index.NewLabelIndex(rootPath, device, idxOpts...)
+	if err != nil {
+		return nil, err
+	}
+	topicIdx, err := index.NewTopicIndex(rootPath, device, idxOpts...)
+	if err != nil {
+		return nil, err
+	}
+	// Layer data rotate with the layer idx file referencing it.
+	data, err := openLayerData(filepath.Join(rootPath, layerDataFilename(device, layerIdx.Rotations()[device])), true)
+	if err != nil {
+		return nil, err
+	}
+	text, err := index.OpenTextIndex(rootPath, device, idxOpts...)
+	if err != nil {
+		return nil, err
+	}
+	l, err := wal.Open(filepath.Join(rootPath, fmt.Sprintf("db-%s.wal", device)), o.syncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{
+		rootPath:   rootPath,
+		device:     device,
+		bucketIdx:  bucketIdx,
+		layerIdx:   layerIdx,
+		labelIdx:   labelIdx,
+		topicIdx:   topicIdx,
+		text:       text,
+		data:       data,
+		wal:        l,
+		clock:      hlc.NewClockWithTime(device, o.now),
+		blobs:      o.blobs,
+		secret:     o.secret,
+		changes:    newChanges(),
+		syncPolicy: o.syncPolicy,
+	}
+	// Never timestamp a layer before already written layers.
+	d.clock.Update(layerIdx.MaxClock())
+	err = d.recover()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Complete transactions interrupted by a crash.
+func (d *DB) recover() error {
+	d.lock()
+	defer d.unlock()
+	return d.writePending()
+}
+
+// Write the transactions logged in the wal, interrupted by a crash or a failed write, then
+// checkpoint it. Writes are idempotent: records already written are skipped.
+// Caller must hold the db lock.
+func (d *DB) writePending() error {
+	for _, records := range d.wal.Pending() {
+		err := d.write(records)
+		if err != nil {
+			return err
+		}
+	}
+	return d.wal.Checkpoint()
+}
+
+func (d *DB) lock() {
+	d.bucketIdx.Lock()
+	d.layerIdx.Lock()
+	d.labelIdx.Lock()
+	d.topicIdx.Lock()
+	d.data.Lock()
+}
+
+func (d *DB) unlock() {
+	d.data.Unlock()
+	d.topicIdx.Unlock()
+	d.labelIdx.Unlock()
+	d.layerIdx.Unlock()
+	d.bucketIdx.Unlock()
+}
+
+// Write records of a transaction. Buckets are written before the layers referencing them,
+// labels and topics last. Caller must hold the db lock.
+func (d *DB) write(records []wal.Record) error {
+	err := d.bucketIdx.WriteRecords(records)
+	if err != nil {
+		return err
+	}
+	wrote := false
+	for _, r := range records {
+		if r.Target == d.data.name() {
+			err = d.data.write(r)
+			if err != nil {
+				return err
+			}
+			wrote = true
+		}
+	}
+	if wrote && d.syncPolicy != wal.SyncNever {
+		err = d.data.sync()
+		if err != nil {
+			return err
+		}
+	}
+	err = d.layerIdx.WriteRecords(records)
+	if err != nil {
+		return err
+	}
+	err = d.labelIdx.WriteRecords(records)
+	if err != nil {
+		return err
+	}
+	return d.topicIdx.WriteRecords(records)
+}
+
+func (d *DB) Close() error {
+	return errorz.NewAggregated(d.text.Save(), d.wal.Close(), d.bucketIdx.Close(), d.layerIdx.Close(), d.labelIdx.Close(), d.topicIdx.Close()).Return()
+}
+
+// Layer index keys are hashed bucket uids.
+func layerKey(uid string) []byte {
+	h := sha256.Sum256([]byte(uid))
+	return h[:layerKeySize]
+}
+
+// Label index keys are labels hashed with the db secret, so label values do not leak next to
+// encrypted data. Fields are length prefixed: a "=" in a key or a value cannot shift them.
+func (d *DB) labelKey(key, value string) []byte {
+	mac := hmac.New(sha256.New, d.secret)
+	for _, field := range []string{key, value} {
+		mac.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field))))
+		mac.Write([]byte(field))
+	}
+	return mac.Sum(nil)[:layerKeySize]
+}
+
+// Save content as a new layer of a bucket, creating the bucket if needed.
+func (d *DB) Save(uid string, s model.State, content string, labels model.Labels) error {
+	b, err := d.Bucket(uid)
+	if err != nil {
+		return err
+	}
+	return d.save(b, s, content, labels)
 }
 
+// Save content as a new layer on top of the base bucket layers.
+func (d *DB) SaveLayer(base *model.Bucket, content string, labels model.Labels) error {
+	return d.save(base, base.State(), content, labels)
+}
+
+// Journal buckets layers are saved as CRDT operations on the base projected document, so they
+// merge with layers concurrently saved by other devices. Other layers record the base heads as
+// their parents. Saving a conflicted bucket without conflict markers resolve the conflict.
+func (d *DB) save(base *model.Bucket, s model.State, content string, labels model.Labels) error {
+	metadata := model.NewMetadata(len(base.Layers())+1, time.Now(), labels)
+	layer := model.NewLayer(content, metadata)
+	if bytes.Equal(s, index.Journal) {
+		ops, err := base.EditOps(content)
+		if err != nil {
+			return err
+		}
+		layer = model.NewOpsLayer(ops, metadata)
+	}
+	if bytes.Equal(s, index.Conflict) && len(merge.Conflicts(content)) == 0 {
+		s = index.Topic
+	}
+	// The bucket word of a deleted bucket may have been compacted.
+	deleted, err := base.Deleted()
+	if err != nil {
+		return err
+	}
+	return d.saveLayer(base, s, layer, content, deleted)
+}
+
+// Save a layer of content on top of the base heads, adding the bucket if it is new or deleted,
+// its bucket word may have been compacted. Whether the bucket is new is decided on commit. Labels
+// changed since the base last layer are labeled or unlabeled, changed topics mentions are
+// recorded and the bucket text is indexed again.
+func (d *DB) saveLayer(base *model.Bucket, s model.State, layer *model.Layer, content string, deleted bool) error {
+	heads, err := base.Heads()
+	if err != nil {
+		return err
+	}
+	layer.SetParents(layerClocks(heads)...)
+	tx := d.Begin()
+	if deleted {
+		tx.AddBucket(base.Uid(), s)
+	} else {
+		tx.AddBucketIfNew(base.Uid(), s)
+	}
+	tx.AddLayer(base.Uid(), s, layer)
+	err = d.stageLabels(tx, base, layer.Metadata().Labels())
+	if err != nil {
+		return err
+	}
+	err = d.stageMentions(tx, base, content)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return d.indexText(base.Uid())
+}
+
+// Stage the topics whose mentions changed since the base projected document.
+func (d *DB) stageMentions(tx *Tx, base *model.Bucket, content string) error {
+	var previous map[string][]int
+	doc, err := base.Project()
+	if err == nil {
+		previous = index.ParseMentions(doc.Content())
+	} else if !errors.Is(err, model.ErrEmptyBucket) && !errors.Is(err, model.ErrDeletedBucket) {
+		return err
+	}
+	mentions := index.ParseMentions(content)
+	for _, topic := range slices.Sorted(maps.Keys(previous)) {
+		if _, ok := mentions[topic]; !ok {
+			tx.Mention(base.Uid(), topic, nil)
+		}
+	}
+	for _, topic := range slices.Sorted(maps.Keys(mentions)) {
+		if !slices.Equal(previous[topic], mentions[topic]) {
+			tx.Mention(base.Uid(), topic, mentions[topic])
+		}
+	}
+	return nil
+}
+
+// Stage the labels changes of a bucket. Projected documents hold the labels of their last layer.
+func (d *DB) stageLabels(tx *Tx, base *model.Bucket, labels model.Labels) error {
+	var previous model.Labels
+	if layers := base.Layers(); len(layers) > 0 {
+		l, err := d.Layer(layers[len(layers)-1])
+		if err != nil {
+			return err
+		}
+		previous = l.Metadata().Labels()
+	}
+	for _, key := range slices.Sorted(maps.Keys(previous)) {
+		if value, ok := labels[key]; !ok || value != previous[key] {
+			tx.Unlabel(base.Uid(), key, previous[key])
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		if value, ok := previous[key]; !ok || value != labels[key] {
+			tx.Label(base.Uid(), key, labels[key])
+		}
+	}
+	return nil
+}
+
+// Save the projected document of a bucket as a snapshot layer, so its history can be compacted.
+func (d *DB) Squash(uid string) error {
+	b, err := d.Bucket(uid)
+	if err != nil {
+		return err
+	}
+	return d.SaveSnapshot(b)
+}
+
+// Save the projected document as a snapshot layer on top of the base bucket layers.
+// Journal snapshots keep the CRDT runes of the document, so concurrent operations still apply.
+// Other buckets must be merged first.
+func (d *DB) SaveSnapshot(base *model.Bucket) error {
+	doc, err := base.Project()
+	if err != nil {
+		return err
+	}
+	heads, err := base.Heads()
+	if err != nil {
+		return err
+	}
+	var runs []crdt.Run
+	if bytes.Equal(base.State(), index.Journal) {
+		runs, err = base.Snapshot()
+		if err != nil {
+			return err
+		}
+	} else if len(heads) > 1 {
+		return fmt.Errorf("%w: %s", ErrUnmerged, base.Uid())
+	}
+	metadata := model.NewMetadata(len(base.Layers())+1, time.Now(), doc.Metadata().Labels())
+	return d.saveLayer(base, base.State(), model.NewSnapshotLayer(doc.Content(), runs, base.Frontier(), metadata), doc.Content(), false)
+}
+
+// Delete a bucket with a tombstone layer. Its layers are dropped by a compaction once the
+// tombstone is older than the retention.
+func (d *DB) Delete(uid string) error {
+	b, err := d.Bucket(uid)
+	if err != nil {
+		return err
+	}
+	if len(b.Layers()) == 0 {
+		return fmt.Errorf("%w: %s", model.ErrEmptyBucket, uid)
+	}
+	metadata := model.NewMetadata(len(b.Layers())+1, time.Now(), nil)
+	return d.saveLayer(b, b.State(), model.NewTombstoneLayer(metadata), "", false)
+}
+
+// Merge the divergent heads of a topic bucket into a new layer.
+// A conflicting merge is saved in Conflict state, its conflict markers waiting for a resolution.
+func (d *DB) Merge(uid string) (conflicted bool, err error) {
+	b, err := d.Bucket(uid)
+	if err != nil {
+		return false, err
+	}
+	merged, conflicted, heads, err := b.Merge()
+	if err != nil {
+		return false, err
+	}
+	if len(heads) < 2 {
+		return false, nil
+	}
+	s := index.Topic
+	if conflicted {
+		s = index.Conflict
+	}
+	layer := model.NewLayer(merged, model.NewMetadata(len(b.Layers())+1, time.Now(), nil))
+	return conflicted, d.saveLayer(b, s, layer, merged, false)
+}
+
+func layerClocks(refs []*model.LayerRef) []hlc.Timestamp {
+	clocks := make([]hlc.Timestamp, 0, len(refs))
+	for _, ref := range refs {
+		clocks = append(clocks, ref.Clock())
+	}
+	return clocks
+}
+
+// Read the layer content referenced by a layer index entry.
+func (d *DB) Layer(ref *model.LayerRef) (*model.Layer, error) {
+	data := d.data
+	if ref.BlocsFilepath() != d.data.name() {
+		var err error
+		data, err = openLayerData(filepath.Join(d.rootPath, ref.BlocsFilepath()), false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	payload, err := data.read(ref.BlocId())
+	if err != nil {
+		return nil, err
+	}
+	return decodeLayer(payload, d.blobs)
+}
+
+// Load a bucket with the layers of all devices.
 func (d *DB) Bucket(uid string) (*model.Bucket, error) {
-	p, errChan := d.layerIdx.Paginate(uid, model.BottomToTop, 100)
+	p, errChan := d.layerIdx.Paginate(layerKey(uid), model.TopToBottom, 100)
 
 	var layers []*model.LayerRef
-	for page, ok, err := p.Next(); ok; {
+	for err, page := range p.All() {
 		if err != nil {
 			return nil, err
 		}
-		_ = page
 		for _, entry := range page.Entries() {
 			layers = append(layers, entry.Val())
+			// Next layers written on this device will follow observed layers.
+			d.clock.Update(entry.Val().Clock())
 		}
 	}
-	b := model.NewBucket(uid, layers)
+	var state model.State
+	if len(layers) > 0 {
+		state = layers[len(layers)-1].State()
+	}
+	b := model.NewBucket(d, uid, state, layers)
 
-	return b, errorz.ConsumedAggregated(errChan)
+	return b, errorz.ConsumedAggregated(errChan).Return()
 }
 
-func (d DB) Query(query Query) ([]model.Bucket, error) {
-	panic("not implemented yet")
+// Uids of the buckets holding a label, ordered by the clock they were labeled.
+func (d *DB) Labeled(key, value string) ([]string, error) {
+	p, errChan := d.labelIdx.Paginate(d.labelKey(key, value), model.TopToBottom, 100)
+	var uids []string
+	for err, page := range p.All() {
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range page.Entries() {
+			uids = append(uids, entry.Val().Uid)
+		}
+	}
+	return uids, errorz.ConsumedAggregated(errChan).Return()
+}
+
+// Uids of the buckets labeled with all labels, nil without labels.
+func (d *DB) labeledAll(labels model.Labels) (map[string]bool, error) {
+	var matching map[string]bool
+	for key, value := range labels {
+		uids, err := d.Labeled(key, value)
+		if err != nil {
+			return nil, err
+		}
+		labeled := make(map[string]bool, len(uids))
+		for _, uid := range uids {
+			if matching == nil || matching[uid] {
+				labeled[uid] = true
+			}
+		}
+		matching = labeled
+	}
+	return matching, nil
+}
+
+// Load the buckets matching a query through the label index, without projecting them.
+// Buckets are ordered by their uids.
+func (d *DB) Query(query Query) ([]model.Bucket, error) {
+	matching, err := d.labeledAll(query.Labels)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]model.Bucket, 0, len(matching))
+	for _, uid := range slices.Sorted(maps.Keys(matching)) {
+		b, err := d.Bucket(uid)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, *b)
+	}
+	return buckets, nil
 }
@@ -0,0 +1,236 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/merge"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_BucketAcrossDevices(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_BucketAcrossDevices")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo from a", nil))
+
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+	bucket, err := b.Bucket("foo")
+	require.NoError(t, err)
+	require.Len(t, bucket.Layers(), 1)
+	require.NoError(t, bucket.Save("foo from b", nil))
+
+	// Device b observed a layer: its layer is ordered after it
+	bucket, err = b.Bucket("foo")
+	require.NoError(t, err)
+	require.Len(t, bucket.Layers(), 2)
+	assert.Equal(t, "b", bucket.Layers()[1].Clock().Device)
+	doc, err := bucket.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "foo from b", doc.Content())
+	assert.Equal(t, 2, doc.Metadata().Version())
+
+	// Device a project the same document
+	a, err = Open(tmpDir, "a")
+	require.NoError(t, err)
+	bucket, err = a.Bucket("foo")
+	require.NoError(t, err)
+	doc, err = bucket.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "foo from b", doc.Content())
+
+	empty, err := a.Bucket("bar")
+	require.NoError(t, err)
+	_, err = empty.Project()
+	assert.Error(t, err)
+}
+
+func TestDB_MergeConcurrentJournalEdits(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_MergeConcurrentJournalEdits")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Journal, "hello world", nil))
+
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+	bucket, err := b.Bucket("foo")
+	require.NoError(t, err)
+	doc, err := bucket.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", doc.Content())
+
+	// Both devices edit the same version without seeing each other
+	require.NoError(t, a.Save("foo", index.Journal, "hello big world", nil))
+	require.NoError(t, bucket.Save("hello world!", nil))
+
+	a, err = Open(tmpDir, "a")
+	require.NoError(t, err)
+	b, err = Open(tmpDir, "b")
+	require.NoError(t, err)
+	for _, d := range []*DB{a, b} {
+		bucket, err := d.Bucket("foo")
+		require.NoError(t, err)
+		require.Len(t, bucket.Layers(), 3)
+		doc, err := bucket.Project()
+		require.NoError(t, err)
+		assert.Equal(t, "hello big world!", doc.Content())
+	}
+}
+
+func TestDB_SaveUnchangedJournal(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_SaveUnchangedJournal")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Journal, "hello world", nil))
+	// A layer without operation, only changing the labels
+	require.NoError(t, a.Save("foo", index.Journal, "hello world", model.Labels{"kind": "day"}))
+	assert.Equal(t, "hello world", projectContent(t, a, "foo"))
+
+	// The layer kind survives the layer encoding
+	a, err = Open(tmpDir, "a")
+	require.NoError(t, err)
+	bucket, err := a.Bucket("foo")
+	require.NoError(t, err)
+	require.Len(t, bucket.Layers(), 2)
+	l, err := a.Layer(bucket.Layers()[1])
+	require.NoError(t, err)
+	assert.True(t, l.IsOps())
+	assert.Empty(t, l.Ops())
+	assert.Equal(t, "hello world", projectContent(t, a, "foo"))
+	require.NoError(t, a.Save("foo", index.Journal, "hello world!", nil))
+	assert.Equal(t, "hello world!", projectContent(t, a, "foo"))
+}
+
+func TestDB_MergeDivergentTopic(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_MergeDivergentTopic")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Topic, "title\nfoo\nbar\nbaz\n", nil))
+
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+	base, err := b.Bucket("foo")
+	require.NoError(t, err)
+
+	// Both devices edit distinct lines of the same version
+	require.NoError(t, a.Save("foo", index.Topic, "title\nFOO\nbar\nbaz\n", nil))
+	require.NoError(t, base.Save("title\nfoo\nbar\nBAZ\n", nil))
+
+	b, err = Open(tmpDir, "b")
+	require.NoError(t, err)
+	bucket, err := b.Bucket("foo")
+	require.NoError(t, err)
+	heads, err := bucket.Heads()
+	require.NoError(t, err)
+	require.Len(t, heads, 2)
+	ancestor, err := bucket.MergeBase(heads...)
+	require.NoError(t, err)
+	assert.Equal(t, bucket.Layers()[0], ancestor)
+
+	conflicted, err := b.Merge("foo")
+	require.NoError(t, err)
+	assert.False(t, conflicted)
+	bucket, err = b.Bucket("foo")
+	require.NoError(t, err)
+	heads, err = bucket.Heads()
+	require.NoError(t, err)
+	assert.Len(t, heads, 1)
+	assert.Equal(t, index.Topic, bucket.State())
+	doc, err := bucket.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "title\nFOO\nbar\nBAZ\n", doc.Content())
+
+	// Nothing left to merge
+	conflicted, err = b.Merge("foo")
+	require.NoError(t, err)
+	assert.False(t, conflicted)
+	bucket, err = b.Bucket("foo")
+	require.NoError(t, err)
+	assert.Len(t, bucket.Layers(), 4)
+}
+
+func TestDB_MergeConflictingTopic(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_MergeConflictingTopic")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Topic, "title\nfoo\n", nil))
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+	base, err := b.Bucket("foo")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Topic, "title\nfoo from a\n", nil))
+	require.NoError(t, base.Save("title\nfoo from b\n", nil))
+
+	a, err = Open(tmpDir, "a")
+	require.NoError(t, err)
+	conflicted, err := a.Merge("foo")
+	require.NoError(t, err)
+	assert.True(t, conflicted)
+
+	bucket, err := a.Bucket("foo")
+	require.NoError(t, err)
+	assert.Equal(t, index.Conflict, bucket.State())
+	doc, err := bucket.Project()
+	require.NoError(t, err)
+	conflicts := merge.Conflicts(doc.Content())
+	require.Len(t, conflicts, 1)
+	assert.ElementsMatch(t, []string{"foo from a\n", "foo from b\n"}, []string{conflicts[0].Ours, conflicts[0].Theirs})
+
+	// Saving without markers resolve the conflict
+	require.NoError(t, bucket.Save("title\nfoo from a and b\n", nil))
+	bucket, err = a.Bucket("foo")
+	require.NoError(t, err)
+	assert.Equal(t, index.Topic, bucket.State())
+	heads, err := bucket.Heads()
+	require.NoError(t, err)
+	assert.Len(t, heads, 1)
+}
+
+func TestDB_Uids(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Uids")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("2024-01-02", index.Journal, "foo", nil))
+	require.NoError(t, a.Save("2024-01-01", index.Journal, "bar", nil))
+	uids, err := a.Uids("2024-")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2024-01-01", "2024-01-02"}, uids)
+
+	// Saves and deletions are seen once the uids are loaded
+	revision := a.Revision("2024-01-02")
+	require.NoError(t, a.Save("2024-01-03", index.Journal, "baz", nil))
+	require.NoError(t, a.Delete("2024-01-02"))
+	assert.NotEqual(t, revision, a.Revision("2024-01-02"))
+	uids, err = a.Uids("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2024-01-01", "2024-01-03"}, uids)
+
+	// Buckets saved by other devices are seen once refreshed
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+	require.NoError(t, b.Save("2024-01-04", index.Journal, "qux", nil))
+	revision = a.Revision("2024-01-01")
+	_, err = a.Refresh()
+	require.NoError(t, err)
+	assert.NotEqual(t, revision, a.Revision("2024-01-01"))
+	uids, err = a.Uids("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2024-01-01", "2024-01-03", "2024-01-04"}, uids)
+}
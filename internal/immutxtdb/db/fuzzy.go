@@ -0,0 +1,345 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/ref"
+	"github.com/mxbossard/utilz/errorz"
+)
+
+// Fuzzy search queries mix terms, quoted phrases and filters:
+//
+//	vojage "train de nuit" kind:trip date:2025-11-01..2025-11-30
+//
+// Terms match the entry text and the names of the mentioned topics and people within a few
+// edits, phrases must be found as is. A label:value filter keeps the buckets holding this label,
+// a date:FROM..TO filter keeps the buckets dated in this range of days, either bound may be
+// omitted. Journal buckets are dated by their uid, other buckets by the day of their last layer.
+
+const (
+	// Score of a bucket mentioning a topic or a person matching a query term.
+	mentionScore = 1.0
+	// Bytes of text kept in a snippet, and before its first highlight.
+	snippetSize     = 160
+	snippetContext  = 40
+	snippetEllipsis = "…"
+)
+
+var labelFilterRegexp = regexp.MustCompile(`^([\pL\pN_.-]+):(.+)$`)
+
+type SearchQuery struct {
+	Text   string
+	Labels model.Labels
+	// Days of the range, zero when the range is open.
+	From time.Time
+	To   time.Time
+}
+
+// Split a query in whitespace separated fields, quoted phrases are kept in one field.
+func queryFields(query string) []string {
+	var fields []string
+	quoted := false
+	field := strings.Builder{}
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			field.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteRune(r)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+func parseDay(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(time.DateOnly, value, time.Local)
+}
+
+// Parse a query of terms, quoted phrases, label:value and date:FROM..TO filters.
+func ParseSearchQuery(query string) (SearchQuery, error) {
+	q := SearchQuery{}
+	var text []string
+	for _, field := range queryFields(query) {
+		m := labelFilterRegexp.FindStringSubmatch(field)
+		switch {
+		case m == nil || strings.HasPrefix(field, `"`):
+			text = append(text, field)
+		case m[1] == "date":
+			from, to, found := strings.Cut(m[2], "..")
+			if !found {
+				to = from
+			}
+			var err error
+			q.From, err = parseDay(from)
+			if err != nil {
+				return SearchQuery{}, fmt.Errorf("bad date range %s: %w", m[2], err)
+			}
+			q.To, err = parseDay(to)
+			if err != nil {
+				return SearchQuery{}, fmt.Errorf("bad date range %s: %w", m[2], err)
+			}
+		default:
+			if q.Labels == nil {
+				q.Labels = model.Labels{}
+			}
+			q.Labels[m[1]] = m[2]
+		}
+	}
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+// Whether a day is in the query date range.
+func (q SearchQuery) inRange(day time.Time) bool {
+	return (q.From.IsZero() || !day.Before(q.From)) && (q.To.IsZero() || !day.After(q.To))
+}
+
+// Text of a bucket around its matches. Highlights are the byte ranges of the matches in the
+// snippet text.
+type Snippet struct {
+	Text       string
+	Highlights [][2]int
+}
+
+// Snippet text with its highlights enclosed in markers.
+func (s Snippet) Highlight(open, close string) string {
+	sb := strings.Builder{}
+	k := 0
+	for _, h := range s.Highlights {
+		sb.WriteString(s.Text[k:h[0]])
+		sb.WriteString(open + s.Text[h[0]:h[1]] + close)
+		k = h[1]
+	}
+	sb.WriteString(s.Text[k:])
+	return sb.String()
+}
+
+// A bucket matching a fuzzy search.
+type SearchHit struct {
+	Uid     string
+	Score   float64
+	Snippet Snippet
+}
+
+// What a bucket matched: indexed terms, and topics and people keys of the topic index.
+type searchMatch struct {
+	uid      string
+	score    float64
+	terms    []string
+	mentions []string
+}
+
+// Search the text of all buckets and the names of the topics and people they mention,
+// tolerating typos. Buckets are ranked by score, buckets matching only filters by uid.
+func (d *DB) FuzzySearch(query string) (model.Paginer[string, SearchHit], error) {
+	q, err := ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	err = d.syncTextIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := map[string]*searchMatch{}
+	if strings.TrimSpace(q.Text) == "" {
+		for _, uid := range d.text.Uids() {
+			matches[uid] = &searchMatch{uid: uid}
+		}
+	}
+	for _, hit := range d.text.FuzzySearch(q.Text) {
+		matches[hit.Uid] = &searchMatch{uid: hit.Uid, score: hit.Score, terms: hit.Terms}
+	}
+	err = d.matchMentions(q.Text, matches)
+	if err != nil {
+		return nil, err
+	}
+
+	labeled, err := d.labeledAll(q.Labels)
+	if err != nil {
+		return nil, err
+	}
+	var ranked []*searchMatch
+	for _, m := range matches {
+		if labeled != nil && !labeled[m.uid] {
+			continue
+		}
+		if !q.From.IsZero() || !q.To.IsZero() {
+			day, ok := d.bucketDay(m.uid)
+			if !ok || !q.inRange(day) {
+				continue
+			}
+		}
+		ranked = append(ranked, m)
+	}
+	slices.SortFunc(ranked, func(a, b *searchMatch) int {
+		if a.score != b.score {
+			if a.score > b.score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.uid, b.uid)
+	})
+
+	p := model.NewPaginer(100, 0, func(push func(k string, v SearchHit, err error) bool) {
+		for _, m := range ranked {
+			snippet, err := d.snippet(m)
+			if !push(m.uid, SearchHit{Uid: m.uid, Score: m.score, Snippet: snippet}, err) {
+				return
+			}
+		}
+	})
+	return p, nil
+}
+
+// Add the buckets mentioning the topics and people whose names match the query terms.
+func (d *DB) matchMentions(text string, matches map[string]*searchMatch) error {
+	var terms []string
+	for _, t := range index.Tokenize(text) {
+		terms = append(terms, t.Term)
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	topics, err := d.Topics()
+	if err != nil {
+		return err
+	}
+	people, err := d.People()
+	if err != nil {
+		return err
+	}
+	keys := map[string]int{}
+	for topic, edits := range index.FuzzyMatch(terms, topics) {
+		keys[topic] = edits
+	}
+	for name, edits := range index.FuzzyMatch(terms, people) {
+		keys[index.PersonKey(name)] = edits
+	}
+	for _, key := range slices.Sorted(maps.Keys(keys)) {
+		p, errChan := d.topicIdx.Paginate(key, model.TopToBottom, 100)
+		for err, page := range p.All() {
+			if err != nil {
+				return err
+			}
+			for _, entry := range page.Entries() {
+				uid := entry.Val().Uid
+				m, ok := matches[uid]
+				if !ok {
+					m = &searchMatch{uid: uid}
+					matches[uid] = m
+				}
+				m.score += mentionScore / float64(1+keys[key])
+				m.mentions = append(m.mentions, key)
+			}
+		}
+		err = errorz.ConsumedAggregated(errChan).Return()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Day of a bucket: the day of its uid for journal buckets, the day of its last layer otherwise.
+func (d *DB) bucketDay(uid string) (time.Time, bool) {
+	day, err := time.ParseInLocation(time.DateOnly, uid, time.Local)
+	if err == nil {
+		return day, true
+	}
+	clock, ok := d.text.Clock(uid)
+	if !ok {
+		return time.Time{}, false
+	}
+	t := clock.Time().Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local), true
+}
+
+// Snippet of the projected text of a matching bucket around its first match.
+func (d *DB) snippet(m *searchMatch) (Snippet, error) {
+	b, err := d.Bucket(m.uid)
+	if err != nil {
+		return Snippet{}, err
+	}
+	doc, err := b.Project()
+	if errors.Is(err, model.ErrDeletedBucket) || errors.Is(err, model.ErrEmptyBucket) {
+		return Snippet{}, nil
+	} else if err != nil {
+		return Snippet{}, err
+	}
+	content := doc.Content()
+
+	var highlights [][2]int
+	for _, t := range index.Tokenize(content) {
+		if slices.Contains(m.terms, t.Term) {
+			highlights = append(highlights, [2]int{t.Start, t.End})
+		}
+	}
+	for _, r := range ref.Parse(content) {
+		key := strings.ToLower(r.Name)
+		if r.Kind == ref.Person {
+			key = index.PersonKey(r.Name)
+		} else if r.Kind != ref.Topic {
+			continue
+		}
+		if slices.Contains(m.mentions, key) {
+			highlights = append(highlights, [2]int{r.Start, r.End})
+		}
+	}
+	slices.SortFunc(highlights, func(a, b [2]int) int { return a[0] - b[0] })
+
+	start := 0
+	if len(highlights) > 0 {
+		start = max(0, highlights[0][0]-snippetContext)
+	}
+	end := min(len(content), start+snippetSize)
+	// Cut on rune boundaries.
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end--
+	}
+	s := Snippet{Text: strings.ReplaceAll(content[start:end], "\n", " ")}
+	offset := 0
+	if start > 0 {
+		s.Text = snippetEllipsis + s.Text
+		offset = len(snippetEllipsis)
+	}
+	if end < len(content) {
+		s.Text += snippetEllipsis
+	}
+	lastEnd := start
+	for _, h := range highlights {
+		// Highlights out of the snippet or overlapping a previous one are dropped.
+		if h[0] < lastEnd || h[1] > end {
+			continue
+		}
+		s.Highlights = append(s.Highlights, [2]int{h[0] - start + offset, h[1] - start + offset})
+		lastEnd = h[1]
+	}
+	return s, nil
+}
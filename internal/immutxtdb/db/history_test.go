@@ -0,0 +1,109 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/diff"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket_History(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucket_History")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, d.Save("day", index.Journal, "# Day\n- foo\n", nil))
+	time.Sleep(5 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, d.Save("day", index.Journal, "# Day\n- foo\n- bar\n", nil))
+	require.NoError(t, d.Save("day", index.Journal, "# Day\n- bar\n- baz\n", nil))
+
+	bucket, err := d.Bucket("day")
+	require.NoError(t, err)
+	doc, err := bucket.ProjectAt(2)
+	require.NoError(t, err)
+	assert.Equal(t, "# Day\n- foo\n- bar\n", doc.Content())
+	assert.Equal(t, 2, doc.Metadata().Version())
+	_, err = bucket.ProjectAt(4)
+	assert.ErrorIs(t, err, model.ErrNoVersion)
+
+	assert.Equal(t, 1, bucket.VersionAt(between))
+	doc, err = bucket.ProjectAtTime(between)
+	require.NoError(t, err)
+	assert.Equal(t, "# Day\n- foo\n", doc.Content())
+	_, err = bucket.ProjectAtTime(between.Add(-time.Hour))
+	assert.ErrorIs(t, err, model.ErrEmptyBucket)
+
+	lines, err := bucket.Diff(1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []diff.Line{
+		{Op: diff.Equal, Text: "# Day"},
+		{Op: diff.Delete, Text: "- foo"},
+		{Op: diff.Insert, Text: "- bar"},
+		{Op: diff.Insert, Text: "- baz"},
+	}, lines)
+	lines, err = bucket.Diff(0, 1)
+	require.NoError(t, err)
+	assert.Len(t, lines, 2)
+
+	// A restored version is a new layer
+	require.NoError(t, bucket.Restore(1))
+	assert.Equal(t, "# Day\n- foo\n", projectContent(t, d, "day"))
+	bucket, err = d.Bucket("day")
+	require.NoError(t, err)
+	assert.Len(t, bucket.Layers(), 4)
+
+	// A deleted bucket can be restored
+	require.NoError(t, d.Delete("day"))
+	bucket, err = d.Bucket("day")
+	require.NoError(t, err)
+	require.NoError(t, bucket.Restore(3))
+	assert.Equal(t, "# Day\n- bar\n- baz\n", projectContent(t, d, "day"))
+}
+
+func TestBucket_ProjectAll(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucket_ProjectAll")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Journal, "hello world", nil))
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+	stale, err := b.Bucket("foo")
+	require.NoError(t, err)
+
+	// The snapshot does not fold the concurrent edit of b
+	require.NoError(t, a.Save("foo", index.Journal, "hello big world", nil))
+	require.NoError(t, a.Squash("foo"))
+	require.NoError(t, stale.Save("hello world!", nil))
+	a, err = Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Journal, "hello big world!!", nil))
+	require.NoError(t, a.Delete("foo"))
+	require.NoError(t, a.Save("foo", index.Journal, "again", nil))
+
+	bucket, err := a.Bucket("foo")
+	require.NoError(t, err)
+	var versions []int
+	require.NoError(t, bucket.ProjectAll(func(version int, doc model.Document, deleted bool) {
+		versions = append(versions, version)
+		expected, err := bucket.ProjectAt(version)
+		if deleted {
+			assert.ErrorIs(t, err, model.ErrDeletedBucket)
+			return
+		}
+		require.NoError(t, err)
+		assert.Equal(t, expected.Content(), doc.Content(), "version %d", version)
+		assert.Equal(t, expected.Metadata().Version(), doc.Metadata().Version())
+	}))
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, versions)
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Query(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Query")
+	defer os.RemoveAll(tmpDir)
+	key, err := LoadSigningKey(filepath.Join(tmpDir, "keys", "a.key"))
+	require.NoError(t, err)
+
+	a, err := Open(filepath.Join(tmpDir, "a"), "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("rome", index.Document, "Rome", model.Labels{"topic": "travel"}))
+	require.NoError(t, a.Save("oslo", index.Document, "Oslo", model.Labels{"topic": "travel", "type": "todo"}))
+	require.NoError(t, a.Save("milk", index.Document, "Milk", model.Labels{"type": "todo"}))
+
+	uids := func(d *DB, labels model.Labels) []string {
+		buckets, err := d.Query(Query{Labels: labels})
+		require.NoError(t, err)
+		var uids []string
+		for _, b := range buckets {
+			uids = append(uids, b.Uid())
+		}
+		return uids
+	}
+	assert.Equal(t, []string{"oslo", "rome"}, uids(a, model.Labels{"topic": "travel"}))
+	assert.Equal(t, []string{"oslo"}, uids(a, model.Labels{"topic": "travel", "type": "todo"}))
+	assert.Empty(t, uids(a, model.Labels{"topic": "work"}))
+	labeled, err := a.Labeled("type", "todo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"oslo", "milk"}, labeled)
+
+	// Labels follow the last layer of a bucket
+	require.NoError(t, a.Save("oslo", index.Document, "Oslo done", model.Labels{"topic": "travel", "type": "done"}))
+	require.NoError(t, a.Delete("rome"))
+	assert.Equal(t, []string{"oslo"}, uids(a, model.Labels{"topic": "travel"}))
+	assert.Equal(t, []string{"milk"}, uids(a, model.Labels{"type": "todo"}))
+
+	// Labels are exported with their layers
+	b, err := Open(filepath.Join(tmpDir, "b"), "b")
+	require.NoError(t, err)
+	patch := &bytes.Buffer{}
+	_, err = a.ExportPatch(patch, Cursor{}, WithSigningKey(key))
+	require.NoError(t, err)
+	_, err = b.ImportPatch(patch, WithTrustedDevice("a", key.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"oslo"}, uids(b, model.Labels{"topic": "travel"}))
+	require.NoError(t, b.Save("milk", index.Document, "Milk", nil))
+	assert.Empty(t, uids(b, model.Labels{"type": "todo"}))
+
+	stats, err := a.Compact(WithRetention(0))
+	require.NoError(t, err)
+	// Oslo todo label and travel label of rome
+	assert.Equal(t, 2, stats.Labels)
+	assert.Equal(t, []string{"oslo"}, uids(a, model.Labels{"topic": "travel"}))
+	assert.Equal(t, []string{"milk"}, uids(a, model.Labels{"type": "todo"}))
+}
+
+func TestDB_LabelKey(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_LabelKey")
+	defer os.RemoveAll(tmpDir)
+	secret, err := LoadSecret(filepath.Join(tmpDir, "db.secret"))
+	require.NoError(t, err)
+	loaded, err := LoadSecret(filepath.Join(tmpDir, "db.secret"))
+	require.NoError(t, err)
+	assert.Equal(t, secret, loaded)
+
+	a, err := Open(filepath.Join(tmpDir, "a"), "a", WithSecret(secret))
+	require.NoError(t, err)
+	other, err := Open(filepath.Join(tmpDir, "other"), "other")
+	require.NoError(t, err)
+
+	// Hashes depend on the secret, and a "=" cannot move between the key and the value
+	assert.NotEqual(t, a.labelKey("type", "todo"), other.labelKey("type", "todo"))
+	assert.NotEqual(t, a.labelKey("a=b", "c"), a.labelKey("a", "b=c"))
+
+	require.NoError(t, a.Save("rome", index.Document, "Rome", model.Labels{"a=b": "c"}))
+	labeled, err := a.Labeled("a", "b=c")
+	require.NoError(t, err)
+	assert.Empty(t, labeled)
+	labeled, err = a.Labeled("a=b", "c")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rome"}, labeled)
+}
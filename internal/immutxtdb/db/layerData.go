@@ -0,0 +1,352 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/blob"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/crdt"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+	"github.com/mxbossard/utilz/filez"
+)
+
+// Append only file of layer contents. A layer is referenced by its bloc id: its position in the file.
+// BLOC: [PAYLOAD_LEN,CRC32(PAYLOAD),PAYLOAD]
+
+const blocHeaderSize = 8
+
+type layerData struct {
+	*sync.Mutex
+	path    string
+	offsets []int64
+	size    int64
+}
+
+func layerDataFilename(device string, rotation int) string {
+	return fmt.Sprintf("data-%s-%03d.dat", device, rotation)
+}
+
+// Open a layer data file, indexing its blocs. A torn last bloc is truncated if repair is set.
+func openLayerData(path string, repair bool) (*layerData, error) {
+	d := &layerData{
+		Mutex: &sync.Mutex{},
+		path:  path,
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, blocHeaderSize)
+	var offset int64
+	for offset+blocHeaderSize <= info.Size() {
+		_, err := f.ReadAt(header, offset)
+		if err != nil {
+			return nil, err
+		}
+		next := offset + blocHeaderSize + int64(binary.BigEndian.Uint32(header[0:4]))
+		if next > info.Size() {
+			break
+		}
+		d.offsets = append(d.offsets, offset)
+		offset = next
+	}
+	d.size = offset
+	if offset < info.Size() && repair {
+		err = os.Truncate(path, offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *layerData) name() string {
+	return filepath.Base(d.path)
+}
+
+// Count of blocs in the file, it is also the bloc id of next written bloc.
+func (d *layerData) count() int {
+	return len(d.offsets)
+}
+
+func (d *layerData) record(blocId int, payload []byte) wal.Record {
+	return wal.Record{Target: d.name(), Seq: blocId, Data: payload}
+}
+
+// Write a bloc logged in a wal. Already written blocs are skipped.
+// Caller must hold the lock.
+func (d *layerData) write(r wal.Record) error {
+	if r.Seq < d.count() {
+		return nil
+	} else if r.Seq > d.count() {
+		return fmt.Errorf("cannot write bloc #%d in %s: next bloc is %d", r.Seq, d.name(), d.count())
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, filez.DefaultFilePerms)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bloc := make([]byte, blocHeaderSize, blocHeaderSize+len(r.Data))
+	binary.BigEndian.PutUint32(bloc[0:4], uint32(len(r.Data)))
+	binary.BigEndian.PutUint32(bloc[4:8], crc32.ChecksumIEEE(r.Data))
+	bloc = append(bloc, r.Data...)
+	_, err = f.Write(bloc)
+	if err != nil {
+		return err
+	}
+	d.offsets = append(d.offsets, d.size)
+	d.size += int64(len(bloc))
+	return nil
+}
+
+// Flush written blocs to disk.
+func (d *layerData) sync() error {
+	f, err := os.OpenFile(d.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (d *layerData) read(blocId int) ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+	if blocId < 0 || blocId >= d.count() {
+		return nil, fmt.Errorf("bloc #%d does not exist in %s", blocId, d.name())
+	}
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, blocHeaderSize)
+	_, err = f.ReadAt(header, d.offsets[blocId])
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	_, err = f.ReadAt(payload, d.offsets[blocId]+blocHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("bad layer bloc checksum")
+	}
+	return payload, nil
+}
+
+type layerPayload struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Labels  model.Labels `json:"labels,omitempty"`
+	Content string       `json:"content,omitempty"`
+	Ops     []crdt.Op    `json:"ops,omitempty"`
+	// Layer of CRDT operations, set as its operations are omitted when there is none.
+	OpsLayer bool            `json:"opsLayer,omitempty"`
+	Parents  []hlc.Timestamp `json:"parents,omitempty"`
+	// Root of the content in the blob store, replacing the inline content. For a layer of CRDT
+	// operations, root of the texts its operations insert, cut by their lengths.
+	Blob     *blob.CID  `json:"blob,omitempty"`
+	TextLens []int      `json:"textLens,omitempty"`
+	Snapshot bool       `json:"snapshot,omitempty"`
+	Runs     []crdt.Run `json:"runs,omitempty"`
+	// Root of the texts of the runs in the blob store, cut by their lengths.
+	RunsBlob *blob.CID       `json:"runsBlob,omitempty"`
+	RunLens  []int           `json:"runLens,omitempty"`
+	Frontier []hlc.Timestamp `json:"frontier,omitempty"`
+	Deleted  bool            `json:"deleted,omitempty"`
+}
+
+// Encode a layer, storing its content in the blob store if any.
+func encodeLayer(l *model.Layer, blobs blob.BlobStore) ([]byte, error) {
+	m := l.Metadata()
+	p := layerPayload{
+		Version:  m.Version(),
+		Created:  m.Created(),
+		Labels:   m.Labels(),
+		Content:  l.Content(),
+		Ops:      l.Ops(),
+		OpsLayer: l.IsOps(),
+		Parents:  l.Parents(),
+		Snapshot: m.Snapshoted(),
+		Runs:     l.Runs(),
+		Frontier: l.Frontier(),
+		Deleted:  l.Deleted(),
+	}
+	if blobs != nil && !p.OpsLayer && p.Content != "" {
+		root, err := blob.PutContent(blobs, []byte(p.Content))
+		if err != nil {
+			return nil, err
+		}
+		p.Blob = &root
+		p.Content = ""
+	}
+	if blobs != nil && p.OpsLayer {
+		err := putOpsTexts(&p, blobs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if blobs != nil && len(p.Runs) > 0 {
+		err := putRunsTexts(&p, blobs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(p)
+}
+
+// Roots of the contents of a payload in the blob store.
+func (p layerPayload) roots() []blob.CID {
+	var roots []blob.CID
+	for _, root := range []*blob.CID{p.Blob, p.RunsBlob} {
+		if root != nil {
+			roots = append(roots, *root)
+		}
+	}
+	return roots
+}
+
+// Store texts as one content, return its root and the length of each text.
+func putTexts(blobs blob.BlobStore, texts []string) (blob.CID, []int, error) {
+	lens := make([]int, len(texts))
+	for k, text := range texts {
+		lens[k] = len(text)
+	}
+	root, err := blob.PutContent(blobs, []byte(strings.Join(texts, "")))
+	return root, lens, err
+}
+
+// Cut a content stored by putTexts back into its texts.
+func cutTexts(content string, lens []int) ([]string, error) {
+	texts := make([]string, len(lens))
+	for k, n := range lens {
+		if n < 0 || n > len(content) {
+			return nil, errors.New("decoding layer: texts are shorter than their lengths")
+		}
+		texts[k], content = content[:n], content[n:]
+	}
+	if content != "" {
+		return nil, errors.New("decoding layer: texts are longer than their lengths")
+	}
+	return texts, nil
+}
+
+// Store the texts inserted by the operations of a payload as one content, so a paragraph typed
+// in a journal is stored once like the paragraphs of other layers.
+func putOpsTexts(p *layerPayload, blobs blob.BlobStore) error {
+	ops := slices.Clone(p.Ops)
+	texts := make([]string, len(ops))
+	for k := range ops {
+		texts[k], ops[k].Text = ops[k].Text, ""
+	}
+	if strings.Join(texts, "") == "" {
+		return nil
+	}
+	root, lens, err := putTexts(blobs, texts)
+	if err != nil {
+		return err
+	}
+	p.Ops, p.TextLens, p.Blob = ops, lens, &root
+	return nil
+}
+
+// Store the texts of the runs of a snapshot as one content. They make up the snapshot content,
+// which is stored once.
+func putRunsTexts(p *layerPayload, blobs blob.BlobStore) error {
+	runs := slices.Clone(p.Runs)
+	texts := make([]string, len(runs))
+	for k := range runs {
+		texts[k], runs[k].Text = runs[k].Text, ""
+	}
+	root, lens, err := putTexts(blobs, texts)
+	if err != nil {
+		return err
+	}
+	p.Runs, p.RunLens, p.RunsBlob = runs, lens, &root
+	return nil
+}
+
+// Read a content of a payload from the blob store.
+func getContent(blobs blob.BlobStore, root blob.CID) (string, error) {
+	if blobs == nil {
+		return "", fmt.Errorf("%w: layer content %s", ErrNoBlobStore, root)
+	}
+	content, err := blob.GetContent(blobs, root)
+	return string(content), err
+}
+
+func decodeLayer(payload []byte, blobs blob.BlobStore) (*model.Layer, error) {
+	var p layerPayload
+	err := json.Unmarshal(payload, &p)
+	if err != nil {
+		return nil, fmt.Errorf("decoding layer: %w", err)
+	}
+	if p.Blob != nil {
+		content, err := getContent(blobs, *p.Blob)
+		if err != nil {
+			return nil, err
+		}
+		p.Content = content
+		if p.OpsLayer {
+			p.Content = ""
+			if len(p.TextLens) != len(p.Ops) {
+				return nil, fmt.Errorf("decoding layer: %d text lengths for %d operations", len(p.TextLens), len(p.Ops))
+			}
+			texts, err := cutTexts(content, p.TextLens)
+			if err != nil {
+				return nil, err
+			}
+			for k, text := range texts {
+				p.Ops[k].Text = text
+			}
+		}
+	}
+	if p.RunsBlob != nil {
+		content, err := getContent(blobs, *p.RunsBlob)
+		if err != nil {
+			return nil, err
+		}
+		if len(p.RunLens) != len(p.Runs) {
+			return nil, fmt.Errorf("decoding layer: %d text lengths for %d runs", len(p.RunLens), len(p.Runs))
+		}
+		texts, err := cutTexts(content, p.RunLens)
+		if err != nil {
+			return nil, err
+		}
+		for k, text := range texts {
+			p.Runs[k].Text = text
+		}
+	}
+	metadata := model.NewMetadata(p.Version, p.Created, p.Labels)
+	l := model.NewLayer(p.Content, metadata)
+	if p.OpsLayer {
+		l = model.NewOpsLayer(p.Ops, metadata)
+	} else if p.Snapshot {
+		l = model.NewSnapshotLayer(p.Content, p.Runs, p.Frontier, metadata)
+	} else if p.Deleted {
+		l = model.NewTombstoneLayer(metadata)
+	}
+	l.SetParents(p.Parents...)
+	return l, nil
+}
@@ -0,0 +1,469 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+	"github.com/mxbossard/utilz/filez"
+)
+
+// A patch bundles the words and layer data written by a device, to sync another db offline
+// (by mail, usb key, ...). Patches are signed by the device, and optionally encrypted with a
+// passphrase. Importing a patch write its words into the other devices files of the db.
+//
+// PATCH: [MAGIC,FLAGS,(SALT,NONCE)?,BODY]
+// BODY: [PUBLIC_KEY,SIGNATURE(PAYLOAD),PAYLOAD], encrypted with AES-GCM if FLAGS has patchEncrypted.
+
+var (
+	patchMagic = []byte("tjpatch0")
+
+	ErrBadPatch         = errors.New("not a valid patch")
+	ErrUntrustedPatch   = errors.New("patch is not signed by a trusted key")
+	ErrNoSigningKey     = errors.New("a signing key is required to export a patch")
+	ErrPassphraseNeeded = errors.New("patch is encrypted, a passphrase is required")
+)
+
+const (
+	patchEncrypted     = byte(1)
+	patchSaltSize      = 16
+	patchKdfIterations = 600_000
+)
+
+// Data files are named data-DEVICE-NNN.dat like idx files.
+var layerDataFilenameRegexp = regexp.MustCompile(`^data-(.+)-(\d{3})\.dat$`)
+
+// Position reached in each file of a device: the next seq of idx files, the next bloc of data files.
+type Cursor map[string]int
+
+// Format a cursor as name:seq pairs separated by commas.
+func (c Cursor) String() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	pairs := make([]string, 0, len(c))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s:%d", name, c[name]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func ParseCursor(s string) (Cursor, error) {
+	c := Cursor{}
+	if s == "" {
+		return c, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, seq, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("bad cursor pair: %s", pair)
+		}
+		n, err := strconv.Atoi(seq)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad cursor seq: %s", pair)
+		}
+		c[name] = n
+	}
+	return c, nil
+}
+
+type patchPayload struct {
+	Device  string       `json:"device"`
+	Created time.Time    `json:"created"`
+	Records []wal.Record `json:"records"`
+	Blocks  []patchBlock `json:"blocks,omitempty"`
+}
+
+type patchOptions struct {
+	signingKey ed25519.PrivateKey
+	// Public key of each trusted device.
+	trustedKeys map[string]ed25519.PublicKey
+	passphrase  string
+}
+
+type PatchOption func(*patchOptions)
+
+// Sign exported patches with the device key.
+func WithSigningKey(key ed25519.PrivateKey) PatchOption {
+	return func(o *patchOptions) {
+		o.signingKey = key
+	}
+}
+
+// Import the patches of a device signed by its key. Without trusted device no patch is imported.
+func WithTrustedDevice(device string, key ed25519.PublicKey) PatchOption {
+	return func(o *patchOptions) {
+		if o.trustedKeys == nil {
+			o.trustedKeys = map[string]ed25519.PublicKey{}
+		}
+		o.trustedKeys[device] = key
+	}
+}
+
+// Encrypt exported patches, decrypt imported patches with a passphrase.
+func WithPassphrase(passphrase string) PatchOption {
+	return func(o *patchOptions) {
+		o.passphrase = passphrase
+	}
+}
+
+// Load a device signing key, generating it if the file does not exist.
+// The public key is written next to it with a .pub extension, to be shared with other devices.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("bad signing key file: %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path, key.Seed(), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path+".pub", pub, filez.DefaultFilePerms)
+}
+
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad public key file: %s", path)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Cursor of this device files at the first words written since a time.
+// Data blocs and buckets of the layers written since are included, so are their labels and
+// topics mentions.
+func (d *DB) CursorAt(since time.Time) (Cursor, error) {
+	layerCursor, entries, err := d.layerIdx.DeviceCursor(hlc.Timestamp{Wall: since.UnixMilli()})
+	if err != nil {
+		return nil, err
+	}
+	c := Cursor(layerCursor)
+	c[d.data.name()] = d.data.count()
+	keys := map[string]bool{}
+	for _, e := range entries {
+		keys[string(e.UidHash)] = true
+		if e.Ref.BlocsFilepath() == d.data.name() {
+			c[d.data.name()] = min(c[d.data.name()], e.Ref.BlocId())
+		}
+	}
+	bucketCursor, err := d.bucketIdx.DeviceCursor(func(uid string) bool {
+		return keys[string(layerKey(uid))]
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, seq := range bucketCursor {
+		c[name] = seq
+	}
+	labelCursor, err := d.labelIdx.DeviceCursor(hlc.Timestamp{Wall: since.UnixMilli()})
+	if err != nil {
+		return nil, err
+	}
+	topicCursor, err := d.topicIdx.DeviceCursor(hlc.Timestamp{Wall: since.UnixMilli()})
+	if err != nil {
+		return nil, err
+	}
+	for _, cursor := range []map[string]int{labelCursor, topicCursor} {
+		for name, seq := range cursor {
+			// Files missing from a cursor are read from their first word.
+			if seq > 0 {
+				c[name] = seq
+			}
+		}
+	}
+	return c, nil
+}
+
+// Write a patch of the words and layer data written by this device since the cursor.
+// Return the cursor of the next patch.
+func (d *DB) ExportPatch(w io.Writer, since Cursor, opts ...PatchOption) (Cursor, error) {
+	o := patchOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.signingKey == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	// Layers are read first, so the data blocs and buckets they reference are read too
+	// even if layers are saved meanwhile.
+	layerRecords, err := d.layerIdx.DeviceRecords(since)
+	if err != nil {
+		return nil, err
+	}
+	var records []wal.Record
+	for blocId := since[d.data.name()]; blocId < d.data.count(); blocId++ {
+		payload, err := d.data.read(blocId)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, d.data.record(blocId, payload))
+	}
+	blocks, err := d.recordsBlocks(records)
+	if err != nil {
+		return nil, err
+	}
+	bucketRecords, err := d.bucketIdx.DeviceRecords(since)
+	if err != nil {
+		return nil, err
+	}
+	// Labels and topics are read last: those of layers saved meanwhile may be included.
+	labelRecords, err := d.labelIdx.DeviceRecords(since)
+	if err != nil {
+		return nil, err
+	}
+	topicRecords, err := d.topicIdx.DeviceRecords(since)
+	if err != nil {
+		return nil, err
+	}
+	records = slices.Concat(bucketRecords, records, layerRecords, labelRecords, topicRecords)
+
+	next := Cursor{}
+	for name, seq := range since {
+		next[name] = seq
+	}
+	for _, r := range records {
+		next[r.Target] = max(next[r.Target], r.Seq+1)
+	}
+
+	payload, err := json.Marshal(patchPayload{Device: d.device, Created: time.Now(), Records: records, Blocks: blocks})
+	if err != nil {
+		return nil, err
+	}
+	body := slices.Concat([]byte(o.signingKey.Public().(ed25519.PublicKey)), ed25519.Sign(o.signingKey, payload), payload)
+
+	header := slices.Clone(patchMagic)
+	if o.passphrase != "" {
+		salt := make([]byte, patchSaltSize)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := patchCipher(o.passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		header = slices.Concat(header, []byte{patchEncrypted}, salt, nonce)
+		body = aead.Seal(nil, nonce, body, header)
+	} else {
+		header = append(header, 0)
+	}
+	_, err = w.Write(slices.Concat(header, body))
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func patchCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, patchKdfIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Validate and decode a patch. A patch is only accepted from a trusted device, signed by the
+// key of that device.
+func readPatch(r io.Reader, o patchOptions) (*patchPayload, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	k := len(patchMagic)
+	if len(content) < k+1 || !bytes.Equal(content[:k], patchMagic) {
+		return nil, ErrBadPatch
+	}
+	flags := content[k]
+	k++
+	body := content[k:]
+	if flags&patchEncrypted != 0 {
+		if o.passphrase == "" {
+			return nil, ErrPassphraseNeeded
+		}
+		if len(content) < k+patchSaltSize {
+			return nil, ErrBadPatch
+		}
+		aead, err := patchCipher(o.passphrase, content[k:k+patchSaltSize])
+		if err != nil {
+			return nil, err
+		}
+		k += patchSaltSize
+		if len(content) < k+aead.NonceSize() {
+			return nil, ErrBadPatch
+		}
+		nonce := content[k : k+aead.NonceSize()]
+		k += aead.NonceSize()
+		body, err = aead.Open(nil, nonce, content[k:], content[:k])
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt patch: %w", err)
+		}
+	}
+
+	if len(body) < ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, ErrBadPatch
+	}
+	pub := ed25519.PublicKey(body[:ed25519.PublicKeySize])
+	sig := body[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	payload := body[ed25519.PublicKeySize+ed25519.SignatureSize:]
+	if !ed25519.Verify(pub, payload, sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrBadPatch)
+	}
+	if len(o.trustedKeys) == 0 {
+		return nil, fmt.Errorf("%w: no trusted device", ErrUntrustedPatch)
+	}
+
+	p := &patchPayload{}
+	err = json.Unmarshal(payload, p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadPatch, err)
+	}
+	err = checkDevice(p.Device)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadPatch, err)
+	}
+	if key, ok := o.trustedKeys[p.Device]; !ok || !key.Equal(pub) {
+		return nil, fmt.Errorf("%w: device %s", ErrUntrustedPatch, p.Device)
+	}
+	return p, nil
+}
+
+// Validate a patch exported by another device and write its words and layer data into the
+// files of that device. Words already imported are skipped, so a patch can be imported again,
+// for instance after a crash during an import.
+// Return the cursor of the patch device files after the import.
+func (d *DB) ImportPatch(r io.Reader, opts ...PatchOption) (Cursor, error) {
+	o := patchOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	p, err := readPatch(r, o)
+	if err != nil {
+		return nil, err
+	}
+	if p.Device == d.device {
+		return nil, fmt.Errorf("cannot import a patch of this device: %s", d.device)
+	}
+
+	err = d.importBlocks(p.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := d.importRecords(p)
+	if err != nil {
+		return nil, err
+	}
+	// Next layers written on this device will follow imported layers.
+	d.clock.Update(d.layerIdx.MaxClock())
+	return cursor, nil
+}
+
+func (d *DB) importRecords(p *patchPayload) (Cursor, error) {
+	// Every file must belong to the patch device.
+	dataFiles := map[string]*layerData{}
+	cursor := Cursor{}
+	for _, r := range p.Records {
+		if filepath.Base(r.Target) != r.Target {
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrBadPatch, r.Target)
+		}
+		if m := layerDataFilenameRegexp.FindStringSubmatch(r.Target); m != nil && m[1] == p.Device {
+			dataFiles[r.Target] = nil
+		} else if device, ok := index.IdxFilenameDevice(r.Target); !ok || device != p.Device {
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrBadPatch, r.Target)
+		}
+		cursor[r.Target] = max(cursor[r.Target], r.Seq+1)
+	}
+	// Layers are read from the data files of the patch device in the db root.
+	layers, err := d.layerIdx.RecordLayers(p.Records)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadPatch, err)
+	}
+	for _, l := range layers {
+		name := l.BlocsFilepath()
+		if m := layerDataFilenameRegexp.FindStringSubmatch(name); m == nil || m[1] != p.Device || filepath.Base(name) != name {
+			return nil, fmt.Errorf("%w: layer in unexpected file %s", ErrBadPatch, name)
+		}
+	}
+
+	defer d.changes.touchAll()
+	d.lock()
+	defer d.unlock()
+	// Layer data is written before the layers referencing it.
+	for name := range dataFiles {
+		data, err := openLayerData(filepath.Join(d.rootPath, name), true)
+		if err != nil {
+			return nil, err
+		}
+		dataFiles[name] = data
+	}
+	for _, r := range p.Records {
+		if data, ok := dataFiles[r.Target]; ok {
+			err := data.write(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = d.bucketIdx.ImportRecords(p.Records)
+	if err != nil {
+		return nil, err
+	}
+	err = d.layerIdx.ImportRecords(p.Records)
+	if err != nil {
+		return nil, err
+	}
+	err = d.labelIdx.ImportRecords(p.Records)
+	if err != nil {
+		return nil, err
+	}
+	err = d.topicIdx.ImportRecords(p.Records)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func projectContent(t *testing.T, d *DB, uid string) string {
+	bucket, err := d.Bucket(uid)
+	require.NoError(t, err)
+	doc, err := bucket.Project()
+	require.NoError(t, err)
+	return doc.Content()
+}
+
+func TestDB_ExportImportPatch(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_ExportImportPatch")
+	defer os.RemoveAll(tmpDir)
+	key, err := LoadSigningKey(filepath.Join(tmpDir, "keys", "a.key"))
+	require.NoError(t, err)
+	pub, err := LoadPublicKey(filepath.Join(tmpDir, "keys", "a.key.pub"))
+	require.NoError(t, err)
+
+	a, err := Open(filepath.Join(tmpDir, "a"), "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo", nil))
+	require.NoError(t, a.Save("bar", index.Document, "bar", nil))
+
+	patch1 := &bytes.Buffer{}
+	cursor, err := a.ExportPatch(patch1, Cursor{}, WithSigningKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, Cursor{"bucket-a-001.idx": 2, "layer-a-001.idx": 2, "data-a-001.dat": 2}, cursor)
+
+	require.NoError(t, a.Save("foo", index.Document, "foo v2", nil))
+	patch2 := &bytes.Buffer{}
+	cursor, err = a.ExportPatch(patch2, cursor, WithSigningKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, 3, cursor["layer-a-001.idx"])
+	assert.Less(t, patch2.Len(), patch1.Len())
+
+	b, err := Open(filepath.Join(tmpDir, "b"), "b")
+	require.NoError(t, err)
+	// Patches must be imported in order
+	_, err = b.ImportPatch(bytes.NewReader(patch2.Bytes()), WithTrustedDevice("a", pub))
+	assert.Error(t, err)
+
+	imported, err := b.ImportPatch(bytes.NewReader(patch1.Bytes()), WithTrustedDevice("a", pub))
+	require.NoError(t, err)
+	assert.Equal(t, 2, imported["layer-a-001.idx"])
+	assert.Equal(t, "foo", projectContent(t, b, "foo"))
+	assert.Equal(t, "bar", projectContent(t, b, "bar"))
+
+	// Importing twice is harmless
+	for range 2 {
+		_, err = b.ImportPatch(bytes.NewReader(patch2.Bytes()), WithTrustedDevice("a", pub))
+		require.NoError(t, err)
+	}
+	count, err := b.layerIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, "foo v2", projectContent(t, b, "foo"))
+
+	// Layers of b follow imported layers
+	require.NoError(t, b.Save("foo", index.Document, "foo from b", nil))
+	b, err = Open(filepath.Join(tmpDir, "b"), "b")
+	require.NoError(t, err)
+	assert.Equal(t, "foo from b", projectContent(t, b, "foo"))
+
+	// A device cannot import its own patch
+	_, err = a.ImportPatch(bytes.NewReader(patch1.Bytes()))
+	assert.Error(t, err)
+}
+
+func TestDB_PatchValidation(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_PatchValidation")
+	defer os.RemoveAll(tmpDir)
+	key, err := LoadSigningKey(filepath.Join(tmpDir, "a.key"))
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	a, err := Open(filepath.Join(tmpDir, "a"), "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "secret foo", nil))
+	_, err = a.ExportPatch(&bytes.Buffer{}, Cursor{})
+	assert.ErrorIs(t, err, ErrNoSigningKey)
+
+	plain := &bytes.Buffer{}
+	_, err = a.ExportPatch(plain, Cursor{}, WithSigningKey(key))
+	require.NoError(t, err)
+	encrypted := &bytes.Buffer{}
+	_, err = a.ExportPatch(encrypted, Cursor{}, WithSigningKey(key), WithPassphrase("pass"))
+	require.NoError(t, err)
+	assert.NotContains(t, encrypted.String(), "secret foo")
+
+	b, err := Open(filepath.Join(tmpDir, "b"), "b")
+	require.NoError(t, err)
+
+	_, err = b.ImportPatch(bytes.NewReader(plain.Bytes()), WithTrustedDevice("a", otherPub))
+	assert.ErrorIs(t, err, ErrUntrustedPatch)
+
+	tampered := bytes.Clone(plain.Bytes())
+	tampered[len(tampered)-2] ^= 0xff
+	_, err = b.ImportPatch(bytes.NewReader(tampered))
+	assert.ErrorIs(t, err, ErrBadPatch)
+	_, err = b.ImportPatch(bytes.NewReader([]byte("foo")))
+	assert.ErrorIs(t, err, ErrBadPatch)
+
+	_, err = b.ImportPatch(bytes.NewReader(encrypted.Bytes()))
+	assert.ErrorIs(t, err, ErrPassphraseNeeded)
+	_, err = b.ImportPatch(bytes.NewReader(encrypted.Bytes()), WithPassphrase("wrong"))
+	assert.Error(t, err)
+	trusted := WithTrustedDevice("a", key.Public().(ed25519.PublicKey))
+	_, err = b.ImportPatch(bytes.NewReader(encrypted.Bytes()), WithPassphrase("pass"))
+	assert.ErrorIs(t, err, ErrUntrustedPatch)
+	_, err = b.ImportPatch(bytes.NewReader(encrypted.Bytes()), WithPassphrase("pass"), trusted)
+	require.NoError(t, err)
+	assert.Equal(t, "secret foo", projectContent(t, b, "foo"))
+}
+
+// Sign a patch payload without encryption.
+func signPatch(t *testing.T, key ed25519.PrivateKey, p patchPayload) []byte {
+	payload, err := json.Marshal(p)
+	require.NoError(t, err)
+	return slices.Concat(patchMagic, []byte{0}, key.Public().(ed25519.PublicKey), ed25519.Sign(key, payload), payload)
+}
+
+func TestDB_PatchDevice(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_PatchDevice")
+	defer os.RemoveAll(tmpDir)
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPub, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = Open(filepath.Join(tmpDir, "a"), "../a")
+	assert.ErrorIs(t, err, ErrBadDevice)
+	b, err := Open(filepath.Join(tmpDir, "b"), "b")
+	require.NoError(t, err)
+
+	// Devices cannot name files outside the db directory
+	for _, device := range []string{"x/../../../evil", "..", `x\evil`, ""} {
+		patch := signPatch(t, key, patchPayload{Device: device, Records: []wal.Record{
+			{Target: "data-" + device + "-001.dat", Seq: 0, Data: []byte("evil")},
+		}})
+		_, err = b.ImportPatch(bytes.NewReader(patch), WithTrustedDevice(device, pub))
+		assert.ErrorIs(t, err, ErrBadPatch, device)
+	}
+	_, err = os.Stat(filepath.Join(tmpDir, "b", "data-x/../../../evil-001.dat"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Layers cannot reference files of other devices or outside the db directory
+	a, err := Open(filepath.Join(tmpDir, "a"), "a")
+	require.NoError(t, err)
+	for _, file := range []string{"../../x", "data-b-001.dat", "../data-a-001.dat", "layer-a-001.idx"} {
+		a.lock()
+		ref := model.NewClockedLayerRef(file, 0, index.Document, a.clock.Now())
+		records, err := a.layerIdx.EncodeWords(index.LayerEntry{UidHash: layerKey("foo"), Ref: ref})
+		a.unlock()
+		require.NoError(t, err)
+		records[0].Target = filepath.Base(records[0].Target)
+		patch := signPatch(t, key, patchPayload{Device: "a", Records: records})
+		_, err = b.ImportPatch(bytes.NewReader(patch), WithTrustedDevice("a", pub))
+		assert.ErrorIs(t, err, ErrBadPatch, file)
+	}
+	count, err := b.layerIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// A device is bound to its key
+	patch := signPatch(t, otherKey, patchPayload{Device: "a"})
+	_, err = b.ImportPatch(bytes.NewReader(patch), WithTrustedDevice("a", pub), WithTrustedDevice("c", otherPub))
+	assert.ErrorIs(t, err, ErrUntrustedPatch)
+	_, err = b.ImportPatch(bytes.NewReader(patch), WithTrustedDevice("a", otherPub))
+	assert.NoError(t, err)
+}
+
+func TestDB_CursorAt(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_CursorAt")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo", nil))
+	require.NoError(t, a.Save("bar", index.Document, "bar", nil))
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, a.Save("foo", index.Document, "foo v2", nil))
+
+	cursor, err := a.CursorAt(since)
+	require.NoError(t, err)
+	// Layer and data since the time, bucket of the layer
+	assert.Equal(t, Cursor{"bucket-a-001.idx": 0, "layer-a-001.idx": 2, "data-a-001.dat": 2}, cursor)
+
+	cursor, err = a.CursorAt(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, Cursor{"bucket-a-001.idx": 2, "layer-a-001.idx": 3, "data-a-001.dat": 3}, cursor)
+
+	parsed, err := ParseCursor(cursor.String())
+	require.NoError(t, err)
+	assert.Equal(t, cursor, parsed)
+	_, err = ParseCursor("foo")
+	assert.Error(t, err)
+}
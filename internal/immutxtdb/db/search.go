@@ -0,0 +1,92 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/errorz"
+)
+
+// The text index is derived from the layers of all devices: a bucket saved on this device is
+// indexed again right away, buckets changed by other devices are indexed again by the next
+// search, once their last layer differs from the one they were indexed at. The index is saved
+// by searches and on close, so a new start only indexes the buckets changed meanwhile.
+
+// Search the projected text of all buckets. Buckets are ranked by their BM25 score, quoted
+// phrases of the query must be found in the buckets.
+func (d *DB) Search(query string) (model.Paginer[string, index.TextHit], error) {
+	err := d.syncTextIndex()
+	if err != nil {
+		return nil, err
+	}
+	p, errChan := d.text.Paginate(query, model.TopToBottom, 100)
+	return p, errorz.ConsumedAggregated(errChan).Return()
+}
+
+// Index again the buckets whose last layer changed since they were indexed, and forget the
+// buckets dropped by a compaction.
+func (d *DB) syncTextIndex() error {
+	uids, err := d.bucketUids()
+	if err != nil {
+		return err
+	}
+	last := map[string]hlc.Timestamp{}
+	p, errChan := d.layerIdx.PaginateAll(model.TopToBottom, 100)
+	for err, page := range p.All() {
+		if err != nil {
+			return err
+		}
+		for _, entry := range page.Entries() {
+			key := string(entry.Key())
+			if clock := entry.Val().Clock(); clock.Compare(last[key]) > 0 {
+				last[key] = clock
+			}
+		}
+	}
+	err = errorz.ConsumedAggregated(errChan).Return()
+	if err != nil {
+		return err
+	}
+
+	indexed := map[string]bool{}
+	for _, uid := range uids {
+		clock, ok := last[string(layerKey(uid))]
+		if !ok {
+			continue
+		}
+		indexed[uid] = true
+		if previous, ok := d.text.Clock(uid); ok && previous.Compare(clock) == 0 {
+			continue
+		}
+		err = d.indexText(uid)
+		if err != nil {
+			return err
+		}
+	}
+	for _, uid := range d.text.Uids() {
+		if !indexed[uid] {
+			d.text.Remove(uid)
+		}
+	}
+	return d.text.Save()
+}
+
+// Index the projected text of a bucket. Deleted buckets are removed from the index.
+func (d *DB) indexText(uid string) error {
+	b, err := d.Bucket(uid)
+	if err != nil {
+		return err
+	}
+	doc, err := b.Project()
+	if errors.Is(err, model.ErrDeletedBucket) || errors.Is(err, model.ErrEmptyBucket) {
+		d.text.Remove(uid)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	layers := b.Layers()
+	d.text.Update(uid, doc.Content(), layers[len(layers)-1].Clock())
+	return nil
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Search(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Search")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+
+	search := func(d *DB, query string) []string {
+		p, err := d.Search(query)
+		require.NoError(t, err)
+		var uids []string
+		for err, page := range p.All() {
+			require.NoError(t, err)
+			for _, entry := range page.Entries() {
+				uids = append(uids, entry.Key())
+			}
+		}
+		return uids
+	}
+	require.NoError(t, a.Save("day", index.Journal, "Réunion avec Léa.", nil))
+	require.NoError(t, a.Save("notes", index.Document, "Compte rendu de la réunion", nil))
+	assert.Equal(t, []string{"day", "notes"}, search(a, "reunion"))
+
+	// Saved buckets are indexed again
+	require.NoError(t, a.Save("day", index.Journal, "Déjeuner avec Léa.", nil))
+	assert.Equal(t, []string{"notes"}, search(a, "reunion"))
+
+	// Buckets changed by other devices are indexed again
+	_, err = b.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"day"}, search(b, "lea"))
+	require.NoError(t, b.Save("day", index.Journal, "Déjeuner avec Léa et Paul.", nil))
+	require.NoError(t, b.Delete("notes"))
+	_, err = a.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"day"}, search(a, "paul"))
+	assert.Empty(t, search(a, "reunion"))
+
+	// The index is saved: a new start does not index the buckets again
+	require.NoError(t, a.Close())
+	a, err = Open(tmpDir, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"day"}, a.text.Uids())
+	dayBucket, err := a.Bucket("day")
+	require.NoError(t, err)
+	layers := dayBucket.Layers()
+	clock, ok := a.text.Clock("day")
+	assert.True(t, ok)
+	assert.Equal(t, layers[len(layers)-1].Clock(), clock)
+	assert.Equal(t, []string{"day"}, search(a, "paul"))
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := ParseSearchQuery(`vojage "train de nuit" kind:trip date:2025-11-01..2025-11-30`)
+	require.NoError(t, err)
+	assert.Equal(t, `vojage "train de nuit"`, q.Text)
+	assert.Equal(t, model.Labels{"kind": "trip"}, q.Labels)
+	assert.Equal(t, time.Date(2025, 11, 1, 0, 0, 0, 0, time.Local), q.From)
+	assert.Equal(t, time.Date(2025, 11, 30, 0, 0, 0, 0, time.Local), q.To)
+
+	q, err = ParseSearchQuery(`"a:b" date:..2025-11-30`)
+	require.NoError(t, err)
+	assert.Equal(t, `"a:b"`, q.Text)
+	assert.True(t, q.From.IsZero())
+	q, err = ParseSearchQuery(`date:2025-11-24`)
+	require.NoError(t, err)
+	assert.Equal(t, q.From, q.To)
+	_, err = ParseSearchQuery(`date:hier`)
+	assert.Error(t, err)
+}
+
+func TestDB_FuzzySearch(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_FuzzySearch")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	search := func(query string) []SearchHit {
+		p, err := d.FuzzySearch(query)
+		require.NoError(t, err)
+		var hits []SearchHit
+		for err, page := range p.All() {
+			require.NoError(t, err)
+			for _, entry := range page.Entries() {
+				hits = append(hits, entry.Val())
+			}
+		}
+		return hits
+	}
+	uids := func(query string) []string {
+		var uids []string
+		for _, hit := range search(query) {
+			uids = append(uids, hit.Uid)
+		}
+		return uids
+	}
+	require.NoError(t, d.Save("2025-11-24", index.Journal, "Réunion avec @Léa pour le &voyage.", model.Labels{"mood": "good"}))
+	require.NoError(t, d.Save("2025-11-25", index.Journal, "Billets de train réservés.", nil))
+	require.NoError(t, d.Save("trips", index.Document, "Liste des voyages en train", model.Labels{"mood": "good"}))
+
+	// Typos in terms and in topic and people names
+	assert.Equal(t, []string{"2025-11-24"}, uids("reunoin"))
+	assert.Equal(t, []string{"2025-11-24", "trips"}, uids("vojage"))
+	assert.Equal(t, []string{"2025-11-24"}, uids("lea"))
+	assert.Equal(t, []string{"2025-11-25", "trips"}, uids("trein"))
+	// Filters
+	assert.Equal(t, []string{"trips"}, uids("trein mood:good"))
+	assert.Equal(t, []string{"2025-11-24", "trips"}, uids("mood:good"))
+	assert.Equal(t, []string{"2025-11-25", "trips"}, uids("trein date:2025-11-25.."))
+	assert.Equal(t, []string{"2025-11-25"}, uids("trein date:2025-11-25"))
+	assert.Empty(t, uids("trein date:..2025-11-24"))
+
+	hits := search("reunoin lea")
+	require.Len(t, hits, 1)
+	assert.Equal(t, "[Réunion] avec [@Léa] pour le &voyage.", hits[0].Snippet.Highlight("[", "]"))
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+)
+
+// Topics mentioned by at least one bucket, sorted by name.
+func (d *DB) Topics() ([]string, error) {
+	return d.topicIdx.Topics()
+}
+
+// Count the mentions of a topic in all buckets.
+func (d *DB) CountMentions(topic string) (int, error) {
+	return d.topicIdx.CountMentions(strings.ToLower(topic))
+}
+
+// Paginate the buckets mentioning a topic, ordered by the date their mentions were saved.
+func (d *DB) Mentions(topic string, order model.Order) (model.Paginer[string, index.MentionRef], chan error) {
+	return d.topicIdx.Paginate(strings.ToLower(topic), order, 100)
+}
+
+// People mentioned by at least one bucket, sorted by lower cased name.
+func (d *DB) People() ([]string, error) {
+	return d.topicIdx.People()
+}
+
+// Paginate the buckets mentioning a person, ordered by the date their mentions were saved.
+func (d *DB) PersonMentions(name string, order model.Order) (model.Paginer[string, index.MentionRef], chan error) {
+	return d.topicIdx.Paginate(index.PersonKey(name), order, 100)
+}
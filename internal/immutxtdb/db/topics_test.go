@@ -0,0 +1,93 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Topics(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Topics")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+
+	mentioning := func(d *DB, topic string) []string {
+		p, _ := d.Mentions(topic, model.TopToBottom)
+		var uids []string
+		for err, page := range p.All() {
+			require.NoError(t, err)
+			for _, entry := range page.Entries() {
+				uids = append(uids, entry.Val().Uid)
+			}
+		}
+		return uids
+	}
+	require.NoError(t, a.Save("2025-11-24", index.Journal, "Billets pour &Rome.", nil))
+	require.NoError(t, a.Save("rome", index.Topic, "# &Rome\nVille de &Rome, voir &voyage", nil))
+	require.NoError(t, a.Save("2025-11-25", index.Journal, "Valise, &voyage demain", nil))
+	require.NoError(t, a.Save("2025-11-24", index.Journal, "Billets pour &Rome. Hôtel à &rome aussi", nil))
+
+	topics, err := a.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rome", "voyage"}, topics)
+	count, err := a.CountMentions("Rome")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	// Ordered by the date the mentions were saved
+	assert.Equal(t, []string{"rome", "2025-11-24"}, mentioning(a, "rome"))
+	assert.Equal(t, []string{"rome", "2025-11-25"}, mentioning(a, "voyage"))
+	p, _ := a.Mentions("rome", model.BottomToTop)
+	page, _, err := p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []int{13, 30}, page.Entries()[0].Val().Positions)
+
+	// Mentions removed by other devices
+	_, err = b.Refresh()
+	require.NoError(t, err)
+	require.NoError(t, b.Save("2025-11-25", index.Journal, "Valise", nil))
+	require.NoError(t, b.Delete("rome"))
+	_, err = a.Refresh()
+	require.NoError(t, err)
+	topics, err = a.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rome"}, topics)
+	assert.Equal(t, []string{"2025-11-24"}, mentioning(a, "rome"))
+	assert.Empty(t, mentioning(a, "voyage"))
+}
+
+func TestDB_People(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_People")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, d.Save("2025-11-24", index.Journal, "Dîner avec @Léa et @bob pour &voyage", nil))
+	require.NoError(t, d.Save("2025-11-25", index.Journal, "Appel de @léa le @2025-11-26", nil))
+
+	people, err := d.People()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob", "léa"}, people)
+	topics, err := d.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"voyage"}, topics)
+
+	p, _ := d.PersonMentions("Léa", model.TopToBottom)
+	var uids []string
+	for err, page := range p.All() {
+		require.NoError(t, err)
+		for _, entry := range page.Entries() {
+			uids = append(uids, entry.Val().Uid)
+		}
+	}
+	assert.Equal(t, []string{"2025-11-24", "2025-11-25"}, uids)
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+)
+
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+type stagedLayer struct {
+	uid   string
+	state model.State
+	layer *model.Layer
+}
+
+type stagedLabel struct {
+	uid, key, value string
+	state           model.State
+}
+
+type stagedMention struct {
+	uid, topic string
+	positions  []int
+}
+
+// Tx stage bucket, layer, label and mention adds to write them as one atomic unit:
+// after a crash either all of them are written or none.
+type Tx struct {
+	db         *DB
+	buckets    []index.BucketEntry
+	newBuckets []index.BucketEntry
+	layers     []stagedLayer
+	labels     []stagedLabel
+	mentions   []stagedMention
+	done       bool
+}
+
+func (d *DB) Begin() *Tx {
+	return &Tx{db: d}
+}
+
+func (t *Tx) AddBucket(uid string, s model.State) {
+	t.buckets = append(t.buckets, index.BucketEntry{Uid: uid, State: s})
+}
+
+// Add a bucket unless it holds layers when the tx is committed.
+func (t *Tx) AddBucketIfNew(uid string, s model.State) {
+	t.newBuckets = append(t.newBuckets, index.BucketEntry{Uid: uid, State: s})
+}
+
+func (t *Tx) AddLayer(uid string, s model.State, l *model.Layer) {
+	t.layers = append(t.layers, stagedLayer{uid: uid, state: s, layer: l})
+}
+
+// Label a bucket. The label is clocked with the layer staged for the bucket if any.
+func (t *Tx) Label(uid, key, value string) {
+	t.labels = append(t.labels, stagedLabel{uid: uid, key: key, value: value, state: index.Labeled})
+}
+
+// Unlabel a bucket. The label is clocked with the layer staged for the bucket if any.
+func (t *Tx) Unlabel(uid, key, value string) {
+	t.labels = append(t.labels, stagedLabel{uid: uid, key: key, value: value, state: index.Unlabeled})
+}
+
+// Record the positions of the mentions of a topic in a bucket, none if the bucket does not
+// mention it anymore. Mentions are clocked with the layer staged for the bucket if any.
+func (t *Tx) Mention(uid, topic string, positions []int) {
+	t.mentions = append(t.mentions, stagedMention{uid: uid, topic: topic, positions: positions})
+}
+
+func (t *Tx) Rollback() {
+	t.done = true
+}
+
+func (t *Tx) Commit() error {
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	d := t.db
+	// Once the db is unlocked: the live uids are computed holding the changes lock.
+	defer d.changes.touch(t.uids()...)
+	d.lock()
+	defer d.unlock()
+
+	// A previous commit which failed after logging its records is completed first: the
+	// checkpoint of this commit would drop them.
+	if len(d.wal.Pending()) > 0 {
+		err := d.writePending()
+		if err != nil {
+			return err
+		}
+	}
+	records, err := t.encode()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	// All records are logged in one wal frame before any write.
+	err = d.wal.Append(records...)
+	if err != nil {
+		return err
+	}
+	err = d.write(records)
+	if err != nil {
+		return err
+	}
+	return d.wal.Checkpoint()
+}
+
+// Uids of the buckets the tx may change.
+func (t *Tx) uids() []string {
+	var uids []string
+	for _, b := range slices.Concat(t.buckets, t.newBuckets) {
+		uids = append(uids, b.Uid)
+	}
+	for _, staged := range t.layers {
+		uids = append(uids, staged.uid)
+	}
+	return uids
+}
+
+// Encode staged adds as records. Caller must hold the db lock.
+func (t *Tx) encode() ([]wal.Record, error) {
+	d := t.db
+	buckets := t.buckets
+	for _, b := range t.newBuckets {
+		if d.layerIdx.CountKeyLocked(layerKey(b.Uid)) == 0 {
+			buckets = append(buckets, b)
+		}
+	}
+	records, err := d.bucketIdx.EncodeWords(buckets...)
+	if err != nil {
+		return nil, err
+	}
+	var layerEntries []index.LayerEntry
+	clocks := map[string]hlc.Timestamp{}
+	versions := map[string]int{}
+	for k, staged := range t.layers {
+		// A layer saved concurrently on the same base follows the layers written meanwhile.
+		if _, ok := versions[staged.uid]; !ok {
+			versions[staged.uid] = d.layerIdx.CountKeyLocked(layerKey(staged.uid))
+		}
+		versions[staged.uid]++
+		metadata := staged.layer.Metadata()
+		metadata.SetVersion(max(metadata.Version(), versions[staged.uid]))
+		payload, err := encodeLayer(staged.layer, d.blobs)
+		if err != nil {
+			return nil, err
+		}
+		blocId := d.data.count() + k
+		records = append(records, d.data.record(blocId, payload))
+		ref := model.NewClockedLayerRef(d.data.name(), blocId, staged.state, d.clock.Now())
+		layerEntries = append(layerEntries, index.LayerEntry{UidHash: layerKey(staged.uid), Ref: ref})
+		clocks[staged.uid] = ref.Clock()
+	}
+	layerRecords, err := d.layerIdx.EncodeWords(layerEntries...)
+	if err != nil {
+		return nil, err
+	}
+	var labelEntries []index.LabelEntry
+	for _, staged := range t.labels {
+		clock, ok := clocks[staged.uid]
+		if !ok {
+			clock = d.clock.Now()
+		}
+		ref := index.LabelRef{Uid: staged.uid, State: staged.state, Clock: clock}
+		labelEntries = append(labelEntries, index.LabelEntry{LabelHash: d.labelKey(staged.key, staged.value), Ref: ref})
+	}
+	labelRecords, err := d.labelIdx.EncodeWords(labelEntries...)
+	if err != nil {
+		return nil, err
+	}
+	var topicEntries []index.TopicEntry
+	for _, staged := range t.mentions {
+		clock, ok := clocks[staged.uid]
+		if !ok {
+			clock = d.clock.Now()
+		}
+		ref := index.MentionRef{Uid: staged.uid, Clock: clock, Count: len(staged.positions), Positions: staged.positions}
+		topicEntries = append(topicEntries, index.TopicEntry{Topic: staged.topic, Ref: ref})
+	}
+	topicRecords, err := d.topicIdx.EncodeWords(topicEntries...)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat(records, layerRecords, labelRecords, topicRecords), nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLayer(content string) *model.Layer {
+	return model.NewLayer(content, model.NewMetadata(1, time.Now(), nil))
+}
+
+func assertCounts(t *testing.T, d *DB, buckets, layers int) {
+	count, err := d.bucketIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, buckets, count, "bucket count")
+	count, err = d.layerIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, layers, count, "layer count")
+	assert.Equal(t, layers, d.data.count(), "layer data count")
+}
+
+func TestTx_Commit(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTx_Commit")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "test")
+	require.NoError(t, err)
+
+	tx := d.Begin()
+	tx.AddBucket("foo", index.Document)
+	tx.AddLayer("foo", index.Document, newLayer("foo v1"))
+	tx.AddLayer("foo", index.Document, newLayer("foo v2"))
+	require.NoError(t, tx.Commit())
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	assertCounts(t, d, 1, 2)
+
+	tx = d.Begin()
+	tx.AddBucket("bar", index.Document)
+	tx.Rollback()
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	assertCounts(t, d, 1, 2)
+
+	p, _ := d.layerIdx.PaginateAll(model.TopToBottom, 100)
+	page, _, err := p.Next()
+	require.NoError(t, err)
+	require.Equal(t, 2, page.Len())
+	assert.Equal(t, layerKey("foo"), page.Entries()[1].Key())
+	l, err := d.Layer(page.Entries()[1].Val())
+	require.NoError(t, err)
+	assert.Equal(t, "foo v2", l.Content())
+
+	require.NoError(t, d.Close())
+	d, err = Open(tmpDir, "test")
+	require.NoError(t, err)
+	assertCounts(t, d, 1, 2)
+}
+
+func TestTx_RecoverCommitedTx(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTx_RecoverCommitedTx")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "test")
+	require.NoError(t, err)
+	tx := d.Begin()
+	tx.AddBucket("foo", index.Document)
+	tx.AddLayer("foo", index.Document, newLayer("foo v1"))
+
+	// Crash after the tx was logged, before any write
+	d.lock()
+	records, err := tx.encode()
+	require.NoError(t, err)
+	require.NoError(t, d.wal.Append(records...))
+	d.unlock()
+	require.NoError(t, d.Close())
+
+	d, err = Open(tmpDir, "test")
+	require.NoError(t, err)
+	assertCounts(t, d, 1, 1)
+	assert.Empty(t, d.wal.Pending())
+}
+
+func TestTx_DiscardTornTx(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTx_DiscardTornTx")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "test")
+	require.NoError(t, err)
+	tx := d.Begin()
+	tx.AddBucket("foo", index.Document)
+	tx.AddLayer("foo", index.Document, newLayer("foo v1"))
+
+	// Crash while the tx was logged
+	d.lock()
+	records, err := tx.encode()
+	require.NoError(t, err)
+	require.NoError(t, d.wal.Append(records...))
+	d.unlock()
+	require.NoError(t, d.Close())
+	walPath := filepath.Join(tmpDir, "db-test.wal")
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(walPath, info.Size()-10))
+
+	d, err = Open(tmpDir, "test")
+	require.NoError(t, err)
+	assertCounts(t, d, 0, 0)
+}
+
+var errInjected = errors.New("injected fault")
+
+// A backend whose layer idx files fail their appends while failing is set.
+type failingBackend struct {
+	storage.Backend
+	failing bool
+}
+
+func (b *failingBackend) Open(name string) (storage.Storage, error) {
+	st, err := b.Backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingStorage{Storage: st, backend: b}, nil
+}
+
+type failingStorage struct {
+	storage.Storage
+	backend *failingBackend
+}
+
+func (s *failingStorage) Append(data []byte) error {
+	if s.backend.failing && strings.HasPrefix(filepath.Base(s.Name()), "layer-") {
+		return errInjected
+	}
+	return s.Storage.Append(data)
+}
+
+func TestTx_CompleteFailedTx(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTx_CompleteFailedTx")
+	defer os.RemoveAll(tmpDir)
+
+	b := &failingBackend{Backend: storage.NewMemory(256)}
+	d, err := Open(tmpDir, "test", WithIndexBackend(b))
+	require.NoError(t, err)
+
+	// The bucket and the layer data are written, not the layer word
+	b.failing = true
+	tx := d.Begin()
+	tx.AddBucket("foo", index.Document)
+	tx.AddLayer("foo", index.Document, newLayer("foo v1"))
+	assert.ErrorIs(t, tx.Commit(), errInjected)
+	count, err := d.layerIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// The next commit completes it before its own writes
+	b.failing = false
+	tx = d.Begin()
+	tx.AddBucket("bar", index.Document)
+	tx.AddLayer("bar", index.Document, newLayer("bar v1"))
+	require.NoError(t, tx.Commit())
+	assertCounts(t, d, 2, 2)
+	assert.Empty(t, d.wal.Pending())
+	assert.Equal(t, "foo v1", projectContent(t, d, "foo"))
+	assert.Equal(t, "bar v1", projectContent(t, d, "bar"))
+}
+
+func TestDB_Save(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Save")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "test")
+	require.NoError(t, err)
+	require.NoError(t, d.Save("foo", index.Document, "foo v1", nil))
+	require.NoError(t, d.Save("foo", index.Document, "foo v2", model.Labels{"topic": "bar"}))
+	assertCounts(t, d, 1, 2)
+}
+
+func TestDB_ConcurrentSaves(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_ConcurrentSaves")
+	defer os.RemoveAll(tmpDir)
+
+	d, err := Open(tmpDir, "test")
+	require.NoError(t, err)
+	// Both saves see a new bucket
+	base, err := d.Bucket("foo")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for _, content := range []string{"foo a", "foo b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, d.save(base, index.Document, content, nil))
+		}()
+	}
+	wg.Wait()
+	assertCounts(t, d, 1, 2)
+
+	b, err := d.Bucket("foo")
+	require.NoError(t, err)
+	var versions []int
+	for _, ref := range b.Layers() {
+		l, err := d.Layer(ref)
+		require.NoError(t, err)
+		versions = append(versions, l.Metadata().Version())
+	}
+	assert.ElementsMatch(t, []int{1, 2}, versions)
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+)
+
+// A db directory replicated by a third party tool (Syncthing, rsync, ...) see files of other
+// devices appear and grow underneath the open db. Refresh loads them, and resolve the conflict
+// copies the replication tool may leave behind.
+
+// Syncthing conflict copies are named NAME.sync-conflict-DATE-TIME-DEVICE.EXT
+var syncConflictRegexp = regexp.MustCompile(`^(.+)\.sync-conflict-[^.]+(\.[^.]+)?$`)
+
+const quarantineDirname = "sync-conflicts"
+
+type Resolution int
+
+const (
+	// The copy held nothing more than the original: it was removed.
+	ConflictRemoved Resolution = iota
+	// The copy extended the original of another device: it replaced the original.
+	ConflictReplaced
+	// The copy diverged from the original: it was moved into the sync-conflicts directory.
+	ConflictQuarantined
+)
+
+type ConflictCopy struct {
+	Name       string
+	Original   string
+	Resolution Resolution
+}
+
+// Device owning a db file name, empty if the name is not an idx or a layer data file name.
+func fileDevice(name string) string {
+	if m := layerDataFilenameRegexp.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	device, _ := index.IdxFilenameDevice(name)
+	return device
+}
+
+// Resolve the conflict copies of db files. Files are only appended to, so a copy which is a
+// prefix of its original can be dropped. A longer copy of another device file can replace its
+// original, but this device files are never replaced: this device is their only writer.
+func (d *DB) resolveConflictCopies() ([]ConflictCopy, error) {
+	entries, err := os.ReadDir(d.rootPath)
+	if err != nil {
+		return nil, err
+	}
+	var copies []ConflictCopy
+	for _, entry := range entries {
+		m := syncConflictRegexp.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		c := ConflictCopy{Name: entry.Name(), Original: m[1] + m[2]}
+		path := filepath.Join(d.rootPath, c.Name)
+		originalPath := filepath.Join(d.rootPath, c.Original)
+		device := fileDevice(c.Original)
+		if device == "" {
+			// Stats sidecars and wal are local to each device.
+			if filepath.Ext(c.Original) == ".stats" || filepath.Ext(c.Original) == ".wal" {
+				copies = append(copies, c)
+				err = os.Remove(path)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		original, err := os.ReadFile(originalPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		switch {
+		case bytes.HasPrefix(original, content):
+			c.Resolution = ConflictRemoved
+			err = os.Remove(path)
+		case bytes.HasPrefix(content, original) && device != d.device:
+			c.Resolution = ConflictReplaced
+			err = os.Rename(path, originalPath)
+		default:
+			c.Resolution = ConflictQuarantined
+			err = os.MkdirAll(filepath.Join(d.rootPath, quarantineDirname), 0700)
+			if err == nil {
+				err = os.Rename(path, filepath.Join(d.rootPath, quarantineDirname, c.Name))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	return copies, nil
+}
+
+// Changes found by a refresh.
+type Event struct {
+	// Names of other devices idx files which appeared or grew.
+	Files     []string
+	Conflicts []ConflictCopy
+	Err       error
+}
+
+func (e Event) empty() bool {
+	return len(e.Files) == 0 && len(e.Conflicts) == 0 && e.Err == nil
+}
+
+// Load files of other devices which appeared or grew underneath the db since it was opened or
+// last refreshed, after resolving sync conflict copies.
+func (d *DB) Refresh() (Event, error) {
+	var e Event
+	var err error
+	e.Conflicts, err = d.resolveConflictCopies()
+	if err != nil {
+		return e, err
+	}
+	buckets, err := d.bucketIdx.Refresh()
+	if err != nil {
+		return e, err
+	}
+	layers, err := d.layerIdx.Refresh()
+	if err != nil {
+		return e, err
+	}
+	labels, err := d.labelIdx.Refresh()
+	if err != nil {
+		return e, err
+	}
+	topics, err := d.topicIdx.Refresh()
+	if err != nil {
+		return e, err
+	}
+	e.Files = slices.Concat(buckets, layers, labels, topics)
+	if !e.empty() {
+		d.changes.touchAll()
+	}
+	// Next layers written on this device will follow the new layers.
+	d.clock.Update(d.layerIdx.MaxClock())
+	return e, nil
+}
+
+// Watcher refresh a db periodically and notify its subscribers of the changes.
+type Watcher struct {
+	*sync.Mutex
+	db          *DB
+	interval    time.Duration
+	subscribers []chan Event
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// Poll the db directory every interval until the watcher is closed.
+func (d *DB) Watch(interval time.Duration) *Watcher {
+	w := &Watcher{
+		Mutex:    &sync.Mutex{},
+		db:       d,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			e, err := w.db.Refresh()
+			e.Err = err
+			if !e.empty() {
+				w.notify(e)
+			}
+		}
+	}
+}
+
+// Events are dropped for a subscriber which does not consume them.
+func (w *Watcher) notify(e Event) {
+	w.Lock()
+	defer w.Unlock()
+	for _, s := range w.subscribers {
+		select {
+		case s <- e:
+		default:
+		}
+	}
+}
+
+// Receive the changes found by the next refreshes. The channel is closed with the watcher.
+func (w *Watcher) Subscribe() <-chan Event {
+	w.Lock()
+	defer w.Unlock()
+	s := make(chan Event, 16)
+	w.subscribers = append(w.subscribers, s)
+	return s
+}
+
+func (w *Watcher) Close() {
+	close(w.stop)
+	<-w.done
+	w.Lock()
+	defer w.Unlock()
+	for _, s := range w.subscribers {
+		close(s)
+	}
+	w.subscribers = nil
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Replicate device files of a db directory into another one, like Syncthing would.
+func replicate(t *testing.T, from, to string) {
+	entries, err := os.ReadDir(from)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if fileDevice(entry.Name()) == "" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(from, entry.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(to, entry.Name()), content, 0600))
+	}
+}
+
+func TestDB_Refresh(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Refresh")
+	defer os.RemoveAll(tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+
+	a, err := Open(dirA, "a")
+	require.NoError(t, err)
+	b, err := Open(dirB, "b")
+	require.NoError(t, err)
+	e, err := b.Refresh()
+	require.NoError(t, err)
+	assert.Empty(t, e.Files)
+
+	require.NoError(t, a.Save("foo", index.Document, "foo", nil))
+	replicate(t, dirA, dirB)
+	e, err = b.Refresh()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"bucket-a-001.idx", "layer-a-001.idx"}, e.Files)
+	assert.Equal(t, "foo", projectContent(t, b, "foo"))
+
+	// Grown files
+	require.NoError(t, a.Save("foo", index.Document, "foo v2", nil))
+	replicate(t, dirA, dirB)
+	e, err = b.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"layer-a-001.idx"}, e.Files)
+	assert.Equal(t, "foo v2", projectContent(t, b, "foo"))
+
+	// Nothing changed
+	e, err = b.Refresh()
+	require.NoError(t, err)
+	assert.Empty(t, e.Files)
+
+	// Layers of b follow refreshed layers
+	require.NoError(t, b.Save("foo", index.Document, "foo from b", nil))
+	assert.Equal(t, "foo from b", projectContent(t, b, "foo"))
+}
+
+func TestDB_ResolveConflictCopies(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_ResolveConflictCopies")
+	defer os.RemoveAll(tmpDir)
+
+	b, err := Open(tmpDir, "b")
+	require.NoError(t, err)
+	write := func(name, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0600))
+	}
+	write("data-a-001.dat", "foobar")
+	write("data-a-001.sync-conflict-20251124-101010-ABCDEFG.dat", "foo")
+	write("data-c-001.dat", "foo")
+	write("data-c-001.sync-conflict-20251124-101010-ABCDEFG.dat", "foobar")
+	write("data-d-001.dat", "foo")
+	write("data-d-001.sync-conflict-20251124-101010-ABCDEFG.dat", "baz")
+	write("data-b-001.dat", "foo")
+	write("data-b-001.sync-conflict-20251124-101010-ABCDEFG.dat", "foobar")
+	write("layer-a-001.idx.sync-conflict-20251124-101010-ABCDEFG.stats", "stats")
+
+	e, err := b.Refresh()
+	require.NoError(t, err)
+	resolutions := map[string]Resolution{}
+	for _, c := range e.Conflicts {
+		resolutions[c.Original] = c.Resolution
+	}
+	assert.Equal(t, map[string]Resolution{
+		"data-a-001.dat":        ConflictRemoved,
+		"data-c-001.dat":        ConflictReplaced,
+		"data-d-001.dat":        ConflictQuarantined,
+		"data-b-001.dat":        ConflictQuarantined,
+		"layer-a-001.idx.stats": ConflictRemoved,
+	}, resolutions)
+
+	read := func(path ...string) string {
+		content, err := os.ReadFile(filepath.Join(append([]string{tmpDir}, path...)...))
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Equal(t, "foobar", read("data-a-001.dat"))
+	assert.Equal(t, "foobar", read("data-c-001.dat"))
+	assert.Equal(t, "foo", read("data-d-001.dat"))
+	assert.Equal(t, "baz", read(quarantineDirname, "data-d-001.sync-conflict-20251124-101010-ABCDEFG.dat"))
+	// This device files are never replaced
+	assert.Equal(t, "foo", read("data-b-001.dat"))
+
+	matches, err := filepath.Glob(filepath.Join(tmpDir, "*.sync-conflict-*"))
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestDB_Watch(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDB_Watch")
+	defer os.RemoveAll(tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+
+	a, err := Open(dirA, "a")
+	require.NoError(t, err)
+	b, err := Open(dirB, "b")
+	require.NoError(t, err)
+	w := b.Watch(5 * time.Millisecond)
+	events := w.Subscribe()
+
+	require.NoError(t, a.Save("foo", index.Document, "foo", nil))
+	replicate(t, dirA, dirB)
+	var files []string
+	timeout := time.After(2 * time.Second)
+	for len(files) < 2 {
+		select {
+		case e := <-events:
+			require.NoError(t, e.Err)
+			files = append(files, e.Files...)
+		case <-timeout:
+			require.FailNow(t, "no event received")
+		}
+	}
+	assert.ElementsMatch(t, []string{"bucket-a-001.idx", "layer-a-001.idx"}, files)
+	assert.Equal(t, "foo", projectContent(t, b, "foo"))
+
+	w.Close()
+	_, ok := <-events
+	assert.False(t, ok)
+}
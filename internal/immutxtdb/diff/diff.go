@@ -0,0 +1,127 @@
+package diff
+
+// Myers diff of two sequences.
+
+type Op int
+
+const (
+	Equal Op = iota
+	Insert
+	Delete
+)
+
+// An edit transforming a[AStart:AEnd] into b[BStart:BEnd].
+// Equal and Delete edits cover a range of a, Equal and Insert edits cover a range of b.
+type Edit struct {
+	Op     Op
+	AStart int
+	AEnd   int
+	BStart int
+	BEnd   int
+}
+
+// Compute a minimal edit script transforming a into b. Consecutive edits of same Op are merged.
+func Diff[T comparable](a, b []T) []Edit {
+	// Trim common prefix and suffix, they are frequent in text edits.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	push := func(op Op, aStart, aEnd, bStart, bEnd int) {
+		if aStart == aEnd && bStart == bEnd {
+			return
+		}
+		if n := len(edits); n > 0 && edits[n-1].Op == op && edits[n-1].AEnd == aStart && edits[n-1].BEnd == bStart {
+			edits[n-1].AEnd = aEnd
+			edits[n-1].BEnd = bEnd
+			return
+		}
+		edits = append(edits, Edit{Op: op, AStart: aStart, AEnd: aEnd, BStart: bStart, BEnd: bEnd})
+	}
+
+	push(Equal, 0, prefix, 0, prefix)
+	for _, e := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		push(e.Op, e.AStart+prefix, e.AEnd+prefix, e.BStart+prefix, e.BEnd+prefix)
+	}
+	push(Equal, len(a)-suffix, len(a), len(b)-suffix, len(b))
+	return edits
+}
+
+func myers[T comparable](a, b []T) []Edit {
+	n, m := len(a), len(b)
+	maxD := n + m
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+	found := false
+	for d := 0; d <= maxD && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	trace = append(trace, v)
+
+	// Backtrack from the end to build the edit script.
+	var reversed []Edit
+	x, y := n, m
+	for d := len(trace) - 2; d >= 0 && (x > 0 || y > 0); d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, Edit{Op: Equal, AStart: x - 1, AEnd: x, BStart: y - 1, BEnd: y})
+			x--
+			y--
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			reversed = append(reversed, Edit{Op: Insert, AStart: x, AEnd: x, BStart: y - 1, BEnd: y})
+		} else {
+			reversed = append(reversed, Edit{Op: Delete, AStart: x - 1, AEnd: x, BStart: y, BEnd: y})
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]Edit, 0, len(reversed))
+	for k := len(reversed) - 1; k >= 0; k-- {
+		e := reversed[k]
+		if n := len(edits); n > 0 && edits[n-1].Op == e.Op && edits[n-1].AEnd == e.AStart && edits[n-1].BEnd == e.BStart {
+			edits[n-1].AEnd = e.AEnd
+			edits[n-1].BEnd = e.BEnd
+			continue
+		}
+		edits = append(edits, e)
+	}
+	return edits
+}
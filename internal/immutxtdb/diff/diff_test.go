@@ -0,0 +1,100 @@
+package diff
+
+import (
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Apply edits on a, checking they rebuild b.
+func apply(a, b []rune, edits []Edit) string {
+	out := &strings.Builder{}
+	for _, e := range edits {
+		switch e.Op {
+		case Equal:
+			out.WriteString(string(a[e.AStart:e.AEnd]))
+		case Insert:
+			out.WriteString(string(b[e.BStart:e.BEnd]))
+		}
+	}
+	return out.String()
+}
+
+func TestDiff(t *testing.T) {
+	cases := []struct {
+		a, b string
+		ops  []Op
+	}{
+		{"", "", nil},
+		{"abc", "abc", []Op{Equal}},
+		{"", "abc", []Op{Insert}},
+		{"abc", "", []Op{Delete}},
+		{"abcdef", "abXdef", []Op{Equal, Delete, Insert, Equal}},
+		{"abcabba", "cbabac", nil},
+		{"le chat dort", "le chien dort", nil},
+		{"été", "étés", []Op{Equal, Insert}},
+	}
+	for _, c := range cases {
+		a, b := []rune(c.a), []rune(c.b)
+		edits := Diff(a, b)
+		assert.Equal(t, c.b, apply(a, b, edits), "diff %q -> %q", c.a, c.b)
+		if c.ops != nil {
+			var ops []Op
+			for _, e := range edits {
+				ops = append(ops, e.Op)
+			}
+			assert.Equal(t, c.ops, ops, "diff %q -> %q", c.a, c.b)
+		}
+	}
+}
+
+func TestDiff_Minimal(t *testing.T) {
+	a, b := []rune("abcabba"), []rune("cbabac")
+	changes := 0
+	for _, e := range Diff(a, b) {
+		if e.Op != Equal {
+			changes += (e.AEnd - e.AStart) + (e.BEnd - e.BStart)
+		}
+	}
+	assert.Equal(t, 5, changes)
+}
+
+func TestDiff_Lines(t *testing.T) {
+	a := strings.Split("foo\nbar\nbaz", "\n")
+	b := strings.Split("foo\nbaz\nqux", "\n")
+	edits := Diff(a, b)
+	assert.Equal(t, []Edit{
+		{Op: Equal, AStart: 0, AEnd: 1, BStart: 0, BEnd: 1},
+		{Op: Delete, AStart: 1, AEnd: 2, BStart: 1, BEnd: 1},
+		{Op: Equal, AStart: 2, AEnd: 3, BStart: 1, BEnd: 2},
+		{Op: Insert, AStart: 3, AEnd: 3, BStart: 2, BEnd: 3},
+	}, edits)
+}
+
+func TestDiff_Random(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	randomString := func() []rune {
+		s := make([]rune, r.IntN(20))
+		for k := range s {
+			s[k] = rune('a' + r.IntN(3))
+		}
+		return s
+	}
+	for range 500 {
+		a, b := randomString(), randomString()
+		assert.Equal(t, string(b), apply(a, b, Diff(a, b)), "diff %q -> %q", string(a), string(b))
+	}
+}
+
+func TestLines(t *testing.T) {
+	assert.Equal(t, []Line{
+		{Op: Equal, Text: "foo"},
+		{Op: Delete, Text: "bar"},
+		{Op: Equal, Text: "baz"},
+		{Op: Insert, Text: "qux"},
+	}, Lines("foo\nbar\nbaz\n", "foo\nbaz\nqux\n"))
+	assert.Equal(t, []Line{{Op: Insert, Text: "foo"}}, Lines("", "foo"))
+	assert.Empty(t, Lines("", ""))
+}
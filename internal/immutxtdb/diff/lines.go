@@ -0,0 +1,36 @@
+package diff
+
+import "strings"
+
+// A line of a line diff, without its line feed.
+type Line struct {
+	Op   Op
+	Text string
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Diff the lines of two texts: Equal lines are in both, Delete lines only in a, Insert lines
+// only in b.
+func Lines(a, b string) []Line {
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	var lines []Line
+	for _, e := range Diff(aLines, bLines) {
+		if e.Op == Insert {
+			for _, text := range bLines[e.BStart:e.BEnd] {
+				lines = append(lines, Line{Op: e.Op, Text: text})
+			}
+			continue
+		}
+		for _, text := range aLines[e.AStart:e.AEnd] {
+			lines = append(lines, Line{Op: e.Op, Text: text})
+		}
+	}
+	return lines
+}
@@ -70,6 +70,9 @@ func (e asciiEncoder) Decode(buf []byte) (int, model.State, string, error) {
 }
 
 func (e asciiEncoder) DecodeLastWord(buf []byte) (int, model.State, string, error) {
+	if len(buf) < e.wordSize() {
+		return 0, nil, "", fmt.Errorf("cannot decode last word of data of length: %d < wordSize: %d", len(buf), e.wordSize())
+	}
 	lastWordStart := (len(buf)/e.wordSize() - 1) * e.wordSize()
 	return e.Decode(buf[lastWordStart:])
 }
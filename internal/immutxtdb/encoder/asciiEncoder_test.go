@@ -130,4 +130,8 @@ func TestEncoder_AsciiEncoder(t *testing.T) {
 	assert.Equal(t, 2, seq)
 	assert.Equal(t, expectedState3, s)
 	assert.Equal(t, expectedText3, text)
+
+	// A torn word alone in its bloc
+	_, _, _, err = e3.DecodeLastWord(bufs[:10])
+	assert.Error(t, err)
 }
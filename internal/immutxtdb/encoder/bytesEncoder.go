@@ -106,6 +106,9 @@ func (e *bytesEncoder) Decode(buf []byte) (int, model.State, []byte, error) {
 }
 
 func (e *bytesEncoder) DecodeLastWord(buf []byte) (int, model.State, []byte, error) {
+	if len(buf) < e.wordSize() {
+		return 0, nil, nil, fmt.Errorf("cannot decode last word of data of length: %d < wordSize: %d", len(buf), e.wordSize())
+	}
 	lastWordStart := (len(buf)/e.wordSize() - 1) * e.wordSize()
 	return e.Decode(buf[lastWordStart:])
 }
@@ -0,0 +1,350 @@
+package gitsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sync a db root with a git remote.
+// Each device only appends to its own files (KIND-DEVICE-NNN), so merging the devices commits
+// never conflicts, even between histories started on different devices. Files of other devices
+// pulled from the remote must only have grown, or have been superseded by a new rotation when
+// their device compacted its files: a rewritten file is refused and the pull is rolled back
+// before anything is pushed.
+// Device local files (wal, stats sidecars) are not synced.
+// Synced files are the db files as they are on disk: layer data and blobs are not encrypted.
+// Only local remotes (paths, file:// urls) are synced, unless untrusted remotes are allowed
+// explicitly. Encrypted notes are exchanged through an untrusted remote with patches instead.
+
+var (
+	ErrNotAppendOnly   = errors.New("files were not only appended to")
+	ErrUntrustedRemote = errors.New("remote is not local, synced files are not encrypted")
+)
+
+// Files owned by a device: KIND-DEVICE-NNN.EXT
+var deviceFileRegexp = regexp.MustCompile(`^(bucket|layer|label|topic|data)-(.+)-(\d{3})\.(idx|dat)$`)
+
+const gitignore = "*.wal\n*.stats\n*.tmp\n"
+
+const (
+	DefaultRemote = "origin"
+	DefaultBranch = "main"
+)
+
+type Driver struct {
+	dir    string
+	device string
+	remote string
+	branch string
+	// Allow pushing to a remote which is not local.
+	untrusted bool
+	now       func() time.Time
+}
+
+type Option func(*Driver)
+
+func WithRemote(remote string) Option {
+	return func(d *Driver) {
+		d.remote = remote
+	}
+}
+
+func WithBranch(branch string) Option {
+	return func(d *Driver) {
+		d.branch = branch
+	}
+}
+
+// Allow syncing with a remote which is not local, pushing unencrypted db files to it.
+func WithUntrustedRemote() Option {
+	return func(d *Driver) {
+		d.untrusted = true
+	}
+}
+
+func NewDriver(dir, device string, opts ...Option) *Driver {
+	d := &Driver{
+		dir:    dir,
+		device: device,
+		remote: DefaultRemote,
+		branch: DefaultBranch,
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Summary of a sync.
+type Summary struct {
+	// Files committed, they should only be files of this device.
+	Committed []string
+	// Files of other devices pulled, with their count of appended bytes.
+	Pulled map[string]int64
+	Pushed bool
+}
+
+func (s Summary) String() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "committed %d file(s)", len(s.Committed))
+	names := make([]string, 0, len(s.Pulled))
+	for name := range s.Pulled {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	fmt.Fprintf(sb, ", pulled %d file(s)", len(names))
+	for _, name := range names {
+		fmt.Fprintf(sb, "\n  %s +%d bytes", name, s.Pulled[name])
+	}
+	if s.Pushed {
+		sb.WriteString("\npushed")
+	}
+	return sb.String()
+}
+
+func (d *Driver) git(args ...string) (string, error) {
+	identity := []string{
+		"-c", "user.name=" + d.device,
+		"-c", "user.email=" + d.device + "@tui-journal",
+		"-c", "commit.gpgsign=false",
+	}
+	cmd := exec.Command("git", append(identity, args...)...)
+	cmd.Dir = d.dir
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Init the db root as a git repository tracking the remote url, if it is not one already.
+func (d *Driver) Init(url string) error {
+	err := os.MkdirAll(d.dir, 0700)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, ".git")); err == nil {
+		return nil
+	}
+	for _, args := range [][]string{
+		{"init"},
+		{"symbolic-ref", "HEAD", "refs/heads/" + d.branch},
+		{"remote", "add", d.remote, url},
+	} {
+		_, err := d.git(args...)
+		if err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(d.dir, ".gitignore"), []byte(gitignore), 0600)
+}
+
+type fileState struct {
+	size int64
+	hash [sha256.Size]byte
+}
+
+// Size and hash of the device files of the db root, by file name.
+func (d *Driver) snapshot() (map[string]fileState, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	states := map[string]fileState{}
+	for _, entry := range entries {
+		if entry.IsDir() || !deviceFileRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(d.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		states[entry.Name()] = fileState{size: int64(len(content)), hash: sha256.Sum256(content)}
+	}
+	return states, nil
+}
+
+// Check files only grew or were superseded since the snapshot, and this device files were not
+// changed at all.
+// Return the count of bytes appended to each grown file.
+func (d *Driver) verify(before map[string]fileState) (map[string]int64, error) {
+	grown := map[string]int64{}
+	var rewritten []string
+	after, err := d.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok && !d.superseded(name, after) {
+			rewritten = append(rewritten, name)
+		}
+	}
+	for name, state := range after {
+		old, existed := before[name]
+		if existed && state == old {
+			continue
+		}
+		if deviceFileRegexp.FindStringSubmatch(name)[2] == d.device {
+			rewritten = append(rewritten, name)
+			continue
+		}
+		if existed {
+			prefix, err := readPrefix(filepath.Join(d.dir, name), old.size)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(prefix)) < old.size || sha256.Sum256(prefix) != old.hash {
+				rewritten = append(rewritten, name)
+				continue
+			}
+		}
+		grown[name] = state.size - old.size
+	}
+	if len(rewritten) > 0 {
+		slices.Sort(rewritten)
+		return nil, fmt.Errorf("%w: %s", ErrNotAppendOnly, strings.Join(rewritten, ", "))
+	}
+	return grown, nil
+}
+
+// Whether a file of another device is superseded by a newer rotation of the same kind: the
+// device compacted its files and removed the previous rotation.
+func (d *Driver) superseded(name string, files map[string]fileState) bool {
+	m := deviceFileRegexp.FindStringSubmatch(name)
+	if m[2] == d.device {
+		return false
+	}
+	for other := range files {
+		o := deviceFileRegexp.FindStringSubmatch(other)
+		if o[1] == m[1] && o[2] == m[2] && o[3] > m[3] {
+			return true
+		}
+	}
+	return false
+}
+
+func readPrefix(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, size))
+}
+
+// Undo a pull: move back to the head before the pull, dropping an unfinished merge. Without a
+// head before the pull, the pulled files are removed and the branch is left unborn again.
+func (d *Driver) rollback(head string) error {
+	if head != "" {
+		_, err := d.git("reset", "--hard", "--quiet", head)
+		return err
+	}
+	if _, err := d.git("rev-parse", "--verify", "--quiet", "MERGE_HEAD"); err == nil {
+		_, err = d.git("merge", "--abort")
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := d.git("rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		// The pull did not create the branch.
+		return nil
+	}
+	_, err := d.git("rm", "-r", "--force", "--quiet", ".")
+	if err != nil {
+		return err
+	}
+	_, err = d.git("update-ref", "-d", "HEAD")
+	return err
+}
+
+// Whether a git remote url is a path or a file:// url. Git reads other urls without a scheme,
+// with a colon before any slash, as scp-like host:path urls.
+func localURL(url string) bool {
+	if strings.HasPrefix(url, "file://") {
+		return true
+	}
+	if strings.Contains(url, "://") {
+		return false
+	}
+	colon := strings.Index(url, ":")
+	slash := strings.Index(url, "/")
+	return colon < 0 || (slash >= 0 && slash < colon)
+}
+
+// Commit this device files, pull other devices files, verify they only grew, then push.
+// If the pull or the verification fails, the pull is rolled back and nothing is pushed.
+// A remote which is not local is refused unless untrusted remotes are allowed.
+func (d *Driver) Sync() (*Summary, error) {
+	summary := &Summary{Pulled: map[string]int64{}}
+
+	url, err := d.git("remote", "get-url", d.remote)
+	if err != nil {
+		return nil, err
+	}
+	if !d.untrusted && !localURL(url) {
+		return nil, fmt.Errorf("%w: %s", ErrUntrustedRemote, url)
+	}
+
+	_, err = d.git("add", "--all")
+	if err != nil {
+		return nil, err
+	}
+	changed, err := d.git("diff", "--cached", "--name-only")
+	if err != nil {
+		return nil, err
+	}
+	if changed != "" {
+		summary.Committed = strings.Split(changed, "\n")
+		_, err = d.git("commit", "--quiet", "-m", fmt.Sprintf("Sync %s at %s", d.device, d.now().Format(time.RFC3339)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	remoteHeads, err := d.git("ls-remote", "--heads", d.remote, d.branch)
+	if err != nil {
+		return nil, err
+	}
+	if remoteHeads != "" {
+		before, err := d.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		// Empty if nothing was ever committed locally.
+		head, _ := d.git("rev-parse", "--verify", "--quiet", "HEAD")
+		_, err = d.git("pull", "--quiet", "--no-rebase", "--no-edit", "--allow-unrelated-histories", d.remote, d.branch)
+		if err == nil {
+			summary.Pulled, err = d.verify(before)
+		}
+		if err != nil {
+			// A conflicting pull leaves the merge unfinished, it must not be committed by the
+			// next sync.
+			return nil, errors.Join(err, d.rollback(head))
+		}
+	}
+
+	if _, err := d.git("rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		// Nothing committed yet on any device.
+		return summary, nil
+	}
+	_, err = d.git("push", "--quiet", d.remote, "HEAD:refs/heads/"+d.branch)
+	if err != nil {
+		return nil, err
+	}
+	summary.Pushed = true
+	return summary, nil
+}
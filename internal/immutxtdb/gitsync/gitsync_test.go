@@ -0,0 +1,249 @@
+package gitsync
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupRemote(t *testing.T, tmpDir string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	remote := filepath.Join(tmpDir, "remote.git")
+	out, err := exec.Command("git", "init", "--bare", "--quiet", remote).CombinedOutput()
+	require.NoError(t, err, string(out))
+	return remote
+}
+
+func TestDriver_Sync(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDriver_Sync")
+	defer os.RemoveAll(tmpDir)
+	remote := setupRemote(t, tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+
+	a, err := db.Open(dirA, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo from a", nil))
+	syncA := NewDriver(dirA, "a")
+	require.NoError(t, syncA.Init(remote))
+	summary, err := syncA.Sync()
+	require.NoError(t, err)
+	assert.Contains(t, summary.Committed, "layer-a-001.idx")
+	assert.NotContains(t, summary.Committed, "layer-a.wal")
+	assert.Empty(t, summary.Pulled)
+	assert.True(t, summary.Pushed)
+
+	b, err := db.Open(dirB, "b")
+	require.NoError(t, err)
+	require.NoError(t, b.Save("bar", index.Document, "bar from b", nil))
+	syncB := NewDriver(dirB, "b")
+	require.NoError(t, syncB.Init(remote))
+	summary, err = syncB.Sync()
+	require.NoError(t, err)
+	assert.Contains(t, summary.Pulled, "layer-a-001.idx")
+	assert.True(t, summary.Pushed)
+
+	// b sees layers of a once reopened
+	b, err = db.Open(dirB, "b")
+	require.NoError(t, err)
+	bucket, err := b.Bucket("foo")
+	require.NoError(t, err)
+	doc, err := bucket.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "foo from a", doc.Content())
+
+	// a pulls b files, nothing new to commit
+	summary, err = syncA.Sync()
+	require.NoError(t, err)
+	assert.Empty(t, summary.Committed)
+	assert.Contains(t, summary.Pulled, "layer-b-001.idx")
+	assert.NotContains(t, summary.Pulled, "layer-a-001.idx")
+	assert.Contains(t, summary.String(), "layer-b-001.idx")
+}
+
+func TestDriver_RefuseRewrittenFiles(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDriver_RefuseRewrittenFiles")
+	defer os.RemoveAll(tmpDir)
+	remote := setupRemote(t, tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+
+	a, err := db.Open(dirA, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo from a", nil))
+	syncA := NewDriver(dirA, "a")
+	require.NoError(t, syncA.Init(remote))
+	_, err = syncA.Sync()
+	require.NoError(t, err)
+
+	syncB := NewDriver(dirB, "b")
+	require.NoError(t, syncB.Init(remote))
+	_, err = syncB.Sync()
+	require.NoError(t, err)
+	original, err := os.ReadFile(filepath.Join(dirB, "data-a-001.dat"))
+	require.NoError(t, err)
+
+	// Device a history is rewritten
+	require.NoError(t, os.WriteFile(filepath.Join(dirA, "data-a-001.dat"), []byte("rewritten"), 0600))
+	_, err = syncA.Sync()
+	require.NoError(t, err)
+
+	_, err = syncB.Sync()
+	assert.ErrorIs(t, err, ErrNotAppendOnly)
+	content, err := os.ReadFile(filepath.Join(dirB, "data-a-001.dat"))
+	require.NoError(t, err)
+	assert.Equal(t, original, content)
+
+	// Files of b are not changed by other devices
+	require.NoError(t, os.WriteFile(filepath.Join(dirB, "bucket-b-001.idx"), []byte("b"), 0600))
+	_, err = NewDriver(dirB, "b").Sync()
+	assert.ErrorIs(t, err, ErrNotAppendOnly)
+}
+
+func TestDriver_SyncCompactedFiles(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDriver_SyncCompactedFiles")
+	defer os.RemoveAll(tmpDir)
+	remote := setupRemote(t, tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+
+	a, err := db.Open(dirA, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo v1", nil))
+	require.NoError(t, a.Save("foo", index.Document, "foo v2", nil))
+	syncA := NewDriver(dirA, "a")
+	require.NoError(t, syncA.Init(remote))
+	_, err = syncA.Sync()
+	require.NoError(t, err)
+	syncB := NewDriver(dirB, "b")
+	require.NoError(t, syncB.Init(remote))
+	_, err = syncB.Sync()
+	require.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+	stats, err := a.Compact(db.WithRetention(0))
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Layers)
+	summary, err := syncA.Sync()
+	require.NoError(t, err)
+	assert.Contains(t, summary.Committed, "layer-a-001.idx")
+	assert.Contains(t, summary.Committed, "layer-a-002.idx")
+
+	// Files superseded by a new rotation may disappear
+	summary, err = syncB.Sync()
+	require.NoError(t, err)
+	assert.Contains(t, summary.Pulled, "data-a-002.dat")
+	assert.NoFileExists(t, filepath.Join(dirB, "layer-a-001.idx"))
+	b, err := db.Open(dirB, "b")
+	require.NoError(t, err)
+	bucket, err := b.Bucket("foo")
+	require.NoError(t, err)
+	assert.Len(t, bucket.Layers(), 1)
+	doc, err := bucket.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "foo v2", doc.Content())
+}
+
+func TestDriver_RollbackConflictingPull(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDriver_RollbackConflictingPull")
+	defer os.RemoveAll(tmpDir)
+	remote := setupRemote(t, tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+
+	a, err := db.Open(dirA, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo from a", nil))
+	syncA := NewDriver(dirA, "a")
+	require.NoError(t, syncA.Init(remote))
+	_, err = syncA.Sync()
+	require.NoError(t, err)
+
+	// b holds its own copy of a file of a: both histories add it
+	b, err := db.Open(dirB, "b")
+	require.NoError(t, err)
+	require.NoError(t, b.Save("bar", index.Document, "bar from b", nil))
+	require.NoError(t, os.WriteFile(filepath.Join(dirB, "data-a-001.dat"), []byte("copy"), 0600))
+	syncB := NewDriver(dirB, "b")
+	require.NoError(t, syncB.Init(remote))
+	_, err = syncB.Sync()
+	require.Error(t, err)
+
+	// The merge is aborted, the next sync commits no conflict markers
+	_, err = syncB.git("rev-parse", "--verify", "--quiet", "MERGE_HEAD")
+	assert.Error(t, err)
+	status, err := syncB.git("status", "--porcelain")
+	require.NoError(t, err)
+	assert.Empty(t, status)
+	content, err := os.ReadFile(filepath.Join(dirB, "data-a-001.dat"))
+	require.NoError(t, err)
+	assert.Equal(t, "copy", string(content))
+	summary, err := syncB.Sync()
+	require.Error(t, err)
+	assert.Nil(t, summary)
+	log, err := syncB.git("log", "--oneline")
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(log, "\n"), 1)
+}
+
+func TestDriver_RollbackFirstPull(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDriver_RollbackFirstPull")
+	defer os.RemoveAll(tmpDir)
+	remote := setupRemote(t, tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+
+	// a pushes a file of b
+	a, err := db.Open(dirA, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo from a", nil))
+	require.NoError(t, os.WriteFile(filepath.Join(dirA, "bucket-b-001.idx"), []byte("b"), 0600))
+	syncA := NewDriver(dirA, "a")
+	require.NoError(t, syncA.Init(remote))
+	_, err = syncA.Sync()
+	require.NoError(t, err)
+
+	// b has nothing to commit, the pulled files are removed
+	syncB := NewDriver(dirB, "b")
+	require.NoError(t, syncB.Init(remote))
+	require.NoError(t, os.Remove(filepath.Join(dirB, ".gitignore")))
+	_, err = syncB.Sync()
+	assert.ErrorIs(t, err, ErrNotAppendOnly)
+	assert.NoFileExists(t, filepath.Join(dirB, "bucket-b-001.idx"))
+	assert.NoFileExists(t, filepath.Join(dirB, "data-a-001.dat"))
+	_, err = syncB.git("rev-parse", "--verify", "--quiet", "HEAD")
+	assert.Error(t, err)
+}
+
+func TestDriver_RefuseUntrustedRemote(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDriver_RefuseUntrustedRemote")
+	defer os.RemoveAll(tmpDir)
+	setupRemote(t, tmpDir)
+	dir := filepath.Join(tmpDir, "a")
+
+	a, err := db.Open(dir, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.Save("foo", index.Document, "foo from a", nil))
+	for _, url := range []string{"git@example.com:notes.git", "https://example.com/notes.git"} {
+		syncA := NewDriver(dir, "a")
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, ".git")))
+		require.NoError(t, syncA.Init(url))
+		_, err = syncA.Sync()
+		assert.ErrorIs(t, err, ErrUntrustedRemote, url)
+	}
+
+	assert.True(t, localURL("/tmp/notes.git"))
+	assert.True(t, localURL("file:///tmp/notes.git"))
+	assert.True(t, localURL("./dir:with/colon.git"))
+}
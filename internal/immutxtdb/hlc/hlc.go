@@ -0,0 +1,111 @@
+package hlc
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Hybrid logical clock: wall time in milliseconds, a logical counter and the device id.
+// Timestamps keep close to wall time while never going backward and respecting causality:
+// an event timestamped after observing a remote timestamp is always ordered after it.
+// Device id break ties so all devices agree on a single total order.
+
+const EncodedSize = 12
+
+type Timestamp struct {
+	Wall    int64
+	Counter uint32
+	Device  string
+}
+
+func (t Timestamp) IsZero() bool {
+	return t.Wall == 0 && t.Counter == 0
+}
+
+// Compare wall, then counter, then device. Return -1, 0 or +1.
+func (t Timestamp) Compare(o Timestamp) int {
+	if c := cmp.Compare(t.Wall, o.Wall); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(t.Counter, o.Counter); c != 0 {
+		return c
+	}
+	return cmp.Compare(t.Device, o.Device)
+}
+
+func (t Timestamp) Time() time.Time {
+	return time.UnixMilli(t.Wall)
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d@%s", t.Wall, t.Counter, t.Device)
+}
+
+// Encode wall and counter. Device is not encoded: it is known from the file holding the timestamp.
+func (t Timestamp) Append(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.Wall))
+	return binary.BigEndian.AppendUint32(buf, t.Counter)
+}
+
+func Decode(buf []byte, device string) (Timestamp, error) {
+	if len(buf) < EncodedSize {
+		return Timestamp{}, fmt.Errorf("cannot decode timestamp of length: %d", len(buf))
+	}
+	return Timestamp{
+		Wall:    int64(binary.BigEndian.Uint64(buf[0:8])),
+		Counter: binary.BigEndian.Uint32(buf[8:12]),
+		Device:  device,
+	}, nil
+}
+
+type Clock struct {
+	*sync.Mutex
+	device string
+	last   Timestamp
+	now    func() time.Time
+}
+
+func NewClock(device string) *Clock {
+	return NewClockWithTime(device, time.Now)
+}
+
+// Clock reading the wall time from now.
+func NewClockWithTime(device string, now func() time.Time) *Clock {
+	return &Clock{
+		Mutex:  &sync.Mutex{},
+		device: device,
+		last:   Timestamp{Device: device},
+		now:    now,
+	}
+}
+
+// Timestamp a local event.
+func (c *Clock) Now() Timestamp {
+	c.Lock()
+	defer c.Unlock()
+	wall := c.now().UnixMilli()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall, Device: c.device}
+	} else {
+		c.last.Counter++
+	}
+	return c.last
+}
+
+// Observe a remote timestamp, so next local events are ordered after it.
+func (c *Clock) Update(remote Timestamp) {
+	c.Lock()
+	defer c.Unlock()
+	wall := c.now().UnixMilli()
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = Timestamp{Wall: wall, Device: c.device}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Counter: remote.Counter, Device: c.device}
+	case remote.Wall == c.last.Wall:
+		c.last.Counter = max(c.last.Counter, remote.Counter)
+	}
+}
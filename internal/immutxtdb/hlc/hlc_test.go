@@ -0,0 +1,85 @@
+package hlc
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fixedClock(device string, wall *int64) *Clock {
+	c := NewClock(device)
+	c.now = func() time.Time { return time.UnixMilli(*wall) }
+	return c
+}
+
+func TestClock_Now(t *testing.T) {
+	wall := int64(1000)
+	c := fixedClock("a", &wall)
+
+	t1 := c.Now()
+	assert.Equal(t, Timestamp{Wall: 1000, Device: "a"}, t1)
+
+	// Same wall time increments the counter
+	t2 := c.Now()
+	assert.Equal(t, Timestamp{Wall: 1000, Counter: 1, Device: "a"}, t2)
+
+	// Wall time going backward does not break monotonicity
+	wall = 900
+	t3 := c.Now()
+	assert.Equal(t, 1, t3.Compare(t2))
+
+	wall = 2000
+	t4 := c.Now()
+	assert.Equal(t, Timestamp{Wall: 2000, Device: "a"}, t4)
+}
+
+func TestClock_Update(t *testing.T) {
+	wallA, wallB := int64(1000), int64(5000)
+	a := fixedClock("a", &wallA)
+	b := fixedClock("b", &wallB)
+
+	// b clock is ahead, a observe a b event
+	remote := b.Now()
+	a.Update(remote)
+	local := a.Now()
+	assert.Equal(t, 1, local.Compare(remote), "local event must follow observed event")
+	assert.Equal(t, int64(5000), local.Wall)
+
+	// a wall time catch up
+	wallA = 6000
+	a.Update(remote)
+	local = a.Now()
+	assert.Equal(t, int64(6000), local.Wall)
+	assert.Equal(t, "a", local.Device)
+}
+
+func TestTimestamp_Order(t *testing.T) {
+	stamps := []Timestamp{
+		{Wall: 2, Counter: 0, Device: "a"},
+		{Wall: 1, Counter: 1, Device: "b"},
+		{Wall: 1, Counter: 1, Device: "a"},
+		{Wall: 1, Counter: 0, Device: "c"},
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i].Compare(stamps[j]) < 0 })
+	assert.Equal(t, []Timestamp{
+		{Wall: 1, Counter: 0, Device: "c"},
+		{Wall: 1, Counter: 1, Device: "a"},
+		{Wall: 1, Counter: 1, Device: "b"},
+		{Wall: 2, Counter: 0, Device: "a"},
+	}, stamps)
+}
+
+func TestTimestamp_Encoding(t *testing.T) {
+	ts := Timestamp{Wall: 1732460000000, Counter: 42, Device: "a"}
+	buf := ts.Append(nil)
+	assert.Len(t, buf, EncodedSize)
+	decoded, err := Decode(buf, "a")
+	require.NoError(t, err)
+	assert.Equal(t, ts, decoded)
+
+	_, err = Decode(buf[:3], "a")
+	assert.Error(t, err)
+}
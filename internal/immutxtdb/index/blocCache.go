@@ -0,0 +1,131 @@
+package index
+
+import (
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/cache"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+)
+
+// BlocCache keep decoded words of idx files blocs, keyed by idx file name and bloc.
+// One BlocCache can be shared by multiple indexes.
+type BlocCache = cache.LRU[blocKey, any]
+
+// Build a BlocCache holding at most budget bytes of decoded words.
+func NewBlocCache(budget int) *BlocCache {
+	return cache.NewLRU[blocKey, any](budget)
+}
+
+// A bloc of an idx file. The blocCount bloc holds the count of blocs of the file when it was
+// last read.
+type blocKey struct {
+	name string
+	bloc int
+}
+
+const blocCount = -1
+
+type decodedWord[T any] struct {
+	seq   int
+	state model.State
+	data  T
+}
+
+// Return all decoded words of an idx file in file order, decoding only the blocs missing from
+// the cache.
+func readWords[T any](st storage.Storage, e encoder.Encoder[T], c *BlocCache) ([]decodedWord[T], error) {
+	if words, ok := cachedWords[T](st.Name(), c); ok {
+		return words, nil
+	}
+
+	var words []decodedWord[T]
+	k := 0
+	for b, err := range st.All(model.TopToBottom) {
+		if err != nil {
+			return nil, err
+		}
+		key := blocKey{name: st.Name(), bloc: k}
+		k++
+		if cached, ok := c.Get(key); ok {
+			if bloc, ok := cached.([]decodedWord[T]); ok {
+				words = append(words, bloc...)
+				continue
+			}
+		}
+		var bloc []decodedWord[T]
+		var decodeErr error
+		e.DecodeAll(model.TopToBottom, b, func(seq int, s model.State, data T, err error) {
+			if err != nil && decodeErr == nil {
+				decodeErr = err
+			}
+			bloc = append(bloc, decodedWord[T]{seq: seq, state: s, data: data})
+		})
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		c.Put(key, bloc, len(bloc)*wordSize)
+		words = append(words, bloc...)
+	}
+
+	c.Put(blocKey{name: st.Name(), bloc: blocCount}, k, 0)
+	return words, nil
+}
+
+// Return the decoded words of an idx file if none of its blocs left the cache since it was
+// last read.
+func cachedWords[T any](name string, c *BlocCache) ([]decodedWord[T], bool) {
+	count, ok := c.Get(blocKey{name: name, bloc: blocCount})
+	if !ok {
+		return nil, false
+	}
+	var words []decodedWord[T]
+	for k := range count.(int) {
+		cached, ok := c.Get(blocKey{name: name, bloc: k})
+		if !ok {
+			return nil, false
+		}
+		bloc, ok := cached.([]decodedWord[T])
+		if !ok {
+			return nil, false
+		}
+		words = append(words, bloc...)
+	}
+	return words, true
+}
+
+// Forget the last bloc of an idx file, the only one an append changes. The whole file is
+// forgotten if its count of blocs left the cache.
+func invalidateLastBloc(name string, c *BlocCache) {
+	count, ok := c.Peek(blocKey{name: name, bloc: blocCount})
+	if !ok {
+		invalidateFile(name, c)
+		return
+	}
+	c.Invalidate(blocKey{name: name, bloc: count.(int) - 1})
+	c.Invalidate(blocKey{name: name, bloc: blocCount})
+}
+
+// Forget all blocs of an idx file.
+func invalidateFile(name string, c *BlocCache) {
+	c.InvalidateFunc(func(key blocKey) bool {
+		return key.name == name
+	})
+}
+
+// Iterate over words in the supplied order. Return false if iteration was stopped.
+func walkWords[T any](words []decodedWord[T], order model.Order, yield func(decodedWord[T]) bool) bool {
+	if order == model.TopToBottom {
+		for _, w := range words {
+			if !yield(w) {
+				return false
+			}
+		}
+	} else {
+		for k := len(words) - 1; k >= 0; k-- {
+			if !yield(words[k]) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -1,15 +1,14 @@
 package index
 
 import (
-	"bytes"
-	"fmt"
-	"io"
 	"path/filepath"
 	"sync"
 
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/cache"
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
-	"github.com/mxbossard/utilz/filez"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
 )
 
 // (BUCKET_UID, STATE_PRIVATE_DATA)
@@ -20,18 +19,27 @@ type BucketIndex struct {
 
 	encoder        encoder.Encoder[string]
 	filepathes     []string
-	deviceIdxFiles []*filez.BlocsFile
-	otherIdxFiles  []*filez.BlocsFile
-	seqs           map[string]int
+	backend        storage.Backend
+	device         string
+	deviceIdxFiles []storage.Storage
+	otherIdxFiles  []storage.Storage
+	stats          map[string]*idxStats
+	stamps         map[string]storage.Stamp
+	blocCache      *BlocCache
+	wal            *wal.Log
+	syncPolicy     wal.SyncPolicy
 }
 
-func NewBucketIndex(bucketDir, device string) (*BucketIndex, error) {
+func NewBucketIndex(bucketDir, device string, opts ...Option) (*BucketIndex, error) {
 	// Init bucketIndex
-	// FIXME: manage multiple idx files (rotation)
 	// FIXME: add a filelock
 	// FIXME: add BlocsEncryption
-	firstDeviceFilepath := filepath.Join(bucketDir, fmt.Sprintf("bucket-%s-001.idx", device))
-	dbf1, err := filez.NewBlocsFile(firstDeviceFilepath, 256, 100)
+	o := buildOptions(bucketDir, opts)
+	deviceIdxFiles, otherIdxFiles, err := openIdxFiles(o.backend, bucketKind, device)
+	if err != nil {
+		return nil, err
+	}
+	l, err := openWal(o.backend, bucketKind, device, o.syncPolicy)
 	if err != nil {
 		return nil, err
 	}
@@ -39,86 +47,242 @@ func NewBucketIndex(bucketDir, device string) (*BucketIndex, error) {
 	idx := &BucketIndex{
 		Mutex:          &sync.Mutex{},
 		encoder:        e,
-		deviceIdxFiles: []*filez.BlocsFile{dbf1},
-		otherIdxFiles:  nil,
-		seqs:           make(map[string]int),
+		backend:        o.backend,
+		device:         device,
+		deviceIdxFiles: deviceIdxFiles,
+		otherIdxFiles:  otherIdxFiles,
+		stats:          make(map[string]*idxStats),
+		stamps:         make(map[string]storage.Stamp),
+		blocCache:      o.blocCache,
+		wal:            l,
+		syncPolicy:     o.syncPolicy,
 	}
 
 	// FIXME: need to setup the encoder!
 	//e.Setup()
 
+	err = truncateTornWords(idx.deviceIdxFiles, idx.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.preload()
+	if err != nil {
+		return nil, err
+	}
+	err = idx.recover()
+	if err != nil {
+		return nil, err
+	}
+
 	return idx, nil
 }
 
 func (i *BucketIndex) preload() error {
 	i.Lock()
 	defer i.Unlock()
-	// TODO: read current seq in all files
 	// TODO: load last blocs in cache ?
 
 	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
 	for _, bf := range idxFiles {
-		b, err := bf.GetLastNonEmptyBloc()
-		if err == filez.ErrNotExist {
-			continue
-		} else if err != nil {
-			return err
-		}
-
-		buf := &bytes.Buffer{}
-		n, err := io.Copy(buf, b)
+		s, err := loadIdxStats(i.backend, bf, i.encoder, bucketKey)
 		if err != nil {
 			return err
 		}
+		i.stats[bf.Name()] = s
+	}
+	return nil
+}
+
+func bucketKey(uid string) []byte {
+	return []byte(uid)
+}
 
-		seq, _, _, err := i.encoder.DecodeLastWord(buf.Bytes()[0:n])
-		// _, seq, _, err := decodeLastIndexLine[bool](buf.Bytes()[0:n])
+// Complete writes interrupted by a crash.
+func (i *BucketIndex) recover() error {
+	i.Lock()
+	defer i.Unlock()
+	for _, records := range i.wal.Pending() {
+		err := i.WriteRecords(records)
 		if err != nil {
 			return err
 		}
-		i.seqs[bf.Name()] = seq
-
 	}
-	return nil
+	return i.wal.Checkpoint()
 }
 
-func (i *BucketIndex) selectDeviceBlocFile(uid string) *filez.BlocsFile {
-	return i.deviceIdxFiles[0]
+func (i *BucketIndex) Close() error {
+	return i.wal.Close()
+}
+
+func (i *BucketIndex) selectDeviceBlocFile(uid string) storage.Storage {
+	return i.deviceIdxFiles[len(i.deviceIdxFiles)-1]
 }
 
 func (i *BucketIndex) Add(uid string, s model.State) error {
 	i.Lock()
 	defer i.Unlock()
-	// TODO: write to block file
-	// TODO: how to connect with block file ?
-	// TODO: how to manage bloc file appending ?
-	bf := i.selectDeviceBlocFile(uid)
+	records, err := i.EncodeWords(BucketEntry{Uid: uid, State: s})
+	if err != nil {
+		return err
+	}
+	// Log the word before writing it, a crash between both writes is completed on next open.
+	err = i.wal.Append(records...)
+	if err != nil {
+		return err
+	}
+	err = i.WriteRecords(records)
+	if err != nil {
+		return err
+	}
+	return i.wal.Checkpoint()
+}
+
+type BucketEntry struct {
+	Uid   string
+	State model.State
+}
+
+// Encode entries as words following the last word of the device idx file.
+// Caller must hold the index lock until the records are written.
+func (i *BucketIndex) EncodeWords(entries ...BucketEntry) ([]wal.Record, error) {
+	var records []wal.Record
+	for _, e := range entries {
+		bf := i.selectDeviceBlocFile(e.Uid)
+		bfName := bf.Name()
+		seq := i.stats[bfName].seq
+		for _, r := range records {
+			if r.Target == bfName {
+				seq = r.Seq + 1
+			}
+		}
+		word, err := i.encoder.Encode(seq, e.State, e.Uid)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, wal.Record{Target: bfName, Seq: seq, Data: word})
+	}
+	return records, nil
+}
+
+// Write encoded words into their idx file. Already written words are skipped, so records
+// logged in a wal can be written again after a crash.
+// Caller must hold the index lock.
+func (i *BucketIndex) WriteRecords(records []wal.Record) error {
+	err := replayRecords(i.backend, records, i.deviceIdxFiles, i.stats, i.encoder, bucketKey, i.blocCache)
+	if err != nil {
+		return err
+	}
+	return syncTargets(i.deviceIdxFiles, records, i.syncPolicy)
+}
 
-	bfName := bf.Name()
-	seq := i.seqs[bfName]
+// Words of this device from the since seq of each idx file, targeting idx file names.
+func (i *BucketIndex) DeviceRecords(since map[string]int) ([]wal.Record, error) {
+	i.Lock()
+	defer i.Unlock()
+	return deviceRecords(i.deviceIdxFiles, i.encoder, i.blocCache, since)
+}
 
-	// FIXME: use good byte encoding !
-	entry, err := i.encoder.Encode(seq, s, uid)
-	// entry, err := encodeIndexLine(seq, []byte(uid), s)
+// Write words exported by other devices into their idx files. Already written words are
+// skipped, so importing the same records twice is harmless.
+// Caller must hold the index lock.
+func (i *BucketIndex) ImportRecords(records []wal.Record) error {
+	imported, err := openImportedFiles(i.backend, bucketKind, i.device, records, &i.otherIdxFiles, i.stats, i.encoder, bucketKey)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("writing encoded content (#%d, uid: %s): %v\n", seq, uid, entry)
-	_, err = bf.Write(entry)
+	err = replayRecords(i.backend, imported, i.otherIdxFiles, i.stats, i.encoder, bucketKey, i.blocCache)
 	if err != nil {
 		return err
 	}
-	i.seqs[bfName] = seq + 1
+	dropSupersededFiles(&i.otherIdxFiles, i.stats, i.blocCache)
 	return nil
 }
 
+// First seq of each device idx file holding a bucket matching uid.
+func (i *BucketIndex) DeviceCursor(match func(uid string) bool) (map[string]int, error) {
+	i.Lock()
+	defer i.Unlock()
+	cursor := make(map[string]int, len(i.deviceIdxFiles))
+	for _, bf := range i.deviceIdxFiles {
+		name := filepath.Base(bf.Name())
+		cursor[name] = i.stats[bf.Name()].seq
+		words, err := readWords(bf, i.encoder, i.blocCache)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range words {
+			if match(w.data) {
+				cursor[name] = w.seq
+				break
+			}
+		}
+	}
+	return cursor, nil
+}
+
+// Load idx files of other devices which appeared or grew since the index was opened or last
+// refreshed. Return the names of those files.
+func (i *BucketIndex) Refresh() ([]string, error) {
+	i.Lock()
+	defer i.Unlock()
+	changed, err := refreshOtherFiles(i.backend, bucketKind, i.device, &i.otherIdxFiles, i.stats, i.stamps, i.encoder, bucketKey, i.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	return fileNames(changed), nil
+}
+
+// Rewrite the device idx file into a new rotation holding the buckets to keep. Only the last
+// word of a bucket is kept. Superseded idx files of all devices are removed.
+// Return the count of dropped words.
+// Caller must hold the index lock.
+func (i *BucketIndex) Compact(keep func(uid string, s model.State) bool) (int, error) {
+	words, err := readWords(i.deviceIdxFiles[len(i.deviceIdxFiles)-1], i.encoder, i.blocCache)
+	if err != nil {
+		return 0, err
+	}
+	last := make(map[string]int, len(words))
+	for _, w := range words {
+		last[w.data] = w.seq
+	}
+	dropped, err := rotateDeviceFile(i.backend, bucketKind, i.device, &i.deviceIdxFiles, i.stats, i.encoder, bucketKey, i.blocCache, func(w decodedWord[string]) (string, bool, error) {
+		return w.data, last[w.data] == w.seq && keep(w.data, w.state), nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return dropped, removeSupersededFiles(i.backend, bucketKind)
+}
+
+// Count all entries of all devices without reading the idx files.
 func (i *BucketIndex) Count() (int, error) {
-	// Should be performent and not read all the index to count lines.
 	i.Lock()
 	defer i.Unlock()
 	count := 0
-	for _, k := range i.seqs {
-		count += k
+	for _, s := range i.stats {
+		count += s.seq
+	}
+	return count, nil
+}
+
+// Count entries of a bucket uid.
+func (i *BucketIndex) CountKey(uid string) (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	count := 0
+	for _, s := range i.stats {
+		count += s.countKey(bucketKey(uid))
+	}
+	return count, nil
+}
+
+// Count entries of a State.
+func (i *BucketIndex) CountState(state model.State) (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	count := 0
+	for _, s := range i.stats {
+		count += s.countState(state)
 	}
 	return count, nil
 }
@@ -128,57 +292,28 @@ func (i *BucketIndex) Paginate(key string, order model.Order, limit int) (model.
 }
 
 func (i *BucketIndex) PaginateAll(order model.Order, limit int) (model.Paginer[string, model.State], chan error) {
-	// TODO: cache all the bloc file content ?
 	// TODO: call all the index content ?
 	errChan := make(chan error)
 	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
 	p := model.NewPaginer(defaultPageSize, 0, func(push func(k string, v model.State, err error) bool) {
-		//panic("not implemented yet")
 		for _, bf := range idxFiles {
-			for b := range bf.All(filez.BlocOrdering(order), errChan) {
-				i.encoder.DecodeAll(order, b.Bytes(), func(seq int, s model.State, uid string, err error) {
-					if !push(uid, s, err) {
-						return
-					}
-				})
+			words, err := readWords(bf, i.encoder, i.blocCache)
+			if err != nil {
+				push("", nil, err)
+				return
+			}
+			ok := walkWords(words, order, func(w decodedWord[string]) bool {
+				return push(w.data, w.state, nil)
+			})
+			if !ok {
+				return
 			}
 		}
 	})
 	return p, errChan
 }
 
-/*
-type documentIndex struct {
-	filepathes []string
-}
-
-func (i documentIndex) add(topic string, bucketUid string) error {
-	panic("not implemented yet")
-}
-
-func (i documentIndex) count() (int, error) {
-	panic("not implemented yet")
-}
-
-// Manage sorting
-func (i documentIndex) listAll(uid string, limit int) (cursor[Bucket], error) {
-	panic("not implemented yet")
-}
-
-type textIndex struct {
-	filepathes []string
-}
-
-func (i textIndex) add(topic string, bucketUid string, pos, len int) error {
-	panic("not implemented yet")
-}
-
-func (i textIndex) count() (int, error) {
-	panic("not implemented yet")
-}
-
-// Manage sorting
-func (i textIndex) listAll(uid string, limit int) (cursor[Bucket], error) {
-	panic("not implemented yet")
+// Hit and miss counters of the bloc cache.
+func (i *BucketIndex) CacheStats() cache.Stats {
+	return i.blocCache.Stats()
 }
-*/
@@ -2,9 +2,12 @@ package index
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
 	"github.com/mxbossard/utilz/filez"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -109,3 +112,304 @@ func TestBucketIndex_PaginateAll(t *testing.T) {
 	assert.Equal(t, "foo", entries2[3].Key())
 
 }
+
+func TestBucketIndex_CountAfterReopen(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_CountAfterReopen")
+	defer os.RemoveAll(tmpDir)
+
+	bIdx, err := NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	require.NoError(t, bIdx.Add("foo", Document))
+	require.NoError(t, bIdx.Add("bar", Dump))
+	require.NoError(t, bIdx.Add("foo", Document))
+
+	other, err := NewBucketIndex(tmpDir, "other")
+	require.NoError(t, err)
+	require.NoError(t, other.Add("foo", Dump))
+
+	// Reopen with all files written
+	bIdx, err = NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	assert.Len(t, bIdx.otherIdxFiles, 1)
+
+	count, err := bIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	count, err = bIdx.CountKey("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	count, err = bIdx.CountKey("baz")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = bIdx.CountState(Document)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = bIdx.CountState(Dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Next seq continue after reopen
+	require.NoError(t, bIdx.Add("baz", Document))
+	count, err = bIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+}
+
+func TestBucketIndex_StorageBackends(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_StorageBackends")
+	defer os.RemoveAll(tmpDir)
+	archive, err := storage.OpenArchive(filepath.Join(tmpDir, "idx.archive"), blocsFileBlocSize)
+	require.NoError(t, err)
+
+	backends := map[string]storage.Backend{
+		"memory":  storage.NewMemory(blocsFileBlocSize),
+		"archive": archive,
+	}
+	// The index directory is not used
+	noDir := filepath.Join(tmpDir, "missing")
+	for name, b := range backends {
+		bIdx, err := NewBucketIndex(noDir, "test", WithBackend(b))
+		require.NoError(t, err)
+		require.NoError(t, bIdx.Add("foo", Document))
+		require.NoError(t, bIdx.Add("bar", Dump))
+		other, err := NewBucketIndex(noDir, "other", WithBackend(b))
+		require.NoError(t, err)
+		require.NoError(t, other.Add("foo", Dump))
+
+		bIdx, err = NewBucketIndex(noDir, "test", WithBackend(b))
+		require.NoError(t, err)
+		count, err := bIdx.CountKey("foo")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count, name)
+		count, err = bIdx.CountState(Dump)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count, name)
+		assert.NoDirExists(t, noDir, name)
+	}
+
+	// Stats are rebuilt from the archive blocs
+	require.NoError(t, archive.Close())
+	archive, err = storage.OpenArchive(filepath.Join(tmpDir, "idx.archive"), blocsFileBlocSize)
+	require.NoError(t, err)
+	defer archive.Close()
+	bIdx, err := NewBucketIndex(filepath.Join(tmpDir, "archive"), "test", WithBackend(archive))
+	require.NoError(t, err)
+	count, err := bIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestBucketIndex_CountWithLateStats(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_CountWithLateStats")
+	defer os.RemoveAll(tmpDir)
+
+	other, err := NewBucketIndex(tmpDir, "other")
+	require.NoError(t, err)
+	require.NoError(t, other.Add("foo", Document))
+	statsFile := statsFilepath(other.deviceIdxFiles[0].Name())
+	lateStats, err := os.ReadFile(statsFile)
+	require.NoError(t, err)
+	require.NoError(t, other.Add("bar", Document))
+	require.NoError(t, other.Add("baz", Dump))
+
+	// Sidecar synced before the idx file was fully synced
+	require.NoError(t, os.WriteFile(statsFile, lateStats, 0600))
+
+	bIdx, err := NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	count, err := bIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = bIdx.CountState(Dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Missing sidecar
+	require.NoError(t, os.Remove(statsFile))
+	bIdx, err = NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	count, err = bIdx.CountKey("bar")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestBucketIndex_BlocCache(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_BlocCache")
+	defer os.RemoveAll(tmpDir)
+
+	c := NewBlocCache(1 << 16)
+	bIdx, err := NewBucketIndex(tmpDir, "test", WithBlocCache(c))
+	require.NoError(t, err)
+	lIdx, err := NewLayerIndex(tmpDir, "test", WithBlocCache(c))
+	require.NoError(t, err)
+	require.NoError(t, bIdx.Add("foo", Document))
+	require.NoError(t, lIdx.Add([]byte("foo"), model.NewLayerRef("file", 0, Dump)))
+
+	countAll := func() int {
+		p, _ := bIdx.PaginateAll(model.TopToBottom, 100)
+		page, _, err := p.Next()
+		require.NoError(t, err)
+		return page.Len()
+	}
+
+	// Miss the count of blocs and the bloc
+	assert.Equal(t, 1, countAll())
+	assert.Equal(t, 0, bIdx.CacheStats().Hits)
+	assert.Equal(t, 2, bIdx.CacheStats().Misses)
+
+	assert.Equal(t, 1, countAll())
+	assert.Equal(t, 2, bIdx.CacheStats().Hits)
+
+	// Fill a second bloc
+	require.NoError(t, bIdx.Add("bar", Document))
+	require.NoError(t, bIdx.Add("baz", Document))
+	assert.Equal(t, 3, countAll())
+	_, err = bIdx.deviceIdxFiles[0].ReadBloc(1)
+	require.NoError(t, err)
+
+	// Append invalidate only the last bloc
+	stats := bIdx.CacheStats()
+	require.NoError(t, bIdx.Add("qux", Document))
+	assert.Equal(t, 4, countAll())
+	assert.Equal(t, stats.Hits+1, bIdx.CacheStats().Hits)
+	assert.Equal(t, stats.Misses+2, bIdx.CacheStats().Misses)
+
+	// Cache is shared with the layer index
+	stats = c.Stats()
+	p, _ := lIdx.PaginateAll(model.TopToBottom, 100)
+	_, _, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, stats.Misses+2, lIdx.CacheStats().Misses)
+	assert.Equal(t, stats.Len+2, c.Stats().Len)
+}
+
+func TestBucketIndex_BlocCacheBudget(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_BlocCacheBudget")
+	defer os.RemoveAll(tmpDir)
+
+	// Files bigger than the budget are still cached bloc by bloc
+	c := NewBlocCache(3 * wordSize)
+	bIdx, err := NewBucketIndex(tmpDir, "test", WithBlocCache(c))
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, bIdx.Add(key, Document))
+	}
+	p, _ := bIdx.PaginateAll(model.TopToBottom, 100)
+	page, _, err := p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, 5, page.Len())
+	assert.NotZero(t, c.Stats().Len)
+	assert.LessOrEqual(t, c.Stats().Size, 3*wordSize)
+}
+
+func TestBucketIndex_RecoverFromWal(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_RecoverFromWal")
+	defer os.RemoveAll(tmpDir)
+
+	bIdx, err := NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	require.NoError(t, bIdx.Add("foo", Document))
+	bfName := bIdx.deviceIdxFiles[0].Name()
+
+	// Crash after the word was written but before the wal checkpoint
+	written, err := bIdx.encoder.Encode(0, Document, "foo")
+	require.NoError(t, err)
+	require.NoError(t, bIdx.wal.Append(wal.Record{Target: bfName, Seq: 0, Data: written}))
+
+	// Crash after the word was logged but before it was written
+	logged, err := bIdx.encoder.Encode(1, Dump, "bar")
+	require.NoError(t, err)
+	require.NoError(t, bIdx.wal.Append(wal.Record{Target: bfName, Seq: 1, Data: logged}))
+	require.NoError(t, bIdx.Close())
+
+	bIdx, err = NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	assert.Empty(t, bIdx.wal.Pending())
+
+	count, err := bIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = bIdx.CountKey("bar")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	p, _ := bIdx.PaginateAll(model.TopToBottom, 100)
+	page, _, err := p.Next()
+	require.NoError(t, err)
+	require.Equal(t, 2, page.Len())
+	assert.Equal(t, "foo", page.Entries()[0].Key())
+	assert.Equal(t, "bar", page.Entries()[1].Key())
+
+	// Seq continue after the replayed word
+	require.NoError(t, bIdx.Add("baz", Document))
+	count, err = bIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestBucketIndex_Compact(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_Compact")
+	defer os.RemoveAll(tmpDir)
+
+	bIdx, err := NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	other, err := NewBucketIndex(tmpDir, "other")
+	require.NoError(t, err)
+	for _, uid := range []string{"foo", "bar", "foo", "baz"} {
+		require.NoError(t, bIdx.Add(uid, Document))
+	}
+	require.NoError(t, other.Add("foo", Dump))
+
+	// Only the last word of a bucket is kept
+	bIdx.Lock()
+	dropped, err := bIdx.Compact(func(uid string, s model.State) bool { return true })
+	bIdx.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+
+	// Nothing to drop: no new rotation
+	bIdx.Lock()
+	dropped, err = bIdx.Compact(func(uid string, s model.State) bool { return true })
+	bIdx.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+
+	bIdx.Lock()
+	dropped, err = bIdx.Compact(func(uid string, s model.State) bool { return uid != "bar" })
+	bIdx.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "bucket-test-001.idx"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "bucket-test-002.idx"))
+	assert.FileExists(t, filepath.Join(tmpDir, "bucket-test-003.idx"))
+
+	// Seqs of the new rotation are contiguous
+	require.NoError(t, bIdx.Add("qux", Document))
+	count, err := bIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// Other devices forget the superseded rotation
+	changed, err := other.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bucket-test-003.idx"}, changed)
+	count, err = other.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	count, err = other.CountKey("foo")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	bIdx, err = NewBucketIndex(tmpDir, "test")
+	require.NoError(t, err)
+	count, err = bIdx.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	count, err = bIdx.CountKey("bar")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
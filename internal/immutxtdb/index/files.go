@@ -0,0 +1,132 @@
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+)
+
+// Idx files are named KIND-DEVICE-NNN.idx, NNN being the rotation number of the device file.
+var idxFilenameRegexp = regexp.MustCompile(`^([a-z]+)-(.+)-(\d{3})\.idx$`)
+
+// Kinds of idx files, one per index.
+const (
+	bucketKind = "bucket"
+	layerKind  = "layer"
+	labelKind  = "label"
+	topicKind  = "topic"
+	// The text index is kept in a sidecar only.
+	textKind = "text"
+)
+
+var idxKinds = []string{bucketKind, layerKind, labelKind, topicKind}
+
+// Device owning an idx file name, false if the name is not the name of an idx file of a known
+// kind.
+func IdxFilenameDevice(name string) (string, bool) {
+	m := idxFilenameRegexp.FindStringSubmatch(name)
+	if m == nil || !slices.Contains(idxKinds, m[1]) {
+		return "", false
+	}
+	return m[2], true
+}
+
+func idxFilename(kind, device string, rotation int) string {
+	return fmt.Sprintf("%s-%s-%03d%s", kind, device, rotation, idxFileExt)
+}
+
+// Device owning an idx file.
+func idxFileDevice(path string) string {
+	m := idxFilenameRegexp.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return ""
+	}
+	return m[2]
+}
+
+// A device compacting its idx files rewrites them into a new rotation which supersedes the
+// previous ones, so only the latest rotation of each device is read.
+
+func idxFileRotation(name string) int {
+	m := idxFilenameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return 0
+	}
+	rotation, _ := strconv.Atoi(m[3])
+	return rotation
+}
+
+// Split idx files names of a kind in the latest rotation of each device and the superseded ones.
+func latestIdxFiles(b storage.Backend, kind string) (latest map[string]string, superseded []string, err error) {
+	names, err := b.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	latest = make(map[string]string)
+	// Zero padded rotation number keep lexical order.
+	sort.Strings(names)
+	for _, name := range names {
+		m := idxFilenameRegexp.FindStringSubmatch(name)
+		if m == nil || m[1] != kind {
+			continue
+		}
+		if previous, ok := latest[m[2]]; ok {
+			superseded = append(superseded, previous)
+		}
+		latest[m[2]] = name
+	}
+	return latest, superseded, nil
+}
+
+// List idx files names of a kind in a backend, splitting this device file from other devices
+// files. The device file name is listed even if missing.
+func listIdxFiles(b storage.Backend, kind, device string) (deviceNames, otherNames []string, err error) {
+	latest, _, err := latestIdxFiles(b, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	deviceName, ok := latest[device]
+	if !ok {
+		deviceName = idxFilename(kind, device, 1)
+	}
+	delete(latest, device)
+	for _, name := range latest {
+		otherNames = append(otherNames, name)
+	}
+	sort.Strings(otherNames)
+	return []string{deviceName}, otherNames, nil
+}
+
+// Open idx files of a kind in a backend, splitting this device file from other devices files.
+// The device file is created if missing.
+func openIdxFiles(b storage.Backend, kind, device string) (deviceFiles, otherFiles []storage.Storage, err error) {
+	deviceNames, otherNames, err := listIdxFiles(b, kind, device)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range deviceNames {
+		st, err := b.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		deviceFiles = append(deviceFiles, st)
+	}
+	for _, name := range otherNames {
+		st, err := b.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		otherFiles = append(otherFiles, st)
+	}
+	return deviceFiles, otherFiles, nil
+}
+
+// Name of an idx file in its backend.
+func idxFileName(st storage.Storage) string {
+	return filepath.Base(st.Name())
+}
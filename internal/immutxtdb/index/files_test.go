@@ -0,0 +1,24 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdxFilenameDevice(t *testing.T) {
+	for name, device := range map[string]string{
+		"bucket-a-001.idx":        "a",
+		"layer-my-laptop-002.idx": "my-laptop",
+		"label-b-001.idx":         "b",
+		"topic-c-010.idx":         "c",
+	} {
+		d, ok := IdxFilenameDevice(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, device, d, name)
+	}
+	for _, name := range []string{"foo-a-001.idx", "layer-a-1.idx", "data-a-001.dat", "layer-a-001.idx.wal"} {
+		_, ok := IdxFilenameDevice(name)
+		assert.False(t, ok, name)
+	}
+}
@@ -0,0 +1,145 @@
+package index
+
+import (
+	"slices"
+	"unicode/utf8"
+)
+
+// Typo tolerant matching of terms. Terms within a few edits of each other match, the number of
+// edits allowed grows with the term length. Candidate terms are found by their trigrams: a term
+// within k edits of another one shares all its padded trigrams but at most 3*k.
+
+const trigramPadding = "$"
+
+// Edits allowed for a term to match another one.
+func MaxEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n < 4:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Padded trigrams of a term, so its first and last runes weight more.
+func trigrams(term string) []string {
+	runes := []rune(trigramPadding + trigramPadding + term + trigramPadding)
+	grams := make([]string, 0, len(runes)-2)
+	seen := map[string]bool{}
+	for k := 0; k+3 <= len(runes); k++ {
+		gram := string(runes[k : k+3])
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// Levenshtein distance between two terms, in runes. Returns max+1 as soon as the distance
+// exceeds max.
+func Levenshtein(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		best := current[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			best = min(best, current[j])
+		}
+		if best > max {
+			return max + 1
+		}
+		previous, current = current, previous
+	}
+	return min(previous[len(rb)], max+1)
+}
+
+// Vocabulary of terms searchable by trigrams.
+type trigramSet map[string]map[string]bool
+
+func (s trigramSet) add(term string) {
+	for _, gram := range trigrams(term) {
+		terms, ok := s[gram]
+		if !ok {
+			terms = make(map[string]bool)
+			s[gram] = terms
+		}
+		terms[term] = true
+	}
+}
+
+func (s trigramSet) remove(term string) {
+	for _, gram := range trigrams(term) {
+		delete(s[gram], term)
+		if len(s[gram]) == 0 {
+			delete(s, gram)
+		}
+	}
+}
+
+// Terms of the set within the edits allowed for a term, by edit distance.
+func (s trigramSet) match(term string) map[string]int {
+	maxEdits := MaxEdits(term)
+	grams := trigrams(term)
+	shared := map[string]int{}
+	for _, gram := range grams {
+		for candidate := range s[gram] {
+			shared[candidate]++
+		}
+	}
+	matches := map[string]int{}
+	for candidate, count := range shared {
+		if count < len(grams)-3*maxEdits {
+			continue
+		}
+		if d := Levenshtein(term, candidate, maxEdits); d <= maxEdits {
+			matches[candidate] = d
+		}
+	}
+	return matches
+}
+
+// Match folded terms against a list of names, by edit distance of the best matching term. A
+// name matches by its whole folded form or by one of its terms.
+func FuzzyMatch(terms []string, names []string) map[string]int {
+	s := trigramSet{}
+	byFolded := map[string][]string{}
+	for _, name := range names {
+		forms := []string{Fold(name)}
+		for _, t := range Tokenize(name) {
+			forms = append(forms, t.Term)
+		}
+		for _, folded := range forms {
+			if !slices.Contains(byFolded[folded], name) {
+				s.add(folded)
+				byFolded[folded] = append(byFolded[folded], name)
+			}
+		}
+	}
+	matches := map[string]int{}
+	for _, term := range terms {
+		for folded, d := range s.match(term) {
+			for _, name := range byFolded[folded] {
+				if previous, ok := matches[name]; !ok || d < previous {
+					matches[name] = d
+				}
+			}
+		}
+	}
+	return matches
+}
@@ -0,0 +1,24 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevenshtein(t *testing.T) {
+	assert.Equal(t, 0, Levenshtein("voyage", "voyage", 2))
+	assert.Equal(t, 1, Levenshtein("voyage", "vojage", 2))
+	assert.Equal(t, 2, Levenshtein("voyage", "voyge!", 2))
+	assert.Equal(t, 2, Levenshtein("été", "ete", 2))
+	assert.Equal(t, 3, Levenshtein("voyage", "v", 2))
+	assert.Equal(t, 3, Levenshtein("abcdef", "ghijkl", 2))
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	names := []string{"été-25", "voyage", "jean.dupont", "léa"}
+	assert.Equal(t, map[string]int{"voyage": 1}, FuzzyMatch([]string{"vojage"}, names))
+	assert.Equal(t, map[string]int{"été-25": 0}, FuzzyMatch([]string{"ete"}, names))
+	assert.Equal(t, map[string]int{"jean.dupont": 1, "léa": 0}, FuzzyMatch([]string{"dupond", "lea"}, names))
+	assert.Empty(t, FuzzyMatch([]string{"paris"}, names))
+}
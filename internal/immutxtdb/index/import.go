@@ -0,0 +1,83 @@
+package index
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+)
+
+// Words are exchanged between devices as records targeting idx file names, so they can be
+// written into the idx files of the same name in another db.
+
+// Words of the device idx files from the since seq of each file.
+func deviceRecords[T any](files []storage.Storage, e encoder.Encoder[T], c *BlocCache, since map[string]int) ([]wal.Record, error) {
+	var records []wal.Record
+	for _, st := range files {
+		name := idxFileName(st)
+		words, err := readWords(st, e, c)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range words {
+			if w.seq < since[name] {
+				continue
+			}
+			word, err := e.Encode(w.seq, w.state, w.data)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, wal.Record{Target: name, Seq: w.seq, Data: word})
+		}
+	}
+	return records, nil
+}
+
+// Target imported records at other devices idx files of the backend, opening the missing ones.
+// Records not targeting an idx file of the kind are dropped.
+// Caller must forget the superseded files once the records are written.
+func openImportedFiles[T any](b storage.Backend, kind, device string, records []wal.Record, others *[]storage.Storage, stats map[string]*idxStats, e encoder.Encoder[T], keyOf func(T) []byte) ([]wal.Record, error) {
+	// Words of a rotation superseded by a known rotation of their device are dropped.
+	latest := make(map[string]int)
+	for _, st := range *others {
+		name := idxFileName(st)
+		latest[idxFileDevice(name)] = max(latest[idxFileDevice(name)], idxFileRotation(name))
+	}
+	for _, r := range records {
+		latest[idxFileDevice(r.Target)] = max(latest[idxFileDevice(r.Target)], idxFileRotation(r.Target))
+	}
+	var imported []wal.Record
+	for _, r := range records {
+		m := idxFilenameRegexp.FindStringSubmatch(r.Target)
+		if m == nil || m[1] != kind {
+			continue
+		}
+		if m[2] == device {
+			return nil, fmt.Errorf("cannot import words of this device idx file: %s", r.Target)
+		}
+		if idxFileRotation(r.Target) < latest[m[2]] {
+			continue
+		}
+		k := slices.IndexFunc(*others, func(st storage.Storage) bool {
+			return idxFileName(st) == r.Target
+		})
+		if k < 0 {
+			st, err := b.Open(r.Target)
+			if err != nil {
+				return nil, err
+			}
+			s, err := loadIdxStats(b, st, e, keyOf)
+			if err != nil {
+				return nil, err
+			}
+			stats[st.Name()] = s
+			*others = append(*others, st)
+			k = len(*others) - 1
+		}
+		r.Target = (*others)[k].Name()
+		imported = append(imported, r)
+	}
+	return imported, nil
+}
@@ -1,6 +1,10 @@
 package index
 
-import "github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+import (
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+)
 
 const (
 	indexLineBufferSize        = 1000
@@ -11,9 +15,71 @@ const (
 	asciiEncoderStateSize      = 8
 	asciiEncoderDataSize       = 80
 	asciiEncoderDefaultVersion = 0
+	idxFileExt                 = ".idx"
+	statsFileExt               = ".stats"
+	walFileExt                 = ".wal"
+	blocsFileBlocSize          = 256
+	blocsFileCacheSize         = 100
+	wordSize                   = 8 + asciiEncoderStateSize + asciiEncoderDataSize
+	defaultBlocCacheBudget     = 1 << 20
 )
 
 var (
 	Document = model.BuildState(asciiEncoderStateSize, "document")
 	Dump     = model.BuildState(asciiEncoderStateSize, "dump")
+	// Journal buckets layers are CRDT operations merged without conflict.
+	Journal = model.BuildState(asciiEncoderStateSize, "journal")
+	// Topic buckets divergent layers are three-way merged, a conflicting merge is saved in
+	// Conflict state until its conflict markers are resolved.
+	Topic    = model.BuildState(asciiEncoderStateSize, "topic")
+	Conflict = model.BuildState(asciiEncoderStateSize, "conflict")
+	// Label words states.
+	Labeled   = model.BuildState(asciiEncoderStateSize, "label")
+	Unlabeled = model.BuildState(asciiEncoderStateSize, "unlabel")
+	// Topic words state.
+	Mention = model.BuildState(asciiEncoderStateSize, "mention")
 )
+
+type options struct {
+	blocCache  *BlocCache
+	syncPolicy wal.SyncPolicy
+	backend    storage.Backend
+}
+
+type Option func(*options)
+
+// Share a BlocCache between indexes. Each index has its own default cache otherwise.
+func WithBlocCache(c *BlocCache) Option {
+	return func(o *options) {
+		o.blocCache = c
+	}
+}
+
+// Choose when the write-ahead log is synced to disk. Default is wal.SyncAlways.
+func WithSyncPolicy(policy wal.SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
+
+// Keep idx files and the write-ahead log in a storage backend. Default is the files of the index
+// directory.
+func WithBackend(b storage.Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+func buildOptions(dir string, opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.blocCache == nil {
+		o.blocCache = NewBlocCache(defaultBlocCacheBudget)
+	}
+	if o.backend == nil {
+		o.backend = storage.NewDir(dir, blocsFileBlocSize, blocsFileCacheSize, statsFileExt)
+	}
+	return o
+}
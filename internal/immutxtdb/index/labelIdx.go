@@ -0,0 +1,382 @@
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/cache"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+)
+
+// A bucket is labeled by a word in Labeled state, and unlabeled by a later word in Unlabeled
+// state: the word of a label and a bucket with the greatest clock wins.
+
+// Label of a bucket set or unset at a clock.
+type LabelRef struct {
+	Uid   string
+	State model.State
+	Clock hlc.Timestamp
+}
+
+// (RH(LABEL), HLC, BUCKET_UID, LABELED|UNLABELED)
+type LabelIndex struct {
+	model.Index[[]byte, LabelRef]
+	*sync.Mutex
+
+	encoder        encoder.Encoder[[]byte]
+	backend        storage.Backend
+	device         string
+	deviceIdxFiles []storage.Storage
+	otherIdxFiles  []storage.Storage
+	stats          map[string]*idxStats
+	stamps         map[string]storage.Stamp
+	blocCache      *BlocCache
+	wal            *wal.Log
+	syncPolicy     wal.SyncPolicy
+}
+
+func NewLabelIndex(labelDir, device string, opts ...Option) (*LabelIndex, error) {
+	o := buildOptions(labelDir, opts)
+	deviceIdxFiles, otherIdxFiles, err := openIdxFiles(o.backend, labelKind, device)
+	if err != nil {
+		return nil, err
+	}
+	l, err := openWal(o.backend, labelKind, device, o.syncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	e := encoder.NewBytesEncoder(asciiEncoderDefaultVersion, asciiEncoderStateSize, asciiEncoderDataSize)
+	idx := &LabelIndex{
+		Mutex:          &sync.Mutex{},
+		encoder:        e,
+		backend:        o.backend,
+		device:         device,
+		deviceIdxFiles: deviceIdxFiles,
+		otherIdxFiles:  otherIdxFiles,
+		stats:          make(map[string]*idxStats),
+		stamps:         make(map[string]storage.Stamp),
+		blocCache:      o.blocCache,
+		wal:            l,
+		syncPolicy:     o.syncPolicy,
+	}
+
+	err = truncateTornWords(idx.deviceIdxFiles, idx.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.preload()
+	if err != nil {
+		return nil, err
+	}
+	err = idx.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// Label word data: [KEY_LEN,KEY,HLC,BUCKET_UID]
+// HLC device is not encoded, it is the device owning the idx file.
+func encodeLabelData(labelHash []byte, l LabelRef) ([]byte, error) {
+	if len(labelHash) > math.MaxUint8 {
+		return nil, errors.New("label key is too long")
+	}
+	data := make([]byte, 0, 1+len(labelHash)+hlc.EncodedSize+len(l.Uid))
+	data = append(data, byte(len(labelHash)))
+	data = append(data, labelHash...)
+	data = l.Clock.Append(data)
+	data = append(data, l.Uid...)
+	return data, nil
+}
+
+func decodeLabelData(data []byte, s model.State, device string) ([]byte, LabelRef, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0])+hlc.EncodedSize {
+		return nil, LabelRef{}, fmt.Errorf("bad label data length: %d", len(data))
+	}
+	k := 1 + int(data[0])
+	labelHash := data[1:k]
+	clock, err := hlc.Decode(data[k:k+hlc.EncodedSize], device)
+	if err != nil {
+		return nil, LabelRef{}, err
+	}
+	k += hlc.EncodedSize
+	return labelHash, LabelRef{Uid: string(data[k:]), State: s, Clock: clock}, nil
+}
+
+func labelKey(data []byte) []byte {
+	labelHash, _, err := decodeLabelData(data, nil, "")
+	if err != nil {
+		return nil
+	}
+	return labelHash
+}
+
+func (i *LabelIndex) preload() error {
+	i.Lock()
+	defer i.Unlock()
+
+	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
+	for _, bf := range idxFiles {
+		s, err := loadIdxStats(i.backend, bf, i.encoder, labelKey)
+		if err != nil {
+			return err
+		}
+		i.stats[bf.Name()] = s
+	}
+	return nil
+}
+
+// Complete writes interrupted by a crash.
+func (i *LabelIndex) recover() error {
+	i.Lock()
+	defer i.Unlock()
+	for _, records := range i.wal.Pending() {
+		err := i.WriteRecords(records)
+		if err != nil {
+			return err
+		}
+	}
+	return i.wal.Checkpoint()
+}
+
+func (i *LabelIndex) Close() error {
+	return i.wal.Close()
+}
+
+func (i *LabelIndex) Add(labelHash []byte, l LabelRef) error {
+	i.Lock()
+	defer i.Unlock()
+	records, err := i.EncodeWords(LabelEntry{LabelHash: labelHash, Ref: l})
+	if err != nil {
+		return err
+	}
+	// Log the word before writing it, a crash between both writes is completed on next open.
+	err = i.wal.Append(records...)
+	if err != nil {
+		return err
+	}
+	err = i.WriteRecords(records)
+	if err != nil {
+		return err
+	}
+	return i.wal.Checkpoint()
+}
+
+type LabelEntry struct {
+	LabelHash []byte
+	Ref       LabelRef
+}
+
+// Encode entries as words following the last word of the device idx file.
+// Caller must hold the index lock until the records are written.
+func (i *LabelIndex) EncodeWords(entries ...LabelEntry) ([]wal.Record, error) {
+	var records []wal.Record
+	for _, e := range entries {
+		bf := i.deviceIdxFiles[len(i.deviceIdxFiles)-1]
+		bfName := bf.Name()
+		seq := i.stats[bfName].seq
+		for _, r := range records {
+			if r.Target == bfName {
+				seq = r.Seq + 1
+			}
+		}
+		data, err := encodeLabelData(e.LabelHash, e.Ref)
+		if err != nil {
+			return nil, err
+		}
+		word, err := i.encoder.Encode(seq, e.Ref.State, data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, wal.Record{Target: bfName, Seq: seq, Data: word})
+	}
+	return records, nil
+}
+
+// Write encoded words into their idx file. Already written words are skipped, so records
+// logged in a wal can be written again after a crash.
+// Caller must hold the index lock.
+func (i *LabelIndex) WriteRecords(records []wal.Record) error {
+	err := replayRecords(i.backend, records, i.deviceIdxFiles, i.stats, i.encoder, labelKey, i.blocCache)
+	if err != nil {
+		return err
+	}
+	return syncTargets(i.deviceIdxFiles, records, i.syncPolicy)
+}
+
+// Words of this device from the since seq of each idx file, targeting idx file names.
+func (i *LabelIndex) DeviceRecords(since map[string]int) ([]wal.Record, error) {
+	i.Lock()
+	defer i.Unlock()
+	return deviceRecords(i.deviceIdxFiles, i.encoder, i.blocCache, since)
+}
+
+// Write words exported by other devices into their idx files. Already written words are
+// skipped, so importing the same records twice is harmless.
+// Caller must hold the index lock.
+func (i *LabelIndex) ImportRecords(records []wal.Record) error {
+	imported, err := openImportedFiles(i.backend, labelKind, i.device, records, &i.otherIdxFiles, i.stats, i.encoder, labelKey)
+	if err != nil {
+		return err
+	}
+	err = replayRecords(i.backend, imported, i.otherIdxFiles, i.stats, i.encoder, labelKey, i.blocCache)
+	if err != nil {
+		return err
+	}
+	dropSupersededFiles(&i.otherIdxFiles, i.stats, i.blocCache)
+	return nil
+}
+
+// First seq of each device idx file holding labels set or unset since a clock.
+// Clocks of a device are monotonic, so all following words are written since the clock too.
+func (i *LabelIndex) DeviceCursor(since hlc.Timestamp) (map[string]int, error) {
+	i.Lock()
+	defer i.Unlock()
+	cursor := make(map[string]int, len(i.deviceIdxFiles))
+	for _, bf := range i.deviceIdxFiles {
+		name := filepath.Base(bf.Name())
+		cursor[name] = i.stats[bf.Name()].seq
+		words, err := readWords(bf, i.encoder, i.blocCache)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range words {
+			_, l, err := decodeLabelData(w.data, w.state, i.device)
+			if err != nil {
+				return nil, err
+			}
+			if l.Clock.Compare(since) >= 0 {
+				cursor[name] = w.seq
+				break
+			}
+		}
+	}
+	return cursor, nil
+}
+
+// Load idx files of other devices which appeared or grew since the index was opened or last
+// refreshed. Return the names of those files.
+func (i *LabelIndex) Refresh() ([]string, error) {
+	i.Lock()
+	defer i.Unlock()
+	changed, err := refreshOtherFiles(i.backend, labelKind, i.device, &i.otherIdxFiles, i.stats, i.stamps, i.encoder, labelKey, i.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	return fileNames(changed), nil
+}
+
+// Rewrite the device idx file into a new rotation holding the last word of each label of a
+// bucket. Unlabeled words are kept: they unlabel buckets labeled by other devices. Superseded
+// idx files of all devices are removed. Return the count of dropped words.
+// Caller must hold the index lock.
+func (i *LabelIndex) Compact() (int, error) {
+	words, err := readWords(i.deviceIdxFiles[len(i.deviceIdxFiles)-1], i.encoder, i.blocCache)
+	if err != nil {
+		return 0, err
+	}
+	last := make(map[string]int, len(words))
+	for _, w := range words {
+		labelHash, l, err := decodeLabelData(w.data, w.state, i.device)
+		if err != nil {
+			return 0, err
+		}
+		last[string(labelHash)+l.Uid] = w.seq
+	}
+	dropped, err := rotateDeviceFile(i.backend, labelKind, i.device, &i.deviceIdxFiles, i.stats, i.encoder, labelKey, i.blocCache, func(w decodedWord[[]byte]) ([]byte, bool, error) {
+		labelHash, l, err := decodeLabelData(w.data, w.state, i.device)
+		if err != nil {
+			return nil, false, err
+		}
+		return w.data, last[string(labelHash)+l.Uid] == w.seq, nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return dropped, removeSupersededFiles(i.backend, labelKind)
+}
+
+// Count all entries of all devices without reading the idx files.
+func (i *LabelIndex) Count() (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	count := 0
+	for _, s := range i.stats {
+		count += s.seq
+	}
+	return count, nil
+}
+
+// Count words of a label, labeling or unlabeling a bucket.
+func (i *LabelIndex) CountKey(labelHash []byte) (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	count := 0
+	for _, s := range i.stats {
+		count += s.countKey(labelHash)
+	}
+	return count, nil
+}
+
+// Paginate the buckets holding a label on all devices, ordered by the clock they were labeled.
+func (i *LabelIndex) Paginate(labelHash []byte, order model.Order, limit int) (model.Paginer[[]byte, LabelRef], chan error) {
+	errChan := make(chan error)
+	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
+	p := model.NewPaginer(defaultPageSize, 0, func(push func(k []byte, v LabelRef, err error) bool) {
+		latest := map[string]LabelRef{}
+		for _, bf := range idxFiles {
+			words, err := readWords(bf, i.encoder, i.blocCache)
+			if err != nil {
+				push(nil, LabelRef{}, err)
+				return
+			}
+			device := idxFileDevice(bf.Name())
+			for _, w := range words {
+				key, l, err := decodeLabelData(w.data, w.state, device)
+				if err != nil {
+					push(nil, LabelRef{}, err)
+					return
+				}
+				if !bytes.Equal(key, labelHash) {
+					continue
+				}
+				if previous, ok := latest[l.Uid]; !ok || l.Clock.Compare(previous.Clock) > 0 {
+					latest[l.Uid] = l
+				}
+			}
+		}
+		var labeled []LabelRef
+		for _, l := range latest {
+			if bytes.Equal(l.State, Labeled) {
+				labeled = append(labeled, l)
+			}
+		}
+		slices.SortFunc(labeled, func(a, b LabelRef) int {
+			return a.Clock.Compare(b.Clock)
+		})
+		if order == model.BottomToTop {
+			slices.Reverse(labeled)
+		}
+		for _, l := range labeled {
+			if !push(labelHash, l, nil) {
+				return
+			}
+		}
+	})
+	return p, errChan
+}
+
+// Hit and miss counters of the bloc cache.
+func (i *LabelIndex) CacheStats() cache.Stats {
+	return i.blocCache.Stats()
+}
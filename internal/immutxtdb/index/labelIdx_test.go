@@ -0,0 +1,64 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelIndex_Paginate(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLabelIndex_Paginate")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := NewLabelIndex(tmpDir, "a")
+	require.NoError(t, err)
+	b, err := NewLabelIndex(tmpDir, "b")
+	require.NoError(t, err)
+
+	ref := func(uid string, s model.State, wall int64) LabelRef {
+		return LabelRef{Uid: uid, State: s, Clock: hlc.Timestamp{Wall: wall}}
+	}
+	require.NoError(t, a.Add([]byte("travel"), ref("foo", Labeled, 10)))
+	require.NoError(t, a.Add([]byte("travel"), ref("bar", Labeled, 11)))
+	require.NoError(t, a.Add([]byte("todo"), ref("baz", Labeled, 12)))
+	require.NoError(t, b.Add([]byte("travel"), ref("foo", Unlabeled, 20)))
+	require.NoError(t, b.Add([]byte("travel"), ref("baz", Labeled, 21)))
+	require.NoError(t, a.Add([]byte("travel"), ref("foo", Labeled, 15)))
+
+	// Reopen to read other device files
+	a, err = NewLabelIndex(tmpDir, "a")
+	require.NoError(t, err)
+	count, err := a.CountKey([]byte("travel"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	uids := func(order model.Order) []string {
+		p, _ := a.Paginate([]byte("travel"), order, 100)
+		page, _, err := p.Next()
+		require.NoError(t, err)
+		var uids []string
+		for _, e := range page.Entries() {
+			uids = append(uids, e.Val().Uid)
+		}
+		return uids
+	}
+	// The word with the greatest clock wins
+	assert.Equal(t, []string{"bar", "baz"}, uids(model.TopToBottom))
+	assert.Equal(t, []string{"baz", "bar"}, uids(model.BottomToTop))
+
+	// Only the last word of a label of a bucket is kept
+	a.Lock()
+	dropped, err := a.Compact()
+	a.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, []string{"bar", "baz"}, uids(model.TopToBottom))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "label-a-001.idx"))
+	assert.FileExists(t, filepath.Join(tmpDir, "label-a-002.idx"))
+}
@@ -1,13 +1,21 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"path/filepath"
+	"slices"
 	"sync"
 
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/cache"
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
-	"github.com/mxbossard/utilz/filez"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
 )
 
 // (RH(BUCKET_UID), RH(LAYER_FILE), BLOC_ID, STATE_PUBLIC_DATA)
@@ -18,18 +26,28 @@ type LayerIndex struct {
 
 	encoder        encoder.Encoder[[]byte]
 	filepathes     []string
-	deviceIdxFiles []*filez.BlocsFile
-	otherIdxFiles  []*filez.BlocsFile
-	seqs           map[string]int
+	backend        storage.Backend
+	device         string
+	deviceIdxFiles []storage.Storage
+	otherIdxFiles  []storage.Storage
+	stats          map[string]*idxStats
+	stamps         map[string]storage.Stamp
+	blocCache      *BlocCache
+	wal            *wal.Log
+	syncPolicy     wal.SyncPolicy
+	maxClock       hlc.Timestamp
 }
 
-func NewLayerIndex(layerDir, device string) (*LayerIndex, error) {
+func NewLayerIndex(layerDir, device string, opts ...Option) (*LayerIndex, error) {
 	// Init bucketIndex
-	// FIXME: manage multiple idx files (rotation)
 	// FIXME: add a filelock
 	// FIXME: addRotatingHash ?
-	firstDeviceFilepath := filepath.Join(layerDir, fmt.Sprintf("layer-%s-001.idx", device))
-	dbf1, err := filez.NewBlocsFile(firstDeviceFilepath, 256, 100)
+	o := buildOptions(layerDir, opts)
+	deviceIdxFiles, otherIdxFiles, err := openIdxFiles(o.backend, layerKind, device)
+	if err != nil {
+		return nil, err
+	}
+	l, err := openWal(o.backend, layerKind, device, o.syncPolicy)
 	if err != nil {
 		return nil, err
 	}
@@ -37,33 +55,452 @@ func NewLayerIndex(layerDir, device string) (*LayerIndex, error) {
 	idx := &LayerIndex{
 		Mutex:          &sync.Mutex{},
 		encoder:        e,
-		deviceIdxFiles: []*filez.BlocsFile{dbf1},
-		otherIdxFiles:  nil,
-		seqs:           make(map[string]int),
+		backend:        o.backend,
+		device:         device,
+		deviceIdxFiles: deviceIdxFiles,
+		otherIdxFiles:  otherIdxFiles,
+		stats:          make(map[string]*idxStats),
+		stamps:         make(map[string]storage.Stamp),
+		blocCache:      o.blocCache,
+		wal:            l,
+		syncPolicy:     o.syncPolicy,
 	}
 
 	// FIXME: need to setup the encoder!
 	//e.Setup()
 
+	err = truncateTornWords(idx.deviceIdxFiles, idx.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.preload()
+	if err != nil {
+		return nil, err
+	}
+	err = idx.recover()
+	if err != nil {
+		return nil, err
+	}
+
 	return idx, nil
 }
 
+// Layer word data: [KEY_LEN,KEY,BLOC_ID,HLC,LAYER_FILE]
+// HLC device is not encoded, it is the device owning the idx file.
+func encodeLayerData(uidHash []byte, l *model.LayerRef) ([]byte, error) {
+	if len(uidHash) > math.MaxUint8 {
+		return nil, errors.New("layer key is too long")
+	}
+	data := make([]byte, 0, 1+len(uidHash)+4+hlc.EncodedSize+len(l.BlocsFilepath()))
+	data = append(data, byte(len(uidHash)))
+	data = append(data, uidHash...)
+	data = binary.BigEndian.AppendUint32(data, uint32(l.BlocId()))
+	data = l.Clock().Append(data)
+	data = append(data, l.BlocsFilepath()...)
+	return data, nil
+}
+
+func decodeLayerData(data []byte, s model.State, device string) ([]byte, *model.LayerRef, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0])+4+hlc.EncodedSize {
+		return nil, nil, fmt.Errorf("bad layer data length: %d", len(data))
+	}
+	k := 1 + int(data[0])
+	uidHash := data[1:k]
+	blocId := int(binary.BigEndian.Uint32(data[k : k+4]))
+	k += 4
+	clock, err := hlc.Decode(data[k:k+hlc.EncodedSize], device)
+	if err != nil {
+		return nil, nil, err
+	}
+	k += hlc.EncodedSize
+	blocsFilepath := string(data[k:])
+	return uidHash, model.NewClockedLayerRef(blocsFilepath, blocId, s, clock), nil
+}
+
+func layerKey(data []byte) []byte {
+	uidHash, _, err := decodeLayerData(data, nil, "")
+	if err != nil {
+		return nil
+	}
+	return uidHash
+}
+
+func (i *LayerIndex) preload() error {
+	i.Lock()
+	defer i.Unlock()
+
+	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
+	for _, bf := range idxFiles {
+		s, err := loadIdxStats(i.backend, bf, i.encoder, layerKey)
+		if err != nil {
+			return err
+		}
+		i.stats[bf.Name()] = s
+		err = i.observeLastClock(bf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clocks of a device are monotonic: the last word of its idx file hold its max clock.
+func (i *LayerIndex) observeLastClock(bf storage.Storage) error {
+	last, err := bf.LastNonEmptyBloc()
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, state, data, err := i.encoder.DecodeLastWord(last)
+	if err != nil {
+		return err
+	}
+	_, l, err := decodeLayerData(data, state, idxFileDevice(bf.Name()))
+	if err != nil {
+		return err
+	}
+	i.observeClock(l.Clock())
+	return nil
+}
+
+func (i *LayerIndex) observeClock(clock hlc.Timestamp) {
+	if clock.Compare(i.maxClock) > 0 {
+		i.maxClock = clock
+	}
+}
+
+// Greatest layer clock of all devices.
+func (i *LayerIndex) MaxClock() hlc.Timestamp {
+	i.Lock()
+	defer i.Unlock()
+	return i.maxClock
+}
+
+// Complete writes interrupted by a crash.
+func (i *LayerIndex) recover() error {
+	i.Lock()
+	defer i.Unlock()
+	for _, records := range i.wal.Pending() {
+		err := i.WriteRecords(records)
+		if err != nil {
+			return err
+		}
+	}
+	return i.wal.Checkpoint()
+}
+
+func (i *LayerIndex) Close() error {
+	return i.wal.Close()
+}
+
+func (i *LayerIndex) selectDeviceBlocFile(uidHash []byte) storage.Storage {
+	return i.deviceIdxFiles[len(i.deviceIdxFiles)-1]
+}
+
 func (i *LayerIndex) Add(uidHash []byte, l *model.LayerRef) error {
 	// Write to plain text file but private data is hashed
-	panic("not implemented yet")
+	i.Lock()
+	defer i.Unlock()
+	records, err := i.EncodeWords(LayerEntry{UidHash: uidHash, Ref: l})
+	if err != nil {
+		return err
+	}
+	// Log the word before writing it, a crash between both writes is completed on next open.
+	err = i.wal.Append(records...)
+	if err != nil {
+		return err
+	}
+	err = i.WriteRecords(records)
+	if err != nil {
+		return err
+	}
+	return i.wal.Checkpoint()
+}
+
+type LayerEntry struct {
+	UidHash []byte
+	Ref     *model.LayerRef
+}
+
+// Encode entries as words following the last word of the device idx file.
+// Caller must hold the index lock until the records are written.
+func (i *LayerIndex) EncodeWords(entries ...LayerEntry) ([]wal.Record, error) {
+	var records []wal.Record
+	for _, e := range entries {
+		bf := i.selectDeviceBlocFile(e.UidHash)
+		bfName := bf.Name()
+		seq := i.stats[bfName].seq
+		for _, r := range records {
+			if r.Target == bfName {
+				seq = r.Seq + 1
+			}
+		}
+		data, err := encodeLayerData(e.UidHash, e.Ref)
+		if err != nil {
+			return nil, err
+		}
+		word, err := i.encoder.Encode(seq, e.Ref.State(), data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, wal.Record{Target: bfName, Seq: seq, Data: word})
+		i.observeClock(e.Ref.Clock())
+	}
+	return records, nil
+}
+
+// Write encoded words into their idx file. Already written words are skipped, so records
+// logged in a wal can be written again after a crash.
+// Caller must hold the index lock.
+func (i *LayerIndex) WriteRecords(records []wal.Record) error {
+	err := replayRecords(i.backend, records, i.deviceIdxFiles, i.stats, i.encoder, layerKey, i.blocCache)
+	if err != nil {
+		return err
+	}
+	return syncTargets(i.deviceIdxFiles, records, i.syncPolicy)
+}
+
+// Words of this device from the since seq of each idx file, targeting idx file names.
+func (i *LayerIndex) DeviceRecords(since map[string]int) ([]wal.Record, error) {
+	i.Lock()
+	defer i.Unlock()
+	return deviceRecords(i.deviceIdxFiles, i.encoder, i.blocCache, since)
 }
 
+// Write words exported by other devices into their idx files. Already written words are
+// skipped, so importing the same records twice is harmless.
+// Caller must hold the index lock.
+func (i *LayerIndex) ImportRecords(records []wal.Record) error {
+	imported, err := openImportedFiles(i.backend, layerKind, i.device, records, &i.otherIdxFiles, i.stats, i.encoder, layerKey)
+	if err != nil {
+		return err
+	}
+	err = replayRecords(i.backend, imported, i.otherIdxFiles, i.stats, i.encoder, layerKey, i.blocCache)
+	if err != nil {
+		return err
+	}
+	dropSupersededFiles(&i.otherIdxFiles, i.stats, i.blocCache)
+	for _, r := range imported {
+		_, state, data, err := i.encoder.Decode(r.Data)
+		if err != nil {
+			return err
+		}
+		_, l, err := decodeLayerData(data, state, idxFileDevice(r.Target))
+		if err != nil {
+			return err
+		}
+		i.observeClock(l.Clock())
+	}
+	return nil
+}
+
+// Layers of the records of layer idx files, to check them before importing the records.
+func (i *LayerIndex) RecordLayers(records []wal.Record) ([]*model.LayerRef, error) {
+	var refs []*model.LayerRef
+	for _, r := range records {
+		m := idxFilenameRegexp.FindStringSubmatch(r.Target)
+		if m == nil || m[1] != layerKind {
+			continue
+		}
+		_, state, data, err := i.encoder.Decode(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		_, l, err := decodeLayerData(data, state, m[2])
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, l)
+	}
+	return refs, nil
+}
+
+// First seq of each device idx file holding layers written since a clock, and those layers.
+// Clocks of a device are monotonic, so all following words are written since the clock too.
+func (i *LayerIndex) DeviceCursor(since hlc.Timestamp) (map[string]int, []LayerEntry, error) {
+	i.Lock()
+	defer i.Unlock()
+	cursor := make(map[string]int, len(i.deviceIdxFiles))
+	var entries []LayerEntry
+	for _, bf := range i.deviceIdxFiles {
+		name := filepath.Base(bf.Name())
+		cursor[name] = i.stats[bf.Name()].seq
+		words, err := readWords(bf, i.encoder, i.blocCache)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, w := range words {
+			uidHash, l, err := decodeLayerData(w.data, w.state, i.device)
+			if err != nil {
+				return nil, nil, err
+			}
+			if l.Clock().Compare(since) < 0 {
+				continue
+			}
+			cursor[name] = min(cursor[name], w.seq)
+			entries = append(entries, LayerEntry{UidHash: uidHash, Ref: l})
+		}
+	}
+	return cursor, entries, nil
+}
+
+// Load idx files of other devices which appeared or grew since the index was opened or last
+// refreshed. Return the names of those files.
+func (i *LayerIndex) Refresh() ([]string, error) {
+	i.Lock()
+	defer i.Unlock()
+	changed, err := refreshOtherFiles(i.backend, layerKind, i.device, &i.otherIdxFiles, i.stats, i.stamps, i.encoder, layerKey, i.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	for _, bf := range changed {
+		err = i.observeLastClock(bf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fileNames(changed), nil
+}
+
+// Rotation number of the latest idx file of each device, this device included.
+func (i *LayerIndex) Rotations() map[string]int {
+	i.Lock()
+	defer i.Unlock()
+	rotations := make(map[string]int)
+	for _, bf := range append(slices.Clone(i.deviceIdxFiles), i.otherIdxFiles...) {
+		name := idxFileName(bf)
+		rotations[idxFileDevice(name)] = max(rotations[idxFileDevice(name)], idxFileRotation(name))
+	}
+	return rotations
+}
+
+// Rewrite the device idx file into a new rotation holding the layers to keep, keep may move
+// their reference to a new data file. Flush is called before the new rotation is renamed, to make
+// the data it references durable. Superseded idx files of all devices are removed.
+// Return the count of dropped layers.
+// Caller must hold the index lock.
+func (i *LayerIndex) Compact(keep func(uidHash []byte, l *model.LayerRef) (*model.LayerRef, bool, error), flush func() error) (int, error) {
+	dropped, err := rotateDeviceFile(i.backend, layerKind, i.device, &i.deviceIdxFiles, i.stats, i.encoder, layerKey, i.blocCache, func(w decodedWord[[]byte]) ([]byte, bool, error) {
+		uidHash, l, err := decodeLayerData(w.data, w.state, i.device)
+		if err != nil {
+			return nil, false, err
+		}
+		l, ok, err := keep(uidHash, l)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		data, err := encodeLayerData(uidHash, l)
+		if err != nil {
+			return nil, false, err
+		}
+		return data, true, nil
+	}, flush)
+	if err != nil {
+		return 0, err
+	}
+	return dropped, removeSupersededFiles(i.backend, layerKind)
+}
+
+// Count all entries of all devices without reading the idx files.
 func (i *LayerIndex) Count() (int, error) {
-	// FIXME: Is it needed ?
-	panic("not implemented yet")
+	i.Lock()
+	defer i.Unlock()
+	count := 0
+	for _, s := range i.stats {
+		count += s.seq
+	}
+	return count, nil
+}
+
+// Count layers of a bucket.
+func (i *LayerIndex) CountKey(uidHash []byte) (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	return i.CountKeyLocked(uidHash), nil
+}
+
+// Count layers of a bucket. Caller must hold the index lock.
+func (i *LayerIndex) CountKeyLocked(uidHash []byte) int {
+	count := 0
+	for _, s := range i.stats {
+		count += s.countKey(uidHash)
+	}
+	return count
+}
+
+// Count layers of a State.
+func (i *LayerIndex) CountState(state model.State) (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	count := 0
+	for _, s := range i.stats {
+		count += s.countState(state)
+	}
+	return count, nil
 }
 
-func (i *LayerIndex) Paginate(key string, order model.Order, limit int) (model.Paginer[[]byte, *model.LayerRef], chan error) {
-	// TODO: build a cursor to iterate of the layers of a bucket
-	panic("not implemented yet")
+// Paginate layers of a bucket of all devices ordered by their clocks.
+func (i *LayerIndex) Paginate(uidHash []byte, order model.Order, limit int) (model.Paginer[[]byte, *model.LayerRef], chan error) {
+	errChan := make(chan error)
+	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
+	p := model.NewPaginer(defaultPageSize, 0, func(push func(k []byte, v *model.LayerRef, err error) bool) {
+		var layers []*model.LayerRef
+		for _, bf := range idxFiles {
+			words, err := readWords(bf, i.encoder, i.blocCache)
+			if err != nil {
+				push(nil, nil, err)
+				return
+			}
+			device := idxFileDevice(bf.Name())
+			for _, w := range words {
+				key, l, err := decodeLayerData(w.data, w.state, device)
+				if err != nil {
+					push(nil, nil, err)
+					return
+				}
+				if bytes.Equal(key, uidHash) {
+					layers = append(layers, l)
+				}
+			}
+		}
+		model.SortLayerRefs(layers)
+		if order == model.BottomToTop {
+			slices.Reverse(layers)
+		}
+		for _, l := range layers {
+			if !push(uidHash, l, nil) {
+				return
+			}
+		}
+	})
+	return p, errChan
 }
 
 func (i *LayerIndex) PaginateAll(order model.Order, limit int) (model.Paginer[[]byte, *model.LayerRef], chan error) {
-	// FIXME: Is it needed ?
-	panic("not implemented yet")
+	errChan := make(chan error)
+	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
+	p := model.NewPaginer(defaultPageSize, 0, func(push func(k []byte, v *model.LayerRef, err error) bool) {
+		for _, bf := range idxFiles {
+			words, err := readWords(bf, i.encoder, i.blocCache)
+			if err != nil {
+				push(nil, nil, err)
+				return
+			}
+			device := idxFileDevice(bf.Name())
+			ok := walkWords(words, order, func(w decodedWord[[]byte]) bool {
+				uidHash, l, err := decodeLayerData(w.data, w.state, device)
+				return push(uidHash, l, err)
+			})
+			if !ok {
+				return
+			}
+		}
+	})
+	return p, errChan
+}
+
+// Hit and miss counters of the bloc cache.
+func (i *LayerIndex) CacheStats() cache.Stats {
+	return i.blocCache.Stats()
 }
@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
 	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
 	"github.com/mxbossard/utilz/filez"
 	"github.com/stretchr/testify/assert"
@@ -86,10 +87,10 @@ func TestLayerIndex_PaginateAll(t *testing.T) {
 	require.True(t, page.Len() >= 4)
 
 	entries := page.Entries()
-	assert.Equal(t, "foo", entries[0].Key())
-	assert.Equal(t, "bar", entries[1].Key())
-	assert.Equal(t, "baz", entries[2].Key())
-	assert.Equal(t, "foo", entries[3].Key())
+	assert.Equal(t, []byte("foo"), entries[0].Key())
+	assert.Equal(t, []byte("bar"), entries[1].Key())
+	assert.Equal(t, []byte("baz"), entries[2].Key())
+	assert.Equal(t, []byte("foo"), entries[3].Key())
 
 	p2, errChan := bIdx.PaginateAll(model.BottomToTop, 100)
 	require.NotNil(t, p2)
@@ -103,9 +104,81 @@ func TestLayerIndex_PaginateAll(t *testing.T) {
 	require.True(t, page.Len() >= 4)
 
 	entries2 := page2.Entries()
-	assert.Equal(t, "foo", entries2[0].Key())
-	assert.Equal(t, "baz", entries2[1].Key())
-	assert.Equal(t, "bar", entries2[2].Key())
-	assert.Equal(t, "foo", entries2[3].Key())
+	assert.Equal(t, []byte("foo"), entries2[0].Key())
+	assert.Equal(t, []byte("baz"), entries2[1].Key())
+	assert.Equal(t, []byte("bar"), entries2[2].Key())
+	assert.Equal(t, []byte("foo"), entries2[3].Key())
 
 }
+
+func TestLayerIndex_CountAfterReopen(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLayerIndex_CountAfterReopen")
+	defer os.RemoveAll(tmpDir)
+
+	lIdx, err := NewLayerIndex(tmpDir, "test")
+	require.NoError(t, err)
+	require.NoError(t, lIdx.Add([]byte("foo"), model.NewLayerRef("file", 0, Dump)))
+	require.NoError(t, lIdx.Add([]byte("foo"), model.NewLayerRef("file", 1, Document)))
+
+	other, err := NewLayerIndex(tmpDir, "other")
+	require.NoError(t, err)
+	require.NoError(t, other.Add([]byte("bar"), model.NewLayerRef("file", 0, Dump)))
+
+	lIdx, err = NewLayerIndex(tmpDir, "test")
+	require.NoError(t, err)
+
+	count, err := lIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	count, err = lIdx.CountKey([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = lIdx.CountState(Dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestLayerIndex_PaginateByClock(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLayerIndex_PaginateByClock")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := NewLayerIndex(tmpDir, "a")
+	require.NoError(t, err)
+	b, err := NewLayerIndex(tmpDir, "b")
+	require.NoError(t, err)
+
+	ref := func(blocId int, wall int64, counter uint32) *model.LayerRef {
+		return model.NewClockedLayerRef("file", blocId, Document, hlc.Timestamp{Wall: wall, Counter: counter})
+	}
+	require.NoError(t, a.Add([]byte("foo"), ref(0, 10, 0)))
+	require.NoError(t, a.Add([]byte("bar"), ref(1, 11, 0)))
+	require.NoError(t, a.Add([]byte("foo"), ref(2, 30, 0)))
+	require.NoError(t, b.Add([]byte("foo"), ref(0, 20, 0)))
+	require.NoError(t, b.Add([]byte("foo"), ref(1, 30, 0)))
+
+	// Reopen to read other device files
+	a, err = NewLayerIndex(tmpDir, "a")
+	require.NoError(t, err)
+	assert.Equal(t, hlc.Timestamp{Wall: 30, Device: "b"}, a.MaxClock())
+
+	p, _ := a.Paginate([]byte("foo"), model.TopToBottom, 100)
+	page, _, err := p.Next()
+	require.NoError(t, err)
+	require.Equal(t, 4, page.Len())
+	var clocks []string
+	for _, e := range page.Entries() {
+		assert.Equal(t, []byte("foo"), e.Key())
+		clocks = append(clocks, e.Val().Clock().String())
+	}
+	// Same wall & counter ordered by device
+	assert.Equal(t, []string{"10.0@a", "20.0@b", "30.0@a", "30.0@b"}, clocks)
+
+	p, _ = a.Paginate([]byte("foo"), model.BottomToTop, 100)
+	page, _, err = p.Next()
+	require.NoError(t, err)
+	require.Equal(t, 4, page.Len())
+	assert.Equal(t, "30.0@b", page.Entries()[0].Val().Clock().String())
+	assert.Equal(t, 1, page.Entries()[0].Val().BlocId())
+}
@@ -0,0 +1,110 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+)
+
+func walFileName(kind, device string) string {
+	return fmt.Sprintf("%s-%s%s", kind, device, walFileExt)
+}
+
+// Open the write-ahead log of an index kind, kept in the backend of its idx files.
+func openWal(b storage.Backend, kind, device string, policy wal.SyncPolicy) (*wal.Log, error) {
+	f, err := b.OpenFile(walFileName(kind, device))
+	if err != nil {
+		return nil, err
+	}
+	return wal.OpenFile(f, policy)
+}
+
+// Drop the partial word left at the end of an idx file by a crash during an append, the word
+// logged in the wal is then replayed aligned. Run before the stats are loaded: the torn word may
+// be alone in a new bloc, the last bloc then holds no whole word.
+func truncateTornWords(files []storage.Storage, c *BlocCache) error {
+	for _, st := range files {
+		last, err := st.LastNonEmptyBloc()
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(last)%wordSize == 0 {
+			continue
+		}
+		// Words do not span blocs, only the last bloc is torn.
+		var size int64
+		for b, err := range st.All(model.TopToBottom) {
+			if err != nil {
+				return err
+			}
+			size += int64(len(b))
+		}
+		err = st.Truncate(size - int64(len(last)%wordSize))
+		invalidateFile(st.Name(), c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync the idx files written by records before their wal is checkpointed: a checkpointed word
+// must survive a crash.
+func syncTargets(files []storage.Storage, records []wal.Record, policy wal.SyncPolicy) error {
+	if policy == wal.SyncNever {
+		return nil
+	}
+	synced := make(map[int]bool, len(files))
+	for _, r := range records {
+		k := indexOfFile(files, r.Target)
+		if k < 0 || synced[k] {
+			continue
+		}
+		err := files[k].Sync()
+		if err != nil {
+			return err
+		}
+		synced[k] = true
+	}
+	return nil
+}
+
+// Complete the writes logged in the wal which did not reach their idx file.
+// Records targeting files not owned by this index are ignored.
+func replayRecords[T any](b storage.Backend, records []wal.Record, files []storage.Storage, stats map[string]*idxStats, e encoder.Encoder[T], keyOf func(T) []byte, c *BlocCache) error {
+	for _, r := range records {
+		k := indexOfFile(files, r.Target)
+		if k < 0 {
+			continue
+		}
+		st := files[k]
+		s := stats[st.Name()]
+		if r.Seq < s.seq {
+			// Already written
+			continue
+		} else if r.Seq > s.seq {
+			return fmt.Errorf("cannot replay word #%d in %s: next seq is %d", r.Seq, r.Target, s.seq)
+		}
+		_, state, data, err := e.Decode(r.Data)
+		if err != nil {
+			return fmt.Errorf("cannot replay word #%d in %s: %w", r.Seq, r.Target, err)
+		}
+		err = st.Append(r.Data)
+		invalidateLastBloc(st.Name(), c)
+		if err != nil {
+			return err
+		}
+		s.add(r.Seq, keyOf(data), state)
+		err = saveIdxStats(b, st, s, asciiEncoderStateSize)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
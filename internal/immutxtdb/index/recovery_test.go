@@ -0,0 +1,164 @@
+package index
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errInjected = errors.New("injected fault")
+
+// A backend whose storages tear the append exceeding a byte budget, as a crash during the
+// write would: the word is placed, then cut. Syncs are counted.
+type faultyBackend struct {
+	storage.Backend
+	budget int
+	sizes  map[string]int64
+	syncs  int
+	onSync func()
+}
+
+func (b *faultyBackend) Open(name string) (storage.Storage, error) {
+	st, err := b.Backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyStorage{Storage: st, backend: b}, nil
+}
+
+type faultyStorage struct {
+	storage.Storage
+	backend *faultyBackend
+}
+
+func (s *faultyStorage) Append(data []byte) error {
+	b := s.backend
+	if b.sizes == nil {
+		b.sizes = map[string]int64{}
+	}
+	size := b.sizes[s.Name()]
+	err := s.Storage.Append(data)
+	if err != nil {
+		return err
+	}
+	if b.budget >= len(data) {
+		b.budget -= len(data)
+		b.sizes[s.Name()] = size + int64(len(data))
+		return nil
+	}
+	err = s.Storage.Truncate(size + int64(b.budget))
+	b.sizes[s.Name()] = size + int64(b.budget)
+	b.budget = 0
+	return errors.Join(err, errInjected)
+}
+
+func (s *faultyStorage) Sync() error {
+	b := s.backend
+	b.syncs++
+	if b.onSync != nil {
+		b.onSync()
+	}
+	return s.Storage.Sync()
+}
+
+func TestBucketIndex_RecoverTornWord(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestBucketIndex_RecoverTornWord")
+	defer os.RemoveAll(tmpDir)
+
+	backends := map[string]storage.Backend{
+		"memory": storage.NewMemory(blocsFileBlocSize),
+		"dir":    storage.NewDir(tmpDir, blocsFileBlocSize, blocsFileCacheSize, statsFileExt),
+	}
+	for name, backend := range backends {
+		b := &faultyBackend{Backend: backend, budget: wordSize + 10}
+		bIdx, err := NewBucketIndex(tmpDir, "test", WithBackend(b))
+		require.NoError(t, err)
+		require.NoError(t, bIdx.Add("foo", Document))
+
+		// Crash while appending the word: the idx file ends with a partial word
+		assert.ErrorIs(t, bIdx.Add("bar", Dump), errInjected, name)
+		require.NoError(t, bIdx.Close())
+
+		b.budget = math.MaxInt
+		bIdx, err = NewBucketIndex(tmpDir, "test", WithBackend(b))
+		require.NoError(t, err, name)
+		assert.Empty(t, bIdx.wal.Pending(), name)
+		require.NoError(t, bIdx.Add("baz", Document))
+
+		p, _ := bIdx.PaginateAll(model.TopToBottom, 100)
+		page, _, err := p.Next()
+		require.NoError(t, err, name)
+		require.Equal(t, 3, page.Len(), name)
+		assert.Equal(t, "foo", page.Entries()[0].Key(), name)
+		assert.Equal(t, "bar", page.Entries()[1].Key(), name)
+		assert.Equal(t, "baz", page.Entries()[2].Key(), name)
+		count, err := bIdx.CountState(Dump)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count, name)
+
+		// Words stay aligned on next open
+		bIdx, err = NewBucketIndex(tmpDir, "test", WithBackend(b))
+		require.NoError(t, err, name)
+		count, err = bIdx.Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count, name)
+	}
+}
+
+func TestBucketIndex_RecoverTornWordInNewBloc(t *testing.T) {
+	// Two words fill the first bloc, the third one is torn in a new bloc
+	b := &faultyBackend{Backend: storage.NewMemory(blocsFileBlocSize), budget: 2*wordSize + 10}
+	bIdx, err := NewBucketIndex("", "test", WithBackend(b))
+	require.NoError(t, err)
+	require.NoError(t, bIdx.Add("foo", Document))
+	require.NoError(t, bIdx.Add("bar", Document))
+	assert.ErrorIs(t, bIdx.Add("baz", Dump), errInjected)
+	require.NoError(t, bIdx.Close())
+	st, err := b.Open(bIdx.deviceIdxFiles[0].Name())
+	require.NoError(t, err)
+	last, err := st.LastNonEmptyBloc()
+	require.NoError(t, err)
+	require.Len(t, last, 10)
+
+	b.budget = math.MaxInt
+	bIdx, err = NewBucketIndex("", "test", WithBackend(b))
+	require.NoError(t, err)
+	assert.Empty(t, bIdx.wal.Pending())
+	count, err := bIdx.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = bIdx.CountState(Dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestBucketIndex_SyncBeforeCheckpoint(t *testing.T) {
+	b := &faultyBackend{Backend: storage.NewMemory(blocsFileBlocSize), budget: math.MaxInt}
+	walFile, err := b.OpenFile(walFileName(bucketKind, "test"))
+	require.NoError(t, err)
+	b.onSync = func() {
+		// The word is still logged when the idx file is synced
+		size, err := walFile.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		assert.NotZero(t, size)
+	}
+	bIdx, err := NewBucketIndex("", "test", WithBackend(b))
+	require.NoError(t, err)
+	require.NoError(t, bIdx.Add("foo", Document))
+	assert.Equal(t, 1, b.syncs)
+
+	b.onSync = nil
+	other, err := NewBucketIndex("", "other", WithBackend(b), WithSyncPolicy(wal.SyncNever))
+	require.NoError(t, err)
+	require.NoError(t, other.Add("foo", Document))
+	assert.Equal(t, 1, b.syncs)
+}
@@ -0,0 +1,78 @@
+package index
+
+import (
+	"errors"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+)
+
+// Idx files of other devices may appear or grow under an open index when the db directory is
+// replicated by a third party tool (Syncthing, rsync, ...). They are detected by their size and
+// modification time: blocs are padded, so a file may grow inside its last bloc.
+
+// Open the new idx files of other devices, reopen the grown ones and count their new words.
+// Files superseded by a new rotation are forgotten. Return the new or grown files.
+func refreshOtherFiles[T any](b storage.Backend, kind, device string, others *[]storage.Storage, stats map[string]*idxStats, stamps map[string]storage.Stamp, e encoder.Encoder[T], keyOf func(T) []byte, c *BlocCache) ([]storage.Storage, error) {
+	_, names, err := listIdxFiles(b, kind, device)
+	if err != nil {
+		return nil, err
+	}
+	var changed []storage.Storage
+	for _, name := range names {
+		stamp, err := b.Stat(name)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if old, ok := stamps[name]; ok && old == stamp {
+			continue
+		}
+		stamps[name] = stamp
+		st, err := b.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		s, known := stats[st.Name()]
+		if !known {
+			s = newIdxStats()
+		}
+		seq := s.seq
+		s, err = catchUpIdxStats(st, s, e, keyOf)
+		if err != nil {
+			return nil, err
+		}
+		stats[st.Name()] = s
+		k := indexOfFile(*others, st.Name())
+		if k < 0 {
+			*others = append(*others, st)
+		} else {
+			(*others)[k] = st
+		}
+		if !known || s.seq != seq {
+			invalidateFile(st.Name(), c)
+			changed = append(changed, st)
+		}
+	}
+	dropSupersededFiles(others, stats, c)
+	return changed, nil
+}
+
+func indexOfFile(files []storage.Storage, name string) int {
+	for k, st := range files {
+		if st.Name() == name {
+			return k
+		}
+	}
+	return -1
+}
+
+func fileNames(files []storage.Storage) []string {
+	names := make([]string, 0, len(files))
+	for _, st := range files {
+		names = append(names, idxFileName(st))
+	}
+	return names
+}
@@ -0,0 +1,126 @@
+package index
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+)
+
+// Compaction rewrites the device idx file into a new rotation holding the kept words, renumbered
+// from seq 0 so seqs stay contiguous: counts and cursors of the new rotation stay valid. The new
+// rotation is written under a temp name, synced then renamed, so it is complete once visible to
+// other devices and after a crash, then the previous rotation is removed.
+
+const rotationTmpExt = ".tmp"
+
+// Rewrite the device idx file into a new rotation holding the kept words, keep may rewrite their
+// data. Nothing is rewritten when no word is dropped. Flush, when not nil, is called once the
+// kept words are known, before the new rotation is renamed. Return the count of dropped words.
+// Caller must hold the index lock.
+func rotateDeviceFile[T any](b storage.Backend, kind, device string, files *[]storage.Storage, stats map[string]*idxStats, e encoder.Encoder[T], keyOf func(T) []byte, c *BlocCache, keep func(w decodedWord[T]) (T, bool, error), flush func() error) (int, error) {
+	old := (*files)[len(*files)-1]
+	words, err := readWords(old, e, c)
+	if err != nil {
+		return 0, err
+	}
+	var kept []decodedWord[T]
+	for _, w := range words {
+		data, ok, err := keep(w)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			kept = append(kept, decodedWord[T]{seq: len(kept), state: w.state, data: data})
+		}
+	}
+	dropped := len(words) - len(kept)
+	if dropped == 0 || len(kept) == 0 {
+		// A device rotation is never empty, other devices would keep reading the previous one.
+		return 0, nil
+	}
+
+	name := idxFilename(kind, device, idxFileRotation(idxFileName(old))+1)
+	tmpName := name + rotationTmpExt
+	err = b.Remove(tmpName)
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return 0, err
+	}
+	tmp, err := b.Open(tmpName)
+	if err != nil {
+		return 0, err
+	}
+	s := newIdxStats()
+	for _, w := range kept {
+		word, err := e.Encode(w.seq, w.state, w.data)
+		if err != nil {
+			return 0, err
+		}
+		err = tmp.Append(word)
+		if err != nil {
+			return 0, err
+		}
+		s.add(w.seq, keyOf(w.data), w.state)
+	}
+	if flush != nil {
+		err = flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return 0, err
+	}
+	err = b.Rename(tmpName, name)
+	if err != nil {
+		return 0, err
+	}
+	st, err := b.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	err = saveIdxStats(b, st, s, asciiEncoderStateSize)
+	if err != nil {
+		return 0, err
+	}
+	*files = []storage.Storage{st}
+	stats[st.Name()] = s
+	delete(stats, old.Name())
+	invalidateFile(old.Name(), c)
+	return dropped, nil
+}
+
+// Remove idx files of a kind superseded by a newer rotation of their device, this device
+// previous rotations and the other devices ones once their new rotation is replicated.
+func removeSupersededFiles(b storage.Backend, kind string) error {
+	_, superseded, err := latestIdxFiles(b, kind)
+	if err != nil {
+		return err
+	}
+	for _, name := range superseded {
+		err = b.Remove(name)
+		if err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget other devices files superseded by a newer rotation of their device.
+func dropSupersededFiles(others *[]storage.Storage, stats map[string]*idxStats, c *BlocCache) {
+	latest := make(map[string]int)
+	for _, st := range *others {
+		device := idxFileDevice(st.Name())
+		latest[device] = max(latest[device], idxFileRotation(idxFileName(st)))
+	}
+	*others = slices.DeleteFunc(*others, func(st storage.Storage) bool {
+		if idxFileRotation(idxFileName(st)) < latest[idxFileDevice(st.Name())] {
+			delete(stats, st.Name())
+			invalidateFile(st.Name(), c)
+			return true
+		}
+		return false
+	})
+}
@@ -0,0 +1,225 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+)
+
+// Stats sidecar of an idx file: [MAGIC,VERSION,SEQ,STATE_SIZE,STATE_COUNT,(STATE,COUNT)...,KEY_COUNT,(RH(KEY),COUNT)...]
+// Keys are hashed to not leak private data next to an encrypted idx file.
+
+var statsMagic = []byte("stats000")
+
+const statsVersion = int32(0)
+
+func statsFilepath(idxFilepath string) string {
+	return idxFilepath + statsFileExt
+}
+
+func hashKey(key []byte) uint64 {
+	h := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// idxStats count words of one idx file by key and by state.
+// seq is the next seq to write, so it is also the count of words in the file.
+type idxStats struct {
+	seq    int
+	states map[string]int
+	keys   map[uint64]int
+}
+
+func newIdxStats() *idxStats {
+	return &idxStats{
+		states: make(map[string]int),
+		keys:   make(map[uint64]int),
+	}
+}
+
+func (s *idxStats) add(seq int, key []byte, state model.State) {
+	s.states[string(state)]++
+	s.keys[hashKey(key)]++
+	s.seq = seq + 1
+}
+
+func (s *idxStats) countKey(key []byte) int {
+	return s.keys[hashKey(key)]
+}
+
+func (s *idxStats) countState(state model.State) int {
+	return s.states[string(state)]
+}
+
+func (s *idxStats) marshal(stateSize int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	fields := []any{statsMagic, statsVersion, int32(s.seq), int32(stateSize), int32(len(s.states))}
+	for state, count := range s.states {
+		data := make([]byte, stateSize)
+		copy(data, state)
+		fields = append(fields, data, int32(count))
+	}
+	fields = append(fields, int32(len(s.keys)))
+	for key, count := range s.keys {
+		fields = append(fields, key, int32(count))
+	}
+	for _, f := range fields {
+		err := binary.Write(buf, binary.BigEndian, f)
+		if err != nil {
+			return nil, fmt.Errorf("encoding stats: %w", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalIdxStats(data []byte) (*idxStats, error) {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(statsMagic))
+	var version, seq, stateSize, stateCount, keyCount int32
+	for _, f := range []any{magic, &version, &seq, &stateSize, &stateCount} {
+		err := binary.Read(r, binary.BigEndian, f)
+		if err != nil {
+			return nil, fmt.Errorf("decoding stats: %w", err)
+		}
+	}
+	if !bytes.Equal(magic, statsMagic) || version != statsVersion {
+		return nil, errors.New("not a stats file")
+	}
+	s := newIdxStats()
+	s.seq = int(seq)
+	for range stateCount {
+		state := make([]byte, stateSize)
+		var count int32
+		err := errors.Join(binary.Read(r, binary.BigEndian, state), binary.Read(r, binary.BigEndian, &count))
+		if err != nil {
+			return nil, fmt.Errorf("decoding stats state: %w", err)
+		}
+		s.states[string(state)] = int(count)
+	}
+	err := binary.Read(r, binary.BigEndian, &keyCount)
+	if err != nil {
+		return nil, fmt.Errorf("decoding stats: %w", err)
+	}
+	for range keyCount {
+		var key uint64
+		var count int32
+		err := errors.Join(binary.Read(r, binary.BigEndian, &key), binary.Read(r, binary.BigEndian, &count))
+		if err != nil {
+			return nil, fmt.Errorf("decoding stats key: %w", err)
+		}
+		s.keys[key] = int(count)
+	}
+	return s, nil
+}
+
+// Write the stats as the idx file metadata sidecar.
+func saveIdxStats(b storage.Backend, st storage.Storage, s *idxStats, stateSize int) error {
+	data, err := s.marshal(stateSize)
+	if err != nil {
+		return err
+	}
+	return b.WriteMeta(idxFileName(st), data)
+}
+
+// Load the stats of an idx file. The sidecar may be missing or late (crash, partial sync of
+// an other device files), so the missing words are read from the end of the idx file.
+func loadIdxStats[T any](b storage.Backend, st storage.Storage, e encoder.Encoder[T], keyOf func(T) []byte) (*idxStats, error) {
+	s := newIdxStats()
+	data, err := b.ReadMeta(idxFileName(st))
+	if err == nil {
+		loaded, err := unmarshalIdxStats(data)
+		if err == nil {
+			s = loaded
+		}
+	} else if !errors.Is(err, storage.ErrNotExist) {
+		return nil, err
+	}
+	return catchUpIdxStats(st, s, e, keyOf)
+}
+
+// Last bloc of an idx file holding a whole word. A torn word may start a new bloc of the idx file
+// of an other device, being synced or not yet recovered by its device.
+func lastWholeWordBloc(st storage.Storage) ([]byte, error) {
+	last, err := st.LastNonEmptyBloc()
+	if err != nil || len(last) >= wordSize {
+		return last, err
+	}
+	for b, err := range st.All(model.BottomToTop) {
+		if err != nil {
+			return nil, err
+		}
+		if len(b) >= wordSize {
+			return b, nil
+		}
+	}
+	return nil, storage.ErrNotExist
+}
+
+// Count the words written in the idx file after the stats seq, reading from the end of the file.
+// Stats ahead of the file are reset.
+func catchUpIdxStats[T any](st storage.Storage, s *idxStats, e encoder.Encoder[T], keyOf func(T) []byte) (*idxStats, error) {
+	last, err := lastWholeWordBloc(st)
+	if errors.Is(err, storage.ErrNotExist) {
+		return newIdxStats(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	lastSeq, _, _, err := e.DecodeLastWord(last)
+	if err != nil {
+		return nil, err
+	}
+	if lastSeq < s.seq-1 {
+		// Stats are ahead of the idx file, they cannot be trusted.
+		s = newIdxStats()
+	}
+	if lastSeq < s.seq {
+		return s, nil
+	}
+
+	// Catch up reading from bottom until reaching already counted words.
+	from := s.seq
+	var decodeErr error
+	type word struct {
+		seq   int
+		key   []byte
+		state model.State
+	}
+	missing := make([]word, 0, lastSeq-from+1)
+	for b, err := range st.All(model.BottomToTop) {
+		if err != nil {
+			return nil, err
+		}
+		stop := false
+		e.DecodeAll(model.BottomToTop, b, func(seq int, state model.State, data T, err error) {
+			if stop || decodeErr != nil {
+				return
+			}
+			if err != nil {
+				decodeErr = err
+				return
+			}
+			if seq < from {
+				stop = true
+				return
+			}
+			missing = append(missing, word{seq, keyOf(data), state})
+		})
+		if stop || decodeErr != nil {
+			break
+		}
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	// Apply in file order to keep seq pointing after the last word.
+	for k := len(missing) - 1; k >= 0; k-- {
+		s.add(missing[k].seq, missing[k].key, missing[k].state)
+	}
+	return s, nil
+}
@@ -0,0 +1,453 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+)
+
+// Inverted index of the projected text of buckets. Postings keep the positions of a term in a
+// bucket text, so phrases can be matched. The index is derived from the layers of all devices:
+// it is updated with the clock of the last layer each bucket was indexed at, and saved in the
+// metadata sidecar of the device, like idx stats. A late or lost sidecar only costs indexing
+// again the buckets whose last layer changed since it was saved. The sidecar is never synced.
+//
+// Text sidecar: [MAGIC,VERSION,DOC_COUNT,(UID,CLOCK,LENGTH,TERM_COUNT,(TERM,POS_COUNT,POS...)...)...]
+// UID and TERM are length prefixed, CLOCK is the encoded clock followed by its length prefixed
+// device.
+
+var textMagic = []byte("text0000")
+
+const textVersion = int32(0)
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+type textDoc struct {
+	clock  hlc.Timestamp
+	length int
+	terms  []string
+}
+
+type TextIndex struct {
+	*sync.Mutex
+
+	docs       map[string]*textDoc
+	postings   map[string]map[string][]int
+	vocabulary trigramSet
+	totalLen   int
+
+	// Backend keeping the sidecar, nil for an index kept in memory only.
+	backend storage.Backend
+	name    string
+	changed bool
+}
+
+// Build a text index kept in memory only.
+func NewTextIndex() *TextIndex {
+	return &TextIndex{
+		Mutex:      &sync.Mutex{},
+		docs:       make(map[string]*textDoc),
+		postings:   make(map[string]map[string][]int),
+		vocabulary: trigramSet{},
+	}
+}
+
+// Open the text index of a device, loading its sidecar. A missing or unreadable sidecar opens
+// an empty index.
+func OpenTextIndex(textDir, device string, opts ...Option) (*TextIndex, error) {
+	o := buildOptions(textDir, opts)
+	name := fmt.Sprintf("%s-%s", textKind, device)
+	i := NewTextIndex()
+	data, err := o.backend.ReadMeta(name)
+	if err == nil {
+		loaded, err := unmarshalTextIndex(data)
+		if err == nil {
+			i = loaded
+		}
+	} else if !errors.Is(err, storage.ErrNotExist) {
+		return nil, err
+	}
+	i.backend = o.backend
+	i.name = name
+	return i, nil
+}
+
+// Save the sidecar if the index changed since it was opened or saved.
+func (i *TextIndex) Save() error {
+	i.Lock()
+	defer i.Unlock()
+	if i.backend == nil || !i.changed {
+		return nil
+	}
+	data, err := i.marshal()
+	if err != nil {
+		return err
+	}
+	err = i.backend.WriteMeta(i.name, data)
+	if err != nil {
+		return err
+	}
+	i.changed = false
+	return nil
+}
+
+func appendString(data []byte, s string) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(s)))
+	return append(data, s...)
+}
+
+// Caller must hold the index lock.
+func (i *TextIndex) marshal() ([]byte, error) {
+	data := slices.Clone(textMagic)
+	data = binary.BigEndian.AppendUint32(data, uint32(textVersion))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(i.docs)))
+	for uid, doc := range i.docs {
+		if len(uid) > math.MaxUint16 || len(doc.clock.Device) > math.MaxUint16 {
+			return nil, fmt.Errorf("cannot encode text of %s: uid or device too long", uid)
+		}
+		data = appendString(data, uid)
+		data = doc.clock.Append(data)
+		data = appendString(data, doc.clock.Device)
+		data = binary.BigEndian.AppendUint32(data, uint32(doc.length))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(doc.terms)))
+		for _, term := range doc.terms {
+			positions := i.postings[term][uid]
+			data = appendString(data, term)
+			data = binary.BigEndian.AppendUint32(data, uint32(len(positions)))
+			for _, pos := range positions {
+				data = binary.BigEndian.AppendUint32(data, uint32(pos))
+			}
+		}
+	}
+	return data, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	_, err = io.ReadFull(r, s)
+	return string(s), err
+}
+
+func unmarshalTextIndex(data []byte) (*TextIndex, error) {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(textMagic))
+	var version int32
+	var docCount uint32
+	for _, f := range []any{magic, &version, &docCount} {
+		err := binary.Read(r, binary.BigEndian, f)
+		if err != nil {
+			return nil, fmt.Errorf("decoding text index: %w", err)
+		}
+	}
+	if !bytes.Equal(magic, textMagic) || version != textVersion {
+		return nil, errors.New("not a text index")
+	}
+	i := NewTextIndex()
+	for range docCount {
+		uid, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("decoding text doc: %w", err)
+		}
+		encoded := make([]byte, hlc.EncodedSize)
+		_, err = io.ReadFull(r, encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decoding text doc %s: %w", uid, err)
+		}
+		device, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("decoding text doc %s: %w", uid, err)
+		}
+		clock, err := hlc.Decode(encoded, device)
+		if err != nil {
+			return nil, fmt.Errorf("decoding text doc %s: %w", uid, err)
+		}
+		var length, termCount uint32
+		err = errors.Join(binary.Read(r, binary.BigEndian, &length), binary.Read(r, binary.BigEndian, &termCount))
+		if err != nil {
+			return nil, fmt.Errorf("decoding text doc %s: %w", uid, err)
+		}
+		doc := &textDoc{clock: clock, length: int(length)}
+		for range termCount {
+			term, err := readString(r)
+			if err != nil {
+				return nil, fmt.Errorf("decoding text doc %s: %w", uid, err)
+			}
+			var posCount uint32
+			err = binary.Read(r, binary.BigEndian, &posCount)
+			if err != nil {
+				return nil, fmt.Errorf("decoding text doc %s: %w", uid, err)
+			}
+			if int(posCount) > r.Len()/4 {
+				return nil, fmt.Errorf("decoding text doc %s: %w", uid, io.ErrUnexpectedEOF)
+			}
+			positions := make([]uint32, posCount)
+			err = binary.Read(r, binary.BigEndian, positions)
+			if err != nil {
+				return nil, fmt.Errorf("decoding text doc %s: %w", uid, err)
+			}
+			i.addPostings(uid, term, positions)
+			doc.terms = append(doc.terms, term)
+		}
+		i.docs[uid] = doc
+		i.totalLen += doc.length
+	}
+	return i, nil
+}
+
+// Caller must hold the index lock.
+func (i *TextIndex) addPostings(uid, term string, positions []uint32) {
+	postings, ok := i.postings[term]
+	if !ok {
+		postings = make(map[string][]int)
+		i.postings[term] = postings
+		i.vocabulary.add(term)
+	}
+	for _, pos := range positions {
+		postings[uid] = append(postings[uid], int(pos))
+	}
+}
+
+// Index the text of a bucket at the clock of its last layer, replacing its previous text.
+func (i *TextIndex) Update(uid, text string, clock hlc.Timestamp) {
+	i.Lock()
+	defer i.Unlock()
+	i.remove(uid)
+	tokens := Tokenize(text)
+	doc := &textDoc{clock: clock, length: len(tokens)}
+	for _, t := range tokens {
+		positions, ok := i.postings[t.Term]
+		if !ok {
+			positions = make(map[string][]int)
+			i.postings[t.Term] = positions
+			i.vocabulary.add(t.Term)
+		}
+		if len(positions[uid]) == 0 {
+			doc.terms = append(doc.terms, t.Term)
+		}
+		positions[uid] = append(positions[uid], t.Pos)
+	}
+	i.docs[uid] = doc
+	i.totalLen += doc.length
+	i.changed = true
+}
+
+func (i *TextIndex) Remove(uid string) {
+	i.Lock()
+	defer i.Unlock()
+	i.remove(uid)
+}
+
+// Caller must hold the index lock.
+func (i *TextIndex) remove(uid string) {
+	doc, ok := i.docs[uid]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(i.postings[term], uid)
+		if len(i.postings[term]) == 0 {
+			delete(i.postings, term)
+			i.vocabulary.remove(term)
+		}
+	}
+	i.totalLen -= doc.length
+	delete(i.docs, uid)
+	i.changed = true
+}
+
+// Clock of the last layer a bucket was indexed at.
+func (i *TextIndex) Clock(uid string) (hlc.Timestamp, bool) {
+	i.Lock()
+	defer i.Unlock()
+	doc, ok := i.docs[uid]
+	if !ok {
+		return hlc.Timestamp{}, false
+	}
+	return doc.clock, true
+}
+
+// Uids of the indexed buckets.
+func (i *TextIndex) Uids() []string {
+	i.Lock()
+	defer i.Unlock()
+	uids := make([]string, 0, len(i.docs))
+	for uid := range i.docs {
+		uids = append(uids, uid)
+	}
+	slices.Sort(uids)
+	return uids
+}
+
+// Count indexed buckets.
+func (i *TextIndex) Count() (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	return len(i.docs), nil
+}
+
+// A bucket matching a search, its BM25 score and the indexed terms it matched.
+type TextHit struct {
+	Uid   string
+	Score float64
+	Terms []string
+}
+
+// Split a query in its terms and its quoted phrases.
+func parseTextQuery(query string) (terms []string, phrases [][]string) {
+	for k, part := range strings.Split(query, `"`) {
+		var words []string
+		for _, t := range Tokenize(part) {
+			words = append(words, t.Term)
+		}
+		if k%2 == 1 && len(words) > 1 {
+			phrases = append(phrases, words)
+		}
+		for _, word := range words {
+			if !slices.Contains(terms, word) {
+				terms = append(terms, word)
+			}
+		}
+	}
+	return terms, phrases
+}
+
+// Whether the terms follow each other in a bucket text. Caller must hold the index lock.
+func (i *TextIndex) hasPhrase(uid string, phrase []string) bool {
+	for _, start := range i.postings[phrase[0]][uid] {
+		found := true
+		for k, term := range phrase[1:] {
+			if _, ok := slices.BinarySearch(i.postings[term][uid], start+k+1); !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Rank the buckets matching any query term by their BM25 score. Quoted phrases of the query
+// must be found in the matching buckets.
+func (i *TextIndex) Search(query string) []TextHit {
+	i.Lock()
+	defer i.Unlock()
+	terms, phrases := parseTextQuery(query)
+	expansions := make([]map[string]int, 0, len(terms))
+	for _, term := range terms {
+		expansions = append(expansions, map[string]int{term: 0})
+	}
+	return i.rank(expansions, phrases)
+}
+
+// Rank the buckets matching any query term or a term within a few edits of it. Matches weight
+// less the more edits they are from the query term. Quoted phrases of the query must be found
+// as is in the matching buckets.
+func (i *TextIndex) FuzzySearch(query string) []TextHit {
+	i.Lock()
+	defer i.Unlock()
+	terms, phrases := parseTextQuery(query)
+	expansions := make([]map[string]int, 0, len(terms))
+	for _, term := range terms {
+		expansions = append(expansions, i.vocabulary.match(term))
+	}
+	return i.rank(expansions, phrases)
+}
+
+// Score buckets by the BM25 score of the best matching term of each query term. Caller must
+// hold the index lock.
+func (i *TextIndex) rank(expansions []map[string]int, phrases [][]string) []TextHit {
+	if len(i.docs) == 0 {
+		return nil
+	}
+	avgLen := float64(i.totalLen) / float64(len(i.docs))
+	scores := map[string]float64{}
+	matched := map[string][]string{}
+	for _, expansion := range expansions {
+		best := map[string]float64{}
+		for term, edits := range expansion {
+			postings := i.postings[term]
+			n := float64(len(postings))
+			idf := math.Log(1 + (float64(len(i.docs))-n+0.5)/(n+0.5))
+			for uid, positions := range postings {
+				tf := float64(len(positions))
+				norm := 1 - bm25B + bm25B*float64(i.docs[uid].length)/avgLen
+				score := idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm) / float64(1+edits)
+				best[uid] = max(best[uid], score)
+				if !slices.Contains(matched[uid], term) {
+					matched[uid] = append(matched[uid], term)
+				}
+			}
+		}
+		for uid, score := range best {
+			scores[uid] += score
+		}
+	}
+	var hits []TextHit
+	for uid, score := range scores {
+		matching := true
+		for _, phrase := range phrases {
+			if !i.hasPhrase(uid, phrase) {
+				matching = false
+				break
+			}
+		}
+		if matching {
+			terms := matched[uid]
+			slices.Sort(terms)
+			hits = append(hits, TextHit{Uid: uid, Score: score, Terms: terms})
+		}
+	}
+	sortHits(hits)
+	return hits
+}
+
+// Sort hits by decreasing score, then by uid.
+func sortHits(hits []TextHit) {
+	slices.SortFunc(hits, func(a, b TextHit) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Uid, b.Uid)
+	})
+}
+
+// Paginate the buckets matching a search, best scores first.
+func (i *TextIndex) Paginate(query string, order model.Order, limit int) (model.Paginer[string, TextHit], chan error) {
+	errChan := make(chan error)
+	hits := i.Search(query)
+	if order == model.BottomToTop {
+		slices.Reverse(hits)
+	}
+	p := model.NewPaginer(defaultPageSize, 0, func(push func(k string, v TextHit, err error) bool) {
+		for _, hit := range hits {
+			if !push(hit.Uid, hit, nil) {
+				return
+			}
+		}
+	})
+	return p, errChan
+}
@@ -0,0 +1,106 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenize(t *testing.T) {
+	var terms []string
+	for _, token := range Tokenize("L'été, qu’il fît à Noël: 2 crêpes & œufs!") {
+		terms = append(terms, token.Term)
+	}
+	assert.Equal(t, []string{"ete", "il", "fit", "a", "noel", "2", "crepes", "oeufs"}, terms)
+	assert.Equal(t, []Token{{Term: "foo", Pos: 0, Start: 1, End: 4}, {Term: "bar", Pos: 1, Start: 6, End: 9}}, Tokenize(" foo\n\tbar "))
+}
+
+func TestTextIndex_Search(t *testing.T) {
+	i := NewTextIndex()
+	i.Update("rome", "Voyage à Rome: le Colisée, puis le Forum.", hlc.Timestamp{Wall: 1})
+	i.Update("oslo", "Voyage à Oslo, musée Munch. Voyage en train de nuit.", hlc.Timestamp{Wall: 2})
+	i.Update("milk", "Acheter du lait", hlc.Timestamp{Wall: 3})
+
+	uids := func(query string) []string {
+		var uids []string
+		for _, hit := range i.Search(query) {
+			uids = append(uids, hit.Uid)
+		}
+		return uids
+	}
+	// Term frequency ranks oslo first
+	assert.Equal(t, []string{"oslo", "rome"}, uids("voyage"))
+	// Rare terms weight more
+	assert.Equal(t, []string{"rome", "oslo"}, uids("voyage colisee"))
+	assert.Equal(t, []string{"oslo"}, uids(`"train de nuit"`))
+	assert.Empty(t, uids(`"nuit de train"`))
+	assert.Equal(t, []string{"rome"}, uids(`"voyage a rome" musee`))
+	assert.Empty(t, uids("paris"))
+
+	i.Update("rome", "Rome annulé", hlc.Timestamp{Wall: 4})
+	assert.Equal(t, []string{"oslo"}, uids("voyage"))
+	clock, ok := i.Clock("rome")
+	assert.True(t, ok)
+	assert.Equal(t, hlc.Timestamp{Wall: 4}, clock)
+	i.Remove("oslo")
+	assert.Empty(t, uids("voyage"))
+	assert.Equal(t, []string{"milk", "rome"}, i.Uids())
+}
+
+func TestTextIndex_FuzzySearch(t *testing.T) {
+	i := NewTextIndex()
+	i.Update("rome", "Voyage à Rome: le Colisée, puis le Forum.", hlc.Timestamp{Wall: 1})
+	i.Update("oslo", "Voyage à Oslo, musée Munch. Voyage en train de nuit.", hlc.Timestamp{Wall: 2})
+
+	hits := i.FuzzySearch("colise vojage")
+	if assert.Len(t, hits, 2) {
+		assert.Equal(t, "rome", hits[0].Uid)
+		assert.Equal(t, []string{"colisee", "voyage"}, hits[0].Terms)
+		assert.Equal(t, []string{"voyage"}, hits[1].Terms)
+	}
+	// Exact matches rank before typos
+	i.Update("vojage", "Vojage", hlc.Timestamp{Wall: 3})
+	hits = i.FuzzySearch("vojage")
+	if assert.Len(t, hits, 3) {
+		assert.Equal(t, "vojage", hits[0].Uid)
+	}
+	// Short terms must match exactly
+	assert.Empty(t, i.FuzzySearch("lo"))
+	assert.Empty(t, i.FuzzySearch(`"voyage a roma"`))
+	i.Remove("vojage")
+	assert.Empty(t, i.vocabulary.match("vojag"))
+}
+
+func TestTextIndex_Save(t *testing.T) {
+	b := storage.NewMemory(blocsFileBlocSize)
+	i, err := OpenTextIndex("", "a", WithBackend(b))
+	require.NoError(t, err)
+	clock := hlc.Timestamp{Wall: 1, Counter: 2, Device: "b"}
+	i.Update("rome", "Voyage à Rome: le Colisée, puis le Forum.", clock)
+	i.Update("oslo", "Voyage à Oslo, musée Munch. Voyage en train de nuit.", hlc.Timestamp{Wall: 2})
+	require.NoError(t, i.Save())
+
+	reopened, err := OpenTextIndex("", "a", WithBackend(b))
+	require.NoError(t, err)
+	assert.Equal(t, i.Search(`voyage "train de nuit"`), reopened.Search(`voyage "train de nuit"`))
+	assert.Equal(t, i.FuzzySearch("colise"), reopened.FuzzySearch("colise"))
+	indexed, ok := reopened.Clock("rome")
+	assert.True(t, ok)
+	assert.Equal(t, clock, indexed)
+
+	// Removed buckets are saved too
+	reopened.Remove("rome")
+	require.NoError(t, reopened.Save())
+	reopened, err = OpenTextIndex("", "a", WithBackend(b))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"oslo"}, reopened.Uids())
+
+	// An unreadable sidecar opens an empty index
+	require.NoError(t, b.WriteMeta("text-a", []byte("text0000garbage")))
+	reopened, err = OpenTextIndex("", "a", WithBackend(b))
+	require.NoError(t, err)
+	assert.Empty(t, reopened.Uids())
+}
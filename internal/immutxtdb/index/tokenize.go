@@ -0,0 +1,80 @@
+package index
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Text is tokenized in words of letters and digits, lower cased and folded without accents so
+// "Été" and "ete" match. French elided articles and pronouns (l', d', qu', ...) are dropped.
+
+var foldedRunes = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a",
+	'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ñ': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o",
+	'œ': "oe",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u",
+	'ý': "y", 'ÿ': "y",
+}
+
+var elisions = map[string]bool{
+	"c": true, "d": true, "j": true, "l": true, "m": true, "n": true, "s": true, "t": true,
+	"qu": true, "jusqu": true, "lorsqu": true, "puisqu": true,
+}
+
+// A term of a text, its position among the text terms and the byte offsets of its word.
+type Token struct {
+	Term  string
+	Pos   int
+	Start int
+	End   int
+}
+
+// Lower case a word and fold its accents.
+func Fold(word string) string {
+	sb := strings.Builder{}
+	for _, r := range strings.ToLower(word) {
+		if folded, ok := foldedRunes[r]; ok {
+			sb.WriteString(folded)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’'
+}
+
+// Split a text in folded terms.
+func Tokenize(text string) []Token {
+	var tokens []Token
+	start := -1
+	flush := func(end int, next rune) {
+		if start < 0 {
+			return
+		}
+		term := Fold(text[start:end])
+		token := Token{Term: term, Pos: len(tokens), Start: start, End: end}
+		start = -1
+		if isApostrophe(next) && elisions[term] {
+			return
+		}
+		tokens = append(tokens, token)
+	}
+	for k, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = k
+			}
+		} else {
+			flush(k, r)
+		}
+	}
+	flush(len(text), 0)
+	return tokens
+}
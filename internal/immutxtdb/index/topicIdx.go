@@ -0,0 +1,510 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/cache"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/encoder"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/storage"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/wal"
+	"github.com/mxbossard/tui-journal/internal/ref"
+)
+
+// Buckets mention topics with a &topic reference and people with a @person reference. A word records the mentions of a topic in a
+// bucket each time they change: the word of a topic and a bucket with the greatest clock wins,
+// a bucket not mentioning a topic anymore is recorded without mentions.
+
+const (
+	personSigil = "@"
+	// Longer topics are not mentions, their words would not fit in the idx file.
+	maxTopicSize = 32
+)
+
+// Mentions of a topic in a bucket at a clock. Positions are the byte offsets of the first
+// mentions in the bucket text, as many as fit in a word.
+type MentionRef struct {
+	Uid       string
+	Clock     hlc.Timestamp
+	Count     int
+	Positions []int
+}
+
+// Topic key of the mentions of a person, people share the topic index with topics.
+func PersonKey(name string) string {
+	return personSigil + strings.ToLower(name)
+}
+
+func isPersonKey(topic string) bool {
+	return strings.HasPrefix(topic, personSigil)
+}
+
+// Byte offsets of the topics and people mentioned in a text, by lower cased topic names and
+// person keys.
+func ParseMentions(text string) map[string][]int {
+	mentions := map[string][]int{}
+	for _, r := range ref.Parse(text) {
+		var topic string
+		switch r.Kind {
+		case ref.Topic:
+			topic = strings.ToLower(r.Name)
+		case ref.Person:
+			topic = PersonKey(r.Name)
+		default:
+			continue
+		}
+		if len(topic) > maxTopicSize {
+			continue
+		}
+		mentions[topic] = append(mentions[topic], r.Start)
+	}
+	return mentions
+}
+
+// (TOPIC, HLC, BUCKET_UID, MENTIONS_COUNT, MENTIONS_POSITIONS)
+type TopicIndex struct {
+	model.Index[string, MentionRef]
+	*sync.Mutex
+
+	encoder        encoder.Encoder[[]byte]
+	backend        storage.Backend
+	device         string
+	deviceIdxFiles []storage.Storage
+	otherIdxFiles  []storage.Storage
+	stats          map[string]*idxStats
+	stamps         map[string]storage.Stamp
+	blocCache      *BlocCache
+	wal            *wal.Log
+	syncPolicy     wal.SyncPolicy
+}
+
+func NewTopicIndex(topicDir, device string, opts ...Option) (*TopicIndex, error) {
+	o := buildOptions(topicDir, opts)
+	deviceIdxFiles, otherIdxFiles, err := openIdxFiles(o.backend, topicKind, device)
+	if err != nil {
+		return nil, err
+	}
+	l, err := openWal(o.backend, topicKind, device, o.syncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	e := encoder.NewBytesEncoder(asciiEncoderDefaultVersion, asciiEncoderStateSize, asciiEncoderDataSize)
+	idx := &TopicIndex{
+		Mutex:          &sync.Mutex{},
+		encoder:        e,
+		backend:        o.backend,
+		device:         device,
+		deviceIdxFiles: deviceIdxFiles,
+		otherIdxFiles:  otherIdxFiles,
+		stats:          make(map[string]*idxStats),
+		stamps:         make(map[string]storage.Stamp),
+		blocCache:      o.blocCache,
+		wal:            l,
+		syncPolicy:     o.syncPolicy,
+	}
+
+	err = truncateTornWords(idx.deviceIdxFiles, idx.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.preload()
+	if err != nil {
+		return nil, err
+	}
+	err = idx.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// Topic word data: [TOPIC_LEN,TOPIC,HLC,UID_LEN,UID,COUNT,POSITION...]
+// HLC device is not encoded, it is the device owning the idx file. Positions which do not fit
+// in the word are not encoded.
+func encodeTopicData(topic string, m MentionRef) ([]byte, error) {
+	if len(topic) > math.MaxUint8 || len(m.Uid) > math.MaxUint8 {
+		return nil, errors.New("topic or bucket uid is too long")
+	}
+	data := make([]byte, 0, asciiEncoderDataSize)
+	data = append(data, byte(len(topic)))
+	data = append(data, topic...)
+	data = m.Clock.Append(data)
+	data = append(data, byte(len(m.Uid)))
+	data = append(data, m.Uid...)
+	data = binary.BigEndian.AppendUint16(data, uint16(min(m.Count, math.MaxUint16)))
+	for _, pos := range m.Positions {
+		if len(data)+4 > asciiEncoderDataSize {
+			break
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(pos))
+	}
+	if len(data) > asciiEncoderDataSize {
+		return nil, fmt.Errorf("topic %s of bucket %s does not fit in a word", topic, m.Uid)
+	}
+	return data, nil
+}
+
+func decodeTopicData(data []byte, device string) (string, MentionRef, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0])+hlc.EncodedSize+1 {
+		return "", MentionRef{}, fmt.Errorf("bad topic data length: %d", len(data))
+	}
+	k := 1 + int(data[0])
+	topic := string(data[1:k])
+	clock, err := hlc.Decode(data[k:k+hlc.EncodedSize], device)
+	if err != nil {
+		return "", MentionRef{}, err
+	}
+	k += hlc.EncodedSize
+	uidLen := int(data[k])
+	k++
+	if len(data) < k+uidLen+2 {
+		return "", MentionRef{}, fmt.Errorf("bad topic data length: %d", len(data))
+	}
+	m := MentionRef{Uid: string(data[k : k+uidLen]), Clock: clock}
+	k += uidLen
+	m.Count = int(binary.BigEndian.Uint16(data[k:]))
+	k += 2
+	for ; k+4 <= len(data); k += 4 {
+		m.Positions = append(m.Positions, int(binary.BigEndian.Uint32(data[k:])))
+	}
+	return topic, m, nil
+}
+
+func topicKey(data []byte) []byte {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil
+	}
+	return data[1 : 1+int(data[0])]
+}
+
+func (i *TopicIndex) preload() error {
+	i.Lock()
+	defer i.Unlock()
+
+	idxFiles := append(i.deviceIdxFiles, i.otherIdxFiles...)
+	for _, bf := range idxFiles {
+		s, err := loadIdxStats(i.backend, bf, i.encoder, topicKey)
+		if err != nil {
+			return err
+		}
+		i.stats[bf.Name()] = s
+	}
+	return nil
+}
+
+// Complete writes interrupted by a crash.
+func (i *TopicIndex) recover() error {
+	i.Lock()
+	defer i.Unlock()
+	for _, records := range i.wal.Pending() {
+		err := i.WriteRecords(records)
+		if err != nil {
+			return err
+		}
+	}
+	return i.wal.Checkpoint()
+}
+
+func (i *TopicIndex) Close() error {
+	return i.wal.Close()
+}
+
+func (i *TopicIndex) Add(topic string, m MentionRef) error {
+	i.Lock()
+	defer i.Unlock()
+	records, err := i.EncodeWords(TopicEntry{Topic: topic, Ref: m})
+	if err != nil {
+		return err
+	}
+	// Log the word before writing it, a crash between both writes is completed on next open.
+	err = i.wal.Append(records...)
+	if err != nil {
+		return err
+	}
+	err = i.WriteRecords(records)
+	if err != nil {
+		return err
+	}
+	return i.wal.Checkpoint()
+}
+
+type TopicEntry struct {
+	Topic string
+	Ref   MentionRef
+}
+
+// Encode entries as words following the last word of the device idx file.
+// Caller must hold the index lock until the records are written.
+func (i *TopicIndex) EncodeWords(entries ...TopicEntry) ([]wal.Record, error) {
+	var records []wal.Record
+	for _, e := range entries {
+		bf := i.deviceIdxFiles[len(i.deviceIdxFiles)-1]
+		bfName := bf.Name()
+		seq := i.stats[bfName].seq
+		for _, r := range records {
+			if r.Target == bfName {
+				seq = r.Seq + 1
+			}
+		}
+		data, err := encodeTopicData(e.Topic, e.Ref)
+		if err != nil {
+			return nil, err
+		}
+		word, err := i.encoder.Encode(seq, Mention, data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, wal.Record{Target: bfName, Seq: seq, Data: word})
+	}
+	return records, nil
+}
+
+// Write encoded words into their idx file. Already written words are skipped, so records
+// logged in a wal can be written again after a crash.
+// Caller must hold the index lock.
+func (i *TopicIndex) WriteRecords(records []wal.Record) error {
+	err := replayRecords(i.backend, records, i.deviceIdxFiles, i.stats, i.encoder, topicKey, i.blocCache)
+	if err != nil {
+		return err
+	}
+	return syncTargets(i.deviceIdxFiles, records, i.syncPolicy)
+}
+
+// Words of this device from the since seq of each idx file, targeting idx file names.
+func (i *TopicIndex) DeviceRecords(since map[string]int) ([]wal.Record, error) {
+	i.Lock()
+	defer i.Unlock()
+	return deviceRecords(i.deviceIdxFiles, i.encoder, i.blocCache, since)
+}
+
+// Write words exported by other devices into their idx files. Already written words are
+// skipped, so importing the same records twice is harmless.
+// Caller must hold the index lock.
+func (i *TopicIndex) ImportRecords(records []wal.Record) error {
+	imported, err := openImportedFiles(i.backend, topicKind, i.device, records, &i.otherIdxFiles, i.stats, i.encoder, topicKey)
+	if err != nil {
+		return err
+	}
+	err = replayRecords(i.backend, imported, i.otherIdxFiles, i.stats, i.encoder, topicKey, i.blocCache)
+	if err != nil {
+		return err
+	}
+	dropSupersededFiles(&i.otherIdxFiles, i.stats, i.blocCache)
+	return nil
+}
+
+// First seq of each device idx file holding mentions recorded since a clock.
+// Clocks of a device are monotonic, so all following words are written since the clock too.
+func (i *TopicIndex) DeviceCursor(since hlc.Timestamp) (map[string]int, error) {
+	i.Lock()
+	defer i.Unlock()
+	cursor := make(map[string]int, len(i.deviceIdxFiles))
+	for _, bf := range i.deviceIdxFiles {
+		name := filepath.Base(bf.Name())
+		cursor[name] = i.stats[bf.Name()].seq
+		words, err := readWords(bf, i.encoder, i.blocCache)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range words {
+			_, m, err := decodeTopicData(w.data, i.device)
+			if err != nil {
+				return nil, err
+			}
+			if m.Clock.Compare(since) >= 0 {
+				cursor[name] = w.seq
+				break
+			}
+		}
+	}
+	return cursor, nil
+}
+
+// Load idx files of other devices which appeared or grew since the index was opened or last
+// refreshed. Return the names of those files.
+func (i *TopicIndex) Refresh() ([]string, error) {
+	i.Lock()
+	defer i.Unlock()
+	changed, err := refreshOtherFiles(i.backend, topicKind, i.device, &i.otherIdxFiles, i.stats, i.stamps, i.encoder, topicKey, i.blocCache)
+	if err != nil {
+		return nil, err
+	}
+	return fileNames(changed), nil
+}
+
+// Rewrite the device idx file into a new rotation holding the last word of each topic of a
+// bucket. Words without mentions are kept: they override older mentions recorded by other
+// devices. Superseded idx files of all devices are removed. Return the count of dropped words.
+// Caller must hold the index lock.
+func (i *TopicIndex) Compact() (int, error) {
+	words, err := readWords(i.deviceIdxFiles[len(i.deviceIdxFiles)-1], i.encoder, i.blocCache)
+	if err != nil {
+		return 0, err
+	}
+	last := make(map[string]int, len(words))
+	for _, w := range words {
+		topic, m, err := decodeTopicData(w.data, i.device)
+		if err != nil {
+			return 0, err
+		}
+		last[topic+"\x00"+m.Uid] = w.seq
+	}
+	dropped, err := rotateDeviceFile(i.backend, topicKind, i.device, &i.deviceIdxFiles, i.stats, i.encoder, topicKey, i.blocCache, func(w decodedWord[[]byte]) ([]byte, bool, error) {
+		topic, m, err := decodeTopicData(w.data, i.device)
+		if err != nil {
+			return nil, false, err
+		}
+		return w.data, last[topic+"\x00"+m.Uid] == w.seq, nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return dropped, removeSupersededFiles(i.backend, topicKind)
+}
+
+// Count all entries of all devices without reading the idx files.
+func (i *TopicIndex) Count() (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	count := 0
+	for _, s := range i.stats {
+		count += s.seq
+	}
+	return count, nil
+}
+
+// Last mentions of a topic, of all topics if empty, in each bucket, by topic then by bucket uid.
+// Caller must hold the index lock.
+func (i *TopicIndex) latest(topic string) (map[string]map[string]MentionRef, error) {
+	latest := map[string]map[string]MentionRef{}
+	for _, bf := range append(slices.Clone(i.deviceIdxFiles), i.otherIdxFiles...) {
+		if topic != "" && i.stats[bf.Name()].countKey([]byte(topic)) == 0 {
+			continue
+		}
+		words, err := readWords(bf, i.encoder, i.blocCache)
+		if err != nil {
+			return nil, err
+		}
+		device := idxFileDevice(bf.Name())
+		for _, w := range words {
+			t, m, err := decodeTopicData(w.data, device)
+			if err != nil {
+				return nil, err
+			}
+			if topic != "" && t != topic {
+				continue
+			}
+			mentions, ok := latest[t]
+			if !ok {
+				mentions = map[string]MentionRef{}
+				latest[t] = mentions
+			}
+			if previous, ok := mentions[m.Uid]; !ok || m.Clock.Compare(previous.Clock) > 0 {
+				mentions[m.Uid] = m
+			}
+		}
+	}
+	return latest, nil
+}
+
+// Topics mentioned by at least one bucket, sorted by name.
+func (i *TopicIndex) Topics() ([]string, error) {
+	return i.mentioned(func(topic string) bool { return !isPersonKey(topic) })
+}
+
+// People mentioned by at least one bucket, sorted by lower cased name.
+func (i *TopicIndex) People() ([]string, error) {
+	keys, err := i.mentioned(isPersonKey)
+	if err != nil {
+		return nil, err
+	}
+	for k, key := range keys {
+		keys[k] = strings.TrimPrefix(key, personSigil)
+	}
+	return keys, nil
+}
+
+func (i *TopicIndex) mentioned(accept func(topic string) bool) ([]string, error) {
+	i.Lock()
+	defer i.Unlock()
+	latest, err := i.latest("")
+	if err != nil {
+		return nil, err
+	}
+	var topics []string
+	for topic, mentions := range latest {
+		if !accept(topic) {
+			continue
+		}
+		for _, m := range mentions {
+			if m.Count > 0 {
+				topics = append(topics, topic)
+				break
+			}
+		}
+	}
+	slices.Sort(topics)
+	return topics, nil
+}
+
+// Count the mentions of a topic in all buckets.
+func (i *TopicIndex) CountMentions(topic string) (int, error) {
+	i.Lock()
+	defer i.Unlock()
+	latest, err := i.latest(topic)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, m := range latest[topic] {
+		count += m.Count
+	}
+	return count, nil
+}
+
+// Paginate the buckets mentioning a topic on all devices, ordered by the clock of their
+// mentions.
+func (i *TopicIndex) Paginate(topic string, order model.Order, limit int) (model.Paginer[string, MentionRef], chan error) {
+	errChan := make(chan error)
+	p := model.NewPaginer(defaultPageSize, 0, func(push func(k string, v MentionRef, err error) bool) {
+		i.Lock()
+		latest, err := i.latest(topic)
+		i.Unlock()
+		if err != nil {
+			push("", MentionRef{}, err)
+			return
+		}
+		var mentions []MentionRef
+		for _, m := range latest[topic] {
+			if m.Count > 0 {
+				mentions = append(mentions, m)
+			}
+		}
+		slices.SortFunc(mentions, func(a, b MentionRef) int {
+			return a.Clock.Compare(b.Clock)
+		})
+		if order == model.BottomToTop {
+			slices.Reverse(mentions)
+		}
+		for _, m := range mentions {
+			if !push(topic, m, nil) {
+				return
+			}
+		}
+	})
+	return p, errChan
+}
+
+// Hit and miss counters of the bloc cache.
+func (i *TopicIndex) CacheStats() cache.Stats {
+	return i.blocCache.Stats()
+}
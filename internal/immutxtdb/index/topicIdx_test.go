@@ -0,0 +1,83 @@
+package index
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMentions(t *testing.T) {
+	assert.Equal(t, map[string][]int{
+		"voyage": {0, 29},
+		"été-25": {13},
+	}, ParseMentions("&Voyage pour &été-25, puis &voyage. R&D & &42"))
+	assert.Empty(t, ParseMentions("a && b &"))
+	assert.Equal(t, map[string][]int{
+		"@léa":   {0},
+		"voyage": {21},
+	}, ParseMentions("@Léa le @2025-11-24 &voyage\n# &titre\n`&code`"))
+}
+
+func TestTopicIndex_Mentions(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTopicIndex_Mentions")
+	defer os.RemoveAll(tmpDir)
+
+	a, err := NewTopicIndex(tmpDir, "a")
+	require.NoError(t, err)
+	b, err := NewTopicIndex(tmpDir, "b")
+	require.NoError(t, err)
+
+	ref := func(uid string, wall int64, positions ...int) MentionRef {
+		return MentionRef{Uid: uid, Clock: hlc.Timestamp{Wall: wall}, Count: len(positions), Positions: positions}
+	}
+	require.NoError(t, a.Add("travel", ref("rome", 10, 3, 42)))
+	require.NoError(t, a.Add("travel", ref("oslo", 11, 0)))
+	require.NoError(t, a.Add("work", ref("monday", 12, 7)))
+	require.NoError(t, b.Add("travel", ref("rome", 20)))
+	require.NoError(t, b.Add("travel", ref("paris", 21, 1, 2, 3)))
+	// Positions which do not fit in a word are counted only
+	many := make([]int, 30)
+	require.NoError(t, b.Add("work", ref("tuesday", 22, many...)))
+
+	// Reopen to read other device files
+	a, err = NewTopicIndex(tmpDir, "a")
+	require.NoError(t, err)
+	topics, err := a.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"travel", "work"}, topics)
+	count, err := a.CountMentions("travel")
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	count, err = a.CountMentions("work")
+	require.NoError(t, err)
+	assert.Equal(t, 31, count)
+
+	// Bucket rome does not mention travel anymore
+	p, _ := a.Paginate("travel", model.BottomToTop, 100)
+	page, _, err := p.Next()
+	require.NoError(t, err)
+	require.Equal(t, 2, page.Len())
+	paris := ref("paris", 21, 1, 2, 3)
+	paris.Clock.Device = "b"
+	assert.Equal(t, paris, page.Entries()[0].Val())
+	assert.Equal(t, "oslo", page.Entries()[1].Val().Uid)
+
+	// Only the last word of a topic of a bucket is kept
+	require.NoError(t, b.Add("travel", ref("paris", 23)))
+	require.NoError(t, b.Add("travel", ref("paris", 24, 5)))
+	b.Lock()
+	dropped, err := b.Compact()
+	b.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+	_, err = a.Refresh()
+	require.NoError(t, err)
+	count, err = a.CountMentions("travel")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
@@ -0,0 +1,178 @@
+package merge
+
+import (
+	"strings"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/diff"
+)
+
+// Three-way merge of text lines, like git merge.
+// Changes of ours and theirs since base are applied together. When both sides change the same
+// or adjacent base lines differently, both versions are kept between conflict markers:
+//
+//	<<<<<<< ours
+//	ours lines
+//	=======
+//	theirs lines
+//	>>>>>>> theirs
+
+const (
+	MarkerOurs   = "<<<<<<<"
+	MarkerSep    = "======="
+	MarkerTheirs = ">>>>>>>"
+)
+
+// Lines of base replaced by a side: base[start:end] become lines.
+type hunk struct {
+	start int
+	end   int
+	lines []string
+}
+
+// Split text in lines keeping their line feed, so joining them give back the text.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func hunks(base, side []string) []hunk {
+	var hs []hunk
+	for _, e := range diff.Diff(base, side) {
+		if e.Op == diff.Equal {
+			continue
+		}
+		// Myers edits of a same change are contiguous: merge a delete and its insert.
+		if n := len(hs); n > 0 && hs[n-1].end == e.AStart && e.Op == diff.Insert {
+			hs[n-1].lines = append(hs[n-1].lines, side[e.BStart:e.BEnd]...)
+			continue
+		}
+		h := hunk{start: e.AStart, end: e.AEnd}
+		if e.Op == diff.Insert {
+			h.lines = side[e.BStart:e.BEnd]
+		}
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+// Text of base[lo:hi] with the side hunks applied.
+func apply(base []string, lo, hi int, hs []hunk) []string {
+	var lines []string
+	pos := lo
+	for _, h := range hs {
+		lines = append(lines, base[pos:h.start]...)
+		lines = append(lines, h.lines...)
+		pos = h.end
+	}
+	return append(lines, base[pos:hi]...)
+}
+
+// Write lines, terminating the last one if it is followed by a marker.
+func writeSide(sb *strings.Builder, lines []string, marker bool) {
+	for _, l := range lines {
+		sb.WriteString(l)
+	}
+	if marker && len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		sb.WriteString("\n")
+	}
+}
+
+// Merge ours and theirs changes since base. Conflicting changes are written between markers
+// labelled with oursLabel and theirsLabel, conflicted is true if any.
+func Merge(base, ours, theirs, oursLabel, theirsLabel string) (merged string, conflicted bool) {
+	baseLines := splitLines(base)
+	oursHunks := hunks(baseLines, splitLines(ours))
+	theirsHunks := hunks(baseLines, splitLines(theirs))
+
+	sb := &strings.Builder{}
+	pos := 0
+	o, t := 0, 0
+	for o < len(oursHunks) || t < len(theirsHunks) {
+		// Group hunks of both sides overlapping or touching each other.
+		var first hunk
+		if t >= len(theirsHunks) || o < len(oursHunks) && oursHunks[o].start <= theirsHunks[t].start {
+			first = oursHunks[o]
+		} else {
+			first = theirsHunks[t]
+		}
+		lo, hi := first.start, first.end
+		var oursGroup, theirsGroup []hunk
+		for {
+			if o < len(oursHunks) && oursHunks[o].start <= hi {
+				hi = max(hi, oursHunks[o].end)
+				oursGroup = append(oursGroup, oursHunks[o])
+				o++
+			} else if t < len(theirsHunks) && theirsHunks[t].start <= hi {
+				hi = max(hi, theirsHunks[t].end)
+				theirsGroup = append(theirsGroup, theirsHunks[t])
+				t++
+			} else {
+				break
+			}
+		}
+
+		writeSide(sb, baseLines[pos:lo], false)
+		pos = hi
+		oursLines := apply(baseLines, lo, hi, oursGroup)
+		theirsLines := apply(baseLines, lo, hi, theirsGroup)
+		switch {
+		case len(theirsGroup) == 0:
+			writeSide(sb, oursLines, false)
+		case len(oursGroup) == 0:
+			writeSide(sb, theirsLines, false)
+		case strings.Join(oursLines, "") == strings.Join(theirsLines, ""):
+			writeSide(sb, oursLines, false)
+		default:
+			conflicted = true
+			sb.WriteString(MarkerOurs + " " + oursLabel + "\n")
+			writeSide(sb, oursLines, true)
+			sb.WriteString(MarkerSep + "\n")
+			writeSide(sb, theirsLines, true)
+			sb.WriteString(MarkerTheirs + " " + theirsLabel + "\n")
+		}
+	}
+	writeSide(sb, baseLines[pos:], false)
+	return sb.String(), conflicted
+}
+
+// A conflict found between markers, Start and End are line numbers of its markers.
+type Conflict struct {
+	Start  int
+	End    int
+	Ours   string
+	Theirs string
+}
+
+// Conflicts left in a merged text, in order of appearance.
+func Conflicts(text string) []Conflict {
+	var conflicts []Conflict
+	var current *Conflict
+	var ours, theirs *strings.Builder
+	for k, line := range splitLines(text) {
+		trimmed := strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(trimmed, MarkerOurs) && current == nil:
+			current = &Conflict{Start: k}
+			ours, theirs = &strings.Builder{}, nil
+		case trimmed == MarkerSep && current != nil && theirs == nil:
+			theirs = &strings.Builder{}
+		case strings.HasPrefix(trimmed, MarkerTheirs) && current != nil && theirs != nil:
+			current.End = k
+			current.Ours = ours.String()
+			current.Theirs = theirs.String()
+			conflicts = append(conflicts, *current)
+			current = nil
+		case current != nil && theirs != nil:
+			theirs.WriteString(line)
+		case current != nil:
+			ours.WriteString(line)
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,58 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	cases := []struct {
+		name       string
+		ours       string
+		theirs     string
+		expected   string
+		conflicted bool
+	}{
+		{"unchanged", base, base, base, false},
+		{"ours only", "a\nB\nc\nd\ne\n", base, "a\nB\nc\nd\ne\n", false},
+		{"theirs only", base, "a\nb\nc\nd\n", "a\nb\nc\nd\n", false},
+		{"distinct lines", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", false},
+		{"same change", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", false},
+		{"insert and delete", "a\nb\nx\nc\nd\ne\n", "a\nb\nc\ne\n", "a\nb\nx\nc\ne\n", false},
+		{"same line", "a\nb\nours\nd\ne\n", "a\nb\ntheirs\nd\ne\n", "a\nb\n<<<<<<< o\nours\n=======\ntheirs\n>>>>>>> t\nd\ne\n", true},
+		{"delete and change", "a\nb\nd\ne\n", "a\nb\nC\nd\ne\n", "a\nb\n<<<<<<< o\n=======\nC\n>>>>>>> t\nd\ne\n", true},
+		{"no trailing line feed", "a\nb\nc\nd\nours", "a\nb\nc\nd\ntheirs", "a\nb\nc\nd\n<<<<<<< o\nours\n=======\ntheirs\n>>>>>>> t\n", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			merged, conflicted := Merge(base, c.ours, c.theirs, "o", "t")
+			assert.Equal(t, c.expected, merged)
+			assert.Equal(t, c.conflicted, conflicted)
+		})
+	}
+}
+
+func TestMerge_EmptyBase(t *testing.T) {
+	merged, conflicted := Merge("", "foo\n", "", "o", "t")
+	assert.False(t, conflicted)
+	assert.Equal(t, "foo\n", merged)
+
+	_, conflicted = Merge("", "foo\n", "bar\n", "o", "t")
+	assert.True(t, conflicted)
+}
+
+func TestConflicts(t *testing.T) {
+	merged, conflicted := Merge("a\nb\nc\nd\ne\n", "a\nB\nc\nd\nE1\n", "a\nb2\nc\nd\nE2\n", "o", "t")
+	require.True(t, conflicted)
+
+	conflicts := Conflicts(merged)
+	require.Len(t, conflicts, 2)
+	assert.Equal(t, Conflict{Start: 1, End: 5, Ours: "B\n", Theirs: "b2\n"}, conflicts[0])
+	assert.Equal(t, "E1\n", conflicts[1].Ours)
+	assert.Equal(t, "E2\n", conflicts[1].Theirs)
+
+	assert.Empty(t, Conflicts("a\n=======\nb\n"))
+}
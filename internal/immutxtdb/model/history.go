@@ -0,0 +1,228 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/merge"
+)
+
+// Layers history of a bucket. A layer is saved on top of its parents layers: layers saved
+// concurrently on several devices share their parents and diverge into several heads until
+// they are merged. A layer without recorded parents follows the previous layer in clock order.
+
+var ErrOpsLayer = errors.New("cannot merge lines of a CRDT operations layer")
+
+type history struct {
+	refs    map[hlc.Timestamp]*LayerRef
+	parents map[hlc.Timestamp][]hlc.Timestamp
+}
+
+func (b Bucket) history() (*history, error) {
+	h := &history{
+		refs:    make(map[hlc.Timestamp]*LayerRef, len(b.layers)),
+		parents: make(map[hlc.Timestamp][]hlc.Timestamp, len(b.layers)),
+	}
+	for k, ref := range b.layers {
+		l, err := b.store.Layer(ref)
+		if err != nil {
+			return nil, err
+		}
+		h.refs[ref.clock] = ref
+		parents := l.Parents()
+		if parents == nil && k > 0 {
+			parents = []hlc.Timestamp{b.layers[k-1].clock}
+		}
+		h.parents[ref.clock] = parents
+	}
+	return h, nil
+}
+
+// Clocks of the layer and all its ancestors.
+func (h *history) ancestors(clock hlc.Timestamp, into map[hlc.Timestamp]bool) {
+	stack := []hlc.Timestamp{clock}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if into[c] {
+			continue
+		}
+		into[c] = true
+		stack = append(stack, h.parents[c]...)
+	}
+}
+
+// Latest layer among the ancestors of both sets, nil if they have no common ancestor.
+func (h *history) base(a, b map[hlc.Timestamp]bool) *LayerRef {
+	var base *LayerRef
+	for c := range a {
+		ref, ok := h.refs[c]
+		if ok && b[c] && (base == nil || c.Compare(base.clock) > 0) {
+			base = ref
+		}
+	}
+	return base
+}
+
+// Layers which are not the parent of any other layer, ordered by their clocks.
+func (b Bucket) Heads() ([]*LayerRef, error) {
+	h, err := b.history()
+	if err != nil {
+		return nil, err
+	}
+	return h.heads(b.layers), nil
+}
+
+func (h *history) heads(layers []*LayerRef) []*LayerRef {
+	hasChild := make(map[hlc.Timestamp]bool, len(layers))
+	for _, parents := range h.parents {
+		for _, p := range parents {
+			hasChild[p] = true
+		}
+	}
+	var heads []*LayerRef
+	for _, ref := range layers {
+		if !hasChild[ref.clock] {
+			heads = append(heads, ref)
+		}
+	}
+	return heads
+}
+
+// Latest common ancestor layer of the given layers, nil if they have none.
+func (b Bucket) MergeBase(refs ...*LayerRef) (*LayerRef, error) {
+	h, err := b.history()
+	if err != nil {
+		return nil, err
+	}
+	return h.mergeBase(refs), nil
+}
+
+func (h *history) mergeBase(refs []*LayerRef) *LayerRef {
+	if len(refs) == 0 {
+		return nil
+	}
+	common := map[hlc.Timestamp]bool{}
+	h.ancestors(refs[0].clock, common)
+	for _, ref := range refs[1:] {
+		other := map[hlc.Timestamp]bool{}
+		h.ancestors(ref.clock, other)
+		for c := range common {
+			if !other[c] {
+				delete(common, c)
+			}
+		}
+	}
+	return h.base(common, common)
+}
+
+// Layers saved before a time which no projection nor merge reads anymore, so a compaction
+// can drop them:
+// - all layers of a deleted bucket but its tombstone,
+// - layers folded in the latest snapshot of a CRDT document, it restarts from the snapshot,
+// - ancestors of the merge base of all heads for other buckets.
+func (b Bucket) Obsolete(before time.Time) ([]*LayerRef, error) {
+	if len(b.layers) == 0 {
+		return nil, nil
+	}
+	h, err := b.history()
+	if err != nil {
+		return nil, err
+	}
+	obsolete := map[hlc.Timestamp]bool{}
+	deleted, err := b.Deleted()
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		for _, ref := range b.layers[:len(b.layers)-1] {
+			obsolete[ref.clock] = true
+		}
+	} else {
+		var snapshot *Layer
+		isCrdt := false
+		for _, ref := range b.layers {
+			l, err := b.store.Layer(ref)
+			if err != nil {
+				return nil, err
+			}
+			isCrdt = isCrdt || l.IsOps()
+			if l.Metadata().Snapshoted() {
+				snapshot = l
+			}
+		}
+		if !isCrdt {
+			if base := h.mergeBase(h.heads(b.layers)); base != nil {
+				h.ancestors(base.clock, obsolete)
+				delete(obsolete, base.clock)
+			}
+		} else if snapshot != nil {
+			for _, ref := range b.layers {
+				obsolete[ref.clock] = snapshot.folds(ref.clock)
+			}
+		}
+	}
+
+	var refs []*LayerRef
+	for _, ref := range b.layers {
+		if obsolete[ref.clock] && ref.clock.Time().Before(before) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+func (b Bucket) contentOf(ref *LayerRef) (string, error) {
+	if ref == nil {
+		return "", nil
+	}
+	l, err := b.store.Layer(ref)
+	if err != nil {
+		return "", err
+	}
+	if l.IsOps() {
+		return "", ErrOpsLayer
+	}
+	return l.Content(), nil
+}
+
+// Three-way merge the heads content lines, each head being merged into the previous ones from
+// their latest common ancestor. Conflicting changes are kept between conflict markers labelled
+// with the heads clocks. Heads are returned to be recorded as the merged layer parents.
+func (b Bucket) Merge() (merged string, conflicted bool, heads []*LayerRef, err error) {
+	if len(b.layers) == 0 {
+		return "", false, nil, ErrEmptyBucket
+	}
+	h, err := b.history()
+	if err != nil {
+		return "", false, nil, err
+	}
+	heads = h.heads(b.layers)
+	merged, err = b.contentOf(heads[0])
+	if err != nil {
+		return "", false, nil, err
+	}
+	oursLabel := heads[0].clock.String()
+	mergedAncestors := map[hlc.Timestamp]bool{}
+	h.ancestors(heads[0].clock, mergedAncestors)
+	for _, head := range heads[1:] {
+		headAncestors := map[hlc.Timestamp]bool{}
+		h.ancestors(head.clock, headAncestors)
+		base, err := b.contentOf(h.base(mergedAncestors, headAncestors))
+		if err != nil {
+			return "", false, nil, err
+		}
+		theirs, err := b.contentOf(head)
+		if err != nil {
+			return "", false, nil, err
+		}
+		var headConflicted bool
+		merged, headConflicted = merge.Merge(base, merged, theirs, oursLabel, head.clock.String())
+		conflicted = conflicted || headConflicted
+		for c := range headAncestors {
+			mergedAncestors[c] = true
+		}
+	}
+	return merged, conflicted, heads, nil
+}
@@ -2,8 +2,19 @@ package model
 
 import (
 	"encoding/binary"
+	"errors"
 	"iter"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/crdt"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+)
+
+var (
+	ErrEmptyBucket   = errors.New("bucket has no layer")
+	ErrDeletedBucket = errors.New("bucket is deleted")
 )
 
 type Order int
@@ -43,54 +54,405 @@ type Metadata struct {
 	snapshoted bool
 }
 
+func NewMetadata(version int, created time.Time, labels Labels) *Metadata {
+	return &Metadata{version: version, created: created, updated: created, labels: labels}
+}
+
+func (m Metadata) Version() int {
+	return m.version
+}
+
+func (m Metadata) Created() time.Time {
+	return m.created
+}
+
+func (m Metadata) Updated() time.Time {
+	return m.updated
+}
+
+func (m Metadata) Labels() Labels {
+	return m.labels
+}
+
+func (m Metadata) Commited() bool {
+	return m.commited
+}
+
+func (m Metadata) Snapshoted() bool {
+	return m.snapshoted
+}
+
 type Document struct {
 	content  string
 	metadata *Metadata
 }
 
+func NewDocument(content string, metadata *Metadata) Document {
+	return Document{content: content, metadata: metadata}
+}
+
+func (d Document) Content() string {
+	return d.content
+}
+
+func (d Document) Metadata() *Metadata {
+	return d.metadata
+}
+
 type LayerRef struct {
 	blocsFilepath string
 	blocId        int
 	state         State
+	clock         hlc.Timestamp
 }
 
 func NewLayerRef(blocsFilepath string, blocId int, state State) *LayerRef {
 	return &LayerRef{blocsFilepath: blocsFilepath, blocId: blocId, state: state}
 }
 
+// Build a LayerRef timestamped by the hybrid logical clock of the device which wrote the layer.
+func NewClockedLayerRef(blocsFilepath string, blocId int, state State, clock hlc.Timestamp) *LayerRef {
+	return &LayerRef{blocsFilepath: blocsFilepath, blocId: blocId, state: state, clock: clock}
+}
+
+func (l LayerRef) BlocsFilepath() string {
+	return l.blocsFilepath
+}
+
+func (l LayerRef) BlocId() int {
+	return l.blocId
+}
+
+func (l LayerRef) State() State {
+	return l.state
+}
+
+func (l LayerRef) Clock() hlc.Timestamp {
+	return l.clock
+}
+
+// Order layers by their clocks, giving the same order on all devices.
+func SortLayerRefs(layers []*LayerRef) {
+	slices.SortStableFunc(layers, func(a, b *LayerRef) int {
+		return a.clock.Compare(b.clock)
+	})
+}
+
+// A layer hold either the full document content or CRDT operations editing the previous layers.
+// Parents are the clocks of the layers it was saved on top of.
+// A snapshot layer squash the layers it was saved on top of: it holds the full content, with the
+// CRDT runes of the document for journals, and the latest clock of each device it folds, so the
+// folded layers can be compacted. A tombstone layer delete the bucket.
 type Layer struct {
 	content  string
+	ops      []crdt.Op
+	isOps    bool
+	runs     []crdt.Run
+	frontier []hlc.Timestamp
+	deleted  bool
+	parents  []hlc.Timestamp
 	metadata *Metadata
 }
 
+func NewLayer(content string, metadata *Metadata) *Layer {
+	return &Layer{content: content, metadata: metadata}
+}
+
+func NewOpsLayer(ops []crdt.Op, metadata *Metadata) *Layer {
+	return &Layer{ops: ops, isOps: true, metadata: metadata}
+}
+
+func NewSnapshotLayer(content string, runs []crdt.Run, frontier []hlc.Timestamp, metadata *Metadata) *Layer {
+	m := *metadata
+	m.snapshoted = true
+	return &Layer{content: content, runs: runs, frontier: frontier, metadata: &m}
+}
+
+func NewTombstoneLayer(metadata *Metadata) *Layer {
+	return &Layer{deleted: true, metadata: metadata}
+}
+
+func (l Layer) Content() string {
+	return l.content
+}
+
+func (l Layer) Ops() []crdt.Op {
+	return l.ops
+}
+
+// Whether the layer holds CRDT operations rather than content. A layer saving unchanged content
+// holds no operation.
+func (l Layer) IsOps() bool {
+	return l.isOps
+}
+
+func (l Layer) Runs() []crdt.Run {
+	return l.runs
+}
+
+// Latest clock of each device folded in a snapshot layer.
+func (l Layer) Frontier() []hlc.Timestamp {
+	return l.frontier
+}
+
+// Whether a layer is folded in the snapshot layer. Each device saves its layers in clock order
+// and replicates them in that order, so a snapshot folds all layers of a device up to a clock.
+func (l Layer) folds(clock hlc.Timestamp) bool {
+	for _, f := range l.frontier {
+		if f.Device == clock.Device {
+			return clock.Compare(f) <= 0
+		}
+	}
+	return false
+}
+
+func (l Layer) Deleted() bool {
+	return l.deleted
+}
+
+func (l Layer) Parents() []hlc.Timestamp {
+	return l.parents
+}
+
+func (l *Layer) SetParents(parents ...hlc.Timestamp) {
+	l.parents = parents
+}
+
+func (m *Metadata) SetVersion(version int) {
+	m.version = version
+}
+
+func (l Layer) Metadata() *Metadata {
+	return l.metadata
+}
+
+// Store read and write bucket layers.
+type Store interface {
+	Layer(ref *LayerRef) (*Layer, error)
+	// Save content as a new layer on top of the base bucket layers.
+	SaveLayer(base *Bucket, content string, labels Labels) error
+	// Save the projected document as a snapshot layer on top of the base bucket layers.
+	SaveSnapshot(base *Bucket) error
+}
+
 type Bucket struct {
-	//db     *DB
+	store  Store
 	uid    string
+	state  State
 	layers []*LayerRef
 	//layers *paginer[string, *layer]
 }
 
-func NewBucket(uid string, layers []*LayerRef) *Bucket {
+func NewBucket(store Store, uid string, state State, layers []*LayerRef) *Bucket {
+	layers = slices.Clone(layers)
+	SortLayerRefs(layers)
 	return &Bucket{
+		store:  store,
 		uid:    uid,
+		state:  state,
 		layers: layers,
 	}
 }
 
+func (b Bucket) Uid() string {
+	return b.uid
+}
+
+func (b Bucket) State() State {
+	return b.state
+}
+
+// Layers ordered by their clocks.
+func (b Bucket) Layers() []*LayerRef {
+	return b.layers
+}
+
+// Project the document from the layers.
+// Layers holding CRDT operations are merged without conflict, a layer holding the full document
+// replace previous content. Without CRDT operations concurrent edits are folded by keeping the
+// last layer in clock order. In any case all devices project the same document.
 func (b Bucket) Project() (Document, error) {
-	panic("not implemented yet")
+	if len(b.layers) == 0 {
+		return Document{}, ErrEmptyBucket
+	}
+	first := b.layers[0]
+	last := b.layers[len(b.layers)-1]
+	l, err := b.store.Layer(last)
+	if err != nil {
+		return Document{}, err
+	}
+	if l.Deleted() {
+		return Document{}, ErrDeletedBucket
+	}
+	content := l.Content()
+	if l.IsOps() {
+		doc, err := b.merge()
+		if err != nil {
+			return Document{}, err
+		}
+		content = doc.Text()
+	}
+	metadata := &Metadata{
+		version: len(b.layers),
+		created: first.clock.Time(),
+		updated: last.clock.Time(),
+		labels:  l.Metadata().Labels(),
+	}
+	return NewDocument(content, metadata), nil
+}
+
+// Whether the bucket was deleted by a tombstone layer.
+func (b Bucket) Deleted() (bool, error) {
+	if len(b.layers) == 0 {
+		return false, nil
+	}
+	l, err := b.store.Layer(b.layers[len(b.layers)-1])
+	if err != nil {
+		return false, err
+	}
+	return l.Deleted(), nil
+}
+
+// Clock of the first layer saved since the bucket was last deleted, zero if the bucket is
+// empty or deleted.
+func (b Bucket) Created() (hlc.Timestamp, error) {
+	var created hlc.Timestamp
+	for k := len(b.layers) - 1; k >= 0; k-- {
+		l, err := b.store.Layer(b.layers[k])
+		if err != nil {
+			return hlc.Timestamp{}, err
+		}
+		if l.Deleted() {
+			break
+		}
+		created = b.layers[k].clock
+	}
+	return created, nil
+}
+
+// Fold all layers in clock order into a CRDT document.
+// The document restarts from the latest snapshot, then the layers it does not fold are folded:
+// folded layers may be compacted, other snapshots only squash layers folded separately.
+func (b Bucket) merge() (*crdt.Doc, error) {
+	layers := make([]*Layer, 0, len(b.layers))
+	last := -1
+	for k, ref := range b.layers {
+		l, err := b.store.Layer(ref)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, l)
+		if l.Metadata().Snapshoted() {
+			last = k
+		}
+	}
+	if last < 0 {
+		doc := crdt.NewDoc()
+		for k, l := range layers {
+			err := apply(doc, b.layers[k].clock, l)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return doc, nil
+	}
+
+	doc, err := b.restart(layers, last)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := layers[last]
+	for k, l := range layers[last+1:] {
+		clock := b.layers[last+1+k].clock
+		if snapshot.folds(clock) || l.Metadata().Snapshoted() {
+			continue
+		}
+		err := apply(doc, clock, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Document restarted from the snapshot layer at index last, folding the previous layers the
+// snapshot does not fold.
+func (b Bucket) restart(layers []*Layer, last int) (*crdt.Doc, error) {
+	snapshot := layers[last]
+	doc := crdt.NewDocFromSnapshot(snapshot.Runs())
+	if snapshot.Runs() == nil {
+		err := apply(doc, b.layers[last].clock, snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, l := range layers[:last] {
+		if snapshot.folds(b.layers[k].clock) || l.Metadata().Snapshoted() {
+			continue
+		}
+		err := apply(doc, b.layers[k].clock, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func apply(doc *crdt.Doc, clock hlc.Timestamp, l *Layer) error {
+	ops := l.Ops()
+	if !l.IsOps() {
+		ops = doc.Diff(l.Content())
+	}
+	return doc.Apply(clock, ops)
+}
+
+// Latest layer clock of each device, ordered by device.
+func (b Bucket) Frontier() []hlc.Timestamp {
+	latest := map[string]hlc.Timestamp{}
+	for _, ref := range b.layers {
+		if ref.clock.Compare(latest[ref.clock.Device]) > 0 {
+			latest[ref.clock.Device] = ref.clock
+		}
+	}
+	frontier := make([]hlc.Timestamp, 0, len(latest))
+	for _, clock := range latest {
+		frontier = append(frontier, clock)
+	}
+	slices.SortFunc(frontier, func(a, b hlc.Timestamp) int {
+		return strings.Compare(a.Device, b.Device)
+	})
+	return frontier
+}
+
+// CRDT runes of the projected document, to save in a snapshot layer.
+func (b Bucket) Snapshot() ([]crdt.Run, error) {
+	doc, err := b.merge()
+	if err != nil {
+		return nil, err
+	}
+	return doc.Snapshot(), nil
+}
+
+// CRDT operations transforming the projected document into content.
+func (b Bucket) EditOps(content string) ([]crdt.Op, error) {
+	doc, err := b.merge()
+	if err != nil {
+		return nil, err
+	}
+	return doc.Diff(content), nil
 }
 
 func (b Bucket) Save(content string, labels Labels) error {
-	panic("not implemented yet")
+	return b.store.SaveLayer(&b, content, labels)
 }
 
 func (b Bucket) Commit() error {
 	panic("not implemented yet")
 }
 
+// Save the projected document as a snapshot layer, so the bucket history can be compacted.
 func (b Bucket) Squash() error {
-	panic("not implemented yet")
+	return b.store.SaveSnapshot(&b)
 }
 
 // type cursor[K comparable, V any] struct {
@@ -173,7 +173,7 @@ func (p *paginer[K, V]) All() iter.Seq2[error, *page[K, V]] {
 	}
 }
 
-func NewPaginer[K comparable, V any](pageSize, preloadPageCount int, pusher func(func(K, V, error) bool)) *paginer[K, V] {
+func NewPaginer[K any, V any](pageSize, preloadPageCount int, pusher func(func(K, V, error) bool)) *paginer[K, V] {
 	p := &paginer[K, V]{
 		//errChan:      errChan,
 		pageSize:     pageSize,
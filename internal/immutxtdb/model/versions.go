@@ -0,0 +1,133 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/crdt"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/diff"
+)
+
+// Every save is a layer, so a bucket can be projected as it was at any of its versions.
+// Versions are numbered from 1 in layers clock order: version n is the bucket folding its n
+// first layers, the latest version is the count of layers. A compaction drops the versions of
+// the layers it drops.
+
+var ErrNoVersion = errors.New("bucket has no such version")
+
+// Bucket as it was at a version.
+func (b Bucket) at(version int) (Bucket, error) {
+	if version < 1 || version > len(b.layers) {
+		return Bucket{}, fmt.Errorf("%w: %d", ErrNoVersion, version)
+	}
+	layers := b.layers[:version]
+	return Bucket{store: b.store, uid: b.uid, state: layers[version-1].state, layers: layers}, nil
+}
+
+// Latest version saved at or before a time, 0 if the bucket did not exist yet.
+func (b Bucket) VersionAt(t time.Time) int {
+	version := 0
+	for k, ref := range b.layers {
+		if !ref.clock.Time().After(t) {
+			version = k + 1
+		}
+	}
+	return version
+}
+
+// Project the document as it was at a version.
+func (b Bucket) ProjectAt(version int) (Document, error) {
+	v, err := b.at(version)
+	if err != nil {
+		return Document{}, err
+	}
+	return v.Project()
+}
+
+// Project every version in order, folding each layer once where projecting each version folds
+// all its layers again. Versions ending with a tombstone are yielded deleted, without document.
+func (b Bucket) ProjectAll(yield func(version int, doc Document, deleted bool)) error {
+	doc := crdt.NewDoc()
+	var snapshot *Layer
+	layers := make([]*Layer, 0, len(b.layers))
+	for k, ref := range b.layers {
+		l, err := b.store.Layer(ref)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, l)
+		switch {
+		case l.Metadata().Snapshoted():
+			snapshot = l
+			doc, err = b.restart(layers, k)
+		case snapshot == nil || !snapshot.folds(ref.clock):
+			err = apply(doc, ref.clock, l)
+		}
+		if err != nil {
+			return err
+		}
+
+		if l.Deleted() {
+			yield(k+1, Document{}, true)
+			continue
+		}
+		content := l.Content()
+		if l.IsOps() {
+			content = doc.Text()
+		}
+		metadata := &Metadata{
+			version: k + 1,
+			created: b.layers[0].clock.Time(),
+			updated: ref.clock.Time(),
+			labels:  l.Metadata().Labels(),
+		}
+		yield(k+1, NewDocument(content, metadata), false)
+	}
+	return nil
+}
+
+// Project the document as it was at a time.
+func (b Bucket) ProjectAtTime(t time.Time) (Document, error) {
+	version := b.VersionAt(t)
+	if version == 0 {
+		return Document{}, fmt.Errorf("%w at %s", ErrEmptyBucket, t.Format(time.RFC3339))
+	}
+	return b.ProjectAt(version)
+}
+
+// Content at a version, empty before the first version or when the bucket was deleted.
+func (b Bucket) contentAt(version int) (string, error) {
+	if version == 0 {
+		return "", nil
+	}
+	doc, err := b.ProjectAt(version)
+	if errors.Is(err, ErrDeletedBucket) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return doc.Content(), nil
+}
+
+// Diff the content lines of two versions. Version 0 is the empty bucket.
+func (b Bucket) Diff(from, to int) ([]diff.Line, error) {
+	a, err := b.contentAt(from)
+	if err != nil {
+		return nil, err
+	}
+	c, err := b.contentAt(to)
+	if err != nil {
+		return nil, err
+	}
+	return diff.Lines(a, c), nil
+}
+
+// Save the content of a version as a new layer on top of the bucket.
+func (b Bucket) Restore(version int) error {
+	doc, err := b.ProjectAt(version)
+	if err != nil {
+		return err
+	}
+	return b.store.SaveLayer(&b, doc.Content(), doc.Metadata().Labels())
+}
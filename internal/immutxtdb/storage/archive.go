@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mxbossard/utilz/filez"
+)
+
+// Archive keep all storages in a single append only file, to ship a db as one file.
+// ARCHIVE: [MAGIC,FRAME...]
+// FRAME: [BODY_LEN,CRC32(BODY),BODY]
+// BODY: [OP,NAME_LEN,NAME,DATA]
+// DATA is the appended data, or the new name of a renamed storage.
+// Metadata are kept in memory only: they are rebuilt from the blocs when the archive is opened.
+// Files are kept in memory only too: frames are never torn, a write-ahead log has nothing to
+// complete after a crash.
+
+var archiveMagic = []byte("tjarch00")
+
+const archiveFrameHeaderSize = 8
+
+const (
+	archiveAppend byte = iota
+	archiveRename
+	archiveRemove
+)
+
+type Archive struct {
+	*sync.Mutex
+	file     *os.File
+	blocSize int
+	modTime  time.Time
+	storages map[string]*memBlocs
+	metas    map[string][]byte
+	files    map[string]*memFile
+}
+
+// Open an archive, creating it if missing. A torn frame at the end of the archive is truncated.
+func OpenArchive(path string, blocSize int) (*Archive, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, filez.DefaultFilePerms)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &Archive{
+		Mutex:    &sync.Mutex{},
+		file:     f,
+		blocSize: blocSize,
+		modTime:  info.ModTime(),
+		storages: make(map[string]*memBlocs),
+		metas:    make(map[string][]byte),
+		files:    make(map[string]*memFile),
+	}
+	err = a.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archive) load() error {
+	data, err := io.ReadAll(a.file)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		_, err = a.file.Write(archiveMagic)
+		return err
+	}
+	if !bytes.HasPrefix(data, archiveMagic) {
+		return errors.New("not an archive file")
+	}
+	k := len(archiveMagic)
+	for k+archiveFrameHeaderSize <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[k:]))
+		end := k + archiveFrameHeaderSize + size
+		if end > len(data) {
+			break
+		}
+		body := data[k+archiveFrameHeaderSize : end]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[k+4:]) || len(body) < 3 {
+			break
+		}
+		nameLen := int(binary.BigEndian.Uint16(body[1:]))
+		if 3+nameLen > len(body) {
+			break
+		}
+		err = a.apply(body[0], string(body[3:3+nameLen]), body[3+nameLen:], a.modTime)
+		if err != nil {
+			return err
+		}
+		k = end
+	}
+	if k < len(data) {
+		err = a.file.Truncate(int64(k))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = a.file.Seek(int64(k), io.SeekStart)
+	return err
+}
+
+// Apply an operation in memory. Caller must hold the archive lock.
+func (a *Archive) apply(op byte, name string, data []byte, modTime time.Time) error {
+	switch op {
+	case archiveAppend:
+		b := a.blocs(name)
+		b.Lock()
+		defer b.Unlock()
+		return b.append(data, modTime)
+	case archiveRename:
+		b, ok := a.storages[name]
+		if !ok {
+			return fmt.Errorf("%s: %w", name, ErrNotExist)
+		}
+		delete(a.storages, name)
+		b.Lock()
+		b.name = string(data)
+		b.Unlock()
+		a.storages[string(data)] = b
+		delete(a.metas, string(data))
+		if meta, ok := a.metas[name]; ok {
+			a.metas[string(data)] = meta
+			delete(a.metas, name)
+		}
+	case archiveRemove:
+		if _, ok := a.storages[name]; !ok {
+			return fmt.Errorf("%s: %w", name, ErrNotExist)
+		}
+		delete(a.storages, name)
+		delete(a.metas, name)
+	default:
+		return fmt.Errorf("unknown archive operation: %d", op)
+	}
+	return nil
+}
+
+// Write an operation frame then apply it in memory. Caller must hold the archive lock.
+func (a *Archive) write(op byte, name string, data []byte) error {
+	if len(name) > 0xffff {
+		return fmt.Errorf("storage name too long: %s", name)
+	}
+	body := append([]byte{op}, binary.BigEndian.AppendUint16(nil, uint16(len(name)))...)
+	body = append(append(body, name...), data...)
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(body))
+	offset, err := a.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(frame, body...))
+	if err != nil {
+		// Roll back a partial write, frames appended after a torn frame would be lost.
+		_, seekErr := a.file.Seek(offset, io.SeekStart)
+		return errors.Join(err, a.file.Truncate(offset), seekErr)
+	}
+	return a.apply(op, name, data, time.Now())
+}
+
+// Caller must hold the archive lock.
+func (a *Archive) blocs(name string) *memBlocs {
+	b, ok := a.storages[name]
+	if !ok {
+		b = newMemBlocs(name, a.blocSize)
+		a.storages[name] = b
+	}
+	return b
+}
+
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+func (a *Archive) List() ([]string, error) {
+	a.Lock()
+	defer a.Unlock()
+	var names []string
+	for name, b := range a.storages {
+		if b.getStamp().Size > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (a *Archive) Open(name string) (Storage, error) {
+	a.Lock()
+	defer a.Unlock()
+	return archiveStorage{memBlocs: a.blocs(name), archive: a}, nil
+}
+
+// Check the storage exists before writing the operation. Caller must hold the archive lock.
+func (a *Archive) exists(name string) error {
+	if b, ok := a.storages[name]; !ok || b.getStamp().Size == 0 {
+		return fmt.Errorf("%s: %w", name, ErrNotExist)
+	}
+	return nil
+}
+
+func (a *Archive) Rename(from, to string) error {
+	a.Lock()
+	defer a.Unlock()
+	err := a.exists(from)
+	if err != nil {
+		return err
+	}
+	return a.write(archiveRename, from, []byte(to))
+}
+
+func (a *Archive) Remove(name string) error {
+	a.Lock()
+	defer a.Unlock()
+	err := a.exists(name)
+	if err != nil {
+		return err
+	}
+	return a.write(archiveRemove, name, nil)
+}
+
+func (a *Archive) Stat(name string) (Stamp, error) {
+	a.Lock()
+	b, ok := a.storages[name]
+	a.Unlock()
+	if !ok || b.getStamp().Size == 0 {
+		return Stamp{}, fmt.Errorf("%s: %w", name, ErrNotExist)
+	}
+	return b.getStamp(), nil
+}
+
+func (a *Archive) ReadMeta(name string) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	data, ok := a.metas[name]
+	if !ok {
+		return nil, fmt.Errorf("metadata of %s: %w", name, ErrNotExist)
+	}
+	return data, nil
+}
+
+func (a *Archive) WriteMeta(name string, data []byte) error {
+	a.Lock()
+	defer a.Unlock()
+	a.metas[name] = slices.Clone(data)
+	return nil
+}
+
+func (a *Archive) OpenFile(name string) (File, error) {
+	a.Lock()
+	defer a.Unlock()
+	f, ok := a.files[name]
+	if !ok {
+		f = &memFile{Mutex: &sync.Mutex{}}
+		a.files[name] = f
+	}
+	return &memFileHandle{file: f}, nil
+}
+
+type archiveStorage struct {
+	*memBlocs
+	archive *Archive
+}
+
+// Write the data frame in the archive before appending it in memory.
+func (s archiveStorage) Append(data []byte) error {
+	a := s.archive
+	a.Lock()
+	defer a.Unlock()
+	name := s.Name()
+	if a.storages[name] != s.memBlocs {
+		return fmt.Errorf("%s was renamed or removed", name)
+	}
+	if len(data) > s.blocSize {
+		return fmt.Errorf("cannot append %d bytes in %s: bloc size is %d", len(data), name, s.blocSize)
+	}
+	return a.write(archiveAppend, name, data)
+}
+
+// Frames are written all or nothing, an archive storage never holds a partial word to drop.
+func (s archiveStorage) Truncate(size int64) error {
+	if size < s.getStamp().Size {
+		return fmt.Errorf("cannot truncate %s: archive storages are append only", s.Name())
+	}
+	return nil
+}
+
+func (s archiveStorage) Sync() error {
+	a := s.archive
+	a.Lock()
+	defer a.Unlock()
+	return a.file.Sync()
+}
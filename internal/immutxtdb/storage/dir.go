@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+)
+
+// Dir keep each storage in a blocs file of a directory, and its metadata in a sidecar file.
+type Dir struct {
+	path      string
+	blocSize  int
+	cacheSize int
+	metaExt   string
+}
+
+func NewDir(path string, blocSize, cacheSize int, metaExt string) *Dir {
+	return &Dir{path: path, blocSize: blocSize, cacheSize: cacheSize, metaExt: metaExt}
+}
+
+// Names of the files of the directory, metadata sidecars and temp files excluded.
+func (d *Dir) List() ([]string, error) {
+	entries, err := os.ReadDir(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, d.metaExt) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Open a blocs file. A fresh blocs file does not serve blocs cached before the file grew.
+func (d *Dir) Open(name string) (Storage, error) {
+	bf, err := filez.NewBlocsFile(filepath.Join(d.path, name), d.blocSize, d.cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &blocsFile{bf: bf, blocSize: d.blocSize, cacheSize: d.cacheSize}, nil
+}
+
+func (d *Dir) Stat(name string) (Stamp, error) {
+	info, err := os.Stat(filepath.Join(d.path, name))
+	if os.IsNotExist(err) {
+		return Stamp{}, fmt.Errorf("%s: %w", name, ErrNotExist)
+	} else if err != nil {
+		return Stamp{}, err
+	}
+	return Stamp{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *Dir) Rename(from, to string) error {
+	err := os.Rename(filepath.Join(d.path, from), filepath.Join(d.path, to))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", from, ErrNotExist)
+	} else if err != nil {
+		return err
+	}
+	err = os.Rename(d.metaPath(from), d.metaPath(to))
+	if os.IsNotExist(err) {
+		err = os.Remove(d.metaPath(to))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return SyncDir(d.path)
+}
+
+// Flush the entries of a directory, so the files created or renamed in it survive a crash.
+func SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (d *Dir) Remove(name string) error {
+	err := os.Remove(filepath.Join(d.path, name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", name, ErrNotExist)
+	} else if err != nil {
+		return err
+	}
+	err = os.Remove(d.metaPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *Dir) metaPath(name string) string {
+	return filepath.Join(d.path, name+d.metaExt)
+}
+
+func (d *Dir) ReadMeta(name string) ([]byte, error) {
+	data, err := os.ReadFile(d.metaPath(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("metadata of %s: %w", name, ErrNotExist)
+	}
+	return data, err
+}
+
+// Write the sidecar in a temp file then rename it to never leave a torn sidecar.
+func (d *Dir) WriteMeta(name string, data []byte) error {
+	path := d.metaPath(name)
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, data, filez.DefaultFilePerms)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (d *Dir) OpenFile(name string) (File, error) {
+	return os.OpenFile(filepath.Join(d.path, name), os.O_RDWR|os.O_CREATE, filez.DefaultFilePerms)
+}
+
+type blocsFile struct {
+	bf        *filez.BlocsFile
+	blocSize  int
+	cacheSize int
+}
+
+// Blocs file path.
+func (f *blocsFile) Name() string {
+	return f.bf.Name()
+}
+
+func (f *blocsFile) Append(data []byte) error {
+	_, err := f.bf.Write(data)
+	return err
+}
+
+func (f *blocsFile) ReadBloc(k int) ([]byte, error) {
+	n := 0
+	for bloc, err := range f.All(model.TopToBottom) {
+		if err != nil {
+			return nil, err
+		}
+		if n == k {
+			return bloc, nil
+		}
+		n++
+	}
+	return nil, fmt.Errorf("bloc #%d of %s: %w", k, f.Name(), ErrNotExist)
+}
+
+func (f *blocsFile) LastNonEmptyBloc() ([]byte, error) {
+	b, err := f.bf.GetLastNonEmptyBloc()
+	if err == filez.ErrNotExist {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	_, err = io.Copy(buf, b)
+	return buf.Bytes(), err
+}
+
+func (f *blocsFile) All(order model.Order) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		errChan := make(chan error, 1)
+		for b := range f.bf.All(filez.BlocOrdering(order), errChan) {
+			if !yield(b.Bytes(), nil) {
+				return
+			}
+		}
+		close(errChan)
+		if err := <-errChan; err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// Copy the kept data in a temp blocs file then rename it over the blocs file. Blocs hold whole
+// appends, copying them bloc by bloc never splits an append.
+func (f *blocsFile) Truncate(size int64) error {
+	var kept [][]byte
+	var total int64
+	for bloc, err := range f.All(model.TopToBottom) {
+		if err != nil {
+			return err
+		}
+		kept = append(kept, bloc[:min(int64(len(bloc)), max(size-total, 0))])
+		total += int64(len(bloc))
+	}
+	if total <= size {
+		return nil
+	}
+	path := f.Name()
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, nil, filez.DefaultFilePerms)
+	if err != nil {
+		return err
+	}
+	tmp, err := filez.NewBlocsFile(tmpPath, f.blocSize, f.cacheSize)
+	if err != nil {
+		return err
+	}
+	for _, bloc := range kept {
+		if len(bloc) == 0 {
+			continue
+		}
+		_, err = tmp.Write(bloc)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	// A fresh blocs file does not serve the dropped blocs from its cache.
+	f.bf, err = filez.NewBlocsFile(path, f.blocSize, f.cacheSize)
+	return err
+}
+
+func (f *blocsFile) Sync() error {
+	file, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Memory keep storages in memory, for tests.
+type Memory struct {
+	*sync.Mutex
+	blocSize int
+	storages map[string]*memBlocs
+	metas    map[string][]byte
+	files    map[string]*memFile
+}
+
+func NewMemory(blocSize int) *Memory {
+	return &Memory{
+		Mutex:    &sync.Mutex{},
+		blocSize: blocSize,
+		storages: make(map[string]*memBlocs),
+		metas:    make(map[string][]byte),
+		files:    make(map[string]*memFile),
+	}
+}
+
+func (m *Memory) List() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	var names []string
+	for name, s := range m.storages {
+		// Like files, storages exist once written.
+		if s.getStamp().Size > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (m *Memory) Open(name string) (Storage, error) {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.storages[name]
+	if !ok {
+		s = newMemBlocs(name, m.blocSize)
+		m.storages[name] = s
+	}
+	return s, nil
+}
+
+func (m *Memory) Stat(name string) (Stamp, error) {
+	m.Lock()
+	s, ok := m.storages[name]
+	m.Unlock()
+	if !ok || s.getStamp().Size == 0 {
+		return Stamp{}, fmt.Errorf("%s: %w", name, ErrNotExist)
+	}
+	return s.getStamp(), nil
+}
+
+func (m *Memory) Rename(from, to string) error {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.storages[from]
+	if !ok {
+		return fmt.Errorf("%s: %w", from, ErrNotExist)
+	}
+	delete(m.storages, from)
+	s.Lock()
+	s.name = to
+	s.Unlock()
+	m.storages[to] = s
+	delete(m.metas, to)
+	if meta, ok := m.metas[from]; ok {
+		m.metas[to] = meta
+		delete(m.metas, from)
+	}
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.storages[name]; !ok {
+		return fmt.Errorf("%s: %w", name, ErrNotExist)
+	}
+	delete(m.storages, name)
+	delete(m.metas, name)
+	return nil
+}
+
+func (m *Memory) ReadMeta(name string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	data, ok := m.metas[name]
+	if !ok {
+		return nil, fmt.Errorf("metadata of %s: %w", name, ErrNotExist)
+	}
+	return data, nil
+}
+
+func (m *Memory) WriteMeta(name string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.metas[name] = slices.Clone(data)
+	return nil
+}
+
+func (m *Memory) OpenFile(name string) (File, error) {
+	m.Lock()
+	defer m.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		f = &memFile{Mutex: &sync.Mutex{}}
+		m.files[name] = f
+	}
+	return &memFileHandle{file: f}, nil
+}
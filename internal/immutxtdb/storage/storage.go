@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+)
+
+// Storages hold the blocs of idx files. Words are appended in the last bloc of a storage, a new
+// bloc is started when a word does not fit in it. A backend opens storages by name and keeps a
+// small metadata sidecar next to each of them, and the files of the write-ahead logs which do not
+// fit in blocs.
+
+var ErrNotExist = errors.New("does not exist")
+
+type Storage interface {
+	// Name identifying the storage in its backend, may be prefixed by the backend location.
+	Name() string
+	Append(data []byte) error
+	ReadBloc(k int) ([]byte, error)
+	// Return ErrNotExist if the storage holds no data.
+	LastNonEmptyBloc() ([]byte, error)
+	All(order model.Order) iter.Seq2[[]byte, error]
+	// Keep the first size bytes of data, dropping the data appended after them.
+	Truncate(size int64) error
+	// Flush appended data to stable storage.
+	Sync() error
+}
+
+// Size and modification time of a storage, changing when the storage grows.
+type Stamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+type Backend interface {
+	// Names of the storages of the backend.
+	List() ([]string, error)
+	// Open a storage, created on first append if missing.
+	Open(name string) (Storage, error)
+	Stat(name string) (Stamp, error)
+	// Replace a storage by another one, with its metadata. The rename survives a crash once done.
+	Rename(from, to string) error
+	// Remove a storage and its metadata. Return ErrNotExist if the storage does not exist.
+	Remove(name string) error
+	// Return ErrNotExist if no metadata was written for the storage.
+	ReadMeta(name string) ([]byte, error)
+	WriteMeta(name string, data []byte) error
+	// Open a file read and written in place, created if missing.
+	OpenFile(name string) (File, error)
+}
+
+type File interface {
+	io.ReadWriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// File content kept in memory, shared by the memory and archive backends. Each opening has its
+// own offset.
+type memFile struct {
+	*sync.Mutex
+	data []byte
+}
+
+type memFileHandle struct {
+	file   *memFile
+	offset int64
+}
+
+func (h *memFileHandle) Read(p []byte) (int, error) {
+	h.file.Lock()
+	defer h.file.Unlock()
+	if h.offset >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.file.data[h.offset:])
+	h.offset += int64(n)
+	return n, nil
+}
+
+func (h *memFileHandle) Write(p []byte) (int, error) {
+	h.file.Lock()
+	defer h.file.Unlock()
+	if end := h.offset + int64(len(p)); end > int64(len(h.file.data)) {
+		h.file.data = append(h.file.data, make([]byte, end-int64(len(h.file.data)))...)
+	}
+	n := copy(h.file.data[h.offset:], p)
+	h.offset += int64(n)
+	return n, nil
+}
+
+func (h *memFileHandle) Seek(offset int64, whence int) (int64, error) {
+	h.file.Lock()
+	defer h.file.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += h.offset
+	case io.SeekEnd:
+		offset += int64(len(h.file.data))
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative offset %d", offset)
+	}
+	h.offset = offset
+	return offset, nil
+}
+
+func (h *memFileHandle) Truncate(size int64) error {
+	h.file.Lock()
+	defer h.file.Unlock()
+	if size < int64(len(h.file.data)) {
+		h.file.data = h.file.data[:size]
+	} else {
+		h.file.data = append(h.file.data, make([]byte, size-int64(len(h.file.data)))...)
+	}
+	return nil
+}
+
+// Memory files are never persisted.
+func (h *memFileHandle) Sync() error {
+	return nil
+}
+
+func (h *memFileHandle) Close() error {
+	return nil
+}
+
+// Blocs kept in memory, shared by the memory and archive storages.
+type memBlocs struct {
+	*sync.Mutex
+	name     string
+	blocSize int
+	blocs    [][]byte
+	stamp    Stamp
+}
+
+func newMemBlocs(name string, blocSize int) *memBlocs {
+	return &memBlocs{Mutex: &sync.Mutex{}, name: name, blocSize: blocSize}
+}
+
+func (b *memBlocs) Name() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.name
+}
+
+// Append data without locking, returning an error if data cannot fit in a bloc.
+func (b *memBlocs) append(data []byte, modTime time.Time) error {
+	if len(data) > b.blocSize {
+		return fmt.Errorf("cannot append %d bytes in %s: bloc size is %d", len(data), b.name, b.blocSize)
+	}
+	if len(b.blocs) == 0 || len(b.blocs[len(b.blocs)-1])+len(data) > b.blocSize {
+		b.blocs = append(b.blocs, nil)
+	}
+	last := len(b.blocs) - 1
+	b.blocs[last] = append(b.blocs[last], data...)
+	b.stamp = Stamp{Size: b.stamp.Size + int64(len(data)), ModTime: modTime}
+	return nil
+}
+
+func (b *memBlocs) Append(data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	return b.append(data, time.Now())
+}
+
+func (b *memBlocs) Truncate(size int64) error {
+	b.Lock()
+	defer b.Unlock()
+	if size >= b.stamp.Size {
+		return nil
+	}
+	kept := int64(0)
+	for k, bloc := range b.blocs {
+		if kept+int64(len(bloc)) >= size {
+			b.blocs[k] = bloc[:size-kept]
+			b.blocs = b.blocs[:k+1]
+			break
+		}
+		kept += int64(len(bloc))
+	}
+	b.stamp = Stamp{Size: size, ModTime: time.Now()}
+	return nil
+}
+
+// Memory blocs are never persisted.
+func (b *memBlocs) Sync() error {
+	return nil
+}
+
+func (b *memBlocs) ReadBloc(k int) ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+	if k < 0 || k >= len(b.blocs) {
+		return nil, fmt.Errorf("bloc #%d of %s: %w", k, b.name, ErrNotExist)
+	}
+	return capped(b.blocs[k]), nil
+}
+
+func (b *memBlocs) LastNonEmptyBloc() ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+	for k := len(b.blocs) - 1; k >= 0; k-- {
+		if len(b.blocs[k]) > 0 {
+			return capped(b.blocs[k]), nil
+		}
+	}
+	return nil, ErrNotExist
+}
+
+// Iterate over the blocs existing when the iteration starts.
+func (b *memBlocs) All(order model.Order) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		b.Lock()
+		blocs := make([][]byte, len(b.blocs))
+		for k, bloc := range b.blocs {
+			blocs[k] = capped(bloc)
+		}
+		b.Unlock()
+		walkBlocs(blocs, order, yield)
+	}
+}
+
+// Data appended to a bloc is never written in a capped slice of it.
+func capped(bloc []byte) []byte {
+	return bloc[:len(bloc):len(bloc)]
+}
+
+func walkBlocs(blocs [][]byte, order model.Order, yield func([]byte, error) bool) {
+	if order == model.TopToBottom {
+		for _, bloc := range blocs {
+			if !yield(bloc, nil) {
+				return
+			}
+		}
+		return
+	}
+	for k := len(blocs) - 1; k >= 0; k-- {
+		if !yield(blocs[k], nil) {
+			return
+		}
+	}
+}
+
+func (b *memBlocs) getStamp() Stamp {
+	b.Lock()
+	defer b.Unlock()
+	return b.stamp
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collect(t *testing.T, st Storage, order model.Order) []string {
+	var blocs []string
+	for b, err := range st.All(order) {
+		require.NoError(t, err)
+		blocs = append(blocs, string(b))
+	}
+	return blocs
+}
+
+func testBackend(t *testing.T, b Backend) {
+	names, err := b.List()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	st, err := b.Open("foo")
+	require.NoError(t, err)
+	_, err = st.LastNonEmptyBloc()
+	assert.ErrorIs(t, err, ErrNotExist)
+	_, err = b.Stat("foo")
+	assert.ErrorIs(t, err, ErrNotExist)
+
+	for _, word := range []string{"aaa", "bbb", "ccc", "dd"} {
+		require.NoError(t, st.Append([]byte(word)))
+	}
+	assert.Error(t, st.Append([]byte("too long for a bloc")))
+	assert.Equal(t, []string{"aaabbb", "cccdd"}, collect(t, st, model.TopToBottom))
+	assert.Equal(t, []string{"cccdd", "aaabbb"}, collect(t, st, model.BottomToTop))
+	bloc, err := st.ReadBloc(0)
+	require.NoError(t, err)
+	assert.Equal(t, "aaabbb", string(bloc))
+	_, err = st.ReadBloc(2)
+	assert.ErrorIs(t, err, ErrNotExist)
+	bloc, err = st.LastNonEmptyBloc()
+	require.NoError(t, err)
+	assert.Equal(t, "cccdd", string(bloc))
+
+	stamp, err := b.Stat("foo")
+	require.NoError(t, err)
+	require.NoError(t, st.Append([]byte("e")))
+	grown, err := b.Stat("foo")
+	require.NoError(t, err)
+	assert.NotEqual(t, stamp, grown)
+
+	names, err = b.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, names)
+
+	_, err = b.ReadMeta("foo")
+	assert.ErrorIs(t, err, ErrNotExist)
+	require.NoError(t, b.WriteMeta("foo", []byte("meta")))
+	meta, err := b.ReadMeta("foo")
+	require.NoError(t, err)
+	assert.Equal(t, "meta", string(meta))
+	names, err = b.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, names)
+
+	tmp, err := b.Open("baz.tmp")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Append([]byte("baz")))
+	require.NoError(t, b.WriteMeta("baz.tmp", []byte("baz meta")))
+	require.NoError(t, b.Rename("baz.tmp", "baz"))
+	baz, err := b.Open("baz")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"baz"}, collect(t, baz, model.TopToBottom))
+	meta, err = b.ReadMeta("baz")
+	require.NoError(t, err)
+	assert.Equal(t, "baz meta", string(meta))
+	names, err = b.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"baz", "foo"}, sorted(names))
+
+	require.NoError(t, b.Remove("baz"))
+	assert.ErrorIs(t, b.Remove("baz"), ErrNotExist)
+	assert.ErrorIs(t, b.Rename("baz", "qux"), ErrNotExist)
+	_, err = b.ReadMeta("baz")
+	assert.ErrorIs(t, err, ErrNotExist)
+	names, err = b.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, names)
+}
+
+func sorted(names []string) []string {
+	slices.Sort(names)
+	return names
+}
+
+// Drop a partial word appended by a crash.
+func testTruncate(t *testing.T, b Backend) {
+	st, err := b.Open("trunc")
+	require.NoError(t, err)
+	for _, word := range []string{"aaa", "bbb", "ccc", "d"} {
+		require.NoError(t, st.Append([]byte(word)))
+	}
+	require.NoError(t, st.Truncate(20))
+	assert.Equal(t, []string{"aaabbb", "cccd"}, collect(t, st, model.TopToBottom))
+	require.NoError(t, st.Truncate(9))
+	require.NoError(t, st.Sync())
+	assert.Equal(t, []string{"aaabbb", "ccc"}, collect(t, st, model.TopToBottom))
+	stamp, err := b.Stat("trunc")
+	require.NoError(t, err)
+	require.NoError(t, st.Append([]byte("eee")))
+	assert.Equal(t, []string{"aaabbb", "ccceee"}, collect(t, st, model.TopToBottom))
+	grown, err := b.Stat("trunc")
+	require.NoError(t, err)
+	assert.NotEqual(t, stamp, grown)
+	require.NoError(t, b.Remove("trunc"))
+}
+
+// Files are written in place and keep their content across openings.
+func testFile(t *testing.T, b Backend) {
+	f, err := b.OpenFile("log")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("aaabbb"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(3))
+	_, err = f.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("ccc"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Close())
+
+	f, err = b.OpenFile("log")
+	require.NoError(t, err)
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaccc", string(content))
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, NewMemory(6))
+	testTruncate(t, NewMemory(6))
+	testFile(t, NewMemory(6))
+}
+
+func TestDir(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestDir")
+	defer os.RemoveAll(tmpDir)
+	testBackend(t, NewDir(tmpDir, 6, 10, ".meta"))
+	testTruncate(t, NewDir(tmpDir, 6, 10, ".meta"))
+	testFile(t, NewDir(tmpDir, 6, 10, ".meta"))
+}
+
+func TestArchive(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestArchive")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "db.archive")
+
+	a, err := OpenArchive(path, 6)
+	require.NoError(t, err)
+	testBackend(t, a)
+	bar, err := a.Open("bar")
+	require.NoError(t, err)
+	require.NoError(t, bar.Append([]byte("bar")))
+	require.NoError(t, a.Close())
+
+	// Blocs are rebuilt on open, a torn frame is truncated.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	a, err = OpenArchive(path, 6)
+	require.NoError(t, err)
+	defer a.Close()
+	names, err := a.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, names)
+	foo, err := a.Open("foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaabbb", "cccdde"}, collect(t, foo, model.TopToBottom))
+	require.NoError(t, foo.Append([]byte("f")))
+	assert.Equal(t, []string{"aaabbb", "cccdde", "f"}, collect(t, foo, model.TopToBottom))
+	// Frames are never torn in memory, archive storages are append only
+	assert.Error(t, foo.Truncate(3))
+	require.NoError(t, foo.Truncate(13))
+	require.NoError(t, foo.Sync())
+	// Metadata are not kept in the archive
+	_, err = a.ReadMeta("foo")
+	assert.ErrorIs(t, err, ErrNotExist)
+	testFile(t, a)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "other"), []byte("not an archive"), 0600))
+	_, err = OpenArchive(filepath.Join(tmpDir, "other"), 6)
+	assert.Error(t, err)
+}
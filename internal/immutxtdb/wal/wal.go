@@ -0,0 +1,311 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mxbossard/utilz/filez"
+)
+
+// Write-ahead log of idx words.
+// Words are appended to the log before being written into their idx file, so a crash between
+// both writes can be completed on next open. Once written, the log is checkpointed (truncated).
+//
+// FRAME: [MAGIC,PAYLOAD_LEN,CRC32(PAYLOAD),PAYLOAD]
+// PAYLOAD: [RECORD_COUNT,RECORD...]
+// RECORD: [TARGET_LEN,TARGET,SEQ,DATA_LEN,DATA]
+//
+// A frame is all or nothing: a torn or corrupted frame is truncated on open.
+
+const (
+	frameMagic      = uint32(0x77616c30) // wal0
+	frameHeaderSize = 12
+)
+
+var ErrClosed = errors.New("wal is closed")
+
+type SyncPolicy int
+
+const (
+	// Sync the log on every append.
+	SyncAlways SyncPolicy = iota
+	// Sync the log every BatchSize appends or BatchDelay elapsed. A crash may lose the last batch.
+	SyncBatched
+	// Never sync the log, leave it to the OS.
+	SyncNever
+)
+
+const (
+	DefaultBatchSize  = 32
+	DefaultBatchDelay = 100 * time.Millisecond
+)
+
+// A word to write at seq in the target idx file.
+type Record struct {
+	Target string
+	Seq    int
+	Data   []byte
+}
+
+type File interface {
+	io.ReadWriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type Log struct {
+	*sync.Mutex
+	file       File
+	policy     SyncPolicy
+	batchSize  int
+	batchDelay time.Duration
+	unsynced   int
+	lastSync   time.Time
+	pending    [][]Record
+}
+
+func Open(path string, policy SyncPolicy) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, filez.DefaultFilePerms)
+	if err != nil {
+		return nil, err
+	}
+	return OpenFile(f, policy)
+}
+
+// Open a log kept in a file opened by the caller, the log closes it.
+func OpenFile(f File, policy SyncPolicy) (*Log, error) {
+	l := &Log{
+		Mutex:      &sync.Mutex{},
+		file:       f,
+		policy:     policy,
+		batchSize:  DefaultBatchSize,
+		batchDelay: DefaultBatchDelay,
+		lastSync:   time.Now(),
+	}
+	err := l.recover()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Read all complete frames and truncate the log after the last one.
+func (l *Log) recover() error {
+	_, err := l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	content, err := io.ReadAll(l.file)
+	if err != nil {
+		return err
+	}
+	valid := 0
+	for valid < len(content) {
+		records, n, err := decodeFrame(content[valid:])
+		if err != nil {
+			break
+		}
+		l.pending = append(l.pending, records)
+		valid += n
+	}
+	if valid < len(content) {
+		err = l.file.Truncate(int64(valid))
+		if err != nil {
+			return err
+		}
+		err = l.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = l.file.Seek(int64(valid), io.SeekStart)
+	return err
+}
+
+// Frames found on open or appended since, which may not have been written into their targets
+// until the next checkpoint. Each frame holds records which were appended together.
+func (l *Log) Pending() [][]Record {
+	l.Lock()
+	defer l.Unlock()
+	return slices.Clone(l.pending)
+}
+
+func (l *Log) SetBatch(size int, delay time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	l.batchSize = size
+	l.batchDelay = delay
+}
+
+// Append records atomically in one frame.
+func (l *Log) Append(records ...Record) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return ErrClosed
+	}
+	frame, err := encodeFrame(records)
+	if err != nil {
+		return err
+	}
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(frame)
+	if err != nil {
+		// Do not leave a torn frame before next appends.
+		err = errors.Join(err, l.file.Truncate(offset))
+		_, seekErr := l.file.Seek(offset, io.SeekStart)
+		return fmt.Errorf("appending to wal: %w", errors.Join(err, seekErr))
+	}
+	l.pending = append(l.pending, records)
+	l.unsynced++
+	switch l.policy {
+	case SyncAlways:
+		return l.sync()
+	case SyncBatched:
+		if l.unsynced >= l.batchSize || time.Since(l.lastSync) >= l.batchDelay {
+			return l.sync()
+		}
+	}
+	return nil
+}
+
+func (l *Log) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return ErrClosed
+	}
+	return l.sync()
+}
+
+func (l *Log) sync() error {
+	err := l.file.Sync()
+	if err != nil {
+		return err
+	}
+	l.unsynced = 0
+	l.lastSync = time.Now()
+	return nil
+}
+
+// Forget all records, they must have been written into their targets.
+func (l *Log) Checkpoint() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return ErrClosed
+	}
+	l.pending = nil
+	err := l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if l.policy == SyncNever {
+		return nil
+	}
+	return l.sync()
+}
+
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func encodeFrame(records []Record) ([]byte, error) {
+	payload := &bytes.Buffer{}
+	err := binary.Write(payload, binary.BigEndian, uint32(len(records)))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if len(r.Target) > math.MaxUint16 {
+			return nil, fmt.Errorf("wal record target too long: %s", r.Target)
+		}
+		fields := []any{uint16(len(r.Target)), []byte(r.Target), int32(r.Seq), uint32(len(r.Data)), r.Data}
+		for _, f := range fields {
+			err := binary.Write(payload, binary.BigEndian, f)
+			if err != nil {
+				return nil, fmt.Errorf("encoding wal record: %w", err)
+			}
+		}
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], frameMagic)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[8:12], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(frame, payload.Bytes()...), nil
+}
+
+// Decode the first frame of buf, returning its records and its length.
+func decodeFrame(buf []byte) ([]Record, int, error) {
+	if len(buf) < frameHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(buf[0:4]) != frameMagic {
+		return nil, 0, errors.New("bad wal frame magic")
+	}
+	payloadLen := int(binary.BigEndian.Uint32(buf[4:8]))
+	if len(buf) < frameHeaderSize+payloadLen {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := buf[frameHeaderSize : frameHeaderSize+payloadLen]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[8:12]) {
+		return nil, 0, errors.New("bad wal frame checksum")
+	}
+
+	r := bytes.NewReader(payload)
+	var count uint32
+	err := binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]Record, 0, count)
+	for range count {
+		var targetLen uint16
+		var seq int32
+		var dataLen uint32
+		err := binary.Read(r, binary.BigEndian, &targetLen)
+		if err != nil {
+			return nil, 0, err
+		}
+		target := make([]byte, targetLen)
+		err = errors.Join(binary.Read(r, binary.BigEndian, target), binary.Read(r, binary.BigEndian, &seq), binary.Read(r, binary.BigEndian, &dataLen))
+		if err != nil {
+			return nil, 0, err
+		}
+		if int(dataLen) > r.Len() {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		data := make([]byte, dataLen)
+		err = binary.Read(r, binary.BigEndian, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, Record{Target: string(target), Seq: int(seq), Data: data})
+	}
+	return records, frameHeaderSize + payloadLen, nil
+}
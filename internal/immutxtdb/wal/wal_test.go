@@ -0,0 +1,209 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errInjected = errors.New("injected fault")
+
+// A file failing after writing a byte budget, leaving a torn write behind.
+// Unless survive is set the process is considered crashed: the torn write cannot be rolled back.
+type faultyFile struct {
+	*os.File
+	budget    int
+	survive   bool
+	crashed   bool
+	syncFails bool
+	syncs     int
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.budget >= len(p) {
+		f.budget -= len(p)
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:f.budget])
+	f.budget = 0
+	f.crashed = !f.survive
+	return n, errInjected
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.crashed {
+		return errInjected
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultyFile) Sync() error {
+	f.syncs++
+	if f.syncFails {
+		return errInjected
+	}
+	return f.File.Sync()
+}
+
+func openFaulty(t *testing.T, path string, budget int, policy SyncPolicy) (*Log, *faultyFile) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	ff := &faultyFile{File: f, budget: budget}
+	l, err := OpenFile(ff, policy)
+	require.NoError(t, err)
+	return l, ff
+}
+
+func TestLog_AppendAndRecover(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLog_AppendAndRecover")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "test.wal")
+
+	l, err := Open(path, SyncAlways)
+	require.NoError(t, err)
+	assert.Empty(t, l.Pending())
+
+	err = l.Append(Record{Target: "foo.idx", Seq: 3, Data: []byte("foo")})
+	require.NoError(t, err)
+	err = l.Append(Record{Target: "foo.idx", Seq: 4, Data: []byte("bar")}, Record{Target: "bar.idx", Seq: 0, Data: []byte("baz")})
+	require.NoError(t, err)
+	assert.Len(t, l.Pending(), 2)
+	require.NoError(t, l.Close())
+
+	l, err = Open(path, SyncAlways)
+	require.NoError(t, err)
+	pending := l.Pending()
+	require.Len(t, pending, 2)
+	assert.Equal(t, []Record{{Target: "foo.idx", Seq: 3, Data: []byte("foo")}}, pending[0])
+	require.Len(t, pending[1], 2)
+	assert.Equal(t, "bar.idx", pending[1][1].Target)
+	assert.Equal(t, []byte("baz"), pending[1][1].Data)
+
+	require.NoError(t, l.Checkpoint())
+	require.NoError(t, l.Close())
+
+	l, err = Open(path, SyncAlways)
+	require.NoError(t, err)
+	assert.Empty(t, l.Pending())
+}
+
+func TestLog_TornFrameIsTruncated(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLog_TornFrameIsTruncated")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "test.wal")
+
+	frame, err := encodeFrame([]Record{{Target: "foo.idx", Seq: 0, Data: []byte("foo")}})
+	require.NoError(t, err)
+
+	// Crash in the middle of the second frame
+	l, ff := openFaulty(t, path, len(frame)+len(frame)/2, SyncAlways)
+	require.NoError(t, l.Append(Record{Target: "foo.idx", Seq: 0, Data: []byte("foo")}))
+	err = l.Append(Record{Target: "foo.idx", Seq: 1, Data: []byte("bar")})
+	assert.ErrorIs(t, err, errInjected)
+	require.NoError(t, ff.File.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(len(frame)))
+
+	l, err = Open(path, SyncAlways)
+	require.NoError(t, err)
+	require.Len(t, l.Pending(), 1)
+	assert.Equal(t, 0, l.Pending()[0][0].Seq)
+
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(frame)), info.Size())
+
+	// Appending after recovery does not interleave with the torn bytes
+	require.NoError(t, l.Append(Record{Target: "foo.idx", Seq: 1, Data: []byte("bar")}))
+	require.NoError(t, l.Close())
+	l, err = Open(path, SyncAlways)
+	require.NoError(t, err)
+	assert.Len(t, l.Pending(), 2)
+}
+
+func TestLog_FailedAppendIsRolledBack(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLog_FailedAppendIsRolledBack")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "test.wal")
+
+	frame, err := encodeFrame([]Record{{Target: "foo.idx", Seq: 0, Data: []byte("foo")}})
+	require.NoError(t, err)
+
+	l, ff := openFaulty(t, path, len(frame)+len(frame)/2, SyncAlways)
+	ff.survive = true
+	require.NoError(t, l.Append(Record{Target: "foo.idx", Seq: 0, Data: []byte("foo")}))
+	err = l.Append(Record{Target: "foo.idx", Seq: 1, Data: []byte("bar")})
+	assert.ErrorIs(t, err, errInjected)
+
+	// Process survived the failure: next appends are not hidden behind a torn frame
+	ff.budget = 1 << 20
+	require.NoError(t, l.Append(Record{Target: "foo.idx", Seq: 1, Data: []byte("baz")}))
+	require.NoError(t, l.Close())
+
+	l, err = Open(path, SyncAlways)
+	require.NoError(t, err)
+	require.Len(t, l.Pending(), 2)
+	assert.Equal(t, []byte("baz"), l.Pending()[1][0].Data)
+}
+
+func TestLog_CorruptedFrameIsTruncated(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLog_CorruptedFrameIsTruncated")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "test.wal")
+
+	l, err := Open(path, SyncAlways)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Record{Target: "foo.idx", Seq: 0, Data: []byte("foo")}))
+	require.NoError(t, l.Append(Record{Target: "foo.idx", Seq: 1, Data: []byte("bar")}))
+	require.NoError(t, l.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	content[len(content)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, content, 0600))
+
+	l, err = Open(path, SyncAlways)
+	require.NoError(t, err)
+	assert.Len(t, l.Pending(), 1)
+}
+
+func TestLog_SyncPolicies(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestLog_SyncPolicies")
+	defer os.RemoveAll(tmpDir)
+	r := Record{Target: "foo.idx", Data: []byte("foo")}
+
+	l, ff := openFaulty(t, filepath.Join(tmpDir, "always.wal"), 1<<20, SyncAlways)
+	for range 3 {
+		require.NoError(t, l.Append(r))
+	}
+	assert.Equal(t, 3, ff.syncs)
+
+	l, ff = openFaulty(t, filepath.Join(tmpDir, "batched.wal"), 1<<20, SyncBatched)
+	l.SetBatch(2, time.Hour)
+	for range 5 {
+		require.NoError(t, l.Append(r))
+	}
+	assert.Equal(t, 2, ff.syncs)
+	require.NoError(t, l.Sync())
+	assert.Equal(t, 3, ff.syncs)
+
+	l, ff = openFaulty(t, filepath.Join(tmpDir, "never.wal"), 1<<20, SyncNever)
+	for range 3 {
+		require.NoError(t, l.Append(r))
+	}
+	require.NoError(t, l.Checkpoint())
+	assert.Equal(t, 0, ff.syncs)
+
+	// A failing fsync is reported
+	l, ff = openFaulty(t, filepath.Join(tmpDir, "failing.wal"), 1<<20, SyncAlways)
+	ff.syncFails = true
+	assert.ErrorIs(t, l.Append(r), errInjected)
+}
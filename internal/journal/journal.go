@@ -0,0 +1,211 @@
+package journal
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/date"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/ref"
+)
+
+// The journal holds one entry per day. An entry is a journal bucket whose uid is its day date,
+// 2025-11-24, so every device derives the same bucket for a day and their layers merge.
+// The title of an entry is not stored: it is added when the entry is opened and removed when it
+// is saved, so devices creating the same day offline do not merge two titles.
+
+// Uid of the journal bucket of a day.
+func DayUid(day time.Time) string {
+	return day.Format(time.DateOnly)
+}
+
+// Day of a journal bucket uid.
+func ParseDayUid(uid string) (time.Time, bool) {
+	day, err := time.ParseInLocation(time.DateOnly, uid, time.Local)
+	return day, err == nil
+}
+
+// A day entry and its projected content with its title, empty for a day without entry.
+type Entry struct {
+	Day     time.Time
+	Bucket  *model.Bucket
+	Content string
+}
+
+func (e Entry) Uid() string {
+	return DayUid(e.Day)
+}
+
+// Parser of the references of the entry of a day, relative dates are relative to the day.
+func RefParser(day time.Time) *ref.Parser {
+	return ref.NewParser(ref.WithDateParser(date.NewParser().At(day).Parse))
+}
+
+type Journal struct {
+	db     *db.DB
+	now    func() time.Time
+	locale date.Locale
+}
+
+type Option func(*Journal)
+
+// Clock telling the current day. Default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(j *Journal) {
+		j.now = now
+	}
+}
+
+// Locale of the entries titles. Default is the environment locale.
+func WithLocale(l date.Locale) Option {
+	return func(j *Journal) {
+		j.locale = l
+	}
+}
+
+func New(d *db.DB, opts ...Option) *Journal {
+	j := &Journal{
+		db:     d,
+		now:    time.Now,
+		locale: date.FromEnv(),
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j
+}
+
+func (j *Journal) Today() time.Time {
+	return date.Midnight(j.now())
+}
+
+// Open the entry of a day.
+func (j *Journal) Open(day time.Time) (*Entry, error) {
+	day = date.Midnight(day)
+	b, err := j.db.Bucket(DayUid(day))
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{Day: day, Bucket: b}
+	doc, err := b.Project()
+	if errors.Is(err, model.ErrEmptyBucket) || errors.Is(err, model.ErrDeletedBucket) {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	e.Content = j.withTitle(day, doc.Content())
+	return e, nil
+}
+
+// Title of the entry of a day: # Vendredi 24/11/2025.
+func (j *Journal) Title(day time.Time) string {
+	return "# " + j.locale.FormatDay(day)
+}
+
+// Content of an entry starting with the title of its day, unless it starts with a title. Entries
+// saved with their title keep it.
+func (j *Journal) withTitle(day time.Time, content string) string {
+	if strings.HasPrefix(content, "# ") {
+		return content
+	}
+	return j.Title(day) + "\n" + content
+}
+
+// Open the entry of today, starting with its title if the day has no entry yet. The entry is
+// created when it is first saved.
+func (j *Journal) OpenToday() (*Entry, error) {
+	e, err := j.Open(j.Today())
+	if err != nil {
+		return nil, err
+	}
+	if e.Content == "" {
+		e.Content = j.withTitle(e.Day, "")
+	}
+	return e, nil
+}
+
+// Save content as a new layer of the entry of a day, without the title of the day.
+func (j *Journal) Save(day time.Time, content string) error {
+	day = date.Midnight(day)
+	title := j.Title(day)
+	if content == title {
+		content = ""
+	}
+	content = strings.TrimPrefix(content, title+"\n")
+	return j.db.Save(DayUid(day), index.Journal, content, nil)
+}
+
+// Days having an entry whose uid starts with a prefix, in order.
+func (j *Journal) days(prefix string) ([]time.Time, error) {
+	uids, err := j.db.Uids(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, uid := range uids {
+		if day, ok := ParseDayUid(uid); ok {
+			days = append(days, day)
+		}
+	}
+	return days, nil
+}
+
+// Days of a month having an entry, in order.
+func (j *Journal) Month(year int, month time.Month) ([]time.Time, error) {
+	return j.days(time.Date(year, month, 1, 0, 0, 0, 0, time.Local).Format("2006-01-"))
+}
+
+// Days of a year having an entry, in order.
+func (j *Journal) Year(year int) ([]time.Time, error) {
+	return j.days(strconv.Itoa(year) + "-")
+}
+
+// Days between two days included having an entry, in order.
+func (j *Journal) Days(from, to time.Time) ([]time.Time, error) {
+	all, err := j.days("")
+	if err != nil {
+		return nil, err
+	}
+	from, to = date.Midnight(from), date.Midnight(to)
+	var days []time.Time
+	for _, day := range all {
+		if !day.Before(from) && !day.After(to) {
+			days = append(days, day)
+		}
+	}
+	return days, nil
+}
+
+// Closest day before a day having an entry.
+func (j *Journal) Previous(day time.Time) (time.Time, bool, error) {
+	days, err := j.days("")
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	day = date.Midnight(day)
+	for k := len(days) - 1; k >= 0; k-- {
+		if days[k].Before(day) {
+			return days[k], true, nil
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// Closest day after a day having an entry.
+func (j *Journal) Next(day time.Time) (time.Time, bool, error) {
+	days, err := j.days("")
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	day = date.Midnight(day)
+	for _, d := range days {
+		if d.After(day) {
+			return d, true, nil
+		}
+	}
+	return time.Time{}, false, nil
+}
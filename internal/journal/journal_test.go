@@ -0,0 +1,148 @@
+package journal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/date"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+}
+
+func TestDayUid(t *testing.T) {
+	assert.Equal(t, "2025-11-24", DayUid(day(2025, 11, 24)))
+	d, ok := ParseDayUid("2025-11-24")
+	assert.True(t, ok)
+	assert.Equal(t, day(2025, 11, 24), d)
+	_, ok = ParseDayUid("voyage")
+	assert.False(t, ok)
+}
+
+func TestJournal_OpenToday(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestJournal_OpenToday")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	now := time.Date(2025, 11, 24, 18, 30, 0, 0, time.Local)
+	j := New(d, WithClock(func() time.Time { return now }), WithLocale(date.French))
+	e, err := j.OpenToday()
+	require.NoError(t, err)
+	assert.Equal(t, "2025-11-24", e.Uid())
+	assert.Equal(t, "# Lundi 24/11/2025\n", e.Content)
+	assert.Empty(t, e.Bucket.Layers())
+
+	// The title is not stored
+	require.NoError(t, j.Save(now, "# Lundi 24/11/2025\nRéunion"))
+	e, err = j.OpenToday()
+	require.NoError(t, err)
+	assert.Equal(t, "# Lundi 24/11/2025\nRéunion", e.Content)
+	assert.Len(t, e.Bucket.Layers(), 1)
+	doc, err := e.Bucket.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "Réunion", doc.Content())
+
+	// An edited title is kept
+	require.NoError(t, j.Save(now, "# Lundi, en vacances\nRéunion"))
+	e, err = j.OpenToday()
+	require.NoError(t, err)
+	assert.Equal(t, "# Lundi, en vacances\nRéunion", e.Content)
+
+	e, err = j.Open(day(2025, 11, 23))
+	require.NoError(t, err)
+	assert.Empty(t, e.Content)
+}
+
+func TestJournal_OpenTodayOnTwoDevices(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestJournal_OpenTodayOnTwoDevices")
+	defer os.RemoveAll(tmpDir)
+	key, err := db.LoadSigningKey(filepath.Join(tmpDir, "keys", "b.key"))
+	require.NoError(t, err)
+	pub, err := db.LoadPublicKey(filepath.Join(tmpDir, "keys", "b.key.pub"))
+	require.NoError(t, err)
+	now := time.Date(2025, 11, 24, 18, 30, 0, 0, time.Local)
+	clock := WithClock(func() time.Time { return now })
+
+	// Both devices open and edit the same day offline
+	dA, err := db.Open(filepath.Join(tmpDir, "a"), "a")
+	require.NoError(t, err)
+	a := New(dA, clock, WithLocale(date.French))
+	e, err := a.OpenToday()
+	require.NoError(t, err)
+	require.NoError(t, a.Save(now, e.Content+"Réunion\n"))
+	dB, err := db.Open(filepath.Join(tmpDir, "b"), "b")
+	require.NoError(t, err)
+	b := New(dB, clock, WithLocale(date.French))
+	e, err = b.OpenToday()
+	require.NoError(t, err)
+	require.NoError(t, b.Save(now, e.Content+"Courses\n"))
+
+	patch := &bytes.Buffer{}
+	_, err = dB.ExportPatch(patch, db.Cursor{}, db.WithSigningKey(key))
+	require.NoError(t, err)
+	_, err = dA.ImportPatch(patch, db.WithTrustedDevice("b", pub))
+	require.NoError(t, err)
+
+	e, err = a.OpenToday()
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(e.Content, "# Lundi 24/11/2025"))
+	assert.True(t, strings.HasPrefix(e.Content, "# Lundi 24/11/2025\n"))
+	assert.Contains(t, e.Content, "Réunion")
+	assert.Contains(t, e.Content, "Courses")
+}
+
+func TestJournal_Calendar(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestJournal_Calendar")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	j := New(d)
+	for _, dd := range []time.Time{day(2025, 10, 31), day(2025, 11, 2), day(2025, 11, 24), day(2026, 1, 1)} {
+		require.NoError(t, j.Save(dd, "entry"))
+	}
+	require.NoError(t, d.Save("voyage", index.Topic, "not a day", nil))
+	require.NoError(t, j.Save(day(2025, 11, 3), "deleted"))
+	require.NoError(t, d.Delete("2025-11-03"))
+
+	days, err := j.Month(2025, time.November)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{day(2025, 11, 2), day(2025, 11, 24)}, days)
+	days, err = j.Year(2025)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{day(2025, 10, 31), day(2025, 11, 2), day(2025, 11, 24)}, days)
+	days, err = j.Days(day(2025, 11, 24), day(2026, 1, 1))
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{day(2025, 11, 24), day(2026, 1, 1)}, days)
+
+	previous, ok, err := j.Previous(day(2025, 11, 24))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, day(2025, 11, 2), previous)
+	next, ok, err := j.Next(day(2025, 11, 24))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, day(2026, 1, 1), next)
+	_, ok, err = j.Previous(day(2025, 10, 31))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRefParser(t *testing.T) {
+	refs := RefParser(day(2025, 11, 24)).Parse("Rendre le rapport @!demain à @Léa")
+	if assert.Len(t, refs, 2) {
+		assert.Equal(t, day(2025, 11, 25), refs[0].Time)
+		assert.Equal(t, "Léa", refs[1].Name)
+	}
+}
@@ -0,0 +1,288 @@
+package ref
+
+import (
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mxbossard/tui-journal/internal/date"
+)
+
+// References are written in journal markdown with a sigil before their name: &topic, @person,
+// @2025-11-24 for a date and @!2025-11-30 for a deadline. Kinds may share a sigil: a reference
+// is a date when its name parses as a date, a person otherwise. References are not recognized
+// in code blocks, code spans and headings, nor right after a letter or a digit (R&D, mail@host).
+
+type Kind int
+
+const (
+	Topic Kind = iota
+	Person
+	Date
+	Deadline
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Topic:
+		return "topic"
+	case Person:
+		return "person"
+	case Date:
+		return "date"
+	case Deadline:
+		return "deadline"
+	}
+	return "unknown"
+}
+
+// A reference found in a text. Start and End are the byte offsets of the reference in the
+// text, sigil included. Time is set for dates and deadlines.
+type Ref struct {
+	Kind  Kind
+	Name  string
+	Start int
+	End   int
+	Time  time.Time
+}
+
+// Sigils of each kind of reference. An empty sigil disables a kind.
+type Sigils struct {
+	Topic    string
+	Person   string
+	Date     string
+	Deadline string
+}
+
+var DefaultSigils = Sigils{Topic: "&", Person: "@", Date: "@", Deadline: "@!"}
+
+type sigil struct {
+	prefix string
+	kinds  []Kind
+}
+
+type Parser struct {
+	sigils    []sigil
+	parseDate func(string) (time.Time, bool)
+}
+
+type Option func(*Parser)
+
+func WithSigils(s Sigils) Option {
+	return func(p *Parser) {
+		p.sigils = nil
+		// Dates are tried before people sharing their sigil.
+		for _, c := range []struct {
+			prefix string
+			kind   Kind
+		}{{s.Deadline, Deadline}, {s.Date, Date}, {s.Person, Person}, {s.Topic, Topic}} {
+			if c.prefix == "" {
+				continue
+			}
+			k := slices.IndexFunc(p.sigils, func(s sigil) bool { return s.prefix == c.prefix })
+			if k < 0 {
+				p.sigils = append(p.sigils, sigil{prefix: c.prefix})
+				k = len(p.sigils) - 1
+			}
+			p.sigils[k].kinds = append(p.sigils[k].kinds, c.kind)
+		}
+		// Longest sigils first, so @! is not read as @ followed by !.
+		slices.SortStableFunc(p.sigils, func(a, b sigil) int {
+			return len(b.prefix) - len(a.prefix)
+		})
+	}
+}
+
+// Parse date and deadline names with a function. Default is date.Parse, relative dates are
+// computed from today.
+func WithDateParser(parse func(string) (time.Time, bool)) Option {
+	return func(p *Parser) {
+		p.parseDate = parse
+	}
+}
+
+func NewParser(opts ...Option) *Parser {
+	p := &Parser{parseDate: date.Parse}
+	WithSigils(DefaultSigils)(p)
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+var defaultParser = NewParser()
+
+// Parse the references of a text with the default parser.
+func Parse(text string) []Ref {
+	return defaultParser.Parse(text)
+}
+
+// Replace the references of a text with the default parser.
+func Replace(text string, replace func(r Ref, source string) string) string {
+	return defaultParser.Replace(text, replace)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func nameRunes(kind Kind) func(rune) bool {
+	switch kind {
+	case Date, Deadline:
+		return func(r rune) bool { return isWordRune(r) || strings.ContainsRune("-_/.:+", r) }
+	case Person:
+		return func(r rune) bool { return isWordRune(r) || strings.ContainsRune("-_.", r) }
+	default:
+		return func(r rune) bool { return isWordRune(r) || strings.ContainsRune("-_", r) }
+	}
+}
+
+// Read the name of a reference of a kind at the start of a text. Trailing punctuation is not
+// part of a name.
+func scanName(text string, kind Kind) string {
+	accept := nameRunes(kind)
+	end := 0
+	for end < len(text) {
+		r, size := utf8.DecodeRuneInString(text[end:])
+		if !accept(r) {
+			break
+		}
+		end += size
+	}
+	return strings.TrimRight(text[:end], "-_/.:+")
+}
+
+// Read a reference at the start of a line after its sigil.
+func (p *Parser) scanRef(s sigil, line string) (Ref, bool) {
+	for _, kind := range s.kinds {
+		name := scanName(line[len(s.prefix):], kind)
+		if name == "" {
+			continue
+		}
+		r := Ref{Kind: kind, Name: name, End: len(s.prefix) + len(name)}
+		switch kind {
+		case Date, Deadline:
+			t, ok := p.parseDate(name)
+			if !ok {
+				continue
+			}
+			r.Time = t
+		default:
+			if first, _ := utf8.DecodeRuneInString(name); !unicode.IsLetter(first) {
+				continue
+			}
+		}
+		return r, true
+	}
+	return Ref{}, false
+}
+
+// Marker of a fenced code block line, empty for other lines.
+func fence(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return ""
+	}
+	for _, marker := range []string{"```", "~~~"} {
+		if strings.HasPrefix(trimmed, marker) {
+			return marker
+		}
+	}
+	return ""
+}
+
+func isHeading(line string) bool {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return false
+	}
+	level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+	return level > 0 && level <= 6 && (len(trimmed) == level || trimmed[level] == ' ' || trimmed[level] == '\t')
+}
+
+// Length of the code span starting a line, 0 if the backticks are not closed on the line.
+func codeSpan(line string) int {
+	ticks := len(line) - len(strings.TrimLeft(line, "`"))
+	closing := strings.Index(line[ticks:], line[:ticks])
+	if closing < 0 {
+		return 0
+	}
+	return ticks + closing + ticks
+}
+
+// Read a reference of any sigil at the start of a line.
+func (p *Parser) matchRef(line string) (Ref, bool) {
+	for _, s := range p.sigils {
+		if !strings.HasPrefix(line, s.prefix) {
+			continue
+		}
+		if r, ok := p.scanRef(s, line); ok {
+			return r, true
+		}
+	}
+	return Ref{}, false
+}
+
+func (p *Parser) parseLine(line string, offset int, refs []Ref) []Ref {
+	previous := rune(0)
+	for k := 0; k < len(line); {
+		if line[k] == '`' {
+			if span := codeSpan(line[k:]); span > 0 {
+				k += span
+				previous = '`'
+				continue
+			}
+		}
+		if !isWordRune(previous) {
+			if r, ok := p.matchRef(line[k:]); ok {
+				r.Start += offset + k
+				r.End += offset + k
+				refs = append(refs, r)
+				k += r.End - r.Start
+				previous, _ = utf8.DecodeLastRuneInString(line[:k])
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(line[k:])
+		previous = r
+		k += size
+	}
+	return refs
+}
+
+// Parse the references of a text, ordered by position.
+func (p *Parser) Parse(text string) []Ref {
+	var refs []Ref
+	openFence := ""
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		switch {
+		case openFence != "":
+			if fence(line) == openFence {
+				openFence = ""
+			}
+		case fence(line) != "":
+			openFence = fence(line)
+		case !isHeading(line):
+			refs = p.parseLine(line, offset, refs)
+		}
+		offset += len(line)
+	}
+	return refs
+}
+
+// Replace the references of a text by the result of a function called with each reference and
+// its source text.
+func (p *Parser) Replace(text string, replace func(r Ref, source string) string) string {
+	sb := strings.Builder{}
+	k := 0
+	for _, r := range p.Parse(text) {
+		sb.WriteString(text[k:r.Start])
+		sb.WriteString(replace(r, text[r.Start:r.End]))
+		k = r.End
+	}
+	sb.WriteString(text[k:])
+	return sb.String()
+}
@@ -0,0 +1,47 @@
+package ref
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	text := "# Voyage à &Rome\n" +
+		"Avec @Léa et @jean.dupont, départ @2025-11-24.\n" +
+		"Billets avant @!30/11/2025 pour &voyage. R&D, lea@mail.fr\n" +
+		"```\n&code @bob\n```\n" +
+		"Voir `&span` et &été-25 @!jamais"
+	date := time.Date(2025, 11, 24, 0, 0, 0, 0, time.Local)
+	deadline := time.Date(2025, 11, 30, 0, 0, 0, 0, time.Local)
+	assert.Equal(t, []Ref{
+		{Kind: Person, Name: "Léa", Start: 23, End: 28},
+		{Kind: Person, Name: "jean.dupont", Start: 32, End: 44},
+		{Kind: Date, Name: "2025-11-24", Start: 54, End: 65, Time: date},
+		{Kind: Deadline, Name: "30/11/2025", Start: 81, End: 93, Time: deadline},
+		{Kind: Topic, Name: "voyage", Start: 99, End: 106},
+		{Kind: Topic, Name: "été-25", Start: 160, End: 169},
+	}, Parse(text))
+	assert.Empty(t, Parse("a && b & @ @!"))
+}
+
+func TestParser_Sigils(t *testing.T) {
+	p := NewParser(
+		WithSigils(Sigils{Topic: "#", Person: "+", Deadline: "!"}),
+		WithDateParser(func(name string) (time.Time, bool) {
+			return time.Time{}, name == "demain"
+		}),
+	)
+	assert.Equal(t, []Ref{
+		{Kind: Topic, Name: "rome", Start: 0, End: 5},
+		{Kind: Person, Name: "lea", Start: 6, End: 10},
+		{Kind: Deadline, Name: "demain", Start: 11, End: 18},
+	}, p.Parse("#rome +lea !demain &voyage @2025-11-24"))
+}
+
+func TestReplace(t *testing.T) {
+	assert.Equal(t, "[&rome] avec [@lea]", Replace("&rome avec @lea", func(r Ref, source string) string {
+		return "[" + source + "]"
+	}))
+}
@@ -0,0 +1,201 @@
+package todo
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/journal"
+)
+
+// Todo lists are buckets holding tasks. They are split, merged and instantiated from templates
+// with new layers, their previous content stays in their history. Created lists are journal
+// buckets when their uid is a day, topic buckets otherwise.
+//
+// Like migrations, the tasks are written in their new list first, then removed from their
+// source: an interrupted operation may leave a task in both lists, it is never lost.
+
+var (
+	ErrListExists = errors.New("todo list already exists")
+	ErrSameList   = errors.New("cannot merge a todo list into itself")
+)
+
+// Bucket of a list, its projected content and the day its relative dates are relative to.
+func (t *Todos) load(uid string) (*model.Bucket, string, time.Time, error) {
+	b, err := t.db.Bucket(uid)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	doc, err := b.Project()
+	if err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("%w: %s", err, uid)
+	}
+	created, err := b.Created()
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	return b, doc.Content(), referenceDay(uid, created), nil
+}
+
+// Create a list with its content, failing if the bucket holds content.
+func (t *Todos) create(uid, content string) error {
+	b, err := t.db.Bucket(uid)
+	if err != nil {
+		return err
+	}
+	deleted, err := b.Deleted()
+	if err != nil {
+		return err
+	}
+	if len(b.Layers()) > 0 && !deleted {
+		return fmt.Errorf("%w: %s", ErrListExists, uid)
+	}
+	s := index.Topic
+	if _, ok := journal.ParseDayUid(uid); ok {
+		s = index.Journal
+	}
+	return t.db.Save(uid, s, content, nil)
+}
+
+// Tasks with the same text once their relative dates are written as dates, whatever their case
+// and spacing, are duplicates.
+func dedupKey(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// Move tasks into a new list, in order, removing them from their lists. Their relative dates
+// are written as dates.
+func (t *Todos) Split(tasks []Task, uid string) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	days := map[string]time.Time{}
+	sources := map[string][]string{}
+	bySource := map[string][]Task{}
+	var lines []string
+	for _, task := range tasks {
+		if _, ok := sources[task.Uid]; !ok {
+			_, content, day, err := t.load(task.Uid)
+			if err != nil {
+				return err
+			}
+			days[task.Uid], sources[task.Uid] = day, strings.Split(content, "\n")
+		}
+		// Fail before creating the list when a task changed.
+		err := replaceTask(sources[task.Uid], task, task.Source)
+		if err != nil {
+			return err
+		}
+		text := absoluteDates(task.Text, days[task.Uid])
+		if task.Origin != "" {
+			text += backLink(task.Origin)
+		}
+		lines = append(lines, task.line(task.Status, text))
+		bySource[task.Uid] = append(bySource[task.Uid], task)
+	}
+	err := t.create(uid, strings.Join(lines, "\n")+"\n")
+	if err != nil {
+		return err
+	}
+	for _, source := range slices.Sorted(maps.Keys(bySource)) {
+		removed := bySource[source]
+		slices.SortFunc(removed, func(a, b Task) int { return b.Line - a.Line })
+		err = t.rewrite(source, func(lines []string) ([]string, error) {
+			for _, task := range removed {
+				err := replaceTask(lines, task, task.Source)
+				if err != nil {
+					return nil, err
+				}
+				lines = slices.Delete(lines, task.Line, task.Line+1)
+			}
+			return lines, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge the src list at the end of the dst list, then delete src. Tasks of src already in dst
+// are not copied, a duplicate done in src marks its open dst task done. Relative dates of src
+// are written as dates.
+func (t *Todos) Merge(dst, src string) error {
+	if dst == src {
+		return fmt.Errorf("%w: %s", ErrSameList, dst)
+	}
+	dstBucket, dstContent, dstDay, err := t.load(dst)
+	if err != nil {
+		return err
+	}
+	_, srcContent, srcDay, err := t.load(src)
+	if err != nil {
+		return err
+	}
+	dstLines := strings.Split(dstContent, "\n")
+	present := map[string]Task{}
+	for _, task := range Parse(dst, dstContent, journal.RefParser(dstDay)) {
+		key := dedupKey(absoluteDates(task.Text, dstDay))
+		if _, ok := present[key]; !ok {
+			present[key] = task
+		}
+	}
+
+	srcContent = absoluteDates(srcContent, srcDay)
+	srcTasks := map[int]Task{}
+	for _, task := range Parse(src, srcContent, journal.RefParser(srcDay)) {
+		srcTasks[task.Line] = task
+	}
+	var merged []string
+	for k, line := range strings.Split(srcContent, "\n") {
+		task, ok := srcTasks[k]
+		if !ok {
+			merged = append(merged, line)
+			continue
+		}
+		key := dedupKey(task.Text)
+		if duplicate, ok := present[key]; ok {
+			if task.Done() && duplicate.Status == Open && duplicate.Uid == dst {
+				dstLines[duplicate.Line] = duplicate.withStatus(Done)
+			}
+			continue
+		}
+		present[key] = task
+		merged = append(merged, line)
+	}
+
+	content := strings.Join(dstLines, "\n")
+	if rest := strings.Trim(strings.Join(merged, "\n"), "\n"); strings.TrimSpace(rest) != "" {
+		content = strings.TrimRight(content, "\n")
+		if content != "" {
+			content += "\n\n"
+		}
+		content += rest + "\n"
+	}
+	if content != dstContent {
+		err = t.saveLayer(dstBucket, content)
+		if err != nil {
+			return err
+		}
+	}
+	return t.db.Delete(src)
+}
+
+// Create a list from a template list, its tasks open. Relative dates are kept, they are relative
+// to the day the list is created: a @!+3d deadline is three days after.
+func (t *Todos) Instantiate(template, uid string) error {
+	_, content, day, err := t.load(template)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(content, "\n")
+	for _, task := range Parse(template, content, journal.RefParser(day)) {
+		lines[task.Line] = task.withStatus(Open)
+	}
+	return t.create(uid, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,106 @@
+package todo
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func content(t *testing.T, d *db.DB, uid string) string {
+	b, err := d.Bucket(uid)
+	require.NoError(t, err)
+	doc, err := b.Project()
+	require.NoError(t, err)
+	return doc.Content()
+}
+
+func TestTodos_Split(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos_Split")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, d.Save("2025-11-24", index.Journal, "# Lundi\n- [ ] Billets @!demain &voyage\n  * [x] Valise\n- [ ] Appeler @Léa", nil))
+	require.NoError(t, d.Save("courses", index.Topic, "- [ ] Lait\n- [ ] Guide &voyage", nil))
+
+	todos := New(d)
+	tasks, err := todos.Tasks(Query{Topic: "voyage"})
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	done, err := todos.Tasks(Query{Statuses: []Status{Done}})
+	require.NoError(t, err)
+	require.NoError(t, todos.Split(append(tasks, done...), "voyage"))
+
+	assert.Equal(t, "- [ ] Billets @!2025-11-25 &voyage\n- [ ] Guide &voyage\n* [x] Valise\n", content(t, d, "voyage"))
+	assert.Equal(t, "# Lundi\n- [ ] Appeler @Léa", content(t, d, "2025-11-24"))
+	assert.Equal(t, "- [ ] Lait", content(t, d, "courses"))
+	b, err := d.Bucket("courses")
+	require.NoError(t, err)
+	assert.Len(t, b.Layers(), 2)
+
+	// Stale tasks are not split, tasks are not split into an existing list
+	assert.ErrorIs(t, todos.Split(tasks, "courses"), ErrStaleTask)
+	open, err := todos.Tasks(Query{Statuses: []Status{Open}, Topic: "voyage"})
+	require.NoError(t, err)
+	assert.ErrorIs(t, todos.Split(open, "courses"), ErrListExists)
+	assert.Equal(t, "- [ ] Lait", content(t, d, "courses"))
+}
+
+func TestTodos_Merge(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos_Merge")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, d.Save("courses", index.Topic, "# Courses\n- [ ] Lait\n- [ ] Pain @!2025-11-30\n", model.Labels{"list": "courses"}))
+	require.NoError(t, d.Save("2025-11-24", index.Journal, "# Lundi\n- [x] lait\n- [ ]  Pain @!+6d\n- [ ] Oeufs\nPour samedi", nil))
+
+	todos := New(d)
+	require.NoError(t, todos.Merge("courses", "2025-11-24"))
+	assert.Equal(t, "# Courses\n- [x] Lait\n- [ ] Pain @!2025-11-30\n\n# Lundi\n- [ ] Oeufs\nPour samedi\n", content(t, d, "courses"))
+	labeled, err := d.Labeled("list", "courses")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"courses"}, labeled)
+
+	// Merged list is deleted, its content is kept in its history
+	uids, err := d.Uids("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"courses"}, uids)
+	b, err := d.Bucket("2025-11-24")
+	require.NoError(t, err)
+	assert.Len(t, b.Layers(), 2)
+
+	assert.ErrorIs(t, todos.Merge("courses", "courses"), ErrSameList)
+	assert.ErrorIs(t, todos.Merge("courses", "2025-11-24"), model.ErrDeletedBucket)
+}
+
+func TestTodos_Instantiate(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos_Instantiate")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	template := "# Voyage\n- [x] Passeport @!-1m\n  - [>] Billets ← [2025-11-24](journal:2025-11-24)\n```\n- [x] code\n```"
+	require.NoError(t, d.Save("template-voyage", index.Topic, template, nil))
+
+	todos := New(d)
+	require.NoError(t, todos.Instantiate("template-voyage", "rome"))
+	assert.Equal(t, "# Voyage\n- [ ] Passeport @!-1m\n  - [ ] Billets ← [2025-11-24](journal:2025-11-24)\n```\n- [x] code\n```", content(t, d, "rome"))
+	assert.Equal(t, template, content(t, d, "template-voyage"))
+
+	assert.ErrorIs(t, todos.Instantiate("template-voyage", "rome"), ErrListExists)
+	assert.ErrorIs(t, todos.Instantiate("absent", "paris"), model.ErrEmptyBucket)
+
+	// A deleted list may be instantiated again
+	require.NoError(t, d.Delete("rome"))
+	require.NoError(t, todos.Instantiate("template-voyage", "rome"))
+	b, err := d.Bucket("rome")
+	require.NoError(t, err)
+	assert.Len(t, b.Layers(), 3)
+}
@@ -0,0 +1,140 @@
+package todo
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/journal"
+	"github.com/mxbossard/tui-journal/internal/ref"
+)
+
+// Open tasks of previous days are copied into the entry of a day first, then marked migrated in
+// their day, one layer per day. A migration interrupted in between is completed by the next one
+// without copying the tasks twice: tasks already open in the day are not copied again.
+// Devices migrating the same day offline each copy the tasks, their merged entry holds all the
+// copies: the next migration keeps one copy of each task.
+
+// Text whose relative dates, relative to a day, are written as dates. Relative dates would be
+// relative to another day once the text is moved to another bucket.
+func absoluteDates(text string, day time.Time) string {
+	return journal.RefParser(day).Replace(text, func(r ref.Ref, source string) string {
+		if r.Kind != ref.Date && r.Kind != ref.Deadline {
+			return source
+		}
+		return source[:len(source)-len(r.Name)] + r.Time.Format(time.DateOnly)
+	})
+}
+
+// Copy of a task migrated from its day, ending with a back-link to the day.
+func (t Task) migratedLine(text string) string {
+	return t.line(Open, text+backLink(t.Uid))
+}
+
+// Content of an entry without the open copies of a task migrated several times. A copy which is
+// not open is kept rather than an open one.
+func dropDuplicateMigrations(uid, content string, day time.Time) string {
+	copies := map[string][]Task{}
+	var keys []string
+	for _, task := range Parse(uid, content, journal.RefParser(day)) {
+		if task.Origin == "" {
+			continue
+		}
+		key := task.Origin + "\n" + dedupKey(task.Text)
+		if _, ok := copies[key]; !ok {
+			keys = append(keys, key)
+		}
+		copies[key] = append(copies[key], task)
+	}
+	var dropped []int
+	for _, key := range keys {
+		tasks := copies[key]
+		kept := slices.IndexFunc(tasks, func(task Task) bool { return task.Status != Open })
+		if kept < 0 {
+			kept = 0
+		}
+		for k, task := range tasks {
+			if k != kept && task.Status == Open {
+				dropped = append(dropped, task.Line)
+			}
+		}
+	}
+	if len(dropped) == 0 {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	slices.Sort(dropped)
+	for k := len(dropped) - 1; k >= 0; k-- {
+		lines = slices.Delete(lines, dropped[k], dropped[k]+1)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Migrate the open tasks of the days before today into the entry of today, created if needed.
+// Returns the migrated tasks.
+func (t *Todos) Migrate(j *journal.Journal) ([]Task, error) {
+	today, err := j.OpenToday()
+	if err != nil {
+		return nil, err
+	}
+	content := dropDuplicateMigrations(today.Uid(), today.Content, today.Day)
+	tasks, err := t.Tasks(Query{Statuses: []Status{Open}})
+	if err != nil {
+		return nil, err
+	}
+	var migrated []Task
+	for _, task := range tasks {
+		if day, ok := journal.ParseDayUid(task.Uid); ok && day.Before(today.Day) {
+			migrated = append(migrated, task)
+		}
+	}
+
+	// Copy the tasks not yet open in today entry.
+	var present []string
+	for _, task := range Parse(today.Uid(), content, journal.RefParser(today.Day)) {
+		if task.Status == Open {
+			present = append(present, task.Text)
+		}
+	}
+	for _, task := range migrated {
+		day, _ := journal.ParseDayUid(task.Uid)
+		text := absoluteDates(task.Text, day)
+		if slices.Contains(present, text) {
+			continue
+		}
+		present = append(present, text)
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += task.migratedLine(text) + "\n"
+	}
+	if content != today.Content {
+		err = j.Save(today.Day, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Mark the tasks migrated in their day.
+	byUid := map[string][]Task{}
+	for _, task := range migrated {
+		byUid[task.Uid] = append(byUid[task.Uid], task)
+	}
+	for _, uid := range slices.Sorted(maps.Keys(byUid)) {
+		dayTasks := byUid[uid]
+		err = t.rewrite(uid, func(lines []string) ([]string, error) {
+			for _, task := range dayTasks {
+				err := replaceTask(lines, task, task.withStatus(Migrated))
+				if err != nil {
+					return nil, err
+				}
+			}
+			return lines, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return migrated, nil
+}
@@ -0,0 +1,135 @@
+package todo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/date"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/journal"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTodos_Migrate(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos_Migrate")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	now := time.Date(2025, 11, 26, 8, 0, 0, 0, time.Local)
+	j := journal.New(d, journal.WithClock(func() time.Time { return now }), journal.WithLocale(date.French))
+	require.NoError(t, j.Save(day(2025, 11, 24), "# Lundi\n  - [ ] Billets @!demain &voyage\n- [x] Valise"))
+	require.NoError(t, j.Save(day(2025, 11, 25), "# Mardi\n* [ ] Appeler @Léa"))
+	require.NoError(t, j.Save(day(2025, 11, 27), "- [ ] Plus tard"))
+
+	todos := New(d)
+	migrated, err := todos.Migrate(j)
+	require.NoError(t, err)
+	assert.Len(t, migrated, 2)
+
+	today, err := j.Open(now)
+	require.NoError(t, err)
+	assert.Equal(t, "# Mercredi 26/11/2025\n"+
+		"- [ ] Billets @!2025-11-25 &voyage ← [2025-11-24](journal:2025-11-24)\n"+
+		"* [ ] Appeler @Léa ← [2025-11-25](journal:2025-11-25)\n", today.Content)
+	source, err := j.Open(day(2025, 11, 24))
+	require.NoError(t, err)
+	assert.Equal(t, "# Lundi\n  - [>] Billets @!demain &voyage\n- [x] Valise", source.Content)
+
+	tasks, err := todos.Tasks(Query{Statuses: []Status{Open}})
+	require.NoError(t, err)
+	require.Len(t, tasks, 3)
+	assert.Equal(t, "2025-11-24", tasks[0].Origin)
+	assert.Equal(t, "Billets @!2025-11-25 &voyage", tasks[0].Text)
+	assert.Equal(t, day(2025, 11, 25), tasks[0].Deadline)
+	migratedTasks, err := todos.Tasks(Query{Statuses: []Status{Migrated}})
+	require.NoError(t, err)
+	assert.Len(t, migratedTasks, 2)
+
+	// Nothing left to migrate
+	migrated, err = todos.Migrate(j)
+	require.NoError(t, err)
+	assert.Empty(t, migrated)
+
+	// Interrupted migrations do not copy tasks twice
+	require.NoError(t, j.Save(day(2025, 11, 25), "# Mardi\n* [ ] Appeler @Léa"))
+	migrated, err = todos.Migrate(j)
+	require.NoError(t, err)
+	assert.Len(t, migrated, 1)
+	today, err = j.Open(now)
+	require.NoError(t, err)
+	assert.Len(t, Parse(today.Uid(), today.Content, journal.RefParser(today.Day)), 2)
+}
+
+func TestTodos_MigrateOnTwoDevices(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos_MigrateOnTwoDevices")
+	defer os.RemoveAll(tmpDir)
+	keyA, err := db.LoadSigningKey(filepath.Join(tmpDir, "keys", "a.key"))
+	require.NoError(t, err)
+	pubA, err := db.LoadPublicKey(filepath.Join(tmpDir, "keys", "a.key.pub"))
+	require.NoError(t, err)
+	keyB, err := db.LoadSigningKey(filepath.Join(tmpDir, "keys", "b.key"))
+	require.NoError(t, err)
+	pubB, err := db.LoadPublicKey(filepath.Join(tmpDir, "keys", "b.key.pub"))
+	require.NoError(t, err)
+	now := time.Date(2025, 11, 26, 8, 0, 0, 0, time.Local)
+	clock := journal.WithClock(func() time.Time { return now })
+
+	dA, err := db.Open(filepath.Join(tmpDir, "a"), "a")
+	require.NoError(t, err)
+	jA := journal.New(dA, clock, journal.WithLocale(date.French))
+	require.NoError(t, jA.Save(day(2025, 11, 25), "# Mardi\n- [ ] Billets\n- [ ] Appeler @Léa"))
+	dB, err := db.Open(filepath.Join(tmpDir, "b"), "b")
+	require.NoError(t, err)
+	jB := journal.New(dB, clock, journal.WithLocale(date.French))
+	patch := &bytes.Buffer{}
+	cursorA, err := dA.ExportPatch(patch, db.Cursor{}, db.WithSigningKey(keyA))
+	require.NoError(t, err)
+	_, err = dB.ImportPatch(patch, db.WithTrustedDevice("a", pubA))
+	require.NoError(t, err)
+
+	// Both devices migrate the day offline, a then marks its copy done
+	todosA, todosB := New(dA), New(dB)
+	_, err = todosA.Migrate(jA)
+	require.NoError(t, err)
+	_, err = todosB.Migrate(jB)
+	require.NoError(t, err)
+	tasks, err := todosA.Tasks(Query{Statuses: []Status{Open}})
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	require.NoError(t, todosA.Toggle(tasks[0]))
+
+	patch.Reset()
+	_, err = dB.ExportPatch(patch, db.Cursor{}, db.WithSigningKey(keyB))
+	require.NoError(t, err)
+	_, err = dA.ImportPatch(patch, db.WithTrustedDevice("b", pubB))
+	require.NoError(t, err)
+	patch.Reset()
+	_, err = dA.ExportPatch(patch, cursorA, db.WithSigningKey(keyA))
+	require.NoError(t, err)
+	_, err = dB.ImportPatch(patch, db.WithTrustedDevice("a", pubA))
+	require.NoError(t, err)
+
+	// The merged entry holds the copies of both devices, the next migration keeps one of each
+	today, err := jA.Open(now)
+	require.NoError(t, err)
+	assert.Len(t, Parse(today.Uid(), today.Content, journal.RefParser(today.Day)), 4)
+	migrated, err := todosA.Migrate(jA)
+	require.NoError(t, err)
+	assert.Empty(t, migrated)
+	today, err = jA.Open(now)
+	require.NoError(t, err)
+	assert.Equal(t, "# Mercredi 26/11/2025\n"+
+		"- [ ] Appeler @Léa ← [2025-11-25](journal:2025-11-25)\n"+
+		"- [x] Billets ← [2025-11-25](journal:2025-11-25)\n", today.Content)
+
+	// Both marks of the source tasks merged, they are still migrated
+	source, err := todosA.Tasks(Query{Statuses: []Status{Migrated}})
+	require.NoError(t, err)
+	assert.Len(t, source, 2)
+}
@@ -0,0 +1,251 @@
+package todo
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/date"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/journal"
+)
+
+// Statistics are computed from the history of the buckets: every layer is a version of the
+// bucket tasks. The first version holding a task tells when it was created, the first version
+// holding it done when it was done. A task is followed by its text in its bucket, a migrated
+// task keeps the creation of the task it was migrated from.
+//
+// The tasks of a day are the tasks of its journal entry, and the tasks created that day in other
+// buckets. Migrated tasks are left out of their day, they are counted in the day they were
+// migrated to.
+
+// A task along the versions of its bucket.
+type Record struct {
+	Uid    string
+	Text   string
+	Origin string
+	// Status and topics of the task in the last version holding it.
+	Status Status
+	Topics []string
+	// Time of the first layer holding the task, and of the first layer holding it done since it
+	// was last open. Done is zero when the task is not done.
+	Created time.Time
+	Done    time.Time
+}
+
+// Day the task belongs to.
+func (r Record) Day() time.Time {
+	if day, ok := journal.ParseDayUid(r.Uid); ok {
+		return day
+	}
+	return date.Midnight(r.Created)
+}
+
+// Count of done tasks among a total.
+type Rate struct {
+	Done, Total int
+}
+
+func (r *Rate) add(done bool) {
+	r.Total++
+	if done {
+		r.Done++
+	}
+}
+
+// Ratio of done tasks, 0 without task.
+func (r Rate) Ratio() float64 {
+	if r.Total == 0 {
+		return 0
+	}
+	return float64(r.Done) / float64(r.Total)
+}
+
+// Completion of the tasks of a day or a week.
+type Period struct {
+	Start time.Time
+	Rate
+}
+
+type Stats struct {
+	// Completion of the tasks of each day and each week of the stats, in order. Weeks start on
+	// monday.
+	Days  []Period
+	Weeks []Period
+	// Completion of the tasks of each lower cased topic.
+	Topics map[string]Rate
+	// Average duration between the creation of the done tasks and the layer marking them done.
+	TimeToDone time.Duration
+	// Days in a row with a task done, ending the last day of the stats, or the day before while
+	// nothing is done yet that day. Longest streak ever.
+	Streak, LongestStreak int
+}
+
+type bucketRecords struct {
+	revision db.Revision
+	records  []Record
+}
+
+// Records of the tasks of a bucket along its versions, projected in one pass.
+func bucketHistory(b *model.Bucket) ([]Record, error) {
+	var records []Record
+	var created hlc.Timestamp
+	byText := map[string]int{}
+	layers := b.Layers()
+	err := b.ProjectAll(func(version int, doc model.Document, deleted bool) {
+		ref := layers[version-1]
+		if deleted {
+			created = hlc.Timestamp{}
+			return
+		}
+		if created.IsZero() {
+			created = ref.Clock()
+		}
+		at := ref.Clock().Time()
+		for _, task := range parseBucket(b.Uid(), doc.Content(), created) {
+			key := dedupKey(task.Text)
+			i, ok := byText[key]
+			if !ok {
+				i = len(records)
+				byText[key] = i
+				records = append(records, Record{Uid: task.Uid, Text: task.Text, Origin: task.Origin, Created: at})
+			}
+			r := &records[i]
+			r.Status, r.Topics = task.Status, task.Topics
+			if !task.Done() {
+				r.Done = time.Time{}
+			} else if r.Done.IsZero() {
+				r.Done = at
+			}
+		}
+	})
+	return records, err
+}
+
+// Records of the tasks of all buckets, ordered by bucket uid and creation.
+func (t *Todos) Records() ([]Record, error) {
+	t.Lock()
+	defer t.Unlock()
+	uids, err := t.db.Uids("")
+	if err != nil {
+		return nil, err
+	}
+	history := make(map[string]*bucketRecords, len(uids))
+	for _, uid := range uids {
+		revision := t.db.Revision(uid)
+		if cached, ok := t.history[uid]; ok && cached.revision == revision {
+			history[uid] = cached
+			continue
+		}
+		b, err := t.db.Bucket(uid)
+		if err != nil {
+			return nil, err
+		}
+		records, err := bucketHistory(b)
+		if err != nil {
+			return nil, err
+		}
+		history[uid] = &bucketRecords{revision: revision, records: records}
+	}
+	t.history = history
+
+	var records []Record
+	for _, uid := range uids {
+		records = append(records, history[uid].records...)
+	}
+	for k, r := range records {
+		if r.Origin == "" || history[r.Origin] == nil {
+			continue
+		}
+		day, _ := journal.ParseDayUid(r.Origin)
+		for _, source := range history[r.Origin].records {
+			if source.Status == Migrated && dedupKey(absoluteDates(source.Text, day)) == dedupKey(r.Text) && source.Created.Before(r.Created) {
+				records[k].Created = source.Created
+			}
+		}
+	}
+	slices.SortStableFunc(records, func(a, b Record) int {
+		if c := strings.Compare(a.Uid, b.Uid); c != 0 {
+			return c
+		}
+		return a.Created.Compare(b.Created)
+	})
+	return records, nil
+}
+
+// Stats of the tasks of the days between two days included.
+func (t *Todos) Stats(from, to time.Time) (*Stats, error) {
+	records, err := t.Records()
+	if err != nil {
+		return nil, err
+	}
+	return computeStats(records, from, to), nil
+}
+
+// Days from a day to another, rounded across daylight saving time changes.
+func daysBetween(from, to time.Time) int {
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
+
+func computeStats(records []Record, from, to time.Time) *Stats {
+	from, to = date.Midnight(from), date.Midnight(to)
+	s := &Stats{Topics: map[string]Rate{}}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		s.Days = append(s.Days, Period{Start: day})
+	}
+	monday := from.AddDate(0, 0, -(int(from.Weekday())+6)%7)
+	for week := monday; !week.After(to); week = week.AddDate(0, 0, 7) {
+		s.Weeks = append(s.Weeks, Period{Start: week})
+	}
+
+	var spent time.Duration
+	var done int
+	doneDays := map[string]bool{}
+	for _, r := range records {
+		if !r.Done.IsZero() {
+			doneDays[journal.DayUid(r.Done.Local())] = true
+		}
+		day := r.Day()
+		if r.Status == Migrated || day.Before(from) || day.After(to) {
+			continue
+		}
+		isDone := r.Status == Done
+		s.Days[daysBetween(from, day)].add(isDone)
+		s.Weeks[daysBetween(monday, day)/7].add(isDone)
+		for _, topic := range r.Topics {
+			rate := s.Topics[topic]
+			rate.add(isDone)
+			s.Topics[topic] = rate
+		}
+		if isDone {
+			spent += r.Done.Sub(r.Created)
+			done++
+		}
+	}
+	if done > 0 {
+		s.TimeToDone = spent / time.Duration(done)
+	}
+
+	day := to
+	if !doneDays[journal.DayUid(day)] {
+		day = day.AddDate(0, 0, -1)
+	}
+	for ; doneDays[journal.DayUid(day)]; day = day.AddDate(0, 0, -1) {
+		s.Streak++
+	}
+	for uid := range doneDays {
+		start, _ := journal.ParseDayUid(uid)
+		if doneDays[journal.DayUid(start.AddDate(0, 0, -1))] {
+			continue
+		}
+		streak := 0
+		for day := start; doneDays[journal.DayUid(day)]; day = day.AddDate(0, 0, 1) {
+			streak++
+		}
+		s.LongestStreak = max(s.LongestStreak, streak)
+	}
+	return s
+}
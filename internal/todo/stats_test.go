@@ -0,0 +1,111 @@
+package todo
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/date"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/journal"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTodos_Records(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos_Records")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, d.Save("courses", index.Topic, "- [ ] Lait &maison\n- [ ] Pain", nil))
+	todos := New(d)
+	open, err := todos.Tasks(Query{})
+	require.NoError(t, err)
+	require.NoError(t, todos.Toggle(open[0]))
+	require.NoError(t, todos.Toggle(open[1]))
+	done, err := todos.Tasks(Query{})
+	require.NoError(t, err)
+	require.NoError(t, todos.Toggle(done[1]))
+
+	records, err := todos.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "Lait &maison", records[0].Text)
+	assert.Equal(t, Done, records[0].Status)
+	assert.Equal(t, []string{"maison"}, records[0].Topics)
+	assert.False(t, records[0].Done.Before(records[0].Created))
+	// Done then open again
+	assert.Equal(t, Open, records[1].Status)
+	assert.True(t, records[1].Done.IsZero())
+	assert.Equal(t, date.Midnight(records[1].Created), records[1].Day())
+
+	// Migrated tasks keep their creation
+	now := time.Now()
+	j := journal.New(d, journal.WithClock(func() time.Time { return now }), journal.WithLocale(date.French))
+	yesterday := date.Midnight(now).AddDate(0, 0, -1)
+	require.NoError(t, j.Save(yesterday, "- [ ] Billets"))
+	migrated, err := todos.Migrate(j)
+	require.NoError(t, err)
+	require.Len(t, migrated, 1)
+	records, err = todos.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, Migrated, records[0].Status)
+	assert.Equal(t, yesterday, records[0].Day())
+	assert.Equal(t, journal.DayUid(yesterday), records[1].Origin)
+	assert.Equal(t, records[0].Created, records[1].Created)
+	assert.Equal(t, date.Midnight(now), records[1].Day())
+}
+
+func TestComputeStats(t *testing.T) {
+	at := func(d int, hour int) time.Time {
+		return time.Date(2025, 11, d, hour, 0, 0, 0, time.Local)
+	}
+	records := []Record{
+		// Done the same day
+		{Uid: "2025-11-24", Status: Done, Topics: []string{"voyage"}, Created: at(24, 8), Done: at(24, 10)},
+		{Uid: "2025-11-24", Status: Open, Topics: []string{"voyage"}, Created: at(24, 8)},
+		// Migrated tasks are counted in the day they were migrated to
+		{Uid: "2025-11-24", Status: Migrated, Created: at(24, 8)},
+		{Uid: "2025-11-25", Status: Done, Origin: "2025-11-24", Created: at(24, 8), Done: at(25, 12)},
+		// Tasks of other buckets belong to the day they were created
+		{Uid: "courses", Status: Done, Created: at(26, 9), Done: at(26, 11)},
+		{Uid: "courses", Status: Open, Created: at(30, 9)},
+		// Out of the stats days, but part of the streaks
+		{Uid: "2025-11-20", Status: Done, Created: at(20, 8), Done: at(21, 8)},
+	}
+
+	s := computeStats(records, at(24, 0), at(30, 18))
+	require.Len(t, s.Days, 7)
+	assert.Equal(t, Period{Start: at(24, 0), Rate: Rate{Done: 1, Total: 2}}, s.Days[0])
+	assert.Equal(t, Rate{Done: 1, Total: 1}, s.Days[1].Rate)
+	assert.Equal(t, Rate{Done: 1, Total: 1}, s.Days[2].Rate)
+	assert.Equal(t, Rate{}, s.Days[3].Rate)
+	assert.Equal(t, 0.0, s.Days[3].Ratio())
+	assert.Equal(t, Rate{Done: 0, Total: 1}, s.Days[6].Rate)
+
+	// Weeks start on monday 24/11, sunday 30/11 ends the first one
+	require.Len(t, s.Weeks, 1)
+	assert.Equal(t, Period{Start: at(24, 0), Rate: Rate{Done: 3, Total: 5}}, s.Weeks[0])
+	assert.Equal(t, 0.6, s.Weeks[0].Ratio())
+	assert.Equal(t, map[string]Rate{"voyage": {Done: 1, Total: 2}}, s.Topics)
+
+	// 2h, 28h and 2h
+	assert.Equal(t, 32*time.Hour/3, s.TimeToDone)
+
+	// Nothing done on 27/11
+	assert.Equal(t, 0, s.Streak)
+	assert.Equal(t, 3, s.LongestStreak)
+	s = computeStats(records, at(20, 0), at(26, 0))
+	assert.Equal(t, 3, s.Streak)
+	require.Len(t, s.Weeks, 2)
+	assert.Equal(t, at(17, 0), s.Weeks[0].Start)
+	// The streak goes on until the end of the day
+	s = computeStats(records, at(20, 0), at(27, 0))
+	assert.Equal(t, 3, s.Streak)
+	s = computeStats(records, at(20, 0), at(28, 0))
+	assert.Equal(t, 0, s.Streak)
+}
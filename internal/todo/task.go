@@ -0,0 +1,151 @@
+package todo
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mxbossard/tui-journal/internal/ref"
+)
+
+// Tasks are markdown task list items: a bullet or a numbered item starting with a checkbox.
+//
+//	- [ ] book the train @!vendredi for &voyage
+//	* [x] call @Léa
+//
+// The task deadline is its first deadline reference, or else its first date reference. Its
+// topics and people are the ones it references. Items in fenced code blocks are not tasks.
+//
+// Open tasks of previous days are migrated into the entry of today, bullet journal style: the
+// source task is marked [>] and its copy ends with a back-link to the day it comes from.
+//
+//	- [ ] book the train @!2025-11-28 for &voyage ← [2025-11-24](journal:2025-11-24)
+
+var (
+	taskRegexp     = regexp.MustCompile(`^(\s*(?:[-*+]|\d+[.)])\s+\[)([^\]]+)(\]\s+)(.*?)\s*$`)
+	backLinkRegexp = regexp.MustCompile(`\s*← \[[^\]]*\]\(journal:([^)]+)\)$`)
+)
+
+type Status rune
+
+const (
+	Open     Status = ' '
+	Done     Status = 'x'
+	Migrated Status = '>'
+)
+
+// Status of a checkbox mark. Devices marking a task concurrently merge their marks, [>>]: a
+// mark repeating a status is that status.
+func parseStatus(mark string) (Status, bool) {
+	if r, _ := utf8.DecodeRuneInString(mark); strings.Count(mark, string(r)) == utf8.RuneCountInString(mark) {
+		mark = string(r)
+	}
+	switch mark {
+	case " ":
+		return Open, true
+	case "x", "X":
+		return Done, true
+	case ">":
+		return Migrated, true
+	}
+	return 0, false
+}
+
+type Task struct {
+	// Uid of the bucket holding the task.
+	Uid string
+	// Line of the task in the bucket content, from 0, and its source text.
+	Line   int
+	Source string
+	Status Status
+	// Text of the task without its back-link.
+	Text string
+	// Uid of the journal bucket the task was migrated from, empty if it was not migrated.
+	Origin string
+	// Zero when the task has no deadline.
+	Deadline time.Time
+	// Lower cased names of the referenced topics and people.
+	Topics []string
+	People []string
+}
+
+func (t Task) Done() bool {
+	return t.Status == Done
+}
+
+// Source line of the task with another status.
+func (t Task) withStatus(s Status) string {
+	m := taskRegexp.FindStringSubmatchIndex(t.Source)
+	return t.Source[:m[4]] + string(s) + t.Source[m[5]:]
+}
+
+// Source line of the task, without indentation, with another status and text.
+func (t Task) line(s Status, text string) string {
+	m := taskRegexp.FindStringSubmatch(t.Source)
+	return strings.TrimLeft(m[1], " \t") + string(s) + m[3] + text
+}
+
+// Back-link to the journal bucket a task was migrated from.
+func backLink(uid string) string {
+	return " ← [" + uid + "](journal:" + uid + ")"
+}
+
+func isFence(line string) bool {
+	trimmed := strings.TrimLeft(line, " ")
+	return len(line)-len(trimmed) <= 3 && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"))
+}
+
+// Parse the tasks of a bucket content. Refs parses the tasks references.
+func Parse(uid, content string, refs *ref.Parser) []Task {
+	var tasks []Task
+	fenced := false
+	for k, line := range strings.Split(content, "\n") {
+		if isFence(line) {
+			fenced = !fenced
+			continue
+		}
+		m := taskRegexp.FindStringSubmatch(line)
+		if fenced || m == nil {
+			continue
+		}
+		status, ok := parseStatus(m[2])
+		if !ok {
+			continue
+		}
+		t := Task{Uid: uid, Line: k, Source: line, Status: status, Text: m[4]}
+		if link := backLinkRegexp.FindStringSubmatchIndex(t.Text); link != nil {
+			t.Origin = t.Text[link[2]:link[3]]
+			t.Text = t.Text[:link[0]]
+		}
+		deadline := false
+		for _, r := range refs.Parse(t.Text) {
+			switch r.Kind {
+			case ref.Topic:
+				t.Topics = appendName(t.Topics, r.Name)
+			case ref.Person:
+				t.People = appendName(t.People, r.Name)
+			case ref.Deadline:
+				if !deadline {
+					t.Deadline = r.Time
+					deadline = true
+				}
+			case ref.Date:
+				if t.Deadline.IsZero() {
+					t.Deadline = r.Time
+				}
+			}
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks
+}
+
+func appendName(names []string, name string) []string {
+	name = strings.ToLower(name)
+	if slices.Contains(names, name) {
+		return names
+	}
+	return append(names, name)
+}
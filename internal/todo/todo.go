@@ -0,0 +1,193 @@
+package todo
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/date"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/hlc"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/journal"
+)
+
+// The tasks index is derived from the projected content of all buckets, like the text index:
+// it is kept in memory and a bucket is parsed again once its db revision differs from the one
+// it was parsed at. Relative dates of journal entries are relative to their day, relative
+// dates of other buckets to the day of their last layer.
+
+var ErrStaleTask = errors.New("task changed since it was read")
+
+type indexedBucket struct {
+	revision db.Revision
+	tasks    []Task
+}
+
+type Todos struct {
+	*sync.Mutex
+
+	db      *db.DB
+	buckets map[string]*indexedBucket
+	// Records of the tasks of each bucket, see Records.
+	history map[string]*bucketRecords
+}
+
+func New(d *db.DB) *Todos {
+	return &Todos{
+		Mutex:   &sync.Mutex{},
+		db:      d,
+		buckets: make(map[string]*indexedBucket),
+		history: make(map[string]*bucketRecords),
+	}
+}
+
+// Tasks matching a query.
+type Query struct {
+	// Statuses of the tasks, any status when empty.
+	Statuses []Status
+	// Lower cased topic the tasks reference, any topic when empty.
+	Topic string
+	// Tasks whose deadline is before the end of this day, any task when zero.
+	DueBy time.Time
+}
+
+func (q Query) matches(t Task) bool {
+	if len(q.Statuses) > 0 && !slices.Contains(q.Statuses, t.Status) {
+		return false
+	}
+	if q.Topic != "" && !slices.Contains(t.Topics, strings.ToLower(q.Topic)) {
+		return false
+	}
+	if !q.DueBy.IsZero() && (t.Deadline.IsZero() || !t.Deadline.Before(date.Midnight(q.DueBy).AddDate(0, 0, 1))) {
+		return false
+	}
+	return true
+}
+
+// Day relative dates of a bucket are relative to: the day of a journal entry, the day other
+// buckets were created. Later layers do not move them.
+func referenceDay(uid string, created hlc.Timestamp) time.Time {
+	if day, ok := journal.ParseDayUid(uid); ok {
+		return day
+	}
+	return date.Midnight(created.Time())
+}
+
+// Tasks of a bucket content.
+func parseBucket(uid, content string, created hlc.Timestamp) []Task {
+	return Parse(uid, content, journal.RefParser(referenceDay(uid, created)))
+}
+
+// Parse again the buckets whose last layer changed since they were parsed, and forget the
+// deleted buckets. Caller must hold the todos lock.
+func (t *Todos) sync() error {
+	uids, err := t.db.Uids("")
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		// Read before the bucket: a bucket changed while loaded is parsed again.
+		revision := t.db.Revision(uid)
+		if indexed, ok := t.buckets[uid]; ok && indexed.revision == revision {
+			continue
+		}
+		b, err := t.db.Bucket(uid)
+		if err != nil {
+			return err
+		}
+		doc, err := b.Project()
+		if err != nil {
+			return err
+		}
+		created, err := b.Created()
+		if err != nil {
+			return err
+		}
+		t.buckets[uid] = &indexedBucket{revision: revision, tasks: parseBucket(uid, doc.Content(), created)}
+	}
+	for uid := range t.buckets {
+		if _, found := slices.BinarySearch(uids, uid); !found {
+			delete(t.buckets, uid)
+		}
+	}
+	return nil
+}
+
+// Tasks matching a query, ordered by bucket uid and line.
+func (t *Todos) Tasks(q Query) ([]Task, error) {
+	t.Lock()
+	defer t.Unlock()
+	err := t.sync()
+	if err != nil {
+		return nil, err
+	}
+	var tasks []Task
+	for _, indexed := range t.buckets {
+		for _, task := range indexed.tasks {
+			if q.matches(task) {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	slices.SortFunc(tasks, func(a, b Task) int {
+		if c := strings.Compare(a.Uid, b.Uid); c != 0 {
+			return c
+		}
+		return a.Line - b.Line
+	})
+	return tasks, nil
+}
+
+// Rewrite the lines of a bucket content as a new layer, keeping its labels. Edit returns the
+// new lines.
+func (t *Todos) rewrite(uid string, edit func(lines []string) ([]string, error)) error {
+	b, err := t.db.Bucket(uid)
+	if err != nil {
+		return err
+	}
+	doc, err := b.Project()
+	if err != nil {
+		return err
+	}
+	lines, err := edit(strings.Split(doc.Content(), "\n"))
+	if err != nil {
+		return err
+	}
+	return t.saveLayer(b, strings.Join(lines, "\n"))
+}
+
+// Save content as a new layer of a bucket, keeping the labels of its last layer.
+func (t *Todos) saveLayer(b *model.Bucket, content string) error {
+	var labels model.Labels
+	if layers := b.Layers(); len(layers) > 0 {
+		l, err := t.db.Layer(layers[len(layers)-1])
+		if err != nil {
+			return err
+		}
+		labels = l.Metadata().Labels()
+	}
+	return t.db.SaveLayer(b, content, labels)
+}
+
+// Replace the source line of a task, failing if the line changed since the task was read.
+func replaceTask(lines []string, task Task, line string) error {
+	if task.Line >= len(lines) || lines[task.Line] != task.Source {
+		return ErrStaleTask
+	}
+	lines[task.Line] = line
+	return nil
+}
+
+// Mark an open task done or a done task open, as a new layer of its bucket.
+func (t *Todos) Toggle(task Task) error {
+	status := Done
+	if task.Done() {
+		status = Open
+	}
+	return t.rewrite(task.Uid, func(lines []string) ([]string, error) {
+		return lines, replaceTask(lines, task, task.withStatus(status))
+	})
+}
@@ -0,0 +1,132 @@
+package todo
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/index"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+	"github.com/mxbossard/tui-journal/internal/journal"
+	"github.com/mxbossard/utilz/filez"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+}
+
+func TestParse(t *testing.T) {
+	content := "# Lundi 24/11/2025\n" +
+		"- [ ] Réserver le train @!demain pour &Voyage avec @Léa\n" +
+		"  * [x] Appeler @Léa @2025-11-20 @!2025-11-30\n" +
+		"1. [X] Valise\n" +
+		"- [?] pas une tâche\n" +
+		"- [] pas une tâche\n" +
+		"```\n- [ ] dans du code\n```\n" +
+		"- [ ]   espaces   "
+	tasks := Parse("2025-11-24", content, journal.RefParser(day(2025, 11, 24)))
+	require.Len(t, tasks, 4)
+	assert.Equal(t, Task{
+		Uid:      "2025-11-24",
+		Line:     1,
+		Source:   "- [ ] Réserver le train @!demain pour &Voyage avec @Léa",
+		Status:   Open,
+		Text:     "Réserver le train @!demain pour &Voyage avec @Léa",
+		Deadline: day(2025, 11, 25),
+		Topics:   []string{"voyage"},
+		People:   []string{"léa"},
+	}, tasks[0])
+	assert.True(t, tasks[1].Done())
+	// Deadlines win over dates
+	assert.Equal(t, day(2025, 11, 30), tasks[1].Deadline)
+	assert.Equal(t, 3, tasks[2].Line)
+	assert.True(t, tasks[2].Deadline.IsZero())
+	assert.Equal(t, "espaces", tasks[3].Text)
+	assert.Equal(t, "- [x]   espaces   ", tasks[3].withStatus(Done))
+}
+
+func TestTodos(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos")
+	defer os.RemoveAll(tmpDir)
+	d, err := db.Open(tmpDir, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, d.Save("2025-11-24", index.Journal, "- [ ] Billets @!demain &voyage\n- [x] Valise", nil))
+	require.NoError(t, d.Save("courses", index.Topic, "* [ ] Lait\n* [ ] Pain @!2025-11-30", model.Labels{"list": "courses"}))
+
+	todos := New(d)
+	tasks, err := todos.Tasks(Query{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 4)
+	assert.Equal(t, "2025-11-24", tasks[0].Uid)
+	assert.Equal(t, "courses", tasks[2].Uid)
+
+	open, err := todos.Tasks(Query{Statuses: []Status{Open}})
+	require.NoError(t, err)
+	assert.Len(t, open, 3)
+	trip, err := todos.Tasks(Query{Topic: "Voyage"})
+	require.NoError(t, err)
+	require.Len(t, trip, 1)
+	assert.Equal(t, day(2025, 11, 25), trip[0].Deadline)
+	due, err := todos.Tasks(Query{DueBy: day(2025, 11, 25)})
+	require.NoError(t, err)
+	assert.Equal(t, trip, due)
+
+	// Toggling writes a new layer and keeps the bucket labels
+	assert.Equal(t, "Lait", open[1].Text)
+	require.NoError(t, todos.Toggle(open[1]))
+	b, err := d.Bucket("courses")
+	require.NoError(t, err)
+	assert.Len(t, b.Layers(), 2)
+	doc, err := b.Project()
+	require.NoError(t, err)
+	assert.Equal(t, "* [x] Lait\n* [ ] Pain @!2025-11-30", doc.Content())
+	labeled, err := d.Labeled("list", "courses")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"courses"}, labeled)
+	// Stale tasks are not toggled
+	assert.ErrorIs(t, todos.Toggle(open[1]), ErrStaleTask)
+	open, err = todos.Tasks(Query{Statuses: []Status{Open}})
+	require.NoError(t, err)
+	assert.Len(t, open, 2)
+
+	require.NoError(t, d.Delete("courses"))
+	tasks, err = todos.Tasks(Query{})
+	require.NoError(t, err)
+	assert.Len(t, tasks, 2)
+}
+
+func TestTodos_RelativeDatesOfLists(t *testing.T) {
+	tmpDir := filez.MkdirTempOrPanic("TestTodos_RelativeDatesOfLists")
+	defer os.RemoveAll(tmpDir)
+	now := day(2025, 11, 24).Add(9 * time.Hour)
+	d, err := db.Open(tmpDir, "a", db.WithClock(func() time.Time { return now }))
+	require.NoError(t, err)
+
+	require.NoError(t, d.Save("voyage", index.Topic, "- [ ] Billets @!+3d\n- [ ] Valise @!+1s", nil))
+	todos := New(d)
+	tasks, err := todos.Tasks(Query{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	assert.Equal(t, day(2025, 11, 27), tasks[0].Deadline)
+
+	// Toggling a task days later does not move the deadlines
+	now = now.AddDate(0, 0, 2)
+	require.NoError(t, todos.Toggle(tasks[1]))
+	tasks, err = todos.Tasks(Query{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	assert.Equal(t, day(2025, 11, 27), tasks[0].Deadline)
+	assert.Equal(t, Done, tasks[1].Status)
+
+	// Deadlines of a list created again are relative to its new creation
+	require.NoError(t, d.Delete("voyage"))
+	require.NoError(t, d.Save("voyage", index.Topic, "- [ ] Billets @!+3d", nil))
+	tasks, err = todos.Tasks(Query{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, day(2025, 11, 29), tasks[0].Deadline)
+}
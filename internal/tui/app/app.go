@@ -7,6 +7,7 @@ import (
 	"github.com/charmbracelet/bubbles/key"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
 	"github.com/mxbossard/tui-journal/internal/tui/journal"
 )
 
@@ -38,8 +39,8 @@ type keymap = struct {
 	quit key.Binding
 }
 
-func Run() {
-	model, err := journal.NewModel()
+func Run(d *db.DB) {
+	model, err := journal.NewModel(d)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,172 @@
+package journal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/diff"
+	immutxtmodel "github.com/mxbossard/tui-journal/internal/immutxtdb/model"
+)
+
+var (
+	selectedRevisionStyle = lipgloss.NewStyle().
+				Background(lipgloss.Color("57")).
+				Foreground(lipgloss.Color("230"))
+
+	insertedLineStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("42"))
+
+	deletedLineStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("196"))
+)
+
+type historyKeymap struct {
+	up, down, restore key.Binding
+}
+
+// Message sent once a revision was restored as a new layer.
+type restoredMsg struct{}
+
+// History panel of a bucket: lists its revisions and diffs the selected one against the
+// previous one.
+type historyPanel struct {
+	viewport viewport.Model
+	keymap   historyKeymap
+	db       *db.DB
+	uid      string
+	bucket   *immutxtmodel.Bucket
+	selected int
+}
+
+func newHistoryPanel(d *db.DB, uid string) *historyPanel {
+	vp := viewport.New(10, 5)
+	vp.Style = lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("62")).
+		PaddingRight(2)
+	return &historyPanel{
+		viewport: vp,
+		db:       d,
+		uid:      uid,
+		keymap: historyKeymap{
+			up: key.NewBinding(
+				key.WithKeys("up"),
+				key.WithHelp("↑", "newer"),
+			),
+			down: key.NewBinding(
+				key.WithKeys("down"),
+				key.WithHelp("↓", "older"),
+			),
+			restore: key.NewBinding(
+				key.WithKeys("enter", "r"),
+				key.WithHelp("r", "restore"),
+			),
+		},
+	}
+}
+
+func (m *historyPanel) updateSizes(width, height int) {
+	m.viewport.Width = width / 2
+	m.viewport.Height = height / 2
+}
+
+// Reload the bucket and select its latest version.
+func (m *historyPanel) load() error {
+	b, err := m.db.Bucket(m.uid)
+	if err != nil {
+		return err
+	}
+	m.bucket = b
+	m.selected = len(b.Layers())
+	return m.render()
+}
+
+func (m *historyPanel) render() error {
+	if m.selected == 0 {
+		m.viewport.SetContent("No revision saved yet")
+		return nil
+	}
+	sb := strings.Builder{}
+	layers := m.bucket.Layers()
+	for version := len(layers); version > 0; version-- {
+		clock := layers[version-1].Clock()
+		line := fmt.Sprintf("#%d %s %s", version, clock.Time().Local().Format(time.DateTime), clock.Device)
+		if version == m.selected {
+			line = selectedRevisionStyle.Render(line)
+		}
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString("\n")
+	lines, err := m.bucket.Diff(m.selected-1, m.selected)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		switch l.Op {
+		case diff.Insert:
+			sb.WriteString(insertedLineStyle.Render("+ "+l.Text) + "\n")
+		case diff.Delete:
+			sb.WriteString(deletedLineStyle.Render("- "+l.Text) + "\n")
+		default:
+			sb.WriteString("  " + l.Text + "\n")
+		}
+	}
+	m.viewport.SetContent(sb.String())
+	return nil
+}
+
+// Save the selected revision content as a new layer.
+func (m *historyPanel) restore() error {
+	err := m.bucket.Restore(m.selected)
+	if err != nil {
+		return err
+	}
+	return m.load()
+}
+
+func (m historyPanel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *historyPanel) Update(msg tea.Msg) (*historyPanel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch {
+		case key.Matches(msg, m.keymap.up) && m.selected < len(m.bucket.Layers()):
+			m.selected++
+		case key.Matches(msg, m.keymap.down) && m.selected > 1:
+			m.selected--
+		case key.Matches(msg, m.keymap.restore) && m.selected > 0:
+			err := m.restore()
+			if errors.Is(err, immutxtmodel.ErrDeletedBucket) {
+				// Nothing to restore from a deleted revision.
+				return m, nil
+			} else if err != nil {
+				return m, reportErr("Not restored: ", err)
+			}
+			return m, func() tea.Msg { return restoredMsg{} }
+		default:
+			var cmd tea.Cmd
+			m.viewport, cmd = m.viewport.Update(msg)
+			return m, cmd
+		}
+		err := m.render()
+		if err != nil {
+			return m, reportErr("History not rendered: ", err)
+		}
+	}
+	return m, nil
+}
+
+func (m historyPanel) View() string {
+	return m.viewport.View()
+}
+
+func (m historyPanel) helpBindings() []key.Binding {
+	return []key.Binding{m.keymap.up, m.keymap.down, m.keymap.restore}
+}
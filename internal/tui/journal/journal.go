@@ -1,30 +1,77 @@
 package journal
 
 import (
+	"time"
+
 	"github.com/charmbracelet/bubbles/help"
 	"github.com/charmbracelet/bubbles/key"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/mxbossard/tui-journal/internal/immutxtdb/db"
+	journalsvc "github.com/mxbossard/tui-journal/internal/journal"
+	"github.com/mxbossard/tui-journal/internal/todo"
 )
 
+var statusStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("160"))
+
 type model struct {
-	input   *textareaModel
-	browser *mdBrowser
-	keymap  keymap
-	help    help.Model
+	input       *textareaModel
+	browser     *mdBrowser
+	history     *historyPanel
+	showHistory bool
+	stats       *statsPanel
+	showStats   bool
+	keymap      keymap
+	help        help.Model
+	journal     *journalsvc.Journal
+	todos       *todo.Todos
+	day         time.Time
+	// Error reported under the editor, such as a failed migration.
+	status string
+}
+
+// Message reporting the error of a panel under the editor.
+type errMsg struct {
+	prefix string
+	err    error
+}
+
+func reportErr(prefix string, err error) tea.Cmd {
+	return func() tea.Msg { return errMsg{prefix: prefix, err: err} }
 }
 
-func NewModel() (*model, error) {
+// Report an error under the editor instead of quitting, the editor content is kept. A success
+// clears the previous error.
+func (m *model) report(prefix string, err error) {
+	m.status = ""
+	if err != nil {
+		m.status = prefix + err.Error()
+	}
+}
+
+func NewModel(d *db.DB) (*model, error) {
 	browser, err := newMdBrowser()
 	if err != nil {
 		return nil, err
 	}
 	input := newTextarea(browser)
+	j := journalsvc.New(d)
+	todos := todo.New(d)
+	today, status, err := openToday(j, todos)
+	if err != nil {
+		return nil, err
+	}
 
 	m := &model{
 		input:   input,
 		browser: browser,
+		history: newHistoryPanel(d, today.Uid()),
+		stats:   newStatsPanel(todos),
 		help:    help.New(),
+		journal: j,
+		todos:   todos,
+		day:     today.Day,
+		status:  status,
 		keymap: keymap{
 			next: key.NewBinding(
 				key.WithKeys("tab"),
@@ -42,6 +89,30 @@ func NewModel() (*model, error) {
 				key.WithKeys("ctrl+w"),
 				key.WithHelp("ctrl+w", "remove an editor"),
 			),
+			save: key.NewBinding(
+				key.WithKeys("ctrl+s"),
+				key.WithHelp("ctrl+s", "save"),
+			),
+			history: key.NewBinding(
+				key.WithKeys("alt+h"),
+				key.WithHelp("alt+h", "history"),
+			),
+			stats: key.NewBinding(
+				key.WithKeys("alt+s"),
+				key.WithHelp("alt+s", "stats"),
+			),
+			previousDay: key.NewBinding(
+				key.WithKeys("alt+left"),
+				key.WithHelp("alt+←", "previous day"),
+			),
+			nextDay: key.NewBinding(
+				key.WithKeys("alt+right"),
+				key.WithHelp("alt+→", "next day"),
+			),
+			today: key.NewBinding(
+				key.WithKeys("alt+t"),
+				key.WithHelp("alt+t", "today"),
+			),
 			quit: key.NewBinding(
 				key.WithKeys("esc", "ctrl+c"),
 				key.WithHelp("esc", "quit"),
@@ -49,12 +120,77 @@ func NewModel() (*model, error) {
 		},
 	}
 
+	browser.setDay(today.Day)
+	m.setContent(today.Content)
 	input.Focus()
 	return m, nil
 }
 
+// Open the entry of today once the open tasks of previous days are migrated into it. A failed
+// migration, a task edited meanwhile on another device, does not prevent opening today: it is
+// returned as a status.
+func openToday(j *journalsvc.Journal, todos *todo.Todos) (*journalsvc.Entry, string, error) {
+	var status string
+	_, err := todos.Migrate(j)
+	if err != nil {
+		status = "Tasks not migrated: " + err.Error()
+	}
+	e, err := j.OpenToday()
+	return e, status, err
+}
+
+// Load the content of a day in the editor.
+func (m *model) load(day time.Time) error {
+	e, err := m.journal.Open(day)
+	if err != nil {
+		return err
+	}
+	m.day = e.Day
+	m.history.uid = e.Uid()
+	m.browser.setDay(e.Day)
+	m.setContent(e.Content)
+	if m.showHistory {
+		return m.history.load()
+	}
+	return nil
+}
+
+// Load the closest day having an entry before or after the current day.
+func (m *model) navigate(adjacent func(time.Time) (time.Time, bool, error)) error {
+	day, ok, err := adjacent(m.day)
+	if err != nil || !ok {
+		return err
+	}
+	return m.load(day)
+}
+
+func (m *model) setContent(content string) {
+	m.input.SetValue(content)
+	err := m.browser.render(content)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Save the editor content as a new layer of the day, then reload the shown panel.
+func (m *model) save() {
+	err := m.journal.Save(m.day, m.input.Value())
+	m.report("Not saved: ", err)
+	if err != nil {
+		return
+	}
+	if m.showHistory {
+		m.report("History not loaded: ", m.history.load())
+	}
+	if m.showStats {
+		m.report("Stats not loaded: ", m.stats.load(m.journal.Today()))
+	}
+}
+
 func (m model) updateSizes(width, height int) (err error) {
 	m.input.updateSizes(width, height)
+	m.history.updateSizes(width, height)
+	m.stats.updateSizes(width, height)
 	err = m.browser.updateSizes(width, height)
 	return
 }
@@ -71,7 +207,51 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch {
 		case key.Matches(msg, m.keymap.quit):
 			return m, tea.Quit
+		case key.Matches(msg, m.keymap.save):
+			m.save()
+			return m, nil
+		case key.Matches(msg, m.keymap.previousDay):
+			m.report("Day not opened: ", m.navigate(m.journal.Previous))
+			return m, nil
+		case key.Matches(msg, m.keymap.nextDay):
+			m.report("Day not opened: ", m.navigate(m.journal.Next))
+			return m, nil
+		case key.Matches(msg, m.keymap.today):
+			today, status, err := openToday(m.journal, m.todos)
+			if err == nil {
+				err = m.load(today.Day)
+			}
+			m.report("Today not opened: ", err)
+			if err == nil {
+				m.status = status
+			}
+			return m, nil
+		case key.Matches(msg, m.keymap.history):
+			m.showHistory = !m.showHistory
+			m.showStats = false
+			if m.showHistory {
+				m.report("History not loaded: ", m.history.load())
+			}
+			return m, nil
+		case key.Matches(msg, m.keymap.stats):
+			m.showStats = !m.showStats
+			m.showHistory = false
+			if m.showStats {
+				m.report("Stats not loaded: ", m.stats.load(m.journal.Today()))
+			}
+			return m, nil
+		case m.showHistory:
+			var cmd tea.Cmd
+			m.history, cmd = m.history.Update(msg)
+			return m, cmd
 		}
+	case restoredMsg:
+		// The restored entry is opened again, with the title of its day.
+		m.report("Day not opened: ", m.load(m.day))
+		return m, nil
+	case errMsg:
+		m.report(msg.prefix, msg.err)
+		return m, nil
 	case tea.WindowSizeMsg:
 		err := m.updateSizes(msg.Width, msg.Height)
 		if err != nil {
@@ -91,12 +271,31 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m model) View() string {
-	help := m.help.ShortHelpView([]key.Binding{
+	bindings := []key.Binding{
+		m.keymap.save,
+		m.keymap.history,
+		m.keymap.stats,
+		m.keymap.previousDay,
+		m.keymap.nextDay,
+		m.keymap.today,
 		m.keymap.quit,
-	})
+	}
+	if m.showHistory {
+		bindings = append(m.history.helpBindings(), bindings...)
+	}
+	help := m.help.ShortHelpView(bindings)
 
 	var views []string
 	views = append(views, m.input.View())
-	views = append(views, m.browser.View())
+	if m.showHistory {
+		views = append(views, m.history.View())
+	} else if m.showStats {
+		views = append(views, m.stats.View())
+	} else {
+		views = append(views, m.browser.View())
+	}
+	if m.status != "" {
+		help = statusStyle.Render(m.status) + "\n" + help
+	}
 	return "\n\n" + lipgloss.JoinHorizontal(lipgloss.Top, views...) + "\n\n" + help
 }
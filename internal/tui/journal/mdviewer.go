@@ -1,10 +1,15 @@
 package journal
 
 import (
+	"time"
+
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/glamour"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/mxbossard/tui-journal/internal/date"
+	journalsvc "github.com/mxbossard/tui-journal/internal/journal"
+	"github.com/mxbossard/tui-journal/internal/ref"
 )
 
 var content = `
@@ -54,6 +59,8 @@ var helpStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("241")).Render
 type mdBrowser struct {
 	viewport viewport.Model
 	renderer *glamour.TermRenderer
+	refs     *ref.Parser
+	locale   date.Locale
 }
 
 func newMdBrowser() (*mdBrowser, error) {
@@ -67,6 +74,8 @@ func newMdBrowser() (*mdBrowser, error) {
 
 	m := &mdBrowser{
 		viewport: vp,
+		refs:     ref.NewParser(),
+		locale:   date.FromEnv(),
 	}
 
 	glamourRenderWidth := width - m.viewport.Style.GetHorizontalFrameSize() - glamourGutter
@@ -114,8 +123,28 @@ func (m *mdBrowser) updateSizes(width, height int) error {
 	return nil
 }
 
+// Emphasize references with markdown so glamour styles them: topics in bold, people in italic
+// and dates as code spans followed by the day they resolve to.
+func (m *mdBrowser) highlightRefs(content string) string {
+	return m.refs.Replace(content, func(r ref.Ref, source string) string {
+		switch r.Kind {
+		case ref.Topic:
+			return "**" + source + "**"
+		case ref.Person:
+			return "_" + source + "_"
+		default:
+			return "`" + source + "` _(" + m.locale.FormatDay(r.Time) + ")_"
+		}
+	})
+}
+
+// Resolve the relative dates of the rendered content from a day.
+func (m *mdBrowser) setDay(day time.Time) {
+	m.refs = journalsvc.RefParser(day)
+}
+
 func (m *mdBrowser) render(content string) error {
-	str, err := m.renderer.Render(content)
+	str, err := m.renderer.Render(m.highlightRefs(content))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,139 @@
+package journal
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mxbossard/tui-journal/internal/todo"
+)
+
+// Days of the stats dashboard, ending today.
+const statsDays = 28
+
+var (
+	statsLabelStyle = lipgloss.NewStyle().Bold(true).Width(14)
+
+	sparklineStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("42"))
+
+	emptySparkStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+
+	sparks = []rune("▁▂▃▄▅▆▇█")
+)
+
+// Stats dashboard of the tasks: completion sparklines by day, week and topic, time to done
+// and streaks.
+type statsPanel struct {
+	viewport viewport.Model
+	todos    *todo.Todos
+}
+
+func newStatsPanel(todos *todo.Todos) *statsPanel {
+	vp := viewport.New(10, 5)
+	vp.Style = lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("62")).
+		PaddingRight(2)
+	return &statsPanel{viewport: vp, todos: todos}
+}
+
+func (m *statsPanel) updateSizes(width, height int) {
+	m.viewport.Width = width / 2
+	m.viewport.Height = height / 2
+}
+
+// Compute again the stats of the days ending today.
+func (m *statsPanel) load(today time.Time) error {
+	s, err := m.todos.Stats(today.AddDate(0, 0, -statsDays+1), today)
+	if err != nil {
+		return err
+	}
+	m.viewport.SetContent(renderStats(s))
+	return nil
+}
+
+// Sparkline of the completion ratio of periods, a dot for periods without task.
+func sparkline(periods []todo.Period) string {
+	sb := strings.Builder{}
+	for _, p := range periods {
+		if p.Total == 0 {
+			sb.WriteString(emptySparkStyle.Render("·"))
+			continue
+		}
+		spark := sparks[int(math.Round(p.Ratio()*float64(len(sparks)-1)))]
+		sb.WriteString(sparklineStyle.Render(string(spark)))
+	}
+	return sb.String()
+}
+
+// Bar of a completion ratio.
+func bar(r todo.Rate, width int) string {
+	done := int(math.Round(r.Ratio() * float64(width)))
+	return sparklineStyle.Render(strings.Repeat("█", done)) + emptySparkStyle.Render(strings.Repeat("░", width-done))
+}
+
+// Sum of the rates of periods.
+func total(periods []todo.Period) todo.Rate {
+	var r todo.Rate
+	for _, p := range periods {
+		r.Done += p.Done
+		r.Total += p.Total
+	}
+	return r
+}
+
+// Duration in days, hours and minutes: 1d 4h, 3h 12m, 5m.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days, hours, minutes := int(d/(24*time.Hour)), int(d/time.Hour)%24, int(d/time.Minute)%60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+func renderStats(s *todo.Stats) string {
+	sb := strings.Builder{}
+	line := func(label, value string) {
+		sb.WriteString(statsLabelStyle.Render(label) + value + "\n")
+	}
+	days := total(s.Days)
+	line("Streak", fmt.Sprintf("%d days, longest %d", s.Streak, s.LongestStreak))
+	line("Time to done", formatDuration(s.TimeToDone))
+	line("Done", fmt.Sprintf("%d/%d tasks of the last %d days", days.Done, days.Total, len(s.Days)))
+	sb.WriteString("\n")
+	line("Days", sparkline(s.Days))
+	line("Weeks", sparkline(s.Weeks))
+	if len(s.Topics) == 0 {
+		return sb.String()
+	}
+	sb.WriteString("\n")
+	for _, topic := range slices.Sorted(maps.Keys(s.Topics)) {
+		r := s.Topics[topic]
+		line("&"+topic, fmt.Sprintf("%s %d/%d", bar(r, 10), r.Done, r.Total))
+	}
+	return sb.String()
+}
+
+func (m statsPanel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *statsPanel) Update(msg tea.Msg) (*statsPanel, tea.Cmd) {
+	var cmd tea.Cmd
+	m.viewport, cmd = m.viewport.Update(msg)
+	return m, cmd
+}
+
+func (m statsPanel) View() string {
+	return m.viewport.View()
+}
@@ -37,7 +37,7 @@ var (
 )
 
 type keymap = struct {
-	next, prev, add, remove, quit key.Binding
+	next, prev, add, remove, save, history, stats, previousDay, nextDay, today, quit key.Binding
 }
 
 type textareaModel struct {
@@ -1,9 +1,48 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/mxbossard/tui-journal/internal/tui/app"
 )
 
 func main() {
-	app.Run()
+	// Flags without a command are the journal db flags.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
+			os.Exit(2)
+		}
+		err := cmd(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	err := run(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// Open the db then run the journal TUI on it.
+func run(args []string) error {
+	fs := flag.NewFlagSet("tui-journal", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	fs.Parse(args)
+
+	d, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	app.Run(d)
+	return nil
 }